@@ -2,10 +2,14 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -32,8 +36,10 @@ type program struct {
 	ruleUpdater    *rules.RuleUpdater
 	clashAPI       *api.ClashAPI
 	webServer      *web.WebServer
-	updateTicker   *time.Ticker
-	logCleanTicker *time.Ticker // 日志清理定时器
+	schedulerStop  chan struct{} // 停止规则调度器
+	logCleanTicker *time.Ticker  // 日志清理定时器
+	pendingRestart bool          // 免打扰时段内推迟的 Clash 重启
+	restartMutex   sync.Mutex
 	stopChan       chan struct{}
 	ctx            context.Context
 	cancel         context.CancelFunc
@@ -48,13 +54,11 @@ func (p *program) Stop(s service.Service) error {
 	// 清理工作
 	logger.Info("ClashRuleSync 服务停止")
 
-	// 取消上下文
+	// 取消上下文，中止正在进行的规则更新和重试
 	p.cancel()
 
-	// 停止更新定时器
-	if p.updateTicker != nil {
-		p.updateTicker.Stop()
-	}
+	// 停止规则调度器
+	p.stopScheduler()
 
 	// 停止日志清理定时器
 	if p.logCleanTicker != nil {
@@ -128,6 +132,7 @@ func (p *program) run() {
 
 	// 创建规则更新器
 	p.ruleUpdater = rules.NewRuleUpdater(cfg)
+	p.ruleUpdater.SetClashAPI(p.clashAPI)
 
 	// 创建 Web 服务器
 	p.webServer = web.NewWebServer(cfg, p.ruleUpdater, p.clashAPI)
@@ -145,50 +150,15 @@ func (p *program) run() {
 			logger.Errorf("启动 Web 服务器失败: %v", err)
 		}
 
-		// 启动规则更新定时器
-		p.startUpdateTicker()
-
-		// 首次启动时尝试更新规则
-		go func() {
-			// 等待一段时间，确保 Clash 完全启动
-			time.Sleep(5 * time.Second)
-
-			// 尝试更新规则
-			success, err := p.ruleUpdater.UpdateAllRules()
-			if err != nil {
-				logger.Errorf("首次更新规则失败: %v", err)
-			} else if success {
-				logger.Info("首次更新规则成功")
-
-				// 保存配置
-				p.cfg.SaveConfig()
-
-				// 尝试重新加载 Clash 配置
-				err = p.clashAPI.ReloadConfig()
-				if err != nil {
-					logger.Errorf("重新加载 Clash 配置失败: %v", err)
-				}
-
-				// 安全重启 Clash
-				logger.Info("正在重启 Clash 以应用新规则...")
-				err = process.RestartClash()
-				if err != nil {
-					logger.Errorf("重启 Clash 失败: %v", err)
-				} else {
-					logger.Info("Clash 重启成功，新规则已生效")
-				}
-			}
-		}()
+		// 启动规则调度器，错过的更新会在 Clash 启动后立即执行
+		p.startScheduler()
 	}
 
 	onClashStop := func() {
 		logger.Info("检测到 Clash 停止，暂停服务...")
 
-		// 停止更新定时器
-		if p.updateTicker != nil {
-			p.updateTicker.Stop()
-			p.updateTicker = nil
-		}
+		// 停止规则调度器
+		p.stopScheduler()
 
 		// 停止 Web 服务器
 		if p.webServer != nil {
@@ -204,59 +174,213 @@ func (p *program) run() {
 	<-p.stopChan
 }
 
-// 启动规则更新定时器
-func (p *program) startUpdateTicker() {
-	// 如果已经有定时器在运行，先停止它
-	if p.updateTicker != nil {
-		p.updateTicker.Stop()
+// 调度器两次检查之间的最长等待时间，用于及时发现休眠唤醒、配置变化和免打扰时段结束
+const schedulerMaxWait = time.Minute
+
+// startScheduler 启动规则调度器
+func (p *program) startScheduler() {
+	p.stopScheduler()
+
+	stop := make(chan struct{})
+	p.schedulerStop = stop
+	go p.runScheduler(stop)
+	go p.runLocalWatcher(stop)
+}
+
+// stopScheduler 停止规则调度器
+func (p *program) stopScheduler() {
+	if p.schedulerStop != nil {
+		close(p.schedulerStop)
+		p.schedulerStop = nil
 	}
+}
 
-	// 创建新的定时器
-	p.updateTicker = time.NewTicker(p.cfg.UpdateInterval)
+// runScheduler 按每个规则提供者的调度计划更新规则
+func (p *program) runScheduler(stop <-chan struct{}) {
+	// 等待一段时间，确保 Clash 完全启动
+	wait := 5 * time.Second
+	// 启动后的首次检查会补上停止期间错过的更新
+	trigger := rules.TriggerStartup
+
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		case <-p.ctx.Done():
+			timer.Stop()
+			return
+		}
 
-	// 在新的 goroutine 中处理定时更新
-	go func() {
-		for {
-			select {
-			case <-p.updateTicker.C:
-				// 检查 Clash 是否在运行
-				if !p.processMonitor.IsClashRunning() {
-					continue
-				}
-
-				logger.Info("定时更新规则...")
-				success, err := p.ruleUpdater.UpdateAllRules()
-				if err != nil {
-					logger.Errorf("定时更新规则失败: %v", err)
-					continue
-				}
-
-				if success {
-					logger.Info("定时更新规则成功")
-
-					// 保存配置
-					p.cfg.SaveConfig()
-
-					// 尝试重新加载 Clash 配置
-					err = p.clashAPI.ReloadConfig()
-					if err != nil {
-						logger.Errorf("重新加载 Clash 配置失败: %v", err)
-					}
-
-					// 安全重启 Clash
-					logger.Info("正在重启 Clash 以应用新规则...")
-					err = process.RestartClash()
-					if err != nil {
-						logger.Errorf("重启 Clash 失败: %v", err)
-					} else {
-						logger.Info("Clash 重启成功，新规则已生效")
-					}
-				}
-			case <-p.ctx.Done():
-				return
-			}
+		p.ruleUpdater.CheckPresetCatalogs(p.ctx)
+		p.removeExpiredOverrides()
+		p.runDueUpdates(trigger)
+		p.applyPendingRestart()
+		trigger = rules.TriggerSchedule
+
+		// 计算下一次检查时间
+		wait = time.Until(p.ruleUpdater.NextRunTime())
+		if wait < time.Second {
+			wait = time.Second
 		}
-	}()
+		if wait > schedulerMaxWait {
+			wait = schedulerMaxWait
+		}
+	}
+}
+
+// 检查本地规则来源变化的间隔
+const localWatchInterval = 5 * time.Second
+
+// runLocalWatcher 定期检查本地文件、目录和内联规则，发生变化时立即更新对应规则
+func (p *program) runLocalWatcher(stop <-chan struct{}) {
+	ticker := time.NewTicker(localWatchInterval)
+	defer ticker.Stop()
+
+	// 记录初始状态
+	p.ruleUpdater.ChangedLocalSources()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+
+		// 没有完成更新的变化会在下一次检查时再次返回
+		changed := p.ruleUpdater.ChangedLocalSources()
+		if len(changed) == 0 || !p.processMonitor.IsClashRunning() {
+			continue
+		}
+
+		logger.Infof("检测到本地规则变化: %v", changed)
+		result, err := p.ruleUpdater.UpdateProviders(p.ctx, rules.TriggerLocal, changed)
+		if err != nil {
+			logger.Errorf("更新本地规则失败: %v", err)
+			continue
+		}
+		p.applyUpdateResult("本地规则变化", result)
+	}
+}
+
+// removeExpiredOverrides 从配置中删除已过期的覆盖条目，受影响的规则会在本轮调度中重新生成
+func (p *program) removeExpiredOverrides() {
+	removed := p.cfg.RemoveExpiredOverrides(time.Now())
+	if len(removed) == 0 {
+		return
+	}
+	for _, o := range removed {
+		scope := o.Provider
+		if scope == "" {
+			scope = "全局"
+		}
+		logger.Infof("覆盖条目已过期: %s %s (%s)", o.Action, o.Value, scope)
+	}
+	if err := p.cfg.SaveConfig(); err != nil {
+		logger.Errorf("保存配置失败: %v", err)
+	}
+}
+
+// runDueUpdates 更新所有已到期的规则提供者
+func (p *program) runDueUpdates(trigger rules.Trigger) {
+	// 检查 Clash 是否在运行
+	if !p.processMonitor.IsClashRunning() {
+		return
+	}
+
+	due := p.ruleUpdater.DueProviders(time.Now())
+	if len(due) == 0 {
+		return
+	}
+
+	var (
+		result rules.UpdateRecord
+		err    error
+	)
+	// 到期的规则覆盖了所有参与定时更新的规则提供者时执行完整更新
+	if len(due) == p.ruleUpdater.ScheduledCount() {
+		logger.Info("定时更新所有规则...")
+		result, err = p.ruleUpdater.UpdateAllRules(p.ctx, trigger)
+	} else {
+		logger.Infof("定时更新规则: %v", due)
+		result, err = p.ruleUpdater.UpdateProviders(p.ctx, trigger, due)
+	}
+	if err != nil {
+		logger.Errorf("定时更新规则失败: %v", err)
+		return
+	}
+	p.applyUpdateResult("定时", result)
+}
+
+// applyUpdateResult 根据更新结果决定是否重新加载并重启 Clash
+func (p *program) applyUpdateResult(trigger string, result rules.UpdateRecord) {
+	// 保存配置（包含最后更新时间）
+	p.cfg.SaveConfig()
+
+	if result.HasFailures() {
+		logger.Warnf("%s更新规则部分失败，失败的规则将按退避策略提前重试", trigger)
+	}
+
+	if !result.HasChanges() {
+		logger.Infof("%s更新规则完成，规则无变化，跳过重启 Clash", trigger)
+		return
+	}
+
+	logger.Infof("%s更新规则成功", trigger)
+
+	// 免打扰时段内推迟重启
+	if p.cfg.QuietHours.Contains(time.Now()) {
+		logger.Infof("当前处于免打扰时段 (%s-%s)，推迟重启 Clash", p.cfg.QuietHours.Start, p.cfg.QuietHours.End)
+		p.restartMutex.Lock()
+		p.pendingRestart = true
+		p.restartMutex.Unlock()
+		return
+	}
+
+	p.restartClash()
+}
+
+// applyPendingRestart 免打扰时段结束后执行被推迟的重启
+func (p *program) applyPendingRestart() {
+	if p.cfg.QuietHours.Contains(time.Now()) {
+		return
+	}
+
+	p.restartMutex.Lock()
+	pending := p.pendingRestart
+	p.pendingRestart = false
+	p.restartMutex.Unlock()
+
+	if pending {
+		logger.Info("免打扰时段已结束，应用推迟的规则更新")
+		p.restartClash()
+	}
+}
+
+// restartClash 重新加载配置并重启 Clash 以应用新规则
+func (p *program) restartClash() {
+	// 尝试重新加载 Clash 配置，Clash 拒绝新规则时恢复最后可用的规则文件，且不再重启
+	err := p.ruleUpdater.ApplyToClash(p.ctx, p.clashAPI)
+	if errors.Is(err, rules.ErrRolledBack) {
+		logger.Errorf("应用新规则失败，已回滚规则，跳过重启 Clash: %v", err)
+		return
+	}
+	if err != nil {
+		logger.Warnf("重新加载 Clash 配置失败: %v", err)
+	}
+
+	// 安全重启 Clash
+	logger.Info("正在重启 Clash 以应用新规则...")
+	err = process.RestartClash(p.ctx)
+	if err != nil {
+		logger.Errorf("重启 Clash 失败: %v", err)
+	} else {
+		logger.Info("Clash 重启成功，新规则已生效")
+	}
 }
 
 // 启动日志清理定时器
@@ -296,6 +420,11 @@ func main() {
 	)
 	flag.Parse()
 
+	// 子命令
+	if flag.Arg(0) == "lookup" {
+		os.Exit(runLookup(flag.Args()[1:]))
+	}
+
 	// 显示版本信息
 	if *showVersion {
 		fmt.Printf("%s v%s\n", appName, version)
@@ -367,3 +496,54 @@ func main() {
 	// 尝试停止服务
 	s.Stop()
 }
+
+// runLookup 执行 lookup 子命令，查询域名或 IP 地址命中了哪些规则，返回退出码
+//
+// 没有命中任何规则时返回 1，参数或查询无效时返回 2
+func runLookup(args []string) int {
+	fs := flag.NewFlagSet("lookup", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "以 JSON 格式输出")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "用法: %s lookup [-json] <域名或IP>\n", appName)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	// 日志输出到标准错误，不影响查询结果的输出
+	logger.Log.SetOutput(os.Stderr)
+
+	cfg, err := config.LoadConfig(config.GetConfigPath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "加载配置失败: %v\n", err)
+		return 2
+	}
+
+	result, err := rules.NewRuleUpdater(cfg).Lookup(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *asJSON {
+		data, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(data))
+	} else if len(result.Matches) == 0 {
+		fmt.Printf("%s 没有命中任何规则\n", result.Query)
+	} else {
+		fmt.Printf("%s 命中 %d 个规则: %s\n", result.Query, len(result.Providers), strings.Join(result.Providers, ", "))
+		for _, match := range result.Matches {
+			fmt.Printf("  %s:%d\t%s\t(%s)\n", match.Provider, match.Line, match.Entry, match.Kind)
+		}
+	}
+
+	if len(result.Matches) == 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,12 +1,17 @@
 package api
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -31,7 +36,24 @@ type ClashAPI struct {
 
 // ClashConfig 表示部分 Clash 配置
 type ClashConfig struct {
-	Mode string `json:"mode"`
+	Mode      string `json:"mode"`
+	MixedPort int    `json:"mixed-port"` // HTTP 和 SOCKS5 混合端口
+	Port      int    `json:"port"`       // HTTP 代理端口
+	SocksPort int    `json:"socks-port"` // SOCKS5 代理端口
+}
+
+// ProxyURL 返回通过 host 访问 Clash 代理的地址，依次使用混合端口、HTTP 端口和 SOCKS5 端口
+func (c *ClashConfig) ProxyURL(host string) (string, bool) {
+	switch {
+	case c.MixedPort > 0:
+		return "http://" + net.JoinHostPort(host, strconv.Itoa(c.MixedPort)), true
+	case c.Port > 0:
+		return "http://" + net.JoinHostPort(host, strconv.Itoa(c.Port)), true
+	case c.SocksPort > 0:
+		return "socks5h://" + net.JoinHostPort(host, strconv.Itoa(c.SocksPort)), true
+	default:
+		return "", false
+	}
 }
 
 // 配置缓存有效期
@@ -60,7 +82,7 @@ func NewClashAPI(baseURL, secret string) *ClashAPI {
 }
 
 // TestConnection 测试与 Clash API 的连接
-func (c *ClashAPI) TestConnection() (bool, error) {
+func (c *ClashAPI) TestConnection(ctx context.Context) (bool, error) {
 	log.Printf("尝试连接到Clash API: %s", c.baseURL)
 
 	// 尝试不同的API路径，以支持不同版本的Clash
@@ -71,10 +93,14 @@ func (c *ClashAPI) TestConnection() (bool, error) {
 		log.Printf("尝试API端点: %s", endpoint)
 
 		// 发送请求
-		resp, err := c.doRequest("GET", endpoint, nil)
+		resp, err := c.doRequest(ctx, "GET", endpoint, nil)
 		if err != nil {
 			log.Printf("连接端点 %s 失败: %v", endpoint, err)
 			lastErr = err
+			// 请求被取消时不再尝试其他端点
+			if ctx.Err() != nil {
+				return false, ctx.Err()
+			}
 			continue
 		}
 
@@ -104,7 +130,7 @@ func (c *ClashAPI) TestConnection() (bool, error) {
 }
 
 // GetConfig 获取当前 Clash 配置（带缓存）
-func (c *ClashAPI) GetConfig() (*ClashConfig, error) {
+func (c *ClashAPI) GetConfig(ctx context.Context) (*ClashConfig, error) {
 	c.mutex.RLock()
 	// 检查缓存是否有效
 	if c.configCache != nil && time.Since(c.configCacheTime) < configCacheTTL {
@@ -115,7 +141,7 @@ func (c *ClashAPI) GetConfig() (*ClashConfig, error) {
 	c.mutex.RUnlock()
 
 	// 缓存无效，需要请求新数据
-	resp, err := c.doRequest("GET", "/configs", nil)
+	resp, err := c.doRequest(ctx, "GET", "/configs", nil)
 	if err != nil {
 		return nil, fmt.Errorf("获取配置失败: %v", err)
 	}
@@ -136,6 +162,28 @@ func (c *ClashAPI) GetConfig() (*ClashConfig, error) {
 	return &config, nil
 }
 
+// ProxyURL 返回 Clash 代理地址，代理与 API 位于同一主机
+func (c *ClashAPI) ProxyURL(ctx context.Context) (string, error) {
+	config, err := c.GetConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	host := "127.0.0.1"
+	if u, err := url.Parse(c.baseURL); err == nil {
+		// API 监听所有地址时通过本机访问代理
+		if h := u.Hostname(); h != "" && h != "0.0.0.0" && h != "::" {
+			host = h
+		}
+	}
+
+	proxyURL, ok := config.ProxyURL(host)
+	if !ok {
+		return "", fmt.Errorf("Clash 未开启 mixed-port、port 或 socks-port")
+	}
+	return proxyURL, nil
+}
+
 // ReloadConfig 重新加载 Clash 配置（仅更新本地文件，不再调用API）
 func (c *ClashAPI) ReloadConfig() error {
 	// 获取 CFW 设置文件路径
@@ -155,8 +203,48 @@ func (c *ClashAPI) ReloadConfig() error {
 	return nil
 }
 
+// ErrConfigRejected 表示 Clash 拒绝加载配置，通常是配置或规则文件有误
+var ErrConfigRejected = errors.New("Clash 拒绝加载配置")
+
+// ErrConfigPathUnknown 表示不知道 Clash 正在使用的配置文件，无法让 Clash 加载并验证新规则
+var ErrConfigPathUnknown = errors.New("未找到 Clash 配置文件路径，无法验证新规则")
+
+// ApplyConfig 通过 PUT /configs 让 Clash 重新加载 configPath 指向的配置文件及其中的规则
+//
+// Clash 返回错误状态码时返回包装了 ErrConfigRejected 的错误；Clash 未运行等无法连接的情况
+// 返回其他错误，表示配置没有被应用但也没有被拒绝。configPath 为空时不发送请求，返回 ErrConfigPathUnknown
+func (c *ClashAPI) ApplyConfig(ctx context.Context, configPath string) error {
+	if configPath == "" {
+		return ErrConfigPathUnknown
+	}
+
+	jsonData, err := json.Marshal(map[string]string{"path": configPath})
+	if err != nil {
+		return fmt.Errorf("序列化请求体失败: %v", err)
+	}
+
+	resp, err := c.doRequest(ctx, "PUT", "/configs?force=true", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("连接 Clash API 失败: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// 清除配置缓存
+	c.mutex.Lock()
+	c.configCache = nil
+	c.mutex.Unlock()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%w，状态码: %d，响应: %s", ErrConfigRejected, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	log.Printf("Clash 已重新加载配置: %s", configPath)
+	return nil
+}
+
 // UpdateRuleProviders 更新规则提供者
-func (c *ClashAPI) UpdateRuleProviders(providerNames []string) error {
+func (c *ClashAPI) UpdateRuleProviders(ctx context.Context, providerNames []string) error {
 	if len(providerNames) == 0 {
 		return nil
 	}
@@ -170,7 +258,7 @@ func (c *ClashAPI) UpdateRuleProviders(providerNames []string) error {
 			defer wg.Done()
 
 			endpoint := fmt.Sprintf("/providers/rules/%s", name)
-			resp, err := c.doRequest("PUT", endpoint, nil)
+			resp, err := c.doRequest(ctx, "PUT", endpoint, nil)
 			if err != nil {
 				errs <- fmt.Errorf("更新规则提供者 %s 失败: %v", name, err)
 				return
@@ -204,8 +292,12 @@ func (c *ClashAPI) UpdateRuleProviders(providerNames []string) error {
 	return nil
 }
 
-// doRequest 执行 HTTP 请求
-func (c *ClashAPI) doRequest(method, path string, body io.Reader) (*http.Response, error) {
+// doRequest 执行 HTTP 请求，ctx 被取消时请求会立即中止
+func (c *ClashAPI) doRequest(ctx context.Context, method, path string, body io.Reader) (*http.Response, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
 	// 构造完整的 URL
 	url := c.baseURL + path
 
@@ -228,7 +320,7 @@ func (c *ClashAPI) doRequest(method, path string, body io.Reader) (*http.Respons
 	}
 
 	// 创建请求
-	req, err := http.NewRequest(method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
 		log.Printf("创建请求失败: %v", err)
 		return nil, err
@@ -253,7 +345,7 @@ func (c *ClashAPI) doRequest(method, path string, body io.Reader) (*http.Respons
 }
 
 // SetRuleProviderConfig 设置规则提供者配置
-func (c *ClashAPI) SetRuleProviderConfig(name, url, path, behavior, interval string) error {
+func (c *ClashAPI) SetRuleProviderConfig(ctx context.Context, name, url, path, behavior, interval string) error {
 	// 构造请求体
 	reqBody := map[string]interface{}{
 		"type":     "http",
@@ -273,7 +365,7 @@ func (c *ClashAPI) SetRuleProviderConfig(name, url, path, behavior, interval str
 	endpoint := fmt.Sprintf("/providers/rules/%s", name)
 
 	// 发送请求
-	resp, err := c.doRequest("PUT", endpoint, bytes.NewBuffer(jsonData))
+	resp, err := c.doRequest(ctx, "PUT", endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
 		return fmt.Errorf("设置规则提供者配置失败: %v", err)
 	}
@@ -573,8 +665,104 @@ func AddRuleToBypass(rule string) error {
 	return UpdateBypassRules(settingsPath, updatedBypass)
 }
 
-// SyncBypassRulesFromDomainList 从域名列表同步绕过规则
-func SyncBypassRulesFromDomainList(domainRules string) error {
+// BypassOverrides 同步绕过规则时强制加入和排除的域名
+type BypassOverrides struct {
+	Include []string
+	Exclude []string
+}
+
+// bypassKey 返回用于比较的域名，忽略大小写和 +.、*.、. 前缀
+func bypassKey(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	for _, prefix := range []string{"+.", "*.", "."} {
+		domain = strings.TrimPrefix(domain, prefix)
+	}
+	return domain
+}
+
+// apply 去掉被排除的域名并加入强制加入的域名
+func (o BypassOverrides) apply(domains []string) []string {
+	if len(o.Include) == 0 && len(o.Exclude) == 0 {
+		return domains
+	}
+
+	f := o.filter()
+	result := make([]string, 0, len(domains)+len(o.Include))
+	for _, domain := range domains {
+		if f.keep(domain) {
+			result = append(result, domain)
+		}
+	}
+	return append(result, f.missing()...)
+}
+
+// bypassFilter 逐个检查域名，去掉被排除的域名并记录强制加入的域名是否已经出现
+type bypassFilter struct {
+	excluded map[string]bool
+	include  []string
+	present  map[string]bool // 强制加入的域名（小写）是否已经出现
+}
+
+// filter 创建逐个检查域名的 bypassFilter
+func (o BypassOverrides) filter() *bypassFilter {
+	f := &bypassFilter{
+		excluded: make(map[string]bool, len(o.Exclude)),
+		include:  o.Include,
+		present:  make(map[string]bool, len(o.Include)),
+	}
+	for _, domain := range o.Exclude {
+		f.excluded[bypassKey(domain)] = true
+	}
+	for _, domain := range o.Include {
+		f.present[strings.ToLower(domain)] = false
+	}
+	return f
+}
+
+// keep 判断域名是否保留
+func (f *bypassFilter) keep(domain string) bool {
+	if f.excluded[bypassKey(domain)] {
+		return false
+	}
+	key := strings.ToLower(domain)
+	if _, ok := f.present[key]; ok {
+		f.present[key] = true
+	}
+	return true
+}
+
+// missing 返回尚未出现的强制加入的域名
+func (f *bypassFilter) missing() []string {
+	var result []string
+	for _, domain := range f.include {
+		key := strings.ToLower(domain)
+		if !f.present[key] {
+			result = append(result, domain)
+			f.present[key] = true
+		}
+	}
+	return result
+}
+
+// staticBypassRules 始终加在绕过规则开头的本地地址
+var staticBypassRules = []string{
+	"localhost",
+	"127.*",
+	"10.*",
+	"172.16.*",
+	"172.17.*",
+	"172.18.*",
+	"172.19.*",
+	"172.20.*",
+	"172.21.*",
+	"172.22.*",
+	"172.23.*",
+	"192.168.*",
+	"<local>",
+}
+
+// SyncBypassRulesFromDomainList 从域名列表同步绕过规则，overrides 中的域名优先于域名列表
+func SyncBypassRulesFromDomainList(domainRules string, overrides BypassOverrides) error {
 	// 获取CFW设置文件路径
 	settingsPath := GetClashCFWSettingsPath()
 	if settingsPath == "" {
@@ -590,31 +778,15 @@ func SyncBypassRulesFromDomainList(domainRules string) error {
 	log.Printf("成功读取CFW设置文件，大小: %d 字节", len(settingsContent))
 
 	// 解析域名规则
-	domains := parseDomainRules(domainRules)
+	domains := overrides.apply(parseDomainRules(domainRules))
 	log.Printf("处理 %d 个域名规则", len(domains))
 
 	// 构建新的绕过规则
-	staticRules := []string{
-		"localhost",
-		"127.*",
-		"10.*",
-		"172.16.*",
-		"172.17.*",
-		"172.18.*",
-		"172.19.*",
-		"172.20.*",
-		"172.21.*",
-		"172.22.*",
-		"172.23.*",
-		"192.168.*",
-		"<local>",
-	}
-
 	var bypassLines []string
 	bypassLines = append(bypassLines, "bypass:")
 
 	// 添加静态规则
-	for _, rule := range staticRules {
+	for _, rule := range staticBypassRules {
 		bypassLines = append(bypassLines, "  - "+rule)
 	}
 
@@ -623,7 +795,7 @@ func SyncBypassRulesFromDomainList(domainRules string) error {
 		bypassLines = append(bypassLines, "  - "+domain)
 	}
 
-	log.Printf("最终构建的绕过规则包含 %d 个静态规则和 %d 个域名规则", len(staticRules), len(domains))
+	log.Printf("最终构建的绕过规则包含 %d 个静态规则和 %d 个域名规则", len(staticBypassRules), len(domains))
 
 	// 更新绕过规则
 	newBypass := strings.Join(bypassLines, "\n")
@@ -633,41 +805,179 @@ func SyncBypassRulesFromDomainList(domainRules string) error {
 // parseDomainRules 解析域名规则文本，支持多种格式
 func parseDomainRules(rulesText string) []string {
 	var domains []string
-	lines := strings.Split(rulesText, "\n")
+	var parser domainRuleParser
+	for _, line := range strings.Split(rulesText, "\n") {
+		if domain, ok := parser.parse(line); ok {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
 
-	inPayloadSection := false
+// domainRuleParser 逐行解析域名规则文本，见 parseDomainRules
+type domainRuleParser struct {
+	inPayloadSection bool
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
+// parse 解析一行，返回其中的域名
+func (p *domainRuleParser) parse(line string) (string, bool) {
+	line = strings.TrimSpace(line)
 
-		// 跳过空行和注释
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	// 跳过空行和注释
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	// 检测payload部分开始
+	if strings.HasPrefix(line, "payload:") {
+		p.inPayloadSection = true
+		return "", false
+	}
+
+	// 处理规则行
+	if p.inPayloadSection || !strings.Contains(line, ":") {
+		// 这可能是一个payload格式的域名项 (- 'domain.com')
+		if strings.HasPrefix(line, "-") {
+			domain := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+			domain = strings.Trim(domain, "'\"")
+			return domain, domain != ""
+		} else if !strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "-") {
+			// 可能是一个普通的域名行
+			domain := strings.TrimSpace(line)
+			return domain, domain != ""
 		}
+	}
+	return "", false
+}
 
-		// 检测payload部分开始
-		if strings.HasPrefix(line, "payload:") {
-			inPayloadSection = true
-			continue
+// bypassTextHeader 匹配CFW设置文件中绕过规则的开始行
+var bypassTextHeader = regexp.MustCompile(`^bypassText:\s*\|`)
+
+// SyncBypassRulesFromFile 与 SyncBypassRulesFromDomainList 相同，但逐行读取域名规则文件，
+// 并逐行写出新的CFW设置文件后替换原文件，规则和设置内容都不会完整读入内存
+func SyncBypassRulesFromFile(rulesPath string, overrides BypassOverrides) error {
+	// 获取CFW设置文件路径
+	settingsPath := GetClashCFWSettingsPath()
+	if settingsPath == "" {
+		return fmt.Errorf("未找到CFW设置文件")
+	}
+
+	rules, err := os.Open(rulesPath)
+	if err != nil {
+		return fmt.Errorf("读取域名规则失败: %v", err)
+	}
+	defer rules.Close()
+
+	settings, err := os.Open(settingsPath)
+	if err != nil {
+		return fmt.Errorf("读取CFW设置文件失败: %v", err)
+	}
+	defer settings.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(settingsPath), ".cfw-settings-*")
+	if err != nil {
+		return fmt.Errorf("写入CFW设置文件失败: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	count, err := writeBypassSettings(tmp, settings, rules, overrides)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), settingsPath)
+	}
+	if err != nil {
+		return fmt.Errorf("写入CFW设置文件失败: %v", err)
+	}
+
+	log.Printf("最终构建的绕过规则包含 %d 个静态规则和 %d 个域名规则", len(staticBypassRules), count)
+	log.Println("成功更新绕过规则")
+	return nil
+}
+
+// writeBypassSettings 将CFW设置逐行复制到 w，bypassText 的内容替换为 rules 中的域名，返回写入的域名数量
+func writeBypassSettings(w io.Writer, settings, rules io.Reader, overrides BypassOverrides) (int, error) {
+	bw := bufio.NewWriter(w)
+	sr := bufio.NewReader(settings)
+	count, found, inBypass := 0, false, false
+	for {
+		line, err := sr.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("读取CFW设置文件失败: %v", err)
 		}
 
-		// 处理规则行
-		if inPayloadSection || !strings.Contains(line, ":") {
-			// 这可能是一个payload格式的域名项 (- 'domain.com')
-			if strings.HasPrefix(line, "-") {
-				domain := strings.TrimSpace(strings.TrimPrefix(line, "-"))
-				domain = strings.Trim(domain, "'\"")
-				if domain != "" {
-					domains = append(domains, domain)
-				}
-			} else if !strings.HasPrefix(line, "  ") && !strings.HasPrefix(line, "-") {
-				// 可能是一个普通的域名行
-				if domain := strings.TrimSpace(line); domain != "" {
-					domains = append(domains, domain)
-				}
+		switch {
+		case line == "":
+		case inBypass && !startsWithLetter(line):
+			// 跳过原有的绕过规则，直到下一个顶层配置项
+		case !found && bypassTextHeader.MatchString(line):
+			found, inBypass = true, true
+			bw.WriteString(strings.TrimRight(line, "\r\n") + "\n")
+			n, err := writeBypassRules(bw, rules, overrides)
+			if err != nil {
+				return 0, err
 			}
+			count = n
+		default:
+			inBypass = false
+			bw.WriteString(line)
 		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+	if !found {
+		return 0, fmt.Errorf("未找到bypassText配置")
+	}
+	return count, bw.Flush()
+}
+
+// writeBypassRules 逐行读取域名规则，按 ensureIndentation 的缩进写出完整的绕过规则，返回写入的域名数量
+func writeBypassRules(w *bufio.Writer, rules io.Reader, overrides BypassOverrides) (int, error) {
+	writeItem := func(item string) {
+		w.WriteString("    - ")
+		w.WriteString(strings.Trim(strings.TrimSpace(item), "'\""))
+		w.WriteString("\n")
 	}
 
-	return domains
+	w.WriteString("  bypass:\n")
+	for _, rule := range staticBypassRules {
+		writeItem(rule)
+	}
+
+	filter := overrides.filter()
+	var parser domainRuleParser
+	count := 0
+	r := bufio.NewReader(rules)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("读取域名规则失败: %v", err)
+		}
+		if domain, ok := parser.parse(line); ok && filter.keep(domain) {
+			writeItem(domain)
+			count++
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	for _, domain := range filter.missing() {
+		writeItem(domain)
+		count++
+	}
+	return count, nil
+}
+
+// startsWithLetter 判断行是否以字母开头，即CFW设置文件中的顶层配置项
+func startsWithLetter(line string) bool {
+	c := line[0]
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
 }
@@ -1,11 +1,16 @@
 package config
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -38,6 +43,38 @@ type Config struct {
 	// 规则源配置
 	RuleProviders []RuleProvider `json:"rule_providers"`
 
+	// 镜像配置，为空时使用内置镜像列表
+	Mirrors []Mirror `json:"mirrors"`
+	// 同时竞速下载的镜像数量，0或1表示按顺序逐个尝试
+	MirrorRaceCount int `json:"mirror_race_count"`
+
+	// 下载重试配置，未设置的字段使用默认值
+	RetryConfig RetryConfig `json:"retry_config"`
+
+	// 免打扰时段，期间更新规则但不重启Clash
+	QuietHours QuietHours `json:"quiet_hours"`
+
+	// 规则条目校验配置
+	Validation ValidationConfig `json:"validation"`
+
+	// 每个规则保留的历史版本数量，为0时使用默认值
+	MaxRuleVersions int `json:"max_rule_versions"`
+
+	// 规则原始内容的最大字节数，规则可以单独设置
+	MaxRuleSize int64 `json:"max_rule_size"`
+
+	// 更新历史的保留策略
+	HistoryRetention HistoryRetention `json:"history_retention"`
+
+	// 默认的下载路径策略，规则可以单独设置，为空时直连
+	FetchPolicy string `json:"fetch_policy"`
+
+	// 本地覆盖条目，优先于上游规则
+	Overrides []Override `json:"overrides"`
+
+	// 额外的预设目录，与内置目录合并后供设置向导使用
+	PresetCatalogs []PresetCatalog `json:"preset_catalogs"`
+
 	// 配置文件路径缓存
 	configPath string
 	// 互斥锁，防止并发写入
@@ -52,10 +89,650 @@ type RuleProvider struct {
 	Behavior string `json:"behavior"`
 	Path     string `json:"path"`
 	Enabled  bool   `json:"enabled"`
+	// 该规则专用的镜像，优先于全局镜像使用
+	Mirrors []Mirror `json:"mirrors,omitempty"`
+	// 该规则的更新间隔（秒），为0时使用全局 UpdateInterval
+	Interval int `json:"interval,omitempty"`
+	// 该规则的 cron 表达式（如 "0 */6 * * *" 或 "@daily"），设置后优先于 Interval
+	Cron string `json:"cron,omitempty"`
+	// 内联规则条目，URL 为空时使用
+	Entries []string `json:"entries,omitempty"`
+	// 规则列表格式（auto、clash、plain、surge、loon、quanx、hosts、dnsmasq），为空时自动识别
+	Format string `json:"format,omitempty"`
+	// 该规则允许的最大无效条目比例，未设置时使用全局配置
+	MaxInvalidRatio *float64 `json:"max_invalid_ratio,omitempty"`
+	// 固定到的历史版本，非空时跳过自动更新直到取消固定
+	Pinned string `json:"pinned,omitempty"`
+	// 规则原始内容的最大字节数，为0时使用全局 MaxRuleSize
+	MaxSize int64 `json:"max_size,omitempty"`
+	// 规则来源的完整性校验，未设置时不校验
+	Verify *Verification `json:"verify,omitempty"`
+	// 下载该规则时使用的HTTP设置，未设置时使用默认设置
+	HTTP *HTTPOptions `json:"http,omitempty"`
+	// 下载路径策略（direct、via-clash、direct-then-clash、clash-then-direct），为空时使用全局 FetchPolicy
+	FetchPolicy string `json:"fetch_policy,omitempty"`
+	// 在格式转换之前依次对每一行执行的过滤和改写
+	Transforms []Transform `json:"transforms,omitempty"`
+	// 由其他规则提供者按集合运算组合而成，设置后不使用 URL 和 Entries
+	Composite []CompositeInput `json:"composite,omitempty"`
+	// 创建该规则时使用的预设 ID，用于提示预设地址变化或已弃用
+	Preset string `json:"preset,omitempty"`
+	// 排列顺序，数值小的在前，相同时按配置中的顺序；决定更新记录、绕过配置和规则查询中的顺序
+	Priority int `json:"priority,omitempty"`
+}
+
+// 规则转换类型
+const (
+	TransformInclude        = "include"         // 只保留匹配正则表达式的行
+	TransformExclude        = "exclude"         // 去掉匹配正则表达式的行
+	TransformIncludeSuffix  = "include_suffix"  // 只保留域名属于指定后缀的行
+	TransformExcludeSuffix  = "exclude_suffix"  // 去掉域名属于指定后缀的行
+	TransformIncludeKeyword = "include_keyword" // 只保留包含指定关键字的行
+	TransformExcludeKeyword = "exclude_keyword" // 去掉包含指定关键字的行
+	TransformConvertPrefix  = "convert_prefix"  // 将 full:、domain:、keyword:、regexp: 前缀转换为 Clash 写法
+	TransformRewrite        = "rewrite"         // 按正则表达式替换，结果为空时去掉该行
+)
+
+// Transform 定义一个规则转换步骤
+type Transform struct {
+	Type string `json:"type"`
+	// include、exclude、rewrite 使用的正则表达式
+	Pattern string `json:"pattern,omitempty"`
+	// rewrite 的替换内容，支持 $1、${name} 等分组引用
+	Replace string `json:"replace,omitempty"`
+	// *_suffix 的域名后缀或 *_keyword 的关键字，匹配任意一个即可
+	Values []string `json:"values,omitempty"`
+}
+
+// 组合规则的集合运算
+const (
+	CompositeUnion      = "union"      // 并集
+	CompositeIntersect  = "intersect"  // 交集
+	CompositeDifference = "difference" // 差集
+)
+
+// CompositeInput 组合规则的一个输入，按顺序对当前结果执行集合运算
+type CompositeInput struct {
+	// 集合运算，为空时视为 union；第一个输入只能是 union
+	Op string `json:"op,omitempty"`
+	// 输入的规则提供者名称
+	Provider string `json:"provider"`
+}
+
+// GetOp 返回输入的集合运算，默认为并集
+func (in CompositeInput) GetOp() string {
+	if in.Op == "" {
+		return CompositeUnion
+	}
+	return in.Op
+}
+
+// 覆盖条目的动作
+const (
+	OverrideInclude = "include" // 强制加入
+	OverrideExclude = "exclude" // 强制排除
+)
+
+// Override 定义一条本地覆盖条目，在每次下载后应用，优先于上游规则
+type Override struct {
+	ID     string `json:"id"`
+	Action string `json:"action"` // include 或 exclude
+	Value  string `json:"value"`
+	// 生效的规则提供者名称，为空时为全局覆盖
+	Provider string `json:"provider,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	// 过期时间，过期后不再生效并自动删除，为空时永久有效
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Expired 判断覆盖条目在 now 时刻是否已过期
+func (o Override) Expired(now time.Time) bool {
+	return o.ExpiresAt != nil && !now.Before(*o.ExpiresAt)
+}
+
+// 下载路径策略
+const (
+	FetchDirect          = "direct"            // 直连（或使用 HTTP 设置中的代理）
+	FetchViaClash        = "via-clash"         // 通过 Clash 代理
+	FetchDirectThenClash = "direct-then-clash" // 直连失败后通过 Clash 代理
+	FetchClashThenDirect = "clash-then-direct" // 通过 Clash 代理失败后直连
+)
+
+// ValidateFetchPolicy 检查下载路径策略是否有效，空值表示使用默认策略
+func ValidateFetchPolicy(policy string) error {
+	switch policy {
+	case "", FetchDirect, FetchViaClash, FetchDirectThenClash, FetchClashThenDirect:
+		return nil
+	default:
+		return fmt.Errorf("无效的下载路径策略: %s", policy)
+	}
+}
+
+// 签名类型
+const (
+	SignatureEd25519  = "ed25519"  // 对原始内容的 ed25519 签名
+	SignatureMinisign = "minisign" // minisign 格式的签名文件
+)
+
+// VerifyAuto 表示校验文件与规则列表放在同一位置，地址为规则地址加上对应后缀
+const VerifyAuto = "auto"
+
+// Verification 定义规则来源的完整性校验，设置的每一项都必须通过
+type Verification struct {
+	// 固定的 SHA-256 摘要（十六进制），内容不一致时拒绝更新
+	SHA256 string `json:"sha256,omitempty"`
+	// 校验和文件地址（sha256sum 格式），为 "auto" 时使用规则地址加 .sha256sum
+	ChecksumURL string `json:"checksum_url,omitempty"`
+	// 签名文件地址，为 "auto" 时使用规则地址加 .minisig（minisign）或 .sig（ed25519）
+	SignatureURL string `json:"signature_url,omitempty"`
+	// 签名类型：ed25519 或 minisign，为空时使用 minisign
+	SignatureType string `json:"signature_type,omitempty"`
+	// 可信公钥，任意一个验证通过即可
+	PublicKeys []string `json:"public_keys,omitempty"`
+}
+
+// GetSignatureType 返回签名类型，未设置时使用 minisign
+func (v Verification) GetSignatureType() string {
+	if v.SignatureType == "" {
+		return SignatureMinisign
+	}
+	return strings.ToLower(v.SignatureType)
+}
+
+// 认证方式
+const (
+	AuthBearer = "bearer" // Authorization: Bearer <token>
+	AuthBasic  = "basic"  // HTTP 基本认证
+)
+
+// RedactedSecret 在接口返回中代替密钥，提交该值时保留原有密钥
+const RedactedSecret = "******"
+
+// HTTPOptions 定义下载单个规则时的HTTP设置
+type HTTPOptions struct {
+	// 附加的请求头，只发送给规则地址所在的主机，不发送给镜像
+	Headers map[string]string `json:"headers,omitempty"`
+	// 认证信息，与请求头一样只发送给规则地址所在的主机
+	Auth *HTTPAuth `json:"auth,omitempty"`
+	// User-Agent，为空时使用默认值
+	UserAgent string `json:"user_agent,omitempty"`
+	// 额外信任的 CA 证书文件（PEM），与系统证书一起使用
+	CAFile string `json:"ca_file,omitempty"`
+	// 跳过 TLS 证书校验，仅用于测试环境
+	InsecureSkipVerify bool `json:"insecure_skip_verify,omitempty"`
+	// 单次请求的超时时间（秒），为0时使用默认值
+	Timeout int `json:"timeout,omitempty"`
+	// 代理地址（http、https、socks5 或 socks5h），为空时使用环境变量中的代理
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// HTTPAuth 定义HTTP认证信息
+type HTTPAuth struct {
+	Type     string `json:"type"`               // bearer 或 basic
+	Token    string `json:"token,omitempty"`    // bearer 令牌
+	Username string `json:"username,omitempty"` // basic 用户名
+	Password string `json:"password,omitempty"` // basic 密码
+}
+
+// IsSensitiveHeader 判断请求头是否可能包含密钥，这类请求头的值在接口返回中会被隐藏
+func IsSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	switch name {
+	case "authorization", "proxy-authorization", "cookie":
+		return true
+	}
+	for _, word := range []string{"token", "secret", "key", "password", "auth"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactProxy 隐藏代理地址中的密码
+func redactProxy(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil || u.User == nil {
+		return proxy
+	}
+	if _, ok := u.User.Password(); !ok {
+		return proxy
+	}
+	u.User = url.UserPassword(u.User.Username(), RedactedSecret)
+	return u.String()
+}
+
+// Redacted 返回隐藏了密钥的副本
+func (o *HTTPOptions) Redacted() *HTTPOptions {
+	if o == nil {
+		return nil
+	}
+	redacted := *o
+	if o.Headers != nil {
+		redacted.Headers = make(map[string]string, len(o.Headers))
+		for name, value := range o.Headers {
+			if IsSensitiveHeader(name) && value != "" {
+				value = RedactedSecret
+			}
+			redacted.Headers[name] = value
+		}
+	}
+	if o.Auth != nil {
+		auth := *o.Auth
+		if auth.Token != "" {
+			auth.Token = RedactedSecret
+		}
+		if auth.Password != "" {
+			auth.Password = RedactedSecret
+		}
+		redacted.Auth = &auth
+	}
+	redacted.Proxy = redactProxy(o.Proxy)
+	return &redacted
+}
+
+// RestoreSecrets 将值为 RedactedSecret 的密钥恢复为 prev 中的原值，
+// 使前端可以原样提交接口返回的设置而不丢失密钥
+func (o *HTTPOptions) RestoreSecrets(prev *HTTPOptions) {
+	if o == nil || prev == nil {
+		return
+	}
+	for name, value := range o.Headers {
+		if value == RedactedSecret {
+			o.Headers[name] = prev.Headers[name]
+		}
+	}
+	if o.Auth != nil && prev.Auth != nil {
+		if o.Auth.Token == RedactedSecret {
+			o.Auth.Token = prev.Auth.Token
+		}
+		if o.Auth.Password == RedactedSecret {
+			o.Auth.Password = prev.Auth.Password
+		}
+	}
+	if o.Proxy != "" && o.Proxy == redactProxy(prev.Proxy) {
+		o.Proxy = prev.Proxy
+	} else if u, err := url.Parse(o.Proxy); err == nil && u.User != nil {
+		if password, ok := u.User.Password(); ok && password == RedactedSecret {
+			if p, err := url.Parse(prev.Proxy); err == nil && p.User != nil && p.User.Username() == u.User.Username() {
+				u.User = p.User
+				o.Proxy = u.String()
+			}
+		}
+	}
+}
+
+// RedactProviders 返回隐藏了HTTP密钥的规则提供者列表副本，用于接口返回
+func RedactProviders(providers []RuleProvider) []RuleProvider {
+	if providers == nil {
+		return nil
+	}
+	redacted := make([]RuleProvider, len(providers))
+	for i, provider := range providers {
+		provider.HTTP = provider.HTTP.Redacted()
+		redacted[i] = provider
+	}
+	return redacted
+}
+
+// OrderedProviders 返回按 Priority 排序的规则提供者列表副本，Priority 相同时保持原有顺序
+func OrderedProviders(providers []RuleProvider) []RuleProvider {
+	ordered := append([]RuleProvider(nil), providers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+	return ordered
+}
+
+// ProviderRanks 返回规则提供者名称到其排序位置的映射
+func ProviderRanks(providers []RuleProvider) map[string]int {
+	ranks := make(map[string]int, len(providers))
+	for i, provider := range OrderedProviders(providers) {
+		ranks[provider.Name] = i
+	}
+	return ranks
+}
+
+// NextPriority 返回排在所有规则提供者之后的 Priority，用于新添加的规则
+func (c *Config) NextPriority() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	next := 0
+	for _, provider := range c.RuleProviders {
+		next = max(next, provider.Priority)
+	}
+	return next + 10
+}
+
+// ReorderRuleProviders 按 names 的顺序重新排列规则提供者，并重新分配间隔为 10 的 Priority；
+// names 必须恰好包含所有规则提供者的名称
+func (c *Config) ReorderRuleProviders(names []string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if len(names) != len(c.RuleProviders) {
+		return fmt.Errorf("规则数量不一致: 需要 %d 个，提供了 %d 个", len(c.RuleProviders), len(names))
+	}
+	byName := make(map[string]RuleProvider, len(c.RuleProviders))
+	for _, provider := range c.RuleProviders {
+		byName[provider.Name] = provider
+	}
+
+	reordered := make([]RuleProvider, 0, len(names))
+	for i, name := range names {
+		provider, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("规则不存在或重复: %s", name)
+		}
+		delete(byName, name)
+		provider.Priority = (i + 1) * 10
+		reordered = append(reordered, provider)
+	}
+	c.RuleProviders = reordered
+	return nil
+}
+
+// 规则来源类型
+const (
+	SourceRemote    = "remote"    // HTTP(S) 地址
+	SourceFile      = "file"      // file:// 本地文件或目录
+	SourceInline    = "inline"    // 配置文件中的内联条目
+	SourceComposite = "composite" // 由其他规则提供者组合而成
+)
+
+// SourceKind 返回规则提供者的来源类型
+func (p RuleProvider) SourceKind() string {
+	switch {
+	case len(p.Composite) > 0:
+		return SourceComposite
+	case p.URL == "" && len(p.Entries) > 0:
+		return SourceInline
+	case strings.HasPrefix(strings.ToLower(p.URL), "file://"):
+		return SourceFile
+	default:
+		return SourceRemote
+	}
+}
+
+// QuietHours 定义每天不允许重启Clash的时段，格式为 "HH:MM"，可以跨越午夜
+type QuietHours struct {
+	Enabled bool   `json:"enabled"`
+	Start   string `json:"start"`
+	End     string `json:"end"`
+}
+
+// parseClock 将 "HH:MM" 解析为当天的分钟数
+func parseClock(value string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("无效的时间 %q，应为 HH:MM 格式", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Validate 检查免打扰时段的格式
+func (q QuietHours) Validate() error {
+	if !q.Enabled {
+		return nil
+	}
+	if _, err := parseClock(q.Start); err != nil {
+		return err
+	}
+	if _, err := parseClock(q.End); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Contains 判断指定时间是否处于免打扰时段
+func (q QuietHours) Contains(t time.Time) bool {
+	if !q.Enabled {
+		return false
+	}
+	start, err := parseClock(q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseClock(q.End)
+	if err != nil || start == end {
+		return false
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	if start < end {
+		return minute >= start && minute < end
+	}
+	// 跨越午夜，例如 23:00-07:00
+	return minute >= start || minute < end
+}
+
+// Mirror 定义一个镜像的URL改写模板
+//
+// 模板中可使用以下占位符：
+//   - {owner} {repo} {ref} {path}：GitHub 文件坐标，仅当原始URL可识别为 GitHub 文件时生效
+//   - {url}：完整的原始URL，适用于前缀式代理
+type Mirror struct {
+	Name     string `json:"name"`
+	Template string `json:"template"`
+}
+
+// DefaultMirrors 返回内置的镜像列表
+func DefaultMirrors() []Mirror {
+	return []Mirror{
+		{Name: "jsdelivr", Template: "https://cdn.jsdelivr.net/gh/{owner}/{repo}@{ref}/{path}"},
+		{Name: "jsdelivr-fastly", Template: "https://fastly.jsdelivr.net/gh/{owner}/{repo}@{ref}/{path}"},
+		{Name: "jsdelivr-testingcf", Template: "https://testingcf.jsdelivr.net/gh/{owner}/{repo}@{ref}/{path}"},
+		{Name: "github-raw", Template: "https://raw.githubusercontent.com/{owner}/{repo}/{ref}/{path}"},
+	}
+}
+
+// GetMirrors 返回生效的全局镜像列表
+func (c *Config) GetMirrors() []Mirror {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if len(c.Mirrors) == 0 {
+		return DefaultMirrors()
+	}
+	mirrors := make([]Mirror, len(c.Mirrors))
+	copy(mirrors, c.Mirrors)
+	return mirrors
+}
+
+// PresetCatalog 定义一个预设目录来源，URL 和 Path 只能设置一个
+type PresetCatalog struct {
+	Name    string `json:"name"`
+	URL     string `json:"url,omitempty"`  // 远程目录地址
+	Path    string `json:"path,omitempty"` // 本地目录文件
+	Enabled bool   `json:"enabled"`
+}
+
+// ValidatePresetCatalogs 检查预设目录来源，名称不能重复
+func ValidatePresetCatalogs(catalogs []PresetCatalog) error {
+	names := make(map[string]bool, len(catalogs))
+	for _, catalog := range catalogs {
+		if catalog.Name == "" {
+			return fmt.Errorf("预设目录名称不能为空")
+		}
+		if names[catalog.Name] {
+			return fmt.Errorf("预设目录名称重复: %s", catalog.Name)
+		}
+		names[catalog.Name] = true
+
+		if (catalog.URL == "") == (catalog.Path == "") {
+			return fmt.Errorf("预设目录 %s 必须设置 url 或 path 中的一个", catalog.Name)
+		}
+		if catalog.URL != "" {
+			u, err := url.Parse(catalog.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("预设目录 %s 的地址无效: %s", catalog.Name, catalog.URL)
+			}
+		}
+	}
+	return nil
+}
+
+// GetPresetCatalogs 返回额外的预设目录来源的副本
+func (c *Config) GetPresetCatalogs() []PresetCatalog {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	catalogs := make([]PresetCatalog, len(c.PresetCatalogs))
+	copy(catalogs, c.PresetCatalogs)
+	return catalogs
+}
+
+// RetryConfig 定义下载重试和失败重新调度策略
+type RetryConfig struct {
+	MaxAttempts      int           `json:"max_attempts"`       // 每个镜像的最大尝试次数
+	BaseDelay        time.Duration `json:"base_delay"`         // 指数退避的初始等待时间
+	MaxDelay         time.Duration `json:"max_delay"`          // 单次重试的最大等待时间，Retry-After 超过该值时改用下一个镜像
+	FailureRetryBase time.Duration `json:"failure_retry_base"` // 更新失败后首次重新尝试的等待时间
+	FailureRetryMax  time.Duration `json:"failure_retry_max"`  // 更新失败后重新尝试的最大等待时间
+}
+
+// DefaultRetryConfig 返回默认的重试配置
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		MaxAttempts:      3,
+		BaseDelay:        1 * time.Second,
+		MaxDelay:         30 * time.Second,
+		FailureRetryBase: 5 * time.Minute,
+		FailureRetryMax:  2 * time.Hour,
+	}
+}
+
+// GetRetryConfig 返回生效的重试配置，未设置的字段使用默认值
+func (c *Config) GetRetryConfig() RetryConfig {
+	c.mutex.RLock()
+	rc := c.RetryConfig
+	c.mutex.RUnlock()
+
+	def := DefaultRetryConfig()
+	if rc.MaxAttempts <= 0 {
+		rc.MaxAttempts = def.MaxAttempts
+	}
+	if rc.BaseDelay <= 0 {
+		rc.BaseDelay = def.BaseDelay
+	}
+	if rc.MaxDelay <= 0 {
+		rc.MaxDelay = def.MaxDelay
+	}
+	if rc.FailureRetryBase <= 0 {
+		rc.FailureRetryBase = def.FailureRetryBase
+	}
+	if rc.FailureRetryMax <= 0 {
+		rc.FailureRetryMax = def.FailureRetryMax
+	}
+	return rc
+}
+
+// ValidationConfig 定义规则条目校验策略
+type ValidationConfig struct {
+	// 无效条目比例超过该值时拒绝整个更新，否则只丢弃无效条目；取值 0-1，为 0 时不允许任何无效条目，未设置时使用默认值
+	MaxInvalidRatio *float64 `json:"max_invalid_ratio,omitempty"`
+}
+
+// 默认允许的最大无效条目比例
+const defaultMaxInvalidRatio = 0.2
+
+// ValidateInvalidRatio 检查无效条目比例是否在 0-1 之间
+func ValidateInvalidRatio(ratio float64) error {
+	if ratio < 0 || ratio > 1 {
+		return fmt.Errorf("无效条目比例应在 0 到 1 之间: %v", ratio)
+	}
+	return nil
+}
+
+// HistoryRetention 定义更新历史的保留策略，超出任一限制的旧记录会被删除
+type HistoryRetention struct {
+	// 保留天数，为0时使用默认值
+	MaxDays int `json:"max_days"`
+	// 最多保留的记录数量，为0时使用默认值
+	MaxRecords int `json:"max_records"`
+}
+
+// DefaultHistoryRetention 返回默认的更新历史保留策略
+func DefaultHistoryRetention() HistoryRetention {
+	return HistoryRetention{
+		MaxDays:    30,
+		MaxRecords: 1000,
+	}
+}
+
+// GetHistoryRetention 返回生效的更新历史保留策略，未设置的字段使用默认值
+func (c *Config) GetHistoryRetention() HistoryRetention {
+	c.mutex.RLock()
+	hr := c.HistoryRetention
+	c.mutex.RUnlock()
+
+	def := DefaultHistoryRetention()
+	if hr.MaxDays <= 0 {
+		hr.MaxDays = def.MaxDays
+	}
+	if hr.MaxRecords <= 0 {
+		hr.MaxRecords = def.MaxRecords
+	}
+	return hr
+}
+
+// 默认保留的规则历史版本数量
+const defaultMaxRuleVersions = 10
+
+// GetMaxRuleVersions 返回每个规则保留的历史版本数量
+func (c *Config) GetMaxRuleVersions() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.MaxRuleVersions <= 0 {
+		return defaultMaxRuleVersions
+	}
+	return c.MaxRuleVersions
+}
+
+// 默认的规则原始内容大小上限
+const defaultMaxRuleSize int64 = 64 << 20
+
+// GetMaxRuleSize 返回规则原始内容的最大字节数
+func (c *Config) GetMaxRuleSize() int64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.MaxRuleSize <= 0 {
+		return defaultMaxRuleSize
+	}
+	return c.MaxRuleSize
+}
+
+// GetFetchPolicy 返回规则提供者的下载路径策略，规则未设置时使用全局配置
+func (c *Config) GetFetchPolicy(provider RuleProvider) string {
+	if provider.FetchPolicy != "" {
+		return provider.FetchPolicy
+	}
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.FetchPolicy != "" {
+		return c.FetchPolicy
+	}
+	return FetchDirect
+}
+
+// GetMaxInvalidRatio 返回全局允许的最大无效条目比例，未设置时使用默认值
+func (c *Config) GetMaxInvalidRatio() float64 {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.Validation.MaxInvalidRatio == nil {
+		return defaultMaxInvalidRatio
+	}
+	return *c.Validation.MaxInvalidRatio
 }
 
 // DefaultConfig 返回默认配置
 func DefaultConfig() *Config {
+	maxInvalidRatio := defaultMaxInvalidRatio
 	cfg := &Config{
 		ClashAPIURL:            "http://127.0.0.1:9090",
 		ClashAPIPort:           9090,
@@ -68,6 +745,13 @@ func DefaultConfig() *Config {
 		AutoStartEnabled:       true,
 		SystemAutoStartEnabled: true,
 		RuleProviders:          []RuleProvider{},
+		RetryConfig:            DefaultRetryConfig(),
+		Validation:             ValidationConfig{MaxInvalidRatio: &maxInvalidRatio},
+		MaxRuleVersions:        defaultMaxRuleVersions,
+		MaxRuleSize:            defaultMaxRuleSize,
+		HistoryRetention:       DefaultHistoryRetention(),
+		Overrides:              []Override{},
+		PresetCatalogs:         []PresetCatalog{},
 	}
 
 	// 设置默认日志配置
@@ -165,6 +849,132 @@ func GetConfigPath() string {
 	return filepath.Join(configDir, "config.json")
 }
 
+// GetOverrides 返回所有覆盖条目的副本，包括已过期但尚未删除的条目
+func (c *Config) GetOverrides() []Override {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	overrides := make([]Override, len(c.Overrides))
+	copy(overrides, c.Overrides)
+	return overrides
+}
+
+// ActiveOverrides 返回 now 时刻对规则提供者生效的覆盖条目，包括全局覆盖；provider 为空时只返回全局覆盖
+func (c *Config) ActiveOverrides(provider string, now time.Time) []Override {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	var active []Override
+	for _, o := range c.Overrides {
+		if (o.Provider == "" || o.Provider == provider) && !o.Expired(now) {
+			active = append(active, o)
+		}
+	}
+	return active
+}
+
+// AddOverride 添加覆盖条目，自动生成 ID 和创建时间
+func (c *Config) AddOverride(o Override) (Override, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if err := c.checkDuplicateOverride(o, ""); err != nil {
+		return Override{}, err
+	}
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return Override{}, fmt.Errorf("生成覆盖条目 ID 失败: %v", err)
+	}
+	o.ID = hex.EncodeToString(id)
+	o.CreatedAt = time.Now()
+	c.Overrides = append(c.Overrides, o)
+	return o, nil
+}
+
+// UpdateOverride 修改覆盖条目，保留原有的 ID 和创建时间
+func (c *Config) UpdateOverride(id string, o Override) (Override, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.Overrides {
+		if c.Overrides[i].ID != id {
+			continue
+		}
+		if err := c.checkDuplicateOverride(o, id); err != nil {
+			return Override{}, err
+		}
+		o.ID = id
+		o.CreatedAt = c.Overrides[i].CreatedAt
+		c.Overrides[i] = o
+		return o, nil
+	}
+	return Override{}, fmt.Errorf("覆盖条目不存在: %s", id)
+}
+
+// checkDuplicateOverride 检查是否已有相同动作、值和作用范围的覆盖条目，调用方需持有 c.mutex
+func (c *Config) checkDuplicateOverride(o Override, exceptID string) error {
+	for _, existing := range c.Overrides {
+		if existing.ID != exceptID && existing.Action == o.Action && existing.Provider == o.Provider &&
+			strings.EqualFold(existing.Value, o.Value) {
+			return fmt.Errorf("已存在相同的覆盖条目: %s", existing.ID)
+		}
+	}
+	return nil
+}
+
+// DeleteOverride 删除覆盖条目，条目不存在时返回 false
+func (c *Config) DeleteOverride(id string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.Overrides {
+		if c.Overrides[i].ID == id {
+			c.Overrides = append(c.Overrides[:i], c.Overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveExpiredOverrides 删除 now 时刻已过期的覆盖条目，返回被删除的条目
+func (c *Config) RemoveExpiredOverrides(now time.Time) []Override {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var removed []Override
+	kept := c.Overrides[:0]
+	for _, o := range c.Overrides {
+		if o.Expired(now) {
+			removed = append(removed, o)
+		} else {
+			kept = append(kept, o)
+		}
+	}
+	c.Overrides = kept
+	return removed
+}
+
+// RenameOverrideProvider 将规则提供者的覆盖条目转移到新名称，newName 为空时删除这些条目
+func (c *Config) RenameOverrideProvider(oldName, newName string) {
+	if oldName == "" {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	kept := c.Overrides[:0]
+	for _, o := range c.Overrides {
+		if o.Provider == oldName {
+			if newName == "" {
+				continue
+			}
+			o.Provider = newName
+		}
+		kept = append(kept, o)
+	}
+	c.Overrides = kept
+}
+
 // GetRuleProvider 通过名称获取规则提供者
 func (c *Config) GetRuleProvider(name string) *RuleProvider {
 	c.mutex.RLock()
@@ -1,6 +1,7 @@
 package process
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -394,7 +395,19 @@ func tryRestartFromCache(cachedPath string, cachedArgs []string) bool {
 }
 
 // RestartClash 安全地结束Clash进程并重新启动它
-func RestartClash() error {
+//
+// ctx 只在结束进程之前以及等待确认启动时生效：一旦Clash进程被结束，
+// 即使 ctx 已取消也会继续完成重新启动，避免Clash停留在未运行状态
+func RestartClash(ctx context.Context) error {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	// 结束进程前检查是否已取消
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("重启Clash已取消: %v", err)
+	}
+
 	// 记录启动时间，用于计算整个过程耗时
 	startTime := time.Now()
 
@@ -499,7 +512,12 @@ func RestartClash() error {
 	// 等待Clash启动并检查是否成功
 	success := false
 	for i := 0; i < 5; i++ {
-		time.Sleep(1 * time.Second)
+		select {
+		case <-time.After(1 * time.Second):
+		case <-ctx.Done():
+			log.Printf("等待Clash启动时被取消: %v", ctx.Err())
+			return fmt.Errorf("已发出启动Clash命令，但确认启动前被取消: %v", ctx.Err())
+		}
 		if verifyClashRunning() {
 			success = true
 			break
@@ -632,6 +650,74 @@ func parseCommandLine(cmdline string) []string {
 	return strings.Fields(cmdline)
 }
 
+// DetectConfigPath 从正在运行的 Clash 进程或上次记录的启动参数中找出 -f 指定的配置文件，
+// 找不到或文件不存在时返回空字符串。只通过 -d 指定目录的进程（如 Clash for Windows 的内核）
+// 由前端通过 API 加载配置，目录中的 config.yaml 不一定是正在使用的配置，因此不作推断
+func DetectConfigPath() string {
+	if processes, err := process.Processes(); err == nil {
+		for _, p := range processes {
+			name, err := p.Name()
+			if err != nil || !isClashProcessName(name) {
+				continue
+			}
+			args, err := p.CmdlineSlice()
+			if err != nil {
+				continue
+			}
+			cwd, _ := p.Cwd()
+			if path := configPathFromArgs(args, cwd); path != "" {
+				return path
+			}
+		}
+	}
+
+	// 进程信息无法读取时使用上次重启时记录的启动参数，相对路径无法确定基准目录，不使用
+	_, args := loadSuccessfulPathFromFile()
+	return configPathFromArgs(args, "")
+}
+
+// isClashProcessName 判断进程名是否为 Clash 进程
+func isClashProcessName(name string) bool {
+	for _, clashName := range ClashProcessNames {
+		if name == clashName {
+			return true
+		}
+	}
+	return false
+}
+
+// configPathFromArgs 从启动参数中取出 -f 指定的配置文件，相对路径基于 cwd 解析
+func configPathFromArgs(args []string, cwd string) string {
+	var path string
+	for i := 1; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-f" || arg == "--f":
+			if i+1 < len(args) {
+				path = args[i+1]
+				i++
+			}
+		case strings.HasPrefix(arg, "-f="):
+			path = strings.TrimPrefix(arg, "-f=")
+		case strings.HasPrefix(arg, "--f="):
+			path = strings.TrimPrefix(arg, "--f=")
+		}
+	}
+	if path == "" {
+		return ""
+	}
+	if !filepath.IsAbs(path) {
+		if cwd == "" {
+			return ""
+		}
+		path = filepath.Join(cwd, path)
+	}
+	if !utils.FileExists(path) {
+		return ""
+	}
+	return path
+}
+
 // findClashExecutable 尝试查找Clash可执行文件的路径
 func findClashExecutable(processName string) (string, error) {
 	// 在Windows上尝试查找Clash for Windows的安装位置
@@ -0,0 +1,262 @@
+package rules
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/process"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// unsafeFilenameChars 匹配不能出现在备份文件名中的字符
+var unsafeFilenameChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// getBackupDir 获取最后可用规则文件的备份目录
+func getBackupDir() string {
+	return filepath.Join(utils.GetConfigDir(), "rules_backup")
+}
+
+// backupPath 返回规则提供者最后可用版本的备份路径
+func backupPath(name string) string {
+	return filepath.Join(getBackupDir(), unsafeFilenameChars.ReplaceAllString(name, "_")+".yaml")
+}
+
+// copyFileAtomic 逐块复制文件，目标文件通过临时文件原子替换
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if err := utils.EnsureDirExists(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp, err := createTempBeside(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return replaceWithTemp(tmp, dst)
+}
+
+// replaceWithTemp 同步并关闭临时文件，然后用它原子替换目标文件，失败时删除临时文件
+func replaceWithTemp(tmp *os.File, path string) error {
+	err := tmp.Sync()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeRuleFile 原子写入规则文件并校验写入结果，见 installRuleFile
+func (ru *RuleUpdater) writeRuleFile(name, path, content string) error {
+	tmp, err := createTempBeside(path)
+	if err != nil {
+		return errors.Wrap(err, "写入规则文件失败")
+	}
+	if _, err := io.WriteString(tmp, content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return errors.Wrap(err, "写入规则文件失败")
+	}
+	return ru.installRuleFile(name, path, tmp, hashContent([]byte(content)))
+}
+
+// installRuleFile 用已写好的临时文件原子替换规则文件并校验写入结果
+//
+// 替换前将当前文件保存为最后可用版本（若当前文件已被确认可用），
+// 替换后重新计算摘要并解析，校验失败时立即恢复原文件。写入成功的规则在
+// ApplyChanges 确认之前处于待确认状态
+func (ru *RuleUpdater) installRuleFile(name, path string, tmp *os.File, hash string) error {
+	ru.backupMutex.Lock()
+	defer ru.backupMutex.Unlock()
+
+	// 待确认的文件尚未被 Clash 成功加载，不能作为最后可用版本
+	if _, pending := ru.pendingFiles[name]; !pending && utils.FileExists(path) {
+		if err := copyFileAtomic(path, backupPath(name)); err != nil {
+			logger.Warnf("备份规则 %s 失败: %v", name, err)
+		}
+	}
+
+	if err := replaceWithTemp(tmp, path); err != nil {
+		return errors.Wrap(err, "写入规则文件失败")
+	}
+
+	if err := verifyRuleFile(path, hash); err != nil {
+		if restoreErr := ru.restoreBackup(name, path); restoreErr != nil {
+			logger.Errorf("恢复规则 %s 失败: %v", name, restoreErr)
+		}
+		return errors.Wrap(err, "规则文件写入后校验失败，已恢复原文件")
+	}
+
+	ru.pendingFiles[name] = path
+	return nil
+}
+
+// verifyRuleFile 重新读取规则文件，确认内容完整且可以解析
+func verifyRuleFile(path, hash string) error {
+	actual, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if actual != hash {
+		return errors.New("写入的内容不完整")
+	}
+	_, err = countPayloadFile(path)
+	return err
+}
+
+// restoreBackup 用最后可用版本恢复规则文件，调用方需持有 ru.backupMutex
+func (ru *RuleUpdater) restoreBackup(name, path string) error {
+	backup := backupPath(name)
+	if !utils.FileExists(backup) {
+		return errors.New("没有可恢复的版本")
+	}
+	if err := copyFileAtomic(backup, path); err != nil {
+		return err
+	}
+	// 恢复后的内容与记录的校验信息不符，下次更新时重新下载
+	ru.stateMutex.Lock()
+	delete(ru.states, name)
+	ru.stateMutex.Unlock()
+	return nil
+}
+
+// ErrRolledBack 表示规则应用失败，待确认的规则文件已恢复到最后可用版本
+var ErrRolledBack = stderrors.New("规则已回滚到最后可用版本")
+
+// ApplyChanges 校验待确认的规则文件，然后调用 apply（通常是让 Clash 重新加载配置）应用规则
+//
+// 待确认的规则文件无法解析，或 apply 返回 api.ErrConfigRejected 时，恢复所有待确认的规则文件，
+// 在更新历史中记录回滚，并返回包装了 ErrRolledBack 的错误，调用方此时不应再重启 Clash。
+// apply 因其他原因失败（如 Clash 未运行）时规则文件已通过解析，仍确认为最后可用版本并返回该错误。
+// 没有待确认的规则时同样会调用 apply
+func (ru *RuleUpdater) ApplyChanges(apply func() error) error {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	ru.backupMutex.Lock()
+	var invalid error
+	for name, path := range ru.pendingFiles {
+		if _, err := countPayloadFile(path); err != nil {
+			invalid = errors.Wrapf(err, "规则 %s 无法解析", name)
+			break
+		}
+	}
+	ru.backupMutex.Unlock()
+
+	err := invalid
+	if err == nil {
+		err = apply()
+	}
+
+	ru.backupMutex.Lock()
+	defer ru.backupMutex.Unlock()
+
+	if err != nil && (invalid != nil || stderrors.Is(err, api.ErrConfigRejected)) {
+		if len(ru.pendingFiles) == 0 {
+			return err
+		}
+		logger.Errorf("应用规则失败，恢复最后可用版本: %v", err)
+		ru.rollback(errors.Wrap(err, "应用规则失败").Error())
+		ru.persistStates()
+		return fmt.Errorf("%w: %w", ErrRolledBack, err)
+	}
+
+	for name, path := range ru.pendingFiles {
+		if copyErr := copyFileAtomic(path, backupPath(name)); copyErr != nil {
+			logger.Warnf("保存规则 %s 的最后可用版本失败: %v", name, copyErr)
+		}
+	}
+	ru.pendingFiles = make(map[string]string)
+	return err
+}
+
+// ApplyToClash 让 Clash 重新加载配置文件以应用已写入的规则，见 ApplyChanges
+//
+// 配置文件由 clashConfigPath 确定。找不到配置文件时规则无法经过 Clash 验证，规则文件仍会被确认，
+// 返回 api.ErrConfigPathUnknown
+func (ru *RuleUpdater) ApplyToClash(ctx context.Context, clash *api.ClashAPI) error {
+	return ru.ApplyChanges(func() error {
+		return clash.ApplyConfig(ctx, ru.clashConfigPath())
+	})
+}
+
+// clashConfigPath 返回应用规则时让 Clash 加载的配置文件，未设置 clash_config_path 时
+// 从 Clash 进程的启动参数中查找，都找不到时返回空字符串
+func (ru *RuleUpdater) clashConfigPath() string {
+	if ru.cfg.ClashConfigPath != "" {
+		return ru.cfg.ClashConfigPath
+	}
+	return process.DetectConfigPath()
+}
+
+// noteUnverified 规则有变化但找不到 Clash 配置文件时，在更新记录中注明新规则无法验证、加载失败时不会自动回滚
+func (ru *RuleUpdater) noteUnverified(record *UpdateRecord) {
+	if !record.HasChanges() || ru.clashConfigPath() != "" {
+		return
+	}
+	record.Unverified = "未设置 clash_config_path，也无法从 Clash 进程的启动参数中找到配置文件，" +
+		"新规则不会经过 Clash 验证，加载失败时无法自动回滚"
+	logger.Warnf("%s", record.Unverified)
+}
+
+// rollback 恢复所有待确认的规则文件并记录到更新历史，调用方需持有 ru.mutex 和 ru.backupMutex
+func (ru *RuleUpdater) rollback(reason string) {
+	names := make([]string, 0, len(ru.pendingFiles))
+	for name := range ru.pendingFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	record := UpdateRecord{
+		Time:      time.Now(),
+		Trigger:   TriggerRollback,
+		Providers: []ProviderRecord{},
+		Rollback:  reason,
+	}
+	for _, name := range names {
+		path := ru.pendingFiles[name]
+		pr := ProviderRecord{
+			Name:          name,
+			EntriesBefore: countRuleEntries(path),
+		}
+		if err := ru.restoreBackup(name, path); err != nil {
+			logger.Errorf("回滚规则 %s 失败: %v", name, err)
+			pr.setStatus(StatusFailed, "回滚失败: "+err.Error())
+		} else {
+			logger.Infof("已将规则 %s 回滚到最后可用版本", name)
+			pr.setStatus(StatusRolledBack, "已回滚到最后可用版本")
+		}
+		pr.EntriesAfter = countRuleEntries(path)
+		record.Providers = append(record.Providers, pr)
+		ru.recordOutcome(pr, time.Now())
+	}
+	ru.pendingFiles = make(map[string]string)
+
+	ru.appendUpdateHistory(record)
+}
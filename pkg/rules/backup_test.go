@@ -0,0 +1,168 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// TestApplyChangesRollback 检查 Clash 拒绝加载时恢复最后可用版本，应用成功或 Clash 无法连接时新文件成为最后可用版本
+func TestApplyChangesRollback(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	ru := NewRuleUpdater(config.DefaultConfig())
+	path := filepath.Join(t.TempDir(), "direct.yaml")
+
+	good := "payload:\n  - 'a.com'\n"
+	bad := "payload:\n  - 'b.com'\n"
+	newer := "payload:\n  - 'c.com'\n"
+	if err := os.WriteFile(path, []byte(good), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	readFile := func() string {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	// Clash 拒绝加载时回滚
+	if err := ru.writeRuleFile("direct", path, bad); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(); got != bad {
+		t.Fatalf("写入后内容 = %q", got)
+	}
+	rejected := func() error { return fmt.Errorf("%w，状态码: 400", api.ErrConfigRejected) }
+	if err := ru.ApplyChanges(rejected); !errors.Is(err, ErrRolledBack) {
+		t.Fatalf("期望返回回滚错误，实际为 %v", err)
+	}
+	if got := readFile(); got != good {
+		t.Errorf("回滚后内容 = %q, 期望 %q", got, good)
+	}
+	history := ru.GetUpdateHistory()
+	if len(history) != 1 || history[0].Rollback == "" || history[0].Providers[0].Status != StatusRolledBack {
+		t.Errorf("更新历史未记录回滚: %+v", history)
+	}
+
+	// 应用成功后，新文件成为最后可用版本
+	if err := ru.writeRuleFile("direct", path, newer); err != nil {
+		t.Fatal(err)
+	}
+	if err := ru.ApplyChanges(func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	backup, err := os.ReadFile(backupPath("direct"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backup) != newer {
+		t.Errorf("最后可用版本 = %q, 期望 %q", backup, newer)
+	}
+
+	// Clash 无法连接时不回滚，已通过解析的文件成为最后可用版本
+	if err := ru.writeRuleFile("direct", path, good); err != nil {
+		t.Fatal(err)
+	}
+	err = ru.ApplyChanges(func() error { return errors.New("connection refused") })
+	if err == nil || errors.Is(err, ErrRolledBack) {
+		t.Fatalf("期望返回连接错误且不回滚，实际为 %v", err)
+	}
+	if got := readFile(); got != good {
+		t.Errorf("连接失败后内容 = %q, 期望 %q", got, good)
+	}
+	if backup, _ := os.ReadFile(backupPath("direct")); string(backup) != good {
+		t.Errorf("最后可用版本 = %q, 期望 %q", backup, good)
+	}
+	if len(ru.GetUpdateHistory()) != 1 {
+		t.Errorf("连接失败不应记录回滚: %+v", ru.GetUpdateHistory())
+	}
+}
+
+// TestApplyToClashDefaultConfig 检查默认配置（未设置 clash_config_path）下从 Clash 的启动参数找到配置文件，
+// Clash 拒绝加载时回滚；找不到配置文件时在更新记录中注明无法回滚
+func TestApplyToClashDefaultConfig(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Path string `json:"path"`
+		}
+		if r.Method != http.MethodPut || r.URL.Path != "/configs" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		requests = append(requests, body.Path)
+		http.Error(w, `{"message":"rule-provider direct: parse error"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+	clash := api.NewClashAPI(server.URL, "")
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{inlineProvider("direct", "a.com")}
+	ru := NewRuleUpdater(cfg)
+	path := filepath.Join(ru.getRulesDir(), "direct.yaml")
+
+	// 找不到配置文件：规则未经验证直接确认，更新记录注明无法回滚
+	record, err := ru.UpdateAllRules(context.Background(), TriggerAPI)
+	if err != nil || !record.HasChanges() {
+		t.Fatalf("首次更新: %+v, %v", record, err)
+	}
+	if record.Unverified == "" || ru.GetUpdateHistory()[0].Unverified == "" {
+		t.Errorf("更新记录没有注明无法验证: %+v", record)
+	}
+	if err := ru.ApplyToClash(context.Background(), clash); !errors.Is(err, api.ErrConfigPathUnknown) {
+		t.Fatalf("期望返回 ErrConfigPathUnknown，实际为 %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("不应请求 Clash 加载配置: %v", requests)
+	}
+	applied, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 上次启动 Clash 时使用了 -f，从中找到配置文件后 Clash 拒绝加载，规则被回滚
+	profile := filepath.Join(t.TempDir(), "profile.yaml")
+	if err := os.WriteFile(profile, []byte("rules:\n  - MATCH,DIRECT\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	launch, _ := json.Marshal(map[string]any{"path": "/usr/bin/mihomo", "args": []string{"mihomo", "-d", t.TempDir(), "-f", profile}})
+	if err := os.WriteFile(filepath.Join(utils.GetConfigDir(), "clash_path.json"), launch, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.RuleProviders[0].Entries = []string{"a.com", "b.com"}
+	record, err = ru.UpdateAllRules(context.Background(), TriggerAPI)
+	if err != nil || !record.HasChanges() {
+		t.Fatalf("第二次更新: %+v, %v", record, err)
+	}
+	if record.Unverified != "" {
+		t.Errorf("找到配置文件时不应注明无法验证: %q", record.Unverified)
+	}
+	if err := ru.ApplyToClash(context.Background(), clash); !errors.Is(err, ErrRolledBack) {
+		t.Fatalf("期望返回回滚错误，实际为 %v", err)
+	}
+	if len(requests) != 1 || requests[0] != profile {
+		t.Errorf("Clash 加载的配置 = %v, 期望 %s", requests, profile)
+	}
+	if got, _ := os.ReadFile(path); string(got) != string(applied) {
+		t.Errorf("回滚后内容 = %q, 期望 %q", got, applied)
+	}
+	if history := ru.GetUpdateHistory(); history[len(history)-1].Trigger != TriggerRollback {
+		t.Errorf("更新历史未记录回滚: %+v", history[len(history)-1])
+	}
+}
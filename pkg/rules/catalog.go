@@ -0,0 +1,479 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// bundledCatalogPath 内置预设目录的位置，与 Web 静态文件一起发布
+var bundledCatalogPath = filepath.Join("static", "config", "default-rules.json")
+
+const (
+	// bundledCatalogName 内置预设目录的名称
+	bundledCatalogName = "内置"
+	// catalogRefreshInterval 远程预设目录的检查间隔
+	catalogRefreshInterval = 24 * time.Hour
+	// catalogFetchTimeout 下载远程预设目录的超时时间
+	catalogFetchTimeout = 30 * time.Second
+	// maxCatalogSize 预设目录文件的最大字节数
+	maxCatalogSize = 1 << 20
+)
+
+// 预设提示类型
+const (
+	NoticeURLChanged = "url_changed" // 预设的地址已更新
+	NoticeDeprecated = "deprecated"  // 预设已弃用
+)
+
+// presetIDPattern 预设 ID 只能包含小写字母、数字和 . _ -
+var presetIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Catalog 是预设目录文件的内容
+type Catalog struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Version int      `json:"version"` // 每次修改目录时递增
+	Rules   []Preset `json:"rules"`
+}
+
+// Preset 是目录中的一个预设规则
+type Preset struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	Behavior    string `json:"behavior,omitempty"` // 为空时与 type 相同
+	Format      string `json:"format,omitempty"`
+	Priority    int    `json:"priority"`
+	Source      string `json:"source,omitempty"` // 上游项目，如 Loyalsoldier、blackmatrix7、ACL4SSR
+	Deprecated  bool   `json:"deprecated,omitempty"`
+	ReplacedBy  string `json:"replaced_by,omitempty"` // 弃用后推荐使用的预设 ID
+	// 提供该预设的目录名称，合并时填写
+	Catalog string `json:"catalog"`
+}
+
+// CatalogInfo 表示一个预设目录来源的加载状态
+type CatalogInfo struct {
+	Name      string    `json:"name"`
+	Location  string    `json:"location"` // 文件路径或地址
+	ID        string    `json:"id"`
+	Version   int       `json:"version"`
+	Presets   int       `json:"presets"`
+	CheckedAt time.Time `json:"checked_at"`
+	UpdatedAt time.Time `json:"updated_at"` // 版本最近一次变化的时间
+	Error     string    `json:"error,omitempty"`
+}
+
+// PresetNotice 提示用户已启用的预设发生了变化
+type PresetNotice struct {
+	Provider   string `json:"provider"`
+	Preset     string `json:"preset"`
+	Kind       string `json:"kind"`
+	Message    string `json:"message"`
+	URL        string `json:"url,omitempty"`         // 预设当前的地址
+	ReplacedBy string `json:"replaced_by,omitempty"` // 推荐替换为的预设
+}
+
+// PresetCatalogs 是合并后的预设目录
+type PresetCatalogs struct {
+	Catalogs []CatalogInfo  `json:"catalogs"`
+	Presets  []Preset       `json:"presets"`
+	Notices  []PresetNotice `json:"notices"`
+}
+
+// ValidateCatalog 检查预设目录的格式
+func ValidateCatalog(c *Catalog) error {
+	if c.ID == "" {
+		return fmt.Errorf("目录缺少 id")
+	}
+	if c.Version < 1 {
+		return fmt.Errorf("目录版本必须为正整数")
+	}
+
+	ids := make(map[string]bool, len(c.Rules))
+	for i, p := range c.Rules {
+		if !presetIDPattern.MatchString(p.ID) {
+			return fmt.Errorf("第 %d 个预设的 id 无效: %q", i+1, p.ID)
+		}
+		if ids[p.ID] {
+			return fmt.Errorf("预设 id 重复: %s", p.ID)
+		}
+		ids[p.ID] = true
+
+		if p.Name == "" {
+			return fmt.Errorf("预设 %s 缺少名称", p.ID)
+		}
+		u, err := url.Parse(p.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("预设 %s 的地址无效: %s", p.ID, p.URL)
+		}
+		switch p.Type {
+		case "domain", "ipcidr", "classical":
+		default:
+			return fmt.Errorf("预设 %s 的类型无效: %s", p.ID, p.Type)
+		}
+		if p.Behavior != "" && p.Behavior != p.Type {
+			return fmt.Errorf("预设 %s 的 behavior 与 type 不一致", p.ID)
+		}
+		if err := ValidateFormat(p.Format); err != nil {
+			return fmt.Errorf("预设 %s: %v", p.ID, err)
+		}
+		if p.Priority < 0 {
+			return fmt.Errorf("预设 %s 的优先级不能为负数", p.ID)
+		}
+		if p.ReplacedBy != "" && !p.Deprecated {
+			return fmt.Errorf("预设 %s 设置了 replaced_by 但没有弃用", p.ID)
+		}
+	}
+	return nil
+}
+
+// parseCatalog 解析并检查预设目录
+func parseCatalog(data []byte) (*Catalog, error) {
+	var c Catalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.Wrap(err, "解析预设目录失败")
+	}
+	if err := ValidateCatalog(&c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// catalogRecord 是一个预设目录来源的持久化状态
+type catalogRecord struct {
+	Version   int             `json:"version"`
+	CheckedAt time.Time       `json:"checked_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	Error     string          `json:"error,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"` // 远程目录最近一次有效的内容，下载失败时使用
+}
+
+// catalogStore 保存预设目录的加载状态
+type catalogStore struct {
+	records   map[string]*catalogRecord
+	catalogs  map[string]*Catalog // 最近一次成功加载的目录
+	notified  map[string]bool     // 已经记录过日志的提示
+	checkedAt time.Time           // 最近一次定期检查的时间
+	mutex     sync.Mutex
+}
+
+// getCatalogStatePath 获取预设目录状态文件路径
+func getCatalogStatePath() string {
+	return filepath.Join(utils.GetConfigDir(), "preset_catalogs.json")
+}
+
+// loadCatalogStore 从文件加载预设目录状态
+func loadCatalogStore() *catalogStore {
+	store := &catalogStore{
+		records:  make(map[string]*catalogRecord),
+		catalogs: make(map[string]*Catalog),
+		notified: make(map[string]bool),
+	}
+
+	data, err := os.ReadFile(getCatalogStatePath())
+	if err != nil {
+		return store
+	}
+	if err := json.Unmarshal(data, &store.records); err != nil {
+		logger.Warnf("解析预设目录状态文件失败，将重新加载: %v", err)
+		store.records = make(map[string]*catalogRecord)
+	}
+	return store
+}
+
+// save 保存预设目录状态到文件，调用方需持有锁
+func (s *catalogStore) save() {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		logger.Warnf("序列化预设目录状态失败: %v", err)
+		return
+	}
+
+	statePath := getCatalogStatePath()
+	if err := utils.EnsureDirExists(filepath.Dir(statePath)); err != nil {
+		logger.Warnf("保存预设目录状态失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(statePath, data, 0644); err != nil {
+		logger.Warnf("保存预设目录状态失败: %v", err)
+	}
+}
+
+// catalogSources 返回内置目录和已启用的额外目录，内置目录在最前面
+func (ru *RuleUpdater) catalogSources() []config.PresetCatalog {
+	sources := []config.PresetCatalog{{Name: bundledCatalogName, Path: bundledCatalogPath, Enabled: true}}
+	for _, c := range ru.cfg.GetPresetCatalogs() {
+		if c.Enabled {
+			sources = append(sources, c)
+		}
+	}
+	return sources
+}
+
+// catalogKey 返回预设目录来源的状态键，地址或路径变化后重新记录版本
+func catalogKey(c config.PresetCatalog) string {
+	if c.URL != "" {
+		return c.Name + "|" + c.URL
+	}
+	return c.Name + "|" + c.Path
+}
+
+// fetchCatalog 下载远程预设目录
+func (ru *RuleUpdater) fetchCatalog(ctx context.Context, rawURL string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, catalogFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "创建请求失败")
+	}
+	req.Header.Set("User-Agent", defaultUserAgent)
+
+	resp, err := ru.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "下载预设目录失败")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载预设目录失败，状态码: %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogSize+1))
+	if err != nil {
+		return nil, errors.Wrap(err, "下载预设目录失败")
+	}
+	if len(data) > maxCatalogSize {
+		return nil, fmt.Errorf("预设目录超过 %d 字节", maxCatalogSize)
+	}
+	return data, nil
+}
+
+// loadCatalog 加载一个预设目录来源并更新其状态，调用方需持有 ru.catalogs.mutex
+//
+// fetch 为 false 时远程目录只使用缓存的内容；远程目录的版本低于已加载的版本时拒绝使用，
+// 加载失败时沿用上一次成功的内容
+func (ru *RuleUpdater) loadCatalog(ctx context.Context, source config.PresetCatalog, fetch bool, now time.Time) {
+	store := ru.catalogs
+	key := catalogKey(source)
+	rec, ok := store.records[key]
+	if !ok {
+		rec = &catalogRecord{}
+		store.records[key] = rec
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case source.URL == "":
+		data, err = os.ReadFile(source.Path)
+		if fetch {
+			rec.CheckedAt = now
+		}
+	case fetch:
+		data, err = ru.fetchCatalog(ctx, source.URL)
+		rec.CheckedAt = now
+	case rec.Content != nil:
+		data = rec.Content
+	default:
+		// 还没有下载过，等待下一次检查
+		return
+	}
+
+	var catalog *Catalog
+	if err == nil {
+		catalog, err = parseCatalog(data)
+	}
+	if err == nil && source.URL != "" && catalog.Version < rec.Version {
+		err = fmt.Errorf("目录版本 %d 低于已加载的版本 %d", catalog.Version, rec.Version)
+	}
+
+	if err != nil {
+		if rec.Error != err.Error() {
+			logger.Warnf("加载预设目录 %s 失败: %v", source.Name, err)
+		}
+		rec.Error = err.Error()
+		if _, ok := store.catalogs[key]; !ok && source.URL != "" && rec.Content != nil {
+			if cached, err := parseCatalog(rec.Content); err == nil {
+				store.catalogs[key] = cached
+			}
+		}
+		return
+	}
+
+	rec.Error = ""
+	if catalog.Version != rec.Version {
+		if rec.Version > 0 {
+			logger.Infof("预设目录 %s 已从版本 %d 更新到 %d", source.Name, rec.Version, catalog.Version)
+		}
+		rec.Version = catalog.Version
+		rec.UpdatedAt = now
+	}
+	if source.URL != "" {
+		rec.Content = data
+	}
+	store.catalogs[key] = catalog
+}
+
+// loadCatalogs 加载所有预设目录来源，返回合并后的目录；fetch 为 false 时不下载远程目录，
+// 否则下载 force 为 true 或超过检查间隔的远程目录
+func (ru *RuleUpdater) loadCatalogs(ctx context.Context, fetch, force bool) PresetCatalogs {
+	store := ru.catalogs
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	// 只在状态变化时写入文件，避免频繁查询提示时反复写入
+	before, _ := json.Marshal(store.records)
+
+	now := time.Now()
+	sources := ru.catalogSources()
+	for _, source := range sources {
+		stale := now.Sub(store.records[catalogKey(source)].checkedAt()) >= catalogRefreshInterval
+		ru.loadCatalog(ctx, source, fetch && (force || stale), now)
+	}
+	if after, _ := json.Marshal(store.records); !bytes.Equal(before, after) {
+		store.save()
+	}
+
+	result := ru.mergeCatalogs(sources)
+	for _, notice := range result.Notices {
+		key := notice.Provider + "|" + notice.Kind + "|" + notice.URL
+		if !store.notified[key] {
+			store.notified[key] = true
+			logger.Warnf("规则 %s: %s", notice.Provider, notice.Message)
+		}
+	}
+	return result
+}
+
+// checkedAt 返回记录的检查时间，记录不存在时返回零值
+func (r *catalogRecord) checkedAt() time.Time {
+	if r == nil {
+		return time.Time{}
+	}
+	return r.CheckedAt
+}
+
+// mergeCatalogs 按来源顺序合并预设，后面的目录中相同 ID 的预设替换前面的，结果按优先级排序；
+// 调用方需持有 ru.catalogs.mutex
+func (ru *RuleUpdater) mergeCatalogs(sources []config.PresetCatalog) PresetCatalogs {
+	store := ru.catalogs
+	result := PresetCatalogs{
+		Catalogs: []CatalogInfo{},
+		Presets:  []Preset{},
+		Notices:  []PresetNotice{},
+	}
+
+	index := make(map[string]int)
+	for _, source := range sources {
+		key := catalogKey(source)
+		info := CatalogInfo{Name: source.Name, Location: source.URL}
+		if info.Location == "" {
+			info.Location = source.Path
+		}
+		if rec := store.records[key]; rec != nil {
+			info.CheckedAt, info.UpdatedAt, info.Error = rec.CheckedAt, rec.UpdatedAt, rec.Error
+		}
+
+		if catalog := store.catalogs[key]; catalog != nil {
+			info.ID, info.Version, info.Presets = catalog.ID, catalog.Version, len(catalog.Rules)
+			for _, preset := range catalog.Rules {
+				preset.Catalog = source.Name
+				if i, ok := index[preset.ID]; ok {
+					result.Presets[i] = preset
+				} else {
+					index[preset.ID] = len(result.Presets)
+					result.Presets = append(result.Presets, preset)
+				}
+			}
+		}
+		result.Catalogs = append(result.Catalogs, info)
+	}
+
+	sort.SliceStable(result.Presets, func(i, j int) bool {
+		return result.Presets[i].Priority < result.Presets[j].Priority
+	})
+
+	byID := make(map[string]Preset, len(result.Presets))
+	for _, preset := range result.Presets {
+		byID[preset.ID] = preset
+	}
+	for _, provider := range ru.cfg.RuleProviders {
+		if !provider.Enabled || provider.Preset == "" {
+			continue
+		}
+		if notice, ok := presetNotice(provider, byID); ok {
+			result.Notices = append(result.Notices, notice)
+		}
+	}
+	return result
+}
+
+// presetNotice 比较规则与其预设，预设已弃用或地址发生变化时返回提示
+func presetNotice(provider config.RuleProvider, presets map[string]Preset) (PresetNotice, bool) {
+	preset, ok := presets[provider.Preset]
+	if !ok {
+		return PresetNotice{}, false
+	}
+	notice := PresetNotice{Provider: provider.Name, Preset: preset.ID, URL: preset.URL}
+
+	if preset.Deprecated {
+		notice.Kind = NoticeDeprecated
+		notice.Message = fmt.Sprintf("预设 %s 已弃用", preset.Name)
+		if replacement, ok := presets[preset.ReplacedBy]; ok {
+			notice.ReplacedBy = replacement.ID
+			notice.Message += fmt.Sprintf("，建议改用 %s (%s)", replacement.Name, replacement.URL)
+		}
+		return notice, true
+	}
+	if provider.URL != preset.URL {
+		notice.Kind = NoticeURLChanged
+		notice.Message = fmt.Sprintf("预设 %s 的地址已更新为 %s", preset.Name, preset.URL)
+		return notice, true
+	}
+	return PresetNotice{}, false
+}
+
+// GetPresetCatalogs 返回合并后的预设目录，远程目录超过检查间隔或 refresh 为 true 时重新下载
+func (ru *RuleUpdater) GetPresetCatalogs(ctx context.Context, refresh bool) PresetCatalogs {
+	return ru.loadCatalogs(ctx, true, refresh)
+}
+
+// GetPresetNotices 返回已启用的预设的变化提示，不下载远程目录
+func (ru *RuleUpdater) GetPresetNotices() []PresetNotice {
+	return ru.loadCatalogs(context.Background(), false, false).Notices
+}
+
+// CheckPresetCatalogs 定期检查预设目录，距离上一次检查不足检查间隔时直接返回
+//
+// 检查时下载过期的远程目录，并为新的变化提示记录日志
+func (ru *RuleUpdater) CheckPresetCatalogs(ctx context.Context) {
+	ru.catalogs.mutex.Lock()
+	recent := time.Since(ru.catalogs.checkedAt) < catalogRefreshInterval
+	if !recent {
+		ru.catalogs.checkedAt = time.Now()
+	}
+	ru.catalogs.mutex.Unlock()
+
+	if !recent {
+		ru.loadCatalogs(ctx, true, false)
+	}
+}
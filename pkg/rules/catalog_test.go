@@ -0,0 +1,161 @@
+package rules
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// writeCatalog 把预设目录写入文件
+func writeCatalog(t *testing.T, path string, c Catalog) {
+	t.Helper()
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testPreset 返回一个有效的预设
+func testPreset(id string, priority int) Preset {
+	return Preset{
+		ID:       id,
+		Name:     id,
+		URL:      "https://example.com/" + id + ".txt",
+		Type:     "domain",
+		Priority: priority,
+	}
+}
+
+// TestValidateCatalog 检查预设目录的格式检查
+func TestValidateCatalog(t *testing.T) {
+	valid := Catalog{ID: "test", Version: 1, Rules: []Preset{testPreset("a", 0), testPreset("b", 10)}}
+	if err := ValidateCatalog(&valid); err != nil {
+		t.Fatalf("有效的目录检查失败: %v", err)
+	}
+
+	tests := map[string]func(c *Catalog){
+		"缺少 id":              func(c *Catalog) { c.ID = "" },
+		"版本为 0":              func(c *Catalog) { c.Version = 0 },
+		"预设 id 无效":           func(c *Catalog) { c.Rules[0].ID = "A B" },
+		"预设 id 重复":           func(c *Catalog) { c.Rules[1].ID = "a" },
+		"缺少名称":               func(c *Catalog) { c.Rules[0].Name = "" },
+		"地址无效":               func(c *Catalog) { c.Rules[0].URL = "ftp://example.com/a.txt" },
+		"类型无效":               func(c *Catalog) { c.Rules[0].Type = "geoip" },
+		"behavior 不一致":       func(c *Catalog) { c.Rules[0].Behavior = "ipcidr" },
+		"格式无效":               func(c *Catalog) { c.Rules[0].Format = "mrs" },
+		"优先级为负数":             func(c *Catalog) { c.Rules[0].Priority = -1 },
+		"未弃用但设置 replaced_by": func(c *Catalog) { c.Rules[0].ReplacedBy = "b" },
+	}
+	for name, mutate := range tests {
+		c := valid
+		c.Rules = append([]Preset(nil), valid.Rules...)
+		mutate(&c)
+		if err := ValidateCatalog(&c); err == nil {
+			t.Errorf("%s: 应返回错误", name)
+		}
+	}
+}
+
+// TestPresetCatalogs 检查额外目录覆盖内置目录中相同 ID 的预设，并提示已启用预设的变化
+func TestPresetCatalogs(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+
+	bundled := testPreset("proxy", 20)
+	oldURL := bundled.URL
+	writeCatalog(t, filepath.Join(dir, "bundled.json"), Catalog{ID: "bundled", Version: 1, Rules: []Preset{
+		bundled, testPreset("direct", 10), testPreset("ads", 30),
+	}})
+	defer func(path string) { bundledCatalogPath = path }(bundledCatalogPath)
+	bundledCatalogPath = filepath.Join(dir, "bundled.json")
+
+	moved := testPreset("proxy", 20)
+	moved.URL = "https://mirror.example.com/proxy.txt"
+	ads := testPreset("ads", 30)
+	ads.Deprecated, ads.ReplacedBy = true, "ads-v2"
+	writeCatalog(t, filepath.Join(dir, "extra.json"), Catalog{ID: "extra", Version: 1, Rules: []Preset{
+		moved, ads, testPreset("ads-v2", 5),
+	}})
+
+	cfg := config.DefaultConfig()
+	cfg.PresetCatalogs = []config.PresetCatalog{{Name: "额外", Path: filepath.Join(dir, "extra.json"), Enabled: true}}
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "proxy", URL: oldURL, Enabled: true, Preset: "proxy"},
+		{Name: "ads", URL: ads.URL, Enabled: true, Preset: "ads"},
+		{Name: "direct", URL: testPreset("direct", 0).URL, Enabled: true, Preset: "direct"},
+	}
+	ru := NewRuleUpdater(cfg)
+
+	result := ru.GetPresetCatalogs(context.Background(), false)
+	var ids, catalogs []string
+	for _, p := range result.Presets {
+		ids = append(ids, p.ID)
+		catalogs = append(catalogs, p.Catalog)
+	}
+	if want := []string{"ads-v2", "direct", "proxy", "ads"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("预设顺序 = %q, 期望 %q", ids, want)
+	}
+	if want := []string{"额外", bundledCatalogName, "额外", "额外"}; !reflect.DeepEqual(catalogs, want) {
+		t.Errorf("预设来源 = %q, 期望 %q", catalogs, want)
+	}
+	if len(result.Catalogs) != 2 || result.Catalogs[0].Version != 1 || result.Catalogs[1].Presets != 3 {
+		t.Errorf("目录状态 = %+v", result.Catalogs)
+	}
+
+	notices := ru.GetPresetNotices()
+	if len(notices) != 2 {
+		t.Fatalf("提示数量 = %d, 期望 2: %+v", len(notices), notices)
+	}
+	if n := notices[0]; n.Provider != "proxy" || n.Kind != NoticeURLChanged || n.URL != moved.URL {
+		t.Errorf("地址变化提示 = %+v", n)
+	}
+	if n := notices[1]; n.Provider != "ads" || n.Kind != NoticeDeprecated || n.ReplacedBy != "ads-v2" {
+		t.Errorf("弃用提示 = %+v", n)
+	}
+}
+
+// TestRemoteCatalogRollback 检查远程目录的版本回退被拒绝，并沿用上一次的内容
+func TestRemoteCatalogRollback(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	writeCatalog(t, filepath.Join(dir, "bundled.json"), Catalog{ID: "bundled", Version: 1})
+	defer func(path string) { bundledCatalogPath = path }(bundledCatalogPath)
+	bundledCatalogPath = filepath.Join(dir, "bundled.json")
+
+	remote := Catalog{ID: "remote", Version: 3, Rules: []Preset{testPreset("new", 0)}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(remote)
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.PresetCatalogs = []config.PresetCatalog{{Name: "远程", URL: server.URL, Enabled: true}}
+	ru := NewRuleUpdater(cfg)
+
+	result := ru.GetPresetCatalogs(context.Background(), true)
+	if len(result.Presets) != 1 || result.Catalogs[1].Version != 3 {
+		t.Fatalf("首次加载结果 = %+v", result)
+	}
+
+	remote = Catalog{ID: "remote", Version: 2, Rules: []Preset{testPreset("old", 0)}}
+	result = ru.GetPresetCatalogs(context.Background(), true)
+	if result.Catalogs[1].Error == "" || result.Catalogs[1].Version != 3 || result.Presets[0].ID != "new" {
+		t.Errorf("版本回退后结果 = %+v", result)
+	}
+
+	// 重新启动后从状态文件中的缓存加载
+	ru = NewRuleUpdater(cfg)
+	if presets := ru.loadCatalogs(context.Background(), false, false).Presets; len(presets) != 1 || presets[0].ID != "new" {
+		t.Errorf("缓存的预设 = %+v", presets)
+	}
+}
@@ -0,0 +1,251 @@
+package rules
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// ValidateComposites 检查规则提供者列表中所有组合规则的输入和依赖关系
+//
+// 添加、编辑或删除规则时使用修改后的完整列表调用，这样重命名或删除被引用的规则也会被发现
+func ValidateComposites(providers []config.RuleProvider) error {
+	byName := make(map[string]config.RuleProvider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name] = provider
+	}
+
+	for _, provider := range providers {
+		if provider.SourceKind() != config.SourceComposite {
+			continue
+		}
+		if err := validateComposite(provider, byName); err != nil {
+			return fmt.Errorf("组合规则 %s: %v", provider.Name, err)
+		}
+	}
+
+	_, err := compositeLevels(providers)
+	return err
+}
+
+// validateComposite 检查单个组合规则的设置
+func validateComposite(provider config.RuleProvider, byName map[string]config.RuleProvider) error {
+	if provider.URL != "" || len(provider.Entries) > 0 {
+		return fmt.Errorf("不能同时设置 url 或 entries")
+	}
+	if len(provider.Mirrors) > 0 || provider.Verify != nil || provider.HTTP != nil || provider.FetchPolicy != "" {
+		return fmt.Errorf("不支持镜像、完整性校验、HTTP 设置和下载路径策略")
+	}
+	if provider.Format != "" && provider.Format != FormatAuto && provider.Format != FormatClash {
+		return fmt.Errorf("不支持设置格式")
+	}
+
+	for i, input := range provider.Composite {
+		switch input.GetOp() {
+		case config.CompositeUnion:
+		case config.CompositeIntersect, config.CompositeDifference:
+			if i == 0 {
+				return fmt.Errorf("第一个输入只能是 union")
+			}
+		default:
+			return fmt.Errorf("不支持的集合运算: %s", input.Op)
+		}
+
+		if input.Provider == provider.Name {
+			return fmt.Errorf("不能引用自身")
+		}
+		source, ok := byName[input.Provider]
+		if !ok {
+			return fmt.Errorf("引用的规则 %s 不存在", input.Provider)
+		}
+		if payloadType(source) != payloadType(provider) {
+			return fmt.Errorf("引用的规则 %s 的类型 %s 与组合规则的类型 %s 不一致",
+				input.Provider, payloadType(source), payloadType(provider))
+		}
+	}
+	return nil
+}
+
+// compositeLevels 计算每个规则提供者的依赖层级，存在循环引用时返回错误
+//
+// 普通规则为 0，组合规则比它的输入中最高的层级大 1，同一层级的规则可以并行更新
+func compositeLevels(providers []config.RuleProvider) (map[string]int, error) {
+	byName := make(map[string]config.RuleProvider, len(providers))
+	for _, provider := range providers {
+		byName[provider.Name] = provider
+	}
+
+	const visiting = -1
+	levels := make(map[string]int, len(providers))
+
+	var visit func(name string, path []string) (int, error)
+	visit = func(name string, path []string) (int, error) {
+		if level, ok := levels[name]; ok {
+			if level != visiting {
+				return level, nil
+			}
+			// path 中从 name 开始的部分构成循环
+			for i, p := range path {
+				if p == name {
+					return 0, fmt.Errorf("组合规则存在循环引用: %s -> %s", strings.Join(path[i:], " -> "), name)
+				}
+			}
+		}
+
+		provider, ok := byName[name]
+		if !ok || provider.SourceKind() != config.SourceComposite {
+			// 不存在的输入由 validateComposite 报告
+			levels[name] = 0
+			return 0, nil
+		}
+
+		levels[name] = visiting
+		level := 0
+		for _, input := range provider.Composite {
+			inputLevel, err := visit(input.Provider, append(path, name))
+			if err != nil {
+				return 0, err
+			}
+			if inputLevel+1 > level {
+				level = inputLevel + 1
+			}
+		}
+		levels[name] = level
+		return level, nil
+	}
+
+	for _, provider := range providers {
+		if _, err := visit(provider.Name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return levels, nil
+}
+
+// withDependents 返回 names 以及直接或间接引用了其中任意规则的组合规则
+func withDependents(providers []config.RuleProvider, names map[string]bool) map[string]bool {
+	result := make(map[string]bool, len(names))
+	for name := range names {
+		result[name] = true
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, provider := range providers {
+			if result[provider.Name] || provider.SourceKind() != config.SourceComposite {
+				continue
+			}
+			for _, input := range provider.Composite {
+				if result[input.Provider] {
+					result[provider.Name] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+	return result
+}
+
+// appendToLevel 将规则提供者加入其依赖层级对应的批次
+func appendToLevel(batches [][]config.RuleProvider, level int, provider config.RuleProvider) [][]config.RuleProvider {
+	for len(batches) <= level {
+		batches = append(batches, nil)
+	}
+	batches[level] = append(batches[level], provider)
+	return batches
+}
+
+// describeComposite 返回组合规则的集合运算描述，如 "direct ∪ apple ∖ blocklist"
+func describeComposite(provider config.RuleProvider) string {
+	var builder strings.Builder
+	for i, input := range provider.Composite {
+		if i > 0 {
+			switch input.GetOp() {
+			case config.CompositeIntersect:
+				builder.WriteString(" ∩ ")
+			case config.CompositeDifference:
+				builder.WriteString(" ∖ ")
+			default:
+				builder.WriteString(" ∪ ")
+			}
+		}
+		builder.WriteString(input.Provider)
+	}
+	return builder.String()
+}
+
+// readComposite 按顺序对输入规则的当前规则文件执行集合运算，将结果写为 Clash 格式的临时文件
+//
+// 条目按处理后的值精确比较，不展开域名后缀；结果保持条目第一次出现的顺序
+func (ru *RuleUpdater) readComposite(provider config.RuleProvider, limit int64) (*ruleBody, string, error) {
+	var result []string
+	members := make(map[string]bool)
+
+	for _, input := range provider.Composite {
+		source := ru.cfg.GetRuleProvider(input.Provider)
+		if source == nil {
+			return nil, "", permanent(fmt.Errorf("引用的规则 %s 不存在", input.Provider))
+		}
+		if !source.Enabled {
+			return nil, "", permanent(fmt.Errorf("引用的规则 %s 已禁用", input.Provider))
+		}
+
+		var values []string
+		set := make(map[string]bool)
+		err := readPayloadFile(filepath.Join(ru.getRulesDir(), source.Path), func(value string) {
+			if !set[value] {
+				set[value] = true
+				values = append(values, value)
+			}
+		}, func() {
+			values, set = nil, make(map[string]bool)
+		})
+		if os.IsNotExist(err) {
+			return nil, "", permanent(fmt.Errorf("引用的规则 %s 还没有规则文件", input.Provider))
+		}
+		if err != nil {
+			return nil, "", permanent(errors.Wrapf(err, "读取引用的规则 %s 失败", input.Provider))
+		}
+
+		switch input.GetOp() {
+		case config.CompositeUnion:
+			for _, value := range values {
+				if !members[value] {
+					members[value] = true
+					result = append(result, value)
+				}
+			}
+		case config.CompositeIntersect, config.CompositeDifference:
+			keep := input.GetOp() == config.CompositeIntersect
+			kept := result[:0]
+			for _, value := range result {
+				if set[value] == keep {
+					kept = append(kept, value)
+				} else {
+					delete(members, value)
+				}
+			}
+			result = kept
+		}
+	}
+
+	spool, err := newSpool(limit)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "写入组合规则失败")
+	}
+	if err := writePayload(spool, result, provider.Name); err != nil {
+		spool.abort()
+		return nil, "", localSourceError(err, "写入组合规则失败")
+	}
+	body, err := spool.finish()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "写入组合规则失败")
+	}
+	return body, describeComposite(provider), nil
+}
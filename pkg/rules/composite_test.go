@@ -0,0 +1,153 @@
+package rules
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// compositeProvider 创建引用 inputs 的组合规则，inputs 的格式为 "运算:名称" 或 "名称"
+func compositeProvider(name string, inputs ...string) config.RuleProvider {
+	provider := config.RuleProvider{Name: name, Type: "domain", Behavior: "domain", Path: name + ".yaml", Enabled: true}
+	for _, input := range inputs {
+		op, name, found := strings.Cut(input, ":")
+		if !found {
+			op, name = "", input
+		}
+		provider.Composite = append(provider.Composite, config.CompositeInput{Op: op, Provider: name})
+	}
+	return provider
+}
+
+// inlineProvider 创建内联规则
+func inlineProvider(name string, entries ...string) config.RuleProvider {
+	return config.RuleProvider{Name: name, Type: "domain", Behavior: "domain", Path: name + ".yaml", Enabled: true, Entries: entries}
+}
+
+// TestCompositeProviders 检查组合规则在输入规则之后按集合运算生成，并随输入变化重新生成
+func TestCompositeProviders(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	// 组合规则排在输入规则之前，更新顺序由依赖关系决定
+	cfg.RuleProviders = []config.RuleProvider{
+		compositeProvider("apple_only", "proxy", "intersect:apple"),
+		compositeProvider("proxy", "direct", "apple", "difference:block"),
+		inlineProvider("direct", "a.example.com", "b.example.com", "ads.example.com"),
+		inlineProvider("apple", "apple.com", "b.example.com"),
+		inlineProvider("block", "ads.example.com", "apple.com"),
+	}
+	ru := NewRuleUpdater(cfg)
+
+	record, err := ru.UpdateAllRules(context.Background(), TriggerAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HasFailures() {
+		t.Fatalf("更新失败: %+v", record.Providers)
+	}
+
+	readEntries := func(name string) []string {
+		var entries []string
+		err := readPayloadFile(filepath.Join(ru.getRulesDir(), name+".yaml"), func(value string) {
+			entries = append(entries, value)
+		}, func() { entries = nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	if got, want := readEntries("proxy"), []string{"a.example.com", "b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("proxy = %q, 期望 %q", got, want)
+	}
+	if got, want := readEntries("apple_only"), []string{"b.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("apple_only = %q, 期望 %q", got, want)
+	}
+
+	// 只更新输入规则时，引用它的组合规则也会重新生成
+	cfg.RuleProviders[4].Entries = []string{"ads.example.com", "b.example.com"}
+	record, err = ru.UpdateProviders(context.Background(), TriggerAPI, []string{"block"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := make(map[string]ProviderStatus)
+	for _, pr := range record.Providers {
+		statuses[pr.Name] = pr.Status
+	}
+	want := map[string]ProviderStatus{"block": StatusChanged, "proxy": StatusChanged, "apple_only": StatusChanged}
+	if !reflect.DeepEqual(statuses, want) {
+		t.Errorf("更新结果 = %v, 期望 %v", statuses, want)
+	}
+	if got, want := readEntries("proxy"), []string{"a.example.com", "apple.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("proxy = %q, 期望 %q", got, want)
+	}
+
+	// 单独更新输入规则同样会重新生成组合规则
+	cfg.RuleProviders[3].Entries = []string{"apple.com", "icloud.com"}
+	if _, err := ru.UpdateRuleProvider(context.Background(), TriggerAPI, "apple"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readEntries("apple_only"), []string{"apple.com", "icloud.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("apple_only = %q, 期望 %q", got, want)
+	}
+}
+
+// TestValidateComposites 检查组合规则的引用、运算和循环引用
+func TestValidateComposites(t *testing.T) {
+	direct := inlineProvider("direct", "a.example.com")
+	cidr := config.RuleProvider{Name: "cidr", Type: "ipcidr", Behavior: "ipcidr", Entries: []string{"10.0.0.0/8"}}
+	withURL := compositeProvider("c", "direct")
+	withURL.URL = "https://example.com/c.txt"
+
+	tests := []struct {
+		name      string
+		providers []config.RuleProvider
+		err       string // 为空时期望有效
+	}{
+		{"有效", []config.RuleProvider{direct, compositeProvider("c", "direct", "difference:direct")}, ""},
+		{"引用不存在", []config.RuleProvider{compositeProvider("c", "missing")}, "不存在"},
+		{"引用自身", []config.RuleProvider{direct, compositeProvider("c", "direct", "c")}, "自身"},
+		{"第一个输入不是并集", []config.RuleProvider{direct, compositeProvider("c", "difference:direct")}, "union"},
+		{"无效运算", []config.RuleProvider{direct, compositeProvider("c", "direct", "xor:direct")}, "集合运算"},
+		{"类型不一致", []config.RuleProvider{direct, cidr, compositeProvider("c", "direct", "cidr")}, "类型"},
+		{"同时设置 url", []config.RuleProvider{direct, withURL}, "url"},
+		{"循环引用", []config.RuleProvider{
+			direct,
+			compositeProvider("a", "direct", "b"),
+			compositeProvider("b", "c"),
+			compositeProvider("c", "a"),
+		}, "a -> b -> c -> a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateComposites(tt.providers)
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("ValidateComposites() = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ValidateComposites() = %v, 期望包含 %q", err, tt.err)
+			}
+		})
+	}
+
+	// 依赖层级
+	levels, err := compositeLevels([]config.RuleProvider{
+		compositeProvider("top", "mid", "direct"),
+		compositeProvider("mid", "direct"),
+		direct,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"top": 2, "mid": 1, "direct": 0}; !reflect.DeepEqual(levels, want) {
+		t.Errorf("compositeLevels() = %v, 期望 %v", levels, want)
+	}
+}
@@ -0,0 +1,246 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// sortChunkSize 外部排序时在内存中累积的记录大小（字节），超过后排序写入临时文件
+var sortChunkSize = 4 << 20
+
+const (
+	// maxMergeFanIn 一次同时合并的临时文件数量上限，超过时先分批合并
+	maxMergeFanIn = 16
+	// sortReadBuffer 合并时每个临时文件的读取缓冲区大小
+	sortReadBuffer = 32 * 1024
+	// sortRecordOverhead 每条记录的偏移量和排序顺序在内存中占用的大小，用于估算 sortChunkSize
+	sortRecordOverhead = 16
+)
+
+// recordSorter 按字节顺序对记录进行外部排序，内存中最多保留 sortChunkSize 字节的记录，
+// 其余部分排序后写入下载临时目录中的文件，最后逐条合并输出。使用后需要调用 close
+type recordSorter struct {
+	buf  []byte // 内存中的记录内容
+	offs []int  // 每条记录在 buf 中的起始位置
+	runs []string
+	err  error
+}
+
+// add 添加一条记录，rec 在返回后可以被调用方复用
+func (s *recordSorter) add(rec []byte) {
+	if s.err != nil {
+		return
+	}
+	s.offs = append(s.offs, len(s.buf))
+	s.buf = append(s.buf, rec...)
+	if len(s.buf)+len(s.offs)*sortRecordOverhead >= sortChunkSize {
+		s.err = s.spill()
+	}
+}
+
+// record 返回内存中的第 i 条记录
+func (s *recordSorter) record(i int) []byte {
+	end := len(s.buf)
+	if i+1 < len(s.offs) {
+		end = s.offs[i+1]
+	}
+	return s.buf[s.offs[i]:end]
+}
+
+// sortChunk 对内存中的记录排序，返回排序后的记录顺序
+func (s *recordSorter) sortChunk() []int {
+	order := make([]int, len(s.offs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(s.record(order[i]), s.record(order[j])) < 0
+	})
+	return order
+}
+
+// spill 将内存中的记录排序后写入临时文件
+func (s *recordSorter) spill() error {
+	if len(s.offs) == 0 {
+		return nil
+	}
+	f, err := createSortRun()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f.Name())
+
+	w := bufio.NewWriterSize(f, sortReadBuffer)
+	for _, i := range s.sortChunk() {
+		writeRecord(w, s.record(i))
+	}
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	s.buf, s.offs = s.buf[:0], s.offs[:0]
+	return err
+}
+
+// each 按顺序将所有记录传给 fn，fn 收到的记录只在调用期间有效。fn 返回错误时停止
+func (s *recordSorter) each(fn func(rec []byte) error) error {
+	if s.err != nil {
+		return s.err
+	}
+	if len(s.runs) == 0 {
+		for _, i := range s.sortChunk() {
+			if err := fn(s.record(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := s.spill(); err != nil {
+		return err
+	}
+	s.buf, s.offs = nil, nil
+	// 临时文件过多时分批合并，限制同时打开的文件和读取缓冲区
+	for len(s.runs) > maxMergeFanIn {
+		f, err := createSortRun()
+		if err != nil {
+			return err
+		}
+		batch := s.runs[:maxMergeFanIn]
+		s.runs = append(s.runs[maxMergeFanIn:], f.Name())
+
+		w := bufio.NewWriterSize(f, sortReadBuffer)
+		err = mergeRuns(batch, func(rec []byte) error {
+			writeRecord(w, rec)
+			return nil
+		})
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		removeFiles(batch)
+		if err != nil {
+			return err
+		}
+	}
+	return mergeRuns(s.runs, fn)
+}
+
+// close 删除临时文件并释放内存
+func (s *recordSorter) close() {
+	removeFiles(s.runs)
+	s.runs, s.buf, s.offs = nil, nil, nil
+}
+
+// createSortRun 在下载临时目录中创建保存已排序记录的临时文件
+func createSortRun() (*os.File, error) {
+	dir := getSpoolDir()
+	if err := utils.EnsureDirExists(dir); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(dir, "sort-*")
+}
+
+// removeFiles 删除文件，忽略错误
+func removeFiles(paths []string) {
+	for _, path := range paths {
+		os.Remove(path)
+	}
+}
+
+// writeRecord 写入带长度前缀的记录
+func writeRecord(w *bufio.Writer, rec []byte) {
+	var prefix [binary.MaxVarintLen64]byte
+	w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(len(rec)))])
+	w.Write(rec)
+}
+
+// runReader 逐条读取一个已排序的临时文件
+type runReader struct {
+	file *os.File
+	r    *bufio.Reader
+	rec  []byte
+}
+
+// next 读取下一条记录，文件结束时返回 io.EOF
+func (rr *runReader) next() error {
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		return err
+	}
+	if uint64(cap(rr.rec)) < n {
+		rr.rec = make([]byte, n)
+	}
+	rr.rec = rr.rec[:n]
+	_, err = io.ReadFull(rr.r, rr.rec)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// runHeap 按当前记录排序的 runReader 最小堆
+type runHeap []*runReader
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return bytes.Compare(h[i].rec, h[j].rec) < 0 }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	rr := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return rr
+}
+
+// mergeRuns 合并多个已排序的临时文件，按顺序将记录传给 fn
+func mergeRuns(paths []string, fn func(rec []byte) error) error {
+	h := make(runHeap, 0, len(paths))
+	defer func() {
+		for _, rr := range h {
+			rr.file.Close()
+		}
+	}()
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		rr := &runReader{file: f, r: bufio.NewReaderSize(f, sortReadBuffer)}
+		if err := rr.next(); err != nil {
+			f.Close()
+			if err == io.EOF {
+				continue
+			}
+			return err
+		}
+		h = append(h, rr)
+	}
+	heap.Init(&h)
+
+	for len(h) > 0 {
+		rr := h[0]
+		if err := fn(rr.rec); err != nil {
+			return err
+		}
+		switch err := rr.next(); err {
+		case nil:
+			heap.Fix(&h, 0)
+		case io.EOF:
+			heap.Pop(&h)
+			rr.file.Close()
+		default:
+			return err
+		}
+	}
+	return nil
+}
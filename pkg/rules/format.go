@@ -0,0 +1,527 @@
+package rules
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+)
+
+// 支持的规则列表格式
+const (
+	FormatAuto    = "auto"    // 根据内容自动识别
+	FormatClash   = "clash"   // Clash rule-provider YAML，校验后以规范格式输出
+	FormatPlain   = "plain"   // 每行一个条目，原样使用
+	FormatSurge   = "surge"   // Surge .list，如 DOMAIN-SUFFIX,example.com
+	FormatLoon    = "loon"    // Loon 规则，语法与 Surge 相同
+	FormatQuanX   = "quanx"   // Quantumult X 分流，如 HOST-SUFFIX,example.com,proxy
+	FormatHosts   = "hosts"   // hosts 文件，如 0.0.0.0 example.com
+	FormatDnsmasq = "dnsmasq" // dnsmasq 配置，如 server=/example.com/114.114.114.114
+)
+
+// SupportedFormats 返回 RuleProvider.Format 可以使用的所有格式
+func SupportedFormats() []string {
+	return []string{FormatAuto, FormatClash, FormatPlain, FormatSurge, FormatLoon, FormatQuanX, FormatHosts, FormatDnsmasq}
+}
+
+// ValidateFormat 检查规则格式名称是否受支持，空字符串等同于 auto
+func ValidateFormat(format string) error {
+	if format == "" {
+		return nil
+	}
+	for _, f := range SupportedFormats() {
+		if format == f {
+			return nil
+		}
+	}
+	return fmt.Errorf("不支持的规则格式 %q，可选: %s", format, strings.Join(SupportedFormats(), ", "))
+}
+
+// entryKind 表示规则条目的匹配方式
+type entryKind int
+
+const (
+	entryRaw           entryKind = iota // 原样输出，不做转换
+	entryDomain                         // 完整域名匹配
+	entryDomainSuffix                   // 域名及其子域名
+	entryDomainKeyword                  // 域名关键字，Clash 的 domain 行为不支持
+	entryIPCIDR                         // IP 网段
+)
+
+// ruleEntry 表示一条规范化后的规则
+type ruleEntry struct {
+	kind  entryKind
+	value string
+}
+
+// conversionReport 记录一次规则转换的结果
+type conversionReport struct {
+	format       string        // 实际使用的格式
+	entries      int           // 写入的条目数量
+	invalidCount int           // 被丢弃的无效条目数量
+	invalid      []string      // 被丢弃的无效条目示例，最多 maxReportedInvalid 条
+	filtered     int           // 被转换步骤去掉的行
+	excluded     int           // 被覆盖条目排除的条目
+	included     int           // 强制加入的条目
+	optimize     OptimizeStats // 去重与网段聚合移除的条目
+}
+
+var dnsmasqLinePattern = regexp.MustCompile(`^(?:server|address|local|ipset|nftset)=/(.+)/[^/]*$`)
+
+// Surge/Loon 与 Quantumult X 的规则类型
+var (
+	surgeKinds = map[string]entryKind{
+		"DOMAIN":         entryDomain,
+		"DOMAIN-SUFFIX":  entryDomainSuffix,
+		"DOMAIN-KEYWORD": entryDomainKeyword,
+		"IP-CIDR":        entryIPCIDR,
+		"IP-CIDR6":       entryIPCIDR,
+	}
+	quanxKinds = map[string]entryKind{
+		"HOST":         entryDomain,
+		"HOST-SUFFIX":  entryDomainSuffix,
+		"HOST-KEYWORD": entryDomainKeyword,
+		"IP-CIDR":      entryIPCIDR,
+		"IP6-CIDR":     entryIPCIDR,
+	}
+	// 不会产生条目的规则类型，仅用于格式识别
+	surgeOtherKinds = map[string]bool{
+		"USER-AGENT": true, "URL-REGEX": true, "PROCESS-NAME": true, "GEOIP": true,
+		"IP-ASN": true, "DOMAIN-WILDCARD": true, "DEST-PORT": true, "SRC-IP": true,
+	}
+	quanxOtherKinds = map[string]bool{
+		"HOST-WILDCARD": true,
+	}
+)
+
+// hosts 文件中不应被视为规则的主机名
+var hostsIgnoredNames = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// isCommentLine 判断是否为注释行，兼容 #、; 和 // 三种注释
+func isCommentLine(line string) bool {
+	return strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "//")
+}
+
+// ruleType 返回逗号分隔规则的类型字段（大写）
+func ruleType(line string) string {
+	if i := strings.IndexByte(line, ','); i > 0 {
+		return strings.ToUpper(strings.TrimSpace(line[:i]))
+	}
+	return ""
+}
+
+// detectFormat 根据内容识别规则列表格式
+func detectFormat(content string) string {
+	if looksLikeYAML(content) {
+		return FormatClash
+	}
+
+	votes := make(map[string]int)
+	checked := 0
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || isCommentLine(line) {
+			continue
+		}
+		if checked++; checked > 200 {
+			break
+		}
+
+		typ := ruleType(line)
+		_, isSurge := surgeKinds[typ]
+		_, isQuanX := quanxKinds[typ]
+		switch {
+		case dnsmasqLinePattern.MatchString(line):
+			votes[FormatDnsmasq]++
+		case isQuanX && !isSurge, quanxOtherKinds[typ]:
+			// HOST-* 和 IP6-CIDR 只出现在 Quantumult X 中
+			votes[FormatQuanX]++
+		case isSurge, surgeOtherKinds[typ]:
+			votes[FormatSurge]++
+		case isHostsLine(line):
+			votes[FormatHosts]++
+		default:
+			votes[FormatPlain]++
+		}
+	}
+
+	// Quantumult X 文件中也会出现 IP-CIDR，只要出现 HOST-* 就视为 Quantumult X
+	if votes[FormatQuanX] > 0 {
+		return FormatQuanX
+	}
+
+	best, bestVotes := FormatPlain, 0
+	for _, format := range []string{FormatSurge, FormatDnsmasq, FormatHosts, FormatPlain} {
+		if votes[format] > bestVotes {
+			best, bestVotes = format, votes[format]
+		}
+	}
+	return best
+}
+
+// isHostsLine 判断是否为 "IP 主机名..." 形式的 hosts 行
+func isHostsLine(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return false
+	}
+	_, err := netip.ParseAddr(fields[0])
+	return err == nil
+}
+
+// normalizeDomain 规范化域名，返回空字符串表示无效
+func normalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || strings.ContainsAny(domain, " \t/,'\"") {
+		return ""
+	}
+	return domain
+}
+
+// normalizeCIDR 规范化 IP 网段，单个 IP 转换为 /32 或 /128
+func normalizeCIDR(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		return prefix.String(), true
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()).String(), true
+	}
+	return "", false
+}
+
+// newEntry 根据规则类型和值创建条目
+func newEntry(kind entryKind, value string) (ruleEntry, bool) {
+	if kind == entryIPCIDR {
+		cidr, ok := normalizeCIDR(value)
+		return ruleEntry{kind: entryIPCIDR, value: cidr}, ok
+	}
+
+	// 以 . 开头的域名表示包含子域名
+	if kind == entryDomain && strings.HasPrefix(strings.TrimSpace(value), ".") {
+		kind = entryDomainSuffix
+	}
+	domain := normalizeDomain(strings.TrimPrefix(strings.TrimSpace(value), "."))
+	return ruleEntry{kind: kind, value: domain}, domain != ""
+}
+
+// ruleConverter 逐行将规则列表转换为 payload 条目，条目交给 optimizer 外部排序，不保存在内存中
+type ruleConverter struct {
+	format      string
+	ruleType    string
+	unsupported int // 无法转换为 Clash 条目的规则，如 USER-AGENT、URL-REGEX
+	dropped     int // 与规则类型不符的条目
+	valid       int // 通过校验的条目，包括重复的条目
+	invalid     int
+	samples     []string // 无效条目示例
+	optimizer   *optimizer
+	transform   *transformer // 格式转换之前的过滤和改写，可以为 nil
+	overrides   *overrideSet // 本地覆盖条目，可以为 nil
+}
+
+// newRuleConverter 创建按 format 解析、输出 ruleType 类型条目的转换器
+func newRuleConverter(format, ruleType string, tr *transformer, ov *overrideSet) *ruleConverter {
+	return &ruleConverter{format: format, ruleType: ruleType, optimizer: newOptimizer(ruleType), transform: tr, overrides: ov}
+}
+
+// addInvalid 记录一条无效条目，只保留前 maxReportedInvalid 条作为示例
+func (c *ruleConverter) addInvalid(line string) {
+	c.invalid++
+	if len(c.samples) < maxReportedInvalid {
+		c.samples = append(c.samples, line)
+	}
+}
+
+// addLongLine 将超过 maxLineLength 的行记为无效条目，示例只保留开头部分
+func (c *ruleConverter) addLongLine(prefix string) {
+	if isCommentLine(strings.TrimSpace(prefix)) {
+		return
+	}
+	c.addInvalid(prefix + "...（超长行）")
+}
+
+// addEntry 将规范化后的条目转换为 payload 值并校验，跳过与规则类型不符的条目
+func (c *ruleConverter) addEntry(entry ruleEntry) {
+	value, ok := formatEntry(entry, c.ruleType)
+	if !ok {
+		c.dropped++
+		return
+	}
+	if err := validateEntry(value, c.ruleType); err != nil {
+		c.addInvalid(invalidEntry(value, err))
+		return
+	}
+	c.valid++
+	if c.overrides.excludes(value) {
+		return
+	}
+	c.optimizer.add(value)
+}
+
+// add 根据规则类型和值创建条目，无效时记录原始行
+func (c *ruleConverter) add(kind entryKind, value, line string) {
+	if entry, ok := newEntry(kind, value); ok {
+		c.addEntry(entry)
+	} else {
+		c.addInvalid(line)
+	}
+}
+
+// parseLine 按规则列表格式解析一行
+func (c *ruleConverter) parseLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || isCommentLine(line) {
+		return
+	}
+	line, ok := c.transform.apply(line)
+	if !ok {
+		return
+	}
+
+	switch c.format {
+	case FormatSurge, FormatLoon, FormatQuanX:
+		kinds := surgeKinds
+		if c.format == FormatQuanX {
+			kinds = quanxKinds
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) < 2 {
+			c.addInvalid(line)
+			return
+		}
+		kind, ok := kinds[strings.ToUpper(strings.TrimSpace(fields[0]))]
+		if !ok {
+			c.unsupported++
+			return
+		}
+		c.add(kind, fields[1], line)
+
+	case FormatHosts:
+		// 去掉行尾注释
+		hostsLine := line
+		if i := strings.IndexByte(hostsLine, '#'); i >= 0 {
+			hostsLine = hostsLine[:i]
+		}
+		fields := strings.Fields(hostsLine)
+		if len(fields) < 2 {
+			c.addInvalid(line)
+			return
+		}
+		if _, err := netip.ParseAddr(fields[0]); err != nil {
+			c.addInvalid(line)
+			return
+		}
+		for _, host := range fields[1:] {
+			if hostsIgnoredNames[strings.ToLower(host)] {
+				continue
+			}
+			c.add(entryDomain, host, line)
+		}
+
+	case FormatDnsmasq:
+		m := dnsmasqLinePattern.FindStringSubmatch(line)
+		if m == nil {
+			c.unsupported++
+			return
+		}
+		// dnsmasq 的域名同时匹配所有子域名
+		for _, domain := range strings.Split(m[1], "/") {
+			if domain == "" || domain == "#" {
+				continue
+			}
+			c.add(entryDomainSuffix, domain, line)
+		}
+
+	default:
+		c.addEntry(ruleEntry{kind: entryRaw, value: line})
+	}
+}
+
+// formatEntry 将条目转换为指定规则类型的 payload 值，返回 false 表示该类型不支持此条目
+func formatEntry(entry ruleEntry, ruleType string) (string, bool) {
+	if ruleType == "classical" {
+		switch entry.kind {
+		case entryRaw:
+			return entry.value, true
+		case entryDomain:
+			return "DOMAIN," + entry.value, true
+		case entryDomainSuffix:
+			return "DOMAIN-SUFFIX," + entry.value, true
+		case entryDomainKeyword:
+			return "DOMAIN-KEYWORD," + entry.value, true
+		case entryIPCIDR:
+			if strings.Contains(entry.value, ":") {
+				return "IP-CIDR6," + entry.value, true
+			}
+			return "IP-CIDR," + entry.value, true
+		}
+		return "", false
+	}
+
+	switch entry.kind {
+	case entryRaw:
+		return entry.value, true
+	case entryDomain:
+		return entry.value, ruleType != "ipcidr"
+	case entryDomainSuffix:
+		return "+." + entry.value, ruleType != "ipcidr"
+	case entryIPCIDR:
+		return entry.value, ruleType != "domain"
+	default:
+		return "", false
+	}
+}
+
+// payloadWriter 逐条写出 Clash rule-provider YAML
+type payloadWriter struct {
+	bw    *bufio.Writer
+	count int
+}
+
+// newPayloadWriter 创建写入 w 的 payloadWriter，写完后需要调用 close
+func newPayloadWriter(w io.Writer) *payloadWriter {
+	bw := bufio.NewWriterSize(w, 64*1024)
+	bw.WriteString("payload:\n")
+	return &payloadWriter{bw: bw}
+}
+
+// add 写入一个 payload 值
+func (p *payloadWriter) add(value string) {
+	p.bw.WriteString("  - '")
+	p.bw.WriteString(strings.ReplaceAll(value, "'", "''"))
+	p.bw.WriteString("'\n")
+	p.count++
+}
+
+// close 结束写入，没有有效规则时添加注释
+func (p *payloadWriter) close(providerName string) error {
+	if p.count == 0 {
+		fmt.Fprintf(p.bw, "  # 空规则文件 - %s\n", providerName)
+	}
+	return p.bw.Flush()
+}
+
+// writePayload 将 payload 值写为 Clash rule-provider YAML
+func writePayload(w io.Writer, values []string, providerName string) error {
+	pw := newPayloadWriter(w)
+	for _, value := range values {
+		pw.add(value)
+	}
+	return pw.close(providerName)
+}
+
+// convertRuleStream 逐行读取任意支持格式的规则列表，转换为 Clash rule-provider YAML 写入 w
+//
+// format 为空或 auto 时根据开头的内容自动识别格式，tr 不为 nil 时在格式转换之前处理每一行，
+// ov 不为 nil 时排除和加入覆盖条目。Clash YAML 无效时返回 *PayloadError；
+// 无效条目比例超过 maxInvalidRatio 时返回 *ValidationError，否则丢弃无效条目。
+// 内存占用取决于去重后的条目数量，与原始内容的大小无关；返回 *ValidationError 等转换错误时不会写入 w
+func convertRuleStream(r io.ReadSeeker, w io.Writer, format, ruleType, providerName string, maxInvalidRatio float64, tr *transformer, ov *overrideSet) (conversionReport, error) {
+	if format == "" || format == FormatAuto {
+		sample, err := readSample(r)
+		if err != nil {
+			return conversionReport{}, errors.Wrap(err, "读取规则内容失败")
+		}
+		format = detectFormat(sample)
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return conversionReport{format: format}, errors.Wrap(err, "读取规则内容失败")
+		}
+	}
+	report := conversionReport{format: format}
+
+	c := newRuleConverter(format, ruleType, tr, ov)
+	defer func() { c.optimizer.close() }()
+	var err error
+	if format == FormatClash {
+		err = readPayload(r, func(value string) {
+			if value, ok := tr.apply(value); ok {
+				c.addEntry(ruleEntry{kind: entryRaw, value: value})
+			}
+		}, func() {
+			tr.reset()
+			ov.reset()
+			c.optimizer.close()
+			c = newRuleConverter(format, ruleType, tr, ov)
+		})
+	} else {
+		err = forEachLine(r, c.parseLine, c.addLongLine)
+	}
+	if err != nil {
+		return report, err
+	}
+	report.invalidCount = c.invalid
+	report.invalid = c.samples
+	if tr != nil {
+		report.filtered = tr.filtered
+	}
+	if ov != nil {
+		report.excluded = ov.excluded
+		report.included = len(ov.include)
+	}
+
+	total := c.valid + c.invalid
+	if total > 0 && float64(c.invalid)/float64(total) > maxInvalidRatio {
+		return report, &ValidationError{
+			Invalid: c.invalid,
+			Total:   total,
+			Limit:   maxInvalidRatio,
+			Samples: c.samples,
+		}
+	}
+
+	if c.unsupported > 0 || c.invalid > 0 || c.dropped > 0 {
+		logger.Infof("规则 %s (%s 格式): 忽略 %d 条不支持的规则、%d 条无效条目、%d 条与类型 %s 不符的条目",
+			providerName, format, c.unsupported, c.invalid, c.dropped, ruleType)
+	}
+
+	// 强制加入的条目在排除之后加入，不受上游内容和转换步骤影响
+	for _, value := range ov.includes() {
+		c.optimizer.add(value)
+	}
+
+	pw := newPayloadWriter(w)
+	stats, err := c.optimizer.each(pw.add)
+	if err != nil {
+		return report, errors.Wrap(err, "优化规则失败")
+	}
+	if err := pw.close(providerName); err != nil {
+		return report, errors.Wrap(err, "写入规则失败")
+	}
+	report.optimize = stats
+	report.entries = pw.count
+	if stats.Removed() > 0 {
+		logger.Infof("规则 %s 优化: 移除 %d 条重复条目、%d 条已被后缀覆盖的域名，合并网段减少 %d 条",
+			providerName, stats.Duplicates, stats.Covered, stats.Merged)
+	}
+	return report, nil
+}
+
+// convertRules 将内存中的规则列表转换为 Clash rule-provider YAML，见 convertRuleStream
+func convertRules(content, format, ruleType, providerName string, maxInvalidRatio float64) (string, conversionReport, error) {
+	var builder strings.Builder
+	report, err := convertRuleStream(strings.NewReader(content), &builder, format, ruleType, providerName, maxInvalidRatio, nil, nil)
+	if err != nil {
+		return "", report, err
+	}
+	return builder.String(), report, nil
+}
@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var updateGolden = flag.Bool("update", false, "更新 testdata 中的 golden 文件")
+
+// TestConvertRulesGolden 将 testdata/formats 下的每种格式转换为 Clash 规则并与 golden 文件比较
+//
+// 修改转换逻辑后可使用 go test ./pkg/rules -run Golden -update 重新生成 golden 文件
+func TestConvertRulesGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string // 为空时自动识别
+		ruleType string
+		detected string
+	}{
+		{name: "surge", ruleType: "mixed", detected: FormatSurge},
+		{name: "loon", format: FormatLoon, ruleType: "mixed", detected: FormatLoon},
+		{name: "quanx", ruleType: "mixed", detected: FormatQuanX},
+		{name: "hosts", ruleType: "domain", detected: FormatHosts},
+		{name: "dnsmasq", ruleType: "domain", detected: FormatDnsmasq},
+		{name: "plain", ruleType: "domain", detected: FormatPlain},
+		{name: "clash", ruleType: "domain", detected: FormatClash},
+		{name: "clash-flow", ruleType: "domain", detected: FormatClash},
+		{name: "plain-colon", ruleType: "domain", detected: FormatPlain},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input, err := os.ReadFile(filepath.Join("testdata", "formats", tt.name+".input"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, report, err := convertRules(string(input), tt.format, tt.ruleType, tt.name, 1)
+			if err != nil {
+				t.Fatalf("转换失败: %v", err)
+			}
+			if report.format != tt.detected {
+				t.Errorf("格式 = %q, 期望 %q", report.format, tt.detected)
+			}
+
+			goldenPath := filepath.Join("testdata", "formats", tt.name+".golden")
+			if *updateGolden {
+				if err := os.WriteFile(goldenPath, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("转换结果与 %s 不一致\n--- 实际 ---\n%s\n--- 期望 ---\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+// TestConvertRulesByType 检查不同规则类型只保留对应的条目
+func TestConvertRulesByType(t *testing.T) {
+	input := "DOMAIN-SUFFIX,example.com\nIP-CIDR,10.0.0.0/8\n"
+
+	tests := []struct {
+		ruleType string
+		want     string
+	}{
+		{"domain", "payload:\n  - '+.example.com'\n"},
+		{"ipcidr", "payload:\n  - '10.0.0.0/8'\n"},
+		{"mixed", "payload:\n  - '+.example.com'\n  - '10.0.0.0/8'\n"},
+	}
+
+	for _, tt := range tests {
+		got, _, err := convertRules(input, FormatAuto, tt.ruleType, "test", 1)
+		if err != nil {
+			t.Fatalf("类型 %s: 转换失败: %v", tt.ruleType, err)
+		}
+		if got != tt.want {
+			t.Errorf("类型 %s: 得到 %q, 期望 %q", tt.ruleType, got, tt.want)
+		}
+	}
+}
+
+// TestConvertRulesInvalidYAML 检查无效的 Clash 规则文件被拒绝并报告出错位置
+func TestConvertRulesInvalidYAML(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		line   int
+		column int
+	}{
+		{"语法错误", "payload:\n  - 'a.com'\n  - 'b.com\n", 3, 0},
+		{"缺少payload", "bypass:\n  - a.com\n", 1, 1},
+		{"payload不是列表", "payload: a.com\n", 1, 10},
+		{"条目不是字符串", "payload:\n  - a.com\n  - {domain: b.com}\n", 3, 5},
+		{"顶层不是映射", "---\n- a.com\n", 2, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := convertRules(tt.input, FormatAuto, "domain", "test", 1)
+			payloadErr, ok := err.(*PayloadError)
+			if !ok {
+				t.Fatalf("期望 *PayloadError, 得到 %v", err)
+			}
+			if payloadErr.Line != tt.line || payloadErr.Column != tt.column {
+				t.Errorf("位置 = %d:%d, 期望 %d:%d (%v)", payloadErr.Line, payloadErr.Column, tt.line, tt.column, err)
+			}
+		})
+	}
+}
+
+// TestConvertRulesValidation 检查少量无效条目被丢弃，而大量无效条目导致整个更新被拒绝
+func TestConvertRulesValidation(t *testing.T) {
+	t.Run("丢弃少量无效条目", func(t *testing.T) {
+		input := "a.com\nb.com\nc.com\nd.com\nbad_domain!.com\n"
+		got, report, err := convertRules(input, FormatPlain, "domain", "test", 0.5)
+		if err != nil {
+			t.Fatalf("转换失败: %v", err)
+		}
+		if len(report.invalid) != 1 {
+			t.Errorf("无效条目 = %v, 期望 1 条", report.invalid)
+		}
+		want := "payload:\n  - 'a.com'\n  - 'b.com'\n  - 'c.com'\n  - 'd.com'\n"
+		if got != want {
+			t.Errorf("得到 %q, 期望 %q", got, want)
+		}
+	})
+
+	t.Run("超长行记为无效", func(t *testing.T) {
+		long := strings.Repeat("a", maxLineLength+100) + ".com"
+		for _, format := range []string{FormatPlain, FormatClash} {
+			input := "a.com\n" + long + "\nb.com\n"
+			if format == FormatClash {
+				input = "payload:\n  - a.com\n  - " + long + "\n  - b.com\n"
+			}
+			got, report, err := convertRules(input, format, "domain", "test", 0.5)
+			if err != nil {
+				t.Fatalf("%s: 转换失败: %v", format, err)
+			}
+			if report.invalidCount != 1 {
+				t.Errorf("%s: 无效条目 = %d, 期望 1", format, report.invalidCount)
+			}
+			if want := "payload:\n  - 'a.com'\n  - 'b.com'\n"; got != want {
+				t.Errorf("%s: 得到 %q, 期望 %q", format, got, want)
+			}
+		}
+
+		_, _, err := convertRules("a.com\n"+long+"\n", FormatPlain, "domain", "test", 0.2)
+		if _, ok := err.(*ValidationError); !ok {
+			t.Errorf("期望 *ValidationError, 得到 %v", err)
+		}
+	})
+
+	t.Run("拒绝错误页面", func(t *testing.T) {
+		input := "<!DOCTYPE html>\n<html>\n<head><title>404 Not Found</title></head>\n<body>not found</body>\n</html>\n"
+		_, _, err := convertRules(input, FormatAuto, "domain", "test", 0.2)
+		validationErr, ok := err.(*ValidationError)
+		if !ok {
+			t.Fatalf("期望 *ValidationError, 得到 %v", err)
+		}
+		if validationErr.Invalid == 0 || len(validationErr.Samples) == 0 {
+			t.Errorf("未报告无效条目: %+v", validationErr)
+		}
+	})
+
+	t.Run("classical规则", func(t *testing.T) {
+		input := "payload:\n  - DOMAIN-SUFFIX,example.com\n  - IP-CIDR,10.0.0.0/8,no-resolve\n  - DST-PORT,70000\n  - FOO,bar\n  - AND,((NETWORK,UDP),(DST-PORT,443))\n"
+		_, report, err := convertRules(input, FormatClash, "classical", "test", 1)
+		if err != nil {
+			t.Fatalf("转换失败: %v", err)
+		}
+		if len(report.invalid) != 2 {
+			t.Errorf("无效条目 = %v, 期望 2 条", report.invalid)
+		}
+	})
+}
@@ -0,0 +1,271 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// Trigger 表示触发一次规则更新的来源
+type Trigger string
+
+const (
+	// TriggerSchedule 定时更新
+	TriggerSchedule Trigger = "schedule"
+	// TriggerStartup 程序启动后的首次更新
+	TriggerStartup Trigger = "startup"
+	// TriggerAPI 通过 Web 界面或 API 手动触发
+	TriggerAPI Trigger = "api"
+	// TriggerLocal 本地规则来源发生变化
+	TriggerLocal Trigger = "local"
+	// TriggerRollback 应用失败后自动回滚
+	TriggerRollback Trigger = "rollback"
+)
+
+// 内存中保留的最近更新记录数量，用于状态页面
+const recentHistorySize = 10
+
+// HistoryQuery 更新历史的查询条件，零值字段表示不过滤
+type HistoryQuery struct {
+	Provider string         // 只返回包含该规则的记录，且记录中只保留该规则
+	Status   ProviderStatus // 只返回包含该状态规则的记录，且记录中只保留该状态的规则
+	Trigger  Trigger
+	Since    time.Time
+	Until    time.Time
+	Offset   int
+	Limit    int
+}
+
+// HistoryPage 分页查询结果，记录按时间从新到旧排列
+type HistoryPage struct {
+	Total   int            `json:"total"`
+	Offset  int            `json:"offset"`
+	Limit   int            `json:"limit"`
+	Records []UpdateRecord `json:"records"`
+}
+
+// historyStore 以 JSON Lines 格式追加保存每一次更新记录
+type historyStore struct {
+	path   string
+	cfg    *config.Config
+	mutex  sync.Mutex
+	loaded bool      // 是否已统计文件中的记录
+	count  int       // 文件中的记录数量
+	oldest time.Time // 文件中最早的记录时间
+}
+
+// getHistoryPath 获取更新历史文件路径
+func getHistoryPath() string {
+	return filepath.Join(utils.GetConfigDir(), "update_history.jsonl")
+}
+
+// openHistoryStore 打开更新历史文件
+//
+// 打开时不修改文件，第一次追加记录时才统计记录并按保留策略清理，只读取历史的命令不会改写文件
+func openHistoryStore(cfg *config.Config) *historyStore {
+	return &historyStore{path: getHistoryPath(), cfg: cfg}
+}
+
+// loadLocked 统计文件中的记录并按保留策略清理，调用方需持有 mutex
+func (s *historyStore) loadLocked() {
+	records := s.readAll()
+	s.count = len(records)
+	s.oldest = time.Time{}
+	if len(records) > 0 {
+		s.oldest = records[0].Time
+	}
+	s.loaded = true
+	s.compactLocked(records)
+}
+
+// readAll 读取全部记录，按写入顺序（从旧到新）排列，损坏的行会被跳过，调用方需持有 mutex
+func (s *historyStore) readAll() []UpdateRecord {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil
+	}
+
+	var records []UpdateRecord
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var record UpdateRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			logger.Warnf("跳过损坏的更新历史记录: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// append 追加一条记录，超出保留策略时清理旧记录
+func (s *historyStore) append(record UpdateRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		logger.Warnf("编码更新历史失败: %v", err)
+		return
+	}
+
+	if err := utils.EnsureDirExists(filepath.Dir(s.path)); err != nil {
+		logger.Warnf("创建更新历史目录失败: %v", err)
+		return
+	}
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logger.Warnf("打开更新历史文件失败: %v", err)
+		return
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		logger.Warnf("写入更新历史失败: %v", err)
+		return
+	}
+
+	if !s.loaded {
+		s.loadLocked()
+		return
+	}
+	s.count++
+	if s.oldest.IsZero() {
+		s.oldest = record.Time
+	}
+
+	// 记录数量超出上限一定比例或存在过期记录时才重写文件，避免每次追加都重写
+	retention := s.cfg.GetHistoryRetention()
+	if s.count > retention.MaxRecords+retention.MaxRecords/10 || s.expired(s.oldest, time.Now()) {
+		s.compactLocked(s.readAll())
+	}
+}
+
+// expired 判断记录是否超过保留天数
+func (s *historyStore) expired(t time.Time, now time.Time) bool {
+	return !t.IsZero() && t.Before(now.AddDate(0, 0, -s.cfg.GetHistoryRetention().MaxDays))
+}
+
+// compactLocked 按保留策略删除过期和超出数量的记录，调用方需持有 mutex
+func (s *historyStore) compactLocked(records []UpdateRecord) {
+	now := time.Now()
+	retention := s.cfg.GetHistoryRetention()
+
+	start := 0
+	for start < len(records) && s.expired(records[start].Time, now) {
+		start++
+	}
+	if len(records)-start > retention.MaxRecords {
+		start = len(records) - retention.MaxRecords
+	}
+	if start == 0 {
+		return
+	}
+	kept := records[start:]
+
+	var buf bytes.Buffer
+	for _, record := range kept {
+		data, err := json.Marshal(record)
+		if err != nil {
+			continue
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	if err := utils.WriteFileAtomic(s.path, buf.Bytes(), 0644); err != nil {
+		logger.Warnf("清理更新历史失败: %v", err)
+		return
+	}
+
+	logger.Infof("已清理 %d 条过期的更新历史", start)
+	s.count = len(kept)
+	s.oldest = time.Time{}
+	if len(kept) > 0 {
+		s.oldest = kept[0].Time
+	}
+}
+
+// recent 返回最近的 n 条记录，按时间从旧到新排列
+func (s *historyStore) recent(n int) []UpdateRecord {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	records := s.readAll()
+	if len(records) > n {
+		records = records[len(records)-n:]
+	}
+	return records
+}
+
+// query 按条件过滤并分页
+func (s *historyStore) query(q HistoryQuery) HistoryPage {
+	s.mutex.Lock()
+	records := s.readAll()
+	s.mutex.Unlock()
+
+	var matched []UpdateRecord
+	for i := len(records) - 1; i >= 0; i-- {
+		if record, ok := q.match(records[i]); ok {
+			matched = append(matched, record)
+		}
+	}
+
+	page := HistoryPage{Total: len(matched), Offset: q.Offset, Limit: q.Limit, Records: []UpdateRecord{}}
+	// 负数偏移量不返回任何记录
+	if q.Offset >= 0 && q.Offset < len(matched) {
+		end := len(matched)
+		if q.Limit > 0 && q.Offset+q.Limit < end {
+			end = q.Offset + q.Limit
+		}
+		page.Records = matched[q.Offset:end]
+	}
+	return page
+}
+
+// match 判断记录是否满足查询条件，按规则或状态过滤时只保留匹配的规则结果
+func (q HistoryQuery) match(record UpdateRecord) (UpdateRecord, bool) {
+	if q.Trigger != "" && record.Trigger != q.Trigger {
+		return record, false
+	}
+	if !q.Since.IsZero() && record.Time.Before(q.Since) {
+		return record, false
+	}
+	if !q.Until.IsZero() && record.Time.After(q.Until) {
+		return record, false
+	}
+	if q.Provider == "" && q.Status == "" {
+		return record, true
+	}
+
+	var providers []ProviderRecord
+	for _, p := range record.Providers {
+		if (q.Provider == "" || p.Name == q.Provider) && (q.Status == "" || p.Status == q.Status) {
+			providers = append(providers, p)
+		}
+	}
+	if len(providers) == 0 {
+		return record, false
+	}
+	record.Providers = providers
+	return record, true
+}
+
+// QueryHistory 查询持久化的更新历史
+func (ru *RuleUpdater) QueryHistory(q HistoryQuery) HistoryPage {
+	return ru.history.query(q)
+}
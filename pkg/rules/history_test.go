@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestHistoryStore 检查更新历史的持久化、过滤、分页和保留策略
+func TestHistoryStore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.HistoryRetention = config.HistoryRetention{MaxDays: 7, MaxRecords: 20}
+
+	now := time.Now()
+	store := openHistoryStore(cfg)
+	// 超过保留天数的记录会被清理
+	store.append(UpdateRecord{Time: now.AddDate(0, 0, -10), Trigger: TriggerSchedule})
+	for i := 0; i < 30; i++ {
+		status := StatusUnchanged
+		if i%3 == 0 {
+			status = StatusFailed
+		}
+		trigger := TriggerSchedule
+		if i%2 == 0 {
+			trigger = TriggerAPI
+		}
+		store.append(UpdateRecord{
+			Time:    now.Add(time.Duration(i) * time.Minute),
+			Trigger: trigger,
+			Providers: []ProviderRecord{
+				{Name: "direct", Status: status},
+				{Name: "proxy", Status: StatusChanged},
+			},
+		})
+	}
+
+	// 重新打开时不修改文件，下一次追加时按保留数量清理
+	store = openHistoryStore(cfg)
+	before, err := os.ReadFile(getHistoryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.query(HistoryQuery{})
+	store.recent(recentHistorySize)
+	if after, _ := os.ReadFile(getHistoryPath()); !bytes.Equal(before, after) {
+		t.Error("只读取历史时不应改写文件")
+	}
+	store.append(UpdateRecord{
+		Time:      now.Add(30 * time.Minute),
+		Trigger:   TriggerSchedule,
+		Providers: []ProviderRecord{{Name: "proxy", Status: StatusChanged}},
+	})
+	all := store.query(HistoryQuery{})
+	if all.Total != 20 {
+		t.Fatalf("保留记录数 = %d, 期望 20", all.Total)
+	}
+	if !all.Records[0].Time.After(all.Records[1].Time) {
+		t.Error("记录应按时间从新到旧排列")
+	}
+
+	failed := store.query(HistoryQuery{Provider: "direct", Status: StatusFailed})
+	for _, record := range failed.Records {
+		if len(record.Providers) != 1 || record.Providers[0].Status != StatusFailed {
+			t.Errorf("过滤后的记录包含不匹配的规则: %+v", record.Providers)
+		}
+	}
+	if failed.Total != 6 {
+		t.Errorf("失败记录数 = %d, 期望 6", failed.Total)
+	}
+
+	page := store.query(HistoryQuery{Trigger: TriggerAPI, Offset: 5, Limit: 3})
+	if page.Total != 9 || len(page.Records) != 3 {
+		t.Errorf("分页结果 total=%d len=%d, 期望 9 和 3", page.Total, len(page.Records))
+	}
+	for _, record := range page.Records {
+		if record.Trigger != TriggerAPI {
+			t.Errorf("触发来源 = %s, 期望 %s", record.Trigger, TriggerAPI)
+		}
+	}
+
+	if page := store.query(HistoryQuery{Offset: -5, Limit: 3}); len(page.Records) != 0 {
+		t.Errorf("负数偏移量返回了 %d 条记录", len(page.Records))
+	}
+
+	if recent := store.recent(recentHistorySize); len(recent) != recentHistorySize {
+		t.Errorf("最近记录数 = %d, 期望 %d", len(recent), recentHistorySize)
+	}
+}
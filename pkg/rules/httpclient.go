@@ -0,0 +1,272 @@
+package rules
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// defaultUserAgent 未设置 User-Agent 时使用的值，有助于绕过某些限制
+const defaultUserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36"
+
+// ValidateHTTPOptions 检查规则提供者的HTTP设置是否有效
+func ValidateHTTPOptions(provider config.RuleProvider) error {
+	opts := provider.HTTP
+	if opts == nil {
+		return nil
+	}
+	if provider.SourceKind() != config.SourceRemote {
+		return fmt.Errorf("本地规则不支持 HTTP 设置")
+	}
+
+	for name := range opts.Headers {
+		if !validHeaderName(name) {
+			return fmt.Errorf("无效的请求头名称: %q", name)
+		}
+	}
+	for name, value := range opts.Headers {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("请求头 %s 的值不能包含换行", name)
+		}
+	}
+
+	if auth := opts.Auth; auth != nil {
+		switch strings.ToLower(auth.Type) {
+		case config.AuthBearer:
+			if auth.Token == "" {
+				return fmt.Errorf("bearer 认证需要设置 token")
+			}
+		case config.AuthBasic:
+			if auth.Username == "" {
+				return fmt.Errorf("basic 认证需要设置 username")
+			}
+		default:
+			return fmt.Errorf("不支持的认证方式: %s", auth.Type)
+		}
+	}
+
+	if opts.Timeout < 0 {
+		return fmt.Errorf("超时时间不能为负数")
+	}
+	if opts.CAFile != "" {
+		if _, err := loadCAFile(opts.CAFile); err != nil {
+			return err
+		}
+	}
+	if opts.Proxy != "" {
+		if _, err := parseProxyURL(opts.Proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validHeaderName 判断请求头名称是否只包含 token 字符
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseProxyURL 解析代理地址，支持 http、https、socks5 和 socks5h
+func parseProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("无效的代理地址: %s", proxy)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("不支持的代理协议: %s", u.Scheme)
+	}
+}
+
+// loadCAFile 读取 CA 证书文件，返回包含系统证书和该文件中证书的证书池
+func loadCAFile(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("读取 CA 证书文件失败: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("CA 证书文件 %s 中没有有效的 PEM 证书", path)
+	}
+	return pool, nil
+}
+
+// transportKey 返回影响连接的HTTP设置，设置相同的规则共用同一个 Transport
+//
+// CA 证书文件的修改时间也计入其中，证书文件更新后会重新加载
+func transportKey(opts *config.HTTPOptions) string {
+	if opts == nil || (opts.CAFile == "" && !opts.InsecureSkipVerify && opts.Proxy == "") {
+		return ""
+	}
+	var modTime int64
+	if info, err := os.Stat(opts.CAFile); err == nil {
+		modTime = info.ModTime().UnixNano()
+	}
+	return fmt.Sprintf("%s\x00%d\x00%t\x00%s", opts.CAFile, modTime, opts.InsecureSkipVerify, opts.Proxy)
+}
+
+// httpClient 返回下载规则时使用的HTTP客户端
+//
+// 设置了 CA 证书、跳过证书校验或代理的规则使用单独的 Transport，并按设置缓存以复用连接。
+// 设置了请求头的规则在重定向到其他主机时不再发送这些请求头
+func (ru *RuleUpdater) httpClient(provider config.RuleProvider) (*http.Client, error) {
+	opts := provider.HTTP
+	client := ru.client
+	key := transportKey(opts)
+	ru.releaseTransport(provider.Name, key)
+	if key != "" {
+		ru.transportMutex.Lock()
+		transport, ok := ru.transports[key]
+		if !ok {
+			var err error
+			transport, err = ru.newTransport(opts)
+			if err != nil {
+				ru.transportMutex.Unlock()
+				return nil, err
+			}
+			ru.transports[key] = transport
+		}
+		ru.transportMutex.Unlock()
+
+		custom := *client
+		custom.Transport = transport
+		client = &custom
+	}
+
+	if opts != nil && opts.Timeout > 0 {
+		custom := *client
+		custom.Timeout = time.Duration(opts.Timeout) * time.Second
+		client = &custom
+	}
+
+	if opts != nil && len(opts.Headers) > 0 {
+		custom := *client
+		checkRedirect := client.CheckRedirect
+		custom.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			// 请求头可能包含令牌，与 Authorization 一样只发送给原始主机
+			if !strings.EqualFold(req.URL.Host, via[0].URL.Host) {
+				for name := range opts.Headers {
+					req.Header.Del(name)
+				}
+			}
+			if checkRedirect != nil {
+				return checkRedirect(req, via)
+			}
+			return nil
+		}
+		client = &custom
+	}
+	return client, nil
+}
+
+// releaseTransport 记录规则提供者使用的 Transport 设置，设置变化（如 CA 证书文件更新）后
+// 旧的 Transport 不再被任何规则使用时关闭其空闲连接并从缓存中删除
+func (ru *RuleUpdater) releaseTransport(name, key string) {
+	ru.transportMutex.Lock()
+	defer ru.transportMutex.Unlock()
+
+	old, ok := ru.transportKeys[name]
+	if ok && old == key {
+		return
+	}
+	if key == "" {
+		delete(ru.transportKeys, name)
+	} else {
+		ru.transportKeys[name] = key
+	}
+	if !ok || old == "" {
+		return
+	}
+	for _, k := range ru.transportKeys {
+		if k == old {
+			return
+		}
+	}
+	if transport, ok := ru.transports[old]; ok {
+		transport.CloseIdleConnections()
+		delete(ru.transports, old)
+	}
+}
+
+// newTransport 基于默认 Transport 创建使用指定 TLS 和代理设置的 Transport
+func (ru *RuleUpdater) newTransport(opts *config.HTTPOptions) (*http.Transport, error) {
+	transport := ru.client.Transport.(*http.Transport).Clone()
+
+	if opts.CAFile != "" || opts.InsecureSkipVerify {
+		tlsConfig := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+		if opts.CAFile != "" {
+			pool, err := loadCAFile(opts.CAFile)
+			if err != nil {
+				return nil, permanent(err)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if opts.Proxy != "" {
+		proxyURL, err := parseProxyURL(opts.Proxy)
+		if err != nil {
+			return nil, permanent(err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return transport, nil
+}
+
+// setRequestOptions 设置请求头，请求头和认证信息只在 withCredentials 为 true 时添加
+func setRequestOptions(req *http.Request, opts *config.HTTPOptions, withCredentials bool) {
+	userAgent := defaultUserAgent
+	if opts != nil && opts.UserAgent != "" {
+		userAgent = opts.UserAgent
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	if opts == nil || !withCredentials {
+		return
+	}
+	for name, value := range opts.Headers {
+		req.Header.Set(name, value)
+	}
+	if auth := opts.Auth; auth != nil {
+		switch strings.ToLower(auth.Type) {
+		case config.AuthBearer:
+			req.Header.Set("Authorization", "Bearer "+auth.Token)
+		case config.AuthBasic:
+			req.SetBasicAuth(auth.Username, auth.Password)
+		}
+	}
+}
+
+// sameHost 判断两个地址是否指向同一主机
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Host, ub.Host)
+}
@@ -0,0 +1,371 @@
+package rules
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+)
+
+// 匹配方式
+const (
+	MatchDomain    = "domain"    // 完整域名
+	MatchSuffix    = "suffix"    // 域名及其子域名，+. 前缀或 DOMAIN-SUFFIX
+	MatchSubdomain = "subdomain" // 只匹配子域名，. 前缀
+	MatchWildcard  = "wildcard"  // * 通配一级域名
+	MatchKeyword   = "keyword"   // DOMAIN-KEYWORD
+	MatchIPCIDR    = "ipcidr"    // IP 网段
+)
+
+// LookupMatch 表示命中查询的一个规则条目
+type LookupMatch struct {
+	Provider string `json:"provider"`
+	Entry    string `json:"entry"`
+	Line     int    `json:"line"` // 条目在规则文件中的行号，从1开始
+	Kind     string `json:"kind"`
+}
+
+// LookupResult 表示一次查询的结果
+type LookupResult struct {
+	Query     string        `json:"query"`
+	Type      string        `json:"type"` // domain 或 ip
+	Providers []string      `json:"providers"`
+	Matches   []LookupMatch `json:"matches"`
+}
+
+// domainNode 是按反向标签组织的域名前缀树节点，如 www.example.com 依次经过 com、example、www
+type domainNode struct {
+	children  map[string]*domainNode
+	exact     []LookupMatch // 完整域名和通配条目
+	suffix    []LookupMatch // 匹配本域名及其子域名
+	subdomain []LookupMatch // 只匹配子域名
+}
+
+// keywordEntry 表示一个域名关键字条目
+type keywordEntry struct {
+	keyword string
+	match   LookupMatch
+}
+
+// ruleMatcher 是根据处理后的规则文件建立的内存匹配器，建立后只读
+type ruleMatcher struct {
+	key      string         // 建立时规则文件的指纹，用于判断是否需要重建
+	order    map[string]int // 规则提供者在配置中的顺序
+	root     *domainNode
+	keywords []keywordEntry
+	prefixes map[int]map[netip.Prefix][]LookupMatch // 按前缀长度分组的网段
+	lengths  []int                                  // prefixes 中出现的前缀长度，从长到短
+	entries  int
+
+	// 每个规则提供者的网段条目数量，以及无法离线判断的条目（如 GEOIP、PROCESS-NAME）数量
+	ipEntries   map[string]int
+	unsupported map[string]int
+}
+
+// newRuleMatcher 创建空的匹配器
+func newRuleMatcher(key string) *ruleMatcher {
+	return &ruleMatcher{
+		key:      key,
+		order:    make(map[string]int),
+		root:     &domainNode{},
+		prefixes: make(map[int]map[netip.Prefix][]LookupMatch),
+
+		ipEntries:   make(map[string]int),
+		unsupported: make(map[string]int),
+	}
+}
+
+// add 按规则类型加入一个条目，不参与域名或 IP 匹配的条目（如 DOMAIN-REGEX、GEOIP）被忽略
+func (m *ruleMatcher) add(provider, ruleType, value string, line int) {
+	match := LookupMatch{Provider: provider, Entry: value, Line: line}
+
+	switch ruleType {
+	case "ipcidr":
+		m.addPrefix(value, match)
+		return
+	case "classical":
+		parts := strings.Split(value, ",")
+		if len(parts) < 2 {
+			return
+		}
+		arg := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(strings.TrimSpace(parts[0])) {
+		case "DOMAIN":
+			m.addDomain(strings.ToLower(arg), MatchDomain, match)
+		case "DOMAIN-SUFFIX":
+			m.addDomain(strings.ToLower(arg), MatchSuffix, match)
+		case "DOMAIN-KEYWORD":
+			if arg != "" {
+				match.Kind = MatchKeyword
+				m.keywords = append(m.keywords, keywordEntry{strings.ToLower(arg), match})
+				m.entries++
+			}
+		case "IP-CIDR", "IP-CIDR6":
+			m.addPrefix(arg, match)
+		default:
+			m.unsupported[provider]++
+		}
+		return
+	}
+
+	domain := strings.ToLower(value)
+	switch {
+	case strings.HasPrefix(domain, "+."):
+		m.addDomain(domain[2:], MatchSuffix, match)
+	case strings.HasPrefix(domain, "."):
+		m.addDomain(domain[1:], MatchSubdomain, match)
+	case strings.Contains(domain, "*"):
+		m.addDomain(domain, MatchWildcard, match)
+	default:
+		m.addDomain(domain, MatchDomain, match)
+	}
+}
+
+// addDomain 将域名条目加入前缀树
+func (m *ruleMatcher) addDomain(domain, kind string, match LookupMatch) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return
+	}
+	labels := strings.Split(domain, ".")
+	node := m.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainNode)
+			}
+			child = &domainNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+
+	match.Kind = kind
+	switch kind {
+	case MatchSuffix:
+		node.suffix = append(node.suffix, match)
+	case MatchSubdomain:
+		node.subdomain = append(node.subdomain, match)
+	default:
+		node.exact = append(node.exact, match)
+	}
+	m.entries++
+}
+
+// addPrefix 将网段条目加入前缀表
+func (m *ruleMatcher) addPrefix(value string, match LookupMatch) {
+	prefix, ok := parsePrefix(strings.TrimSpace(value))
+	if !ok {
+		return
+	}
+	table := m.prefixes[prefix.Bits()]
+	if table == nil {
+		table = make(map[netip.Prefix][]LookupMatch)
+		m.prefixes[prefix.Bits()] = table
+		m.lengths = append(m.lengths, prefix.Bits())
+		sort.Sort(sort.Reverse(sort.IntSlice(m.lengths)))
+	}
+	match.Kind = MatchIPCIDR
+	table[prefix] = append(table[prefix], match)
+	m.ipEntries[match.Provider]++
+	m.entries++
+}
+
+// matchDomain 返回命中域名的所有条目
+func (m *ruleMatcher) matchDomain(domain string) []LookupMatch {
+	labels := strings.Split(domain, ".")
+	var matches []LookupMatch
+
+	// depth 为已经匹配的标签数量，* 节点只匹配一级标签，因此需要同时尝试两条路径
+	var walk func(node *domainNode, depth int)
+	walk = func(node *domainNode, depth int) {
+		if depth == len(labels) {
+			matches = append(matches, node.exact...)
+			matches = append(matches, node.suffix...)
+			return
+		}
+		if depth > 0 {
+			matches = append(matches, node.suffix...)
+			matches = append(matches, node.subdomain...)
+		}
+		label := labels[len(labels)-1-depth]
+		if child := node.children[label]; child != nil {
+			walk(child, depth+1)
+		}
+		if child := node.children["*"]; child != nil && label != "*" {
+			walk(child, depth+1)
+		}
+	}
+	walk(m.root, 0)
+
+	for _, k := range m.keywords {
+		if strings.Contains(domain, k.keyword) {
+			matches = append(matches, k.match)
+		}
+	}
+	return matches
+}
+
+// matchIP 返回包含该地址的所有网段条目，更具体的网段在前
+func (m *ruleMatcher) matchIP(addr netip.Addr) []LookupMatch {
+	var matches []LookupMatch
+	for _, bits := range m.lengths {
+		if bits > addr.BitLen() {
+			continue
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+		matches = append(matches, m.prefixes[bits][prefix]...)
+	}
+	return matches
+}
+
+// lookup 查询域名或 IP 地址
+func (m *ruleMatcher) lookup(query string) (*LookupResult, error) {
+	q := strings.ToLower(strings.TrimSpace(query))
+	result := &LookupResult{Query: q, Providers: []string{}}
+
+	if addr, err := netip.ParseAddr(strings.Trim(q, "[]")); err == nil {
+		result.Type = "ip"
+		result.Matches = m.matchIP(addr.Unmap())
+	} else {
+		q = strings.TrimSuffix(q, ".")
+		if err := validateDomain(q, false); err != nil {
+			return nil, fmt.Errorf("无效的查询 %q: 应为域名或 IP 地址 (%v)", query, err)
+		}
+		result.Query = q
+		result.Type = "domain"
+		result.Matches = m.matchDomain(q)
+	}
+
+	// 按规则提供者在配置中的顺序和行号排序，IP 网段保持从具体到宽泛的顺序
+	sort.SliceStable(result.Matches, func(i, j int) bool {
+		a, b := result.Matches[i], result.Matches[j]
+		if a.Provider != b.Provider {
+			return m.order[a.Provider] < m.order[b.Provider]
+		}
+		return result.Type == "domain" && a.Line < b.Line
+	})
+	if result.Matches == nil {
+		result.Matches = []LookupMatch{}
+	}
+
+	seen := make(map[string]bool)
+	for _, match := range result.Matches {
+		if !seen[match.Provider] {
+			seen[match.Provider] = true
+			result.Providers = append(result.Providers, match.Provider)
+		}
+	}
+	return result, nil
+}
+
+// lookupProviders 返回参与查询的规则提供者及其规则文件，以及由文件大小和修改时间组成的指纹
+func (ru *RuleUpdater) lookupProviders() ([]config.RuleProvider, string) {
+	var providers []config.RuleProvider
+	var key strings.Builder
+	for _, provider := range config.OrderedProviders(ru.cfg.RuleProviders) {
+		if !provider.Enabled {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(ru.getRulesDir(), provider.Path))
+		if err != nil {
+			continue
+		}
+		providers = append(providers, provider)
+		fmt.Fprintf(&key, "%s|%s|%s|%d|%d\n", provider.Name, provider.Path, payloadType(provider),
+			info.Size(), info.ModTime().UnixNano())
+	}
+	return providers, key.String()
+}
+
+// buildMatcher 读取规则文件建立匹配器，无法读取的规则文件被跳过
+func (ru *RuleUpdater) buildMatcher(providers []config.RuleProvider, key string) *ruleMatcher {
+	m := newRuleMatcher(key)
+	for i, provider := range providers {
+		path := filepath.Join(ru.getRulesDir(), provider.Path)
+		if err := m.load(provider.Name, payloadType(provider), path, false); err != nil {
+			logger.Warnf("读取规则 %s 的规则文件失败，查询时将跳过: %v", provider.Name, err)
+			continue
+		}
+		m.order[provider.Name] = i
+	}
+	return m
+}
+
+// load 读取规则文件并加入匹配器，text 为 true 时按每行一个条目的纯文本读取，否则按 Clash YAML 读取
+//
+// 文件无效时不加入任何条目
+func (m *ruleMatcher) load(provider, ruleType, path string, text bool) error {
+	type lineValue struct {
+		value string
+		line  int
+	}
+	var values []lineValue
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if text {
+		lineNo := 0
+		err = forEachLine(f, func(line string) {
+			lineNo++
+			if value := strings.TrimSpace(line); value != "" && !strings.HasPrefix(value, "#") {
+				values = append(values, lineValue{value, lineNo})
+			}
+		}, func(string) {
+			lineNo++
+		})
+	} else {
+		err = readPayloadLines(f, func(value string, line int) {
+			values = append(values, lineValue{value, line})
+		}, func() {
+			values = nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		m.add(provider, ruleType, v.value, v.line)
+	}
+	return nil
+}
+
+// currentMatcher 返回与当前规则文件一致的匹配器，规则文件变化后重新建立
+func (ru *RuleUpdater) currentMatcher() *ruleMatcher {
+	ru.matcherMutex.Lock()
+	defer ru.matcherMutex.Unlock()
+
+	providers, key := ru.lookupProviders()
+	if ru.matcher == nil || ru.matcher.key != key {
+		ru.matcher = ru.buildMatcher(providers, key)
+		logger.Debugf("已建立规则查询索引: %d 个规则，%d 个条目", len(providers), ru.matcher.entries)
+	}
+	return ru.matcher
+}
+
+// refreshMatcher 在规则更新后重建匹配器，规则文件没有变化时不重新读取
+func (ru *RuleUpdater) refreshMatcher() {
+	ru.currentMatcher()
+}
+
+// Lookup 查询域名或 IP 地址命中了哪些规则提供者，返回命中的条目及其在规则文件中的行号
+//
+// 域名按 Clash 的语义匹配完整域名、+. 和 . 前缀、* 通配、DOMAIN-SUFFIX 和 DOMAIN-KEYWORD，
+// IP 地址匹配 ipcidr 规则和 IP-CIDR 条目；DOMAIN-REGEX、GEOIP 等其他规则类型不参与查询
+func (ru *RuleUpdater) Lookup(query string) (*LookupResult, error) {
+	return ru.currentMatcher().lookup(query)
+}
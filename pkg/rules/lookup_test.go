@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestRuleMatcher 检查域名和 IP 地址按 Clash 的语义匹配
+func TestRuleMatcher(t *testing.T) {
+	m := newRuleMatcher("")
+	for i, value := range []string{"example.com", "+.example.org", ".sub.net", "*.wild.io", "a.*.mid.io"} {
+		m.add("domain", "domain", value, i+1)
+	}
+	for i, value := range []string{"DOMAIN,exact.dev", "DOMAIN-SUFFIX,example.com", "DOMAIN-KEYWORD,track",
+		"DOMAIN-REGEX,^ad", "IP-CIDR,10.0.0.0/8,no-resolve", "IP-CIDR6,2001:db8::/32"} {
+		m.add("classical", "classical", value, i+1)
+	}
+	for i, value := range []string{"10.1.0.0/16", "192.168.1.1", "::ffff:172.16.0.0/108"} {
+		m.add("ip", "ipcidr", value, i+1)
+	}
+	m.order = map[string]int{"domain": 0, "classical": 1, "ip": 2}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"example.com", []string{"domain:1", "classical:2"}},
+		{"www.example.com", []string{"classical:2"}},
+		{"example.org", []string{"domain:2"}},
+		{"a.b.example.org", []string{"domain:2"}},
+		{"sub.net", nil},
+		{"x.y.sub.net", []string{"domain:3"}},
+		{"a.wild.io", []string{"domain:4"}},
+		{"wild.io", nil},
+		{"a.b.wild.io", nil},
+		{"a.x.mid.io", []string{"domain:5"}},
+		{"Exact.Dev.", []string{"classical:1"}},
+		{"tracking.example.net", []string{"classical:3"}},
+		{"10.1.2.3", []string{"classical:5", "ip:1"}},
+		{"192.168.1.1", []string{"ip:2"}},
+		{"172.16.5.5", []string{"ip:3"}},
+		{"2001:db8::1", []string{"classical:6"}},
+		{"8.8.8.8", nil},
+	}
+	for _, tt := range tests {
+		result, err := m.lookup(tt.query)
+		if err != nil {
+			t.Errorf("lookup(%q) 失败: %v", tt.query, err)
+			continue
+		}
+		var got []string
+		for _, match := range result.Matches {
+			got = append(got, match.Provider+":"+strconv.Itoa(match.Line))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lookup(%q) = %q, 期望 %q", tt.query, got, tt.want)
+		}
+	}
+
+	if _, err := m.lookup("not a domain"); err == nil {
+		t.Error("无效的查询应返回错误")
+	}
+}
+
+// TestLookup 检查匹配器从规则文件建立，行号与文件一致，并在规则更新后重建
+func TestLookup(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		inlineProvider("direct", "cdn.example.com", "+.example.org"),
+		inlineProvider("proxy", "example.net", "+.example.com"),
+		inlineProvider("disabled", "+.example.com"),
+	}
+	cfg.RuleProviders[2].Enabled = false
+	ru := NewRuleUpdater(cfg)
+
+	if _, err := ru.UpdateAllRules(context.Background(), TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := ru.Lookup("cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"direct", "proxy"}; !reflect.DeepEqual(result.Providers, want) {
+		t.Fatalf("providers = %q, 期望 %q", result.Providers, want)
+	}
+	for _, match := range result.Matches {
+		data, err := os.ReadFile(filepath.Join(ru.getRulesDir(), match.Provider+".yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(data), "\n")
+		if match.Line < 1 || match.Line > len(lines) || !strings.Contains(lines[match.Line-1], match.Entry) {
+			t.Errorf("%s 的条目 %s 不在第 %d 行", match.Provider, match.Entry, match.Line)
+		}
+	}
+
+	// 更新后重建，已删除的条目不再命中
+	cfg.RuleProviders[1].Entries = []string{"example.net"}
+	if _, err := ru.UpdateRuleProvider(context.Background(), TriggerAPI, "proxy"); err != nil {
+		t.Fatal(err)
+	}
+	result, err = ru.Lookup("cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"direct"}; !reflect.DeepEqual(result.Providers, want) {
+		t.Errorf("更新后 providers = %q, 期望 %q", result.Providers, want)
+	}
+}
@@ -0,0 +1,343 @@
+package rules
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// originMirrorPrefix 原始URL对应的镜像名称前缀，不属于任何镜像的原始URL按主机分别统计
+const originMirrorPrefix = "origin"
+
+// originMirrorName 返回原始URL对应的镜像名称，如 origin:raw.githubusercontent.com，
+// 不同主机的健康度互不影响
+func originMirrorName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return originMirrorPrefix
+	}
+	return originMirrorPrefix + ":" + strings.ToLower(u.Host)
+}
+
+// 识别 GitHub 文件地址的正则表达式
+var (
+	jsdelivrPattern  = regexp.MustCompile(`^https?://[^/]*jsdelivr\.net/gh/([^/]+)/([^/@]+)(?:@([^/]+))?/(.+)$`)
+	rawGitHubPattern = regexp.MustCompile(`^https?://raw\.githubusercontent\.com/([^/]+)/([^/]+)/([^/]+)/(.+)$`)
+	githubRawPattern = regexp.MustCompile(`^https?://github\.com/([^/]+)/([^/]+)/(?:raw|blob)/([^/]+)/(.+)$`)
+)
+
+// githubSource 表示可以被镜像改写的 GitHub 文件坐标
+type githubSource struct {
+	owner string
+	repo  string
+	ref   string
+	path  string
+}
+
+// parseGitHubSource 尝试从URL中解析 GitHub 文件坐标
+func parseGitHubSource(rawURL string) (githubSource, bool) {
+	for _, re := range []*regexp.Regexp{jsdelivrPattern, rawGitHubPattern, githubRawPattern} {
+		if m := re.FindStringSubmatch(rawURL); m != nil {
+			ref := m[3]
+			if ref == "" {
+				ref = "HEAD"
+			}
+			return githubSource{owner: m[1], repo: m[2], ref: ref, path: m[4]}, true
+		}
+	}
+	return githubSource{}, false
+}
+
+// expandMirror 使用镜像模板改写原始URL，模板不适用时返回false
+func expandMirror(mirror config.Mirror, rawURL string) (string, bool) {
+	tmpl := mirror.Template
+	if tmpl == "" {
+		return "", false
+	}
+
+	if strings.Contains(tmpl, "{owner}") || strings.Contains(tmpl, "{repo}") ||
+		strings.Contains(tmpl, "{ref}") || strings.Contains(tmpl, "{path}") {
+		src, ok := parseGitHubSource(rawURL)
+		if !ok {
+			return "", false
+		}
+		// jsDelivr 不支持 @HEAD，省略分支时使用默认分支
+		if src.ref == "HEAD" {
+			tmpl = strings.ReplaceAll(tmpl, "@{ref}", "")
+		}
+		tmpl = strings.NewReplacer(
+			"{owner}", src.owner,
+			"{repo}", src.repo,
+			"{ref}", src.ref,
+			"{path}", src.path,
+		).Replace(tmpl)
+	}
+
+	return strings.ReplaceAll(tmpl, "{url}", rawURL), true
+}
+
+// mirrorCandidate 表示一个待尝试的下载地址
+type mirrorCandidate struct {
+	name string
+	url  string
+}
+
+// mirrorCandidates 生成规则提供者的所有下载地址，按镜像健康度排序
+func (ru *RuleUpdater) mirrorCandidates(provider config.RuleProvider) []mirrorCandidate {
+	mirrors := append([]config.Mirror{}, provider.Mirrors...)
+	mirrors = append(mirrors, ru.cfg.GetMirrors()...)
+
+	// 镜像改写结果，用于识别原始URL属于哪个镜像
+	var expanded []mirrorCandidate
+	seen := make(map[string]bool)
+	for _, mirror := range mirrors {
+		mirrorURL, ok := expandMirror(mirror, provider.URL)
+		if !ok || seen[mirrorURL] {
+			continue
+		}
+		seen[mirrorURL] = true
+		expanded = append(expanded, mirrorCandidate{name: mirror.Name, url: mirrorURL})
+	}
+
+	// 原始URL总是第一个候选
+	origin := mirrorCandidate{name: originMirrorName(provider.URL), url: provider.URL}
+	candidates := []mirrorCandidate{origin}
+	for _, c := range expanded {
+		if c.url == provider.URL {
+			candidates[0].name = c.name
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+
+	// 按健康度排序，分数相同保持配置顺序
+	scores := make([]float64, len(candidates))
+	for i, c := range candidates {
+		scores[i] = ru.mirrorHealth.score(c.name)
+	}
+	indexes := make([]int, len(candidates))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(a, b int) bool {
+		return scores[indexes[a]] > scores[indexes[b]]
+	})
+	sorted := make([]mirrorCandidate, len(candidates))
+	for i, idx := range indexes {
+		sorted[i] = candidates[idx]
+	}
+
+	return sorted
+}
+
+// MirrorStats 记录单个镜像的历史表现
+type MirrorStats struct {
+	Successes    int       `json:"successes"`
+	Failures     int       `json:"failures"`
+	AvgLatencyMs float64   `json:"avg_latency_ms"`
+	LastSuccess  time.Time `json:"last_success,omitempty"`
+	LastFailure  time.Time `json:"last_failure,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// MirrorHealth 表示镜像的健康状态，用于API展示
+type MirrorHealth struct {
+	Name        string  `json:"name"`
+	Template    string  `json:"template,omitempty"`
+	SuccessRate float64 `json:"success_rate"`
+	Score       float64 `json:"score"`
+	MirrorStats
+}
+
+// mirrorHealthStore 保存所有镜像的统计数据
+type mirrorHealthStore struct {
+	stats map[string]*MirrorStats
+	mutex sync.Mutex
+}
+
+// 延迟的指数滑动平均系数
+const latencySmoothing = 0.3
+
+// failureHalfLife 失败次数对得分的影响每经过该时间减半，恢复的镜像可以逐渐重新获得优先级
+const failureHalfLife = 24 * time.Hour
+
+// getMirrorStatsPath 获取镜像统计文件路径
+func getMirrorStatsPath() string {
+	return filepath.Join(utils.GetConfigDir(), "mirror_stats.json")
+}
+
+// loadMirrorHealth 从文件加载镜像统计数据
+func loadMirrorHealth() *mirrorHealthStore {
+	store := &mirrorHealthStore{stats: make(map[string]*MirrorStats)}
+
+	data, err := os.ReadFile(getMirrorStatsPath())
+	if err != nil {
+		return store
+	}
+	if err := json.Unmarshal(data, &store.stats); err != nil {
+		logger.Warnf("解析镜像统计文件失败，将重新统计: %v", err)
+		store.stats = make(map[string]*MirrorStats)
+	}
+	// 旧版本把所有原始URL统计在一起，无法区分主机，丢弃后重新统计
+	delete(store.stats, originMirrorPrefix)
+	return store
+}
+
+// save 保存镜像统计数据到文件
+func (s *mirrorHealthStore) save() {
+	s.mutex.Lock()
+	data, err := json.MarshalIndent(s.stats, "", "  ")
+	s.mutex.Unlock()
+	if err != nil {
+		logger.Warnf("序列化镜像统计失败: %v", err)
+		return
+	}
+
+	statsPath := getMirrorStatsPath()
+	if err := utils.EnsureDirExists(filepath.Dir(statsPath)); err != nil {
+		logger.Warnf("保存镜像统计失败: %v", err)
+		return
+	}
+	if err := os.WriteFile(statsPath, data, 0644); err != nil {
+		logger.Warnf("保存镜像统计失败: %v", err)
+	}
+}
+
+// get 获取镜像统计，不存在时创建，调用方需持有锁
+func (s *mirrorHealthStore) get(name string) *MirrorStats {
+	st, ok := s.stats[name]
+	if !ok {
+		st = &MirrorStats{}
+		s.stats[name] = st
+	}
+	return st
+}
+
+// recordSuccess 记录一次成功下载及其耗时
+func (s *mirrorHealthStore) recordSuccess(name string, latency time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := s.get(name)
+	ms := float64(latency.Milliseconds())
+	if st.Successes == 0 {
+		st.AvgLatencyMs = ms
+	} else {
+		st.AvgLatencyMs = st.AvgLatencyMs*(1-latencySmoothing) + ms*latencySmoothing
+	}
+	st.Successes++
+	st.LastSuccess = time.Now()
+}
+
+// recordFailure 记录一次失败下载
+func (s *mirrorHealthStore) recordFailure(name string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st := s.get(name)
+	st.Failures++
+	st.LastFailure = time.Now()
+	if err != nil {
+		st.LastError = err.Error()
+	}
+}
+
+// score 计算镜像得分，越高越优先。没有统计数据的镜像得到中性分数
+func (s *mirrorHealthStore) score(name string) float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	st, ok := s.stats[name]
+	if !ok {
+		return scoreOf(MirrorStats{}, time.Now())
+	}
+	return scoreOf(*st, time.Now())
+}
+
+// scoreOf 根据 now 时刻的成功率（拉普拉斯平滑）和平均延迟计算得分，失败次数按距最后一次失败的时间衰减
+func scoreOf(st MirrorStats, now time.Time) float64 {
+	failures := float64(st.Failures)
+	if !st.LastFailure.IsZero() {
+		if age := now.Sub(st.LastFailure); age > 0 {
+			failures *= math.Exp2(-float64(age) / float64(failureHalfLife))
+		}
+	}
+	successRate := float64(st.Successes+1) / (float64(st.Successes) + failures + 2)
+	latencyFactor := 0.8
+	if st.Successes > 0 {
+		latencyFactor = 1 / (1 + st.AvgLatencyMs/5000)
+	}
+	return successRate * latencyFactor
+}
+
+// GetMirrorHealth 返回所有已配置镜像以及有统计数据的镜像的健康状态
+func (ru *RuleUpdater) GetMirrorHealth() []MirrorHealth {
+	templates := make(map[string]string)
+	var names []string
+	addName := func(name, tmpl string) {
+		if _, ok := templates[name]; ok {
+			return
+		}
+		templates[name] = tmpl
+		names = append(names, name)
+	}
+
+	for _, provider := range ru.cfg.RuleProviders {
+		if provider.Enabled && provider.SourceKind() == config.SourceRemote {
+			addName(originMirrorName(provider.URL), "")
+		}
+	}
+	for _, provider := range ru.cfg.RuleProviders {
+		for _, mirror := range provider.Mirrors {
+			addName(mirror.Name, mirror.Template)
+		}
+	}
+	for _, mirror := range ru.cfg.GetMirrors() {
+		addName(mirror.Name, mirror.Template)
+	}
+
+	ru.mirrorHealth.mutex.Lock()
+	for name := range ru.mirrorHealth.stats {
+		if _, ok := templates[name]; !ok {
+			templates[name] = ""
+			names = append(names, name)
+		}
+	}
+
+	now := time.Now()
+	health := make([]MirrorHealth, 0, len(names))
+	for _, name := range names {
+		var st MirrorStats
+		if s, ok := ru.mirrorHealth.stats[name]; ok {
+			st = *s
+		}
+		successRate := 0.0
+		if total := st.Successes + st.Failures; total > 0 {
+			successRate = float64(st.Successes) / float64(total)
+		}
+		health = append(health, MirrorHealth{
+			Name:        name,
+			Template:    templates[name],
+			SuccessRate: successRate,
+			Score:       scoreOf(st, now),
+			MirrorStats: st,
+		})
+	}
+	ru.mirrorHealth.mutex.Unlock()
+
+	sort.SliceStable(health, func(i, j int) bool {
+		return health[i].Score > health[j].Score
+	})
+	return health
+}
@@ -0,0 +1,308 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestOriginMirrorStats 检查不同主机的原始URL分别统计健康度
+func TestOriginMirrorStats(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	ru := NewRuleUpdater(cfg)
+	github := config.RuleProvider{Name: "github", URL: "https://raw.githubusercontent.com/a/b/release/direct.txt"}
+	gitea := config.RuleProvider{Name: "gitea", URL: "https://Gitea.example.com/lists/proxy.txt"}
+
+	if got := ru.mirrorCandidates(gitea)[0].name; got != "origin:gitea.example.com" {
+		t.Errorf("原始URL的镜像名称 = %q", got)
+	}
+
+	ru.mirrorHealth.recordFailure(ru.mirrorCandidates(gitea)[0].name, errors.New("timeout"))
+	if score := ru.mirrorHealth.score(ru.mirrorCandidates(github)[0].name); score != ru.mirrorHealth.score("unused") {
+		t.Errorf("其他主机的失败影响了 GitHub 的健康度: %v", score)
+	}
+}
+
+// TestExpandMirror 检查镜像模板的占位符替换，GitHub 坐标占位符只适用于可识别的 GitHub 文件地址
+func TestExpandMirror(t *testing.T) {
+	const (
+		jsdelivr = "https://fastly.jsdelivr.net/gh/{owner}/{repo}@{ref}/{path}"
+		raw      = "https://raw.githubusercontent.com/{owner}/{repo}/{ref}/{path}"
+		proxy    = "https://ghproxy.example.com/{url}"
+	)
+	tests := []struct {
+		template string
+		url      string
+		want     string
+		ok       bool
+	}{
+		{jsdelivr, "https://raw.githubusercontent.com/Loyalsoldier/clash-rules/release/direct.txt",
+			"https://fastly.jsdelivr.net/gh/Loyalsoldier/clash-rules@release/direct.txt", true},
+		{jsdelivr, "https://github.com/Loyalsoldier/clash-rules/raw/release/rules/direct.txt",
+			"https://fastly.jsdelivr.net/gh/Loyalsoldier/clash-rules@release/rules/direct.txt", true},
+		// 省略分支的 jsDelivr 地址不生成 @HEAD
+		{jsdelivr, "https://cdn.jsdelivr.net/gh/a/b/dir/x.txt", "https://fastly.jsdelivr.net/gh/a/b/dir/x.txt", true},
+		{raw, "https://cdn.jsdelivr.net/gh/a/b@v1.2/x.txt", "https://raw.githubusercontent.com/a/b/v1.2/x.txt", true},
+		{raw, "https://github.com/a/b/blob/main/x.txt", "https://raw.githubusercontent.com/a/b/main/x.txt", true},
+		{raw, "http://raw.githubusercontent.com/a/b/main/x.txt", "https://raw.githubusercontent.com/a/b/main/x.txt", true},
+		{proxy, "https://raw.githubusercontent.com/a/b/main/x.txt", "https://ghproxy.example.com/https://raw.githubusercontent.com/a/b/main/x.txt", true},
+		{proxy, "https://example.com/lists/direct.txt?v=1", "https://ghproxy.example.com/https://example.com/lists/direct.txt?v=1", true},
+		{"https://mirror.example.com/{repo}/{path}?src={url}", "https://raw.githubusercontent.com/a/b/main/x.txt",
+			"https://mirror.example.com/b/x.txt?src=https://raw.githubusercontent.com/a/b/main/x.txt", true},
+		{"https://static.example.com/direct.txt", "https://example.com/direct.txt", "https://static.example.com/direct.txt", true},
+		// 非 GitHub 地址无法使用 GitHub 坐标占位符
+		{jsdelivr, "https://example.com/lists/direct.txt", "", false},
+		{raw, "https://github.com/a/b", "", false},
+		{"", "https://example.com/direct.txt", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := expandMirror(config.Mirror{Name: "m", Template: tt.template}, tt.url)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("expandMirror(%q, %q) = %q, %v, 期望 %q, %v", tt.template, tt.url, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// TestScoreOf 检查得分按成功率和延迟排序，失败的影响随时间衰减
+func TestScoreOf(t *testing.T) {
+	now := time.Date(2024, 1, 20, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	// 按得分从高到低排列
+	ordered := []struct {
+		name string
+		st   MirrorStats
+	}{
+		{"快且可靠", MirrorStats{Successes: 20, AvgLatencyMs: 100}},
+		{"很久以前失败过", MirrorStats{Successes: 2, Failures: 8, AvgLatencyMs: 100, LastFailure: ago(30 * 24 * time.Hour)}},
+		{"慢但可靠", MirrorStats{Successes: 20, AvgLatencyMs: 3000}},
+		{"没有统计", MirrorStats{}},
+		{"一小时前失败", MirrorStats{Successes: 2, Failures: 8, AvgLatencyMs: 100, LastFailure: ago(time.Hour)}},
+		{"刚刚失败", MirrorStats{Successes: 2, Failures: 8, AvgLatencyMs: 100, LastFailure: now}},
+		{"从未成功", MirrorStats{Failures: 3, LastFailure: now}},
+	}
+	for i := 1; i < len(ordered); i++ {
+		prev, cur := scoreOf(ordered[i-1].st, now), scoreOf(ordered[i].st, now)
+		if prev <= cur {
+			t.Errorf("%s (%.4f) 应高于 %s (%.4f)", ordered[i-1].name, prev, ordered[i].name, cur)
+		}
+	}
+
+	if got := scoreOf(MirrorStats{}, now); got != 0.4 {
+		t.Errorf("没有统计时得分 = %v, 期望 0.4", got)
+	}
+
+	// 每经过一个半衰期失败次数的影响减半
+	decayed := scoreOf(MirrorStats{Successes: 3, Failures: 8, LastFailure: ago(failureHalfLife)}, now)
+	halved := scoreOf(MirrorStats{Successes: 3, Failures: 4}, now)
+	if math.Abs(decayed-halved) > 1e-9 {
+		t.Errorf("一个半衰期后得分 = %v, 期望 %v", decayed, halved)
+	}
+	quarter := scoreOf(MirrorStats{Successes: 3, Failures: 8, LastFailure: ago(2 * failureHalfLife)}, now)
+	if want := scoreOf(MirrorStats{Successes: 3, Failures: 2}, now); math.Abs(quarter-want) > 1e-9 {
+		t.Errorf("两个半衰期后得分 = %v, 期望 %v", quarter, want)
+	}
+
+	// 时钟回拨导致最后失败时间在未来时不衰减
+	future := scoreOf(MirrorStats{Successes: 3, Failures: 8, LastFailure: now.Add(time.Hour)}, now)
+	if want := scoreOf(MirrorStats{Successes: 3, Failures: 8}, now); future != want {
+		t.Errorf("最后失败时间在未来时得分 = %v, 期望 %v", future, want)
+	}
+}
+
+// TestMirrorCandidatesOrder 检查候选地址按健康度排序，得分相同时原始地址在前并保持配置顺序
+func TestMirrorCandidatesOrder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.Mirrors = []config.Mirror{
+		{Name: "jsdelivr", Template: "https://fastly.jsdelivr.net/gh/{owner}/{repo}@{ref}/{path}"},
+		{Name: "proxy", Template: "https://ghproxy.example.com/{url}"},
+	}
+	ru := NewRuleUpdater(cfg)
+	provider := config.RuleProvider{
+		Name: "direct", URL: "https://raw.githubusercontent.com/a/b/main/direct.txt",
+		Mirrors: []config.Mirror{{Name: "own", Template: "https://mirror.example.com/{path}"}},
+	}
+	names := func() string {
+		var names []string
+		for _, c := range ru.mirrorCandidates(provider) {
+			names = append(names, c.name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got, want := names(), "origin:raw.githubusercontent.com,own,jsdelivr,proxy"; got != want {
+		t.Errorf("候选顺序 = %s, 期望 %s", got, want)
+	}
+
+	// 原始地址刚刚失败，代理最近成功
+	now := time.Now()
+	ru.mirrorHealth.stats["origin:raw.githubusercontent.com"] = &MirrorStats{Successes: 5, Failures: 20, AvgLatencyMs: 100, LastFailure: now}
+	ru.mirrorHealth.stats["proxy"] = &MirrorStats{Successes: 5, AvgLatencyMs: 1000}
+	if got, want := names(), "proxy,own,jsdelivr,origin:raw.githubusercontent.com"; got != want {
+		t.Errorf("候选顺序 = %s, 期望 %s", got, want)
+	}
+
+	// 失败发生在很久以前，原始地址恢复优先级
+	ru.mirrorHealth.stats["origin:raw.githubusercontent.com"].LastFailure = now.Add(-60 * 24 * time.Hour)
+	if got, want := names(), "origin:raw.githubusercontent.com,proxy,own,jsdelivr"; got != want {
+		t.Errorf("候选顺序 = %s, 期望 %s", got, want)
+	}
+}
+
+// raceServer 启动一个测试服务器，handler 返回前记录请求是否被客户端断开
+func raceServer(t *testing.T, handler func(w http.ResponseWriter, r *http.Request)) (*httptest.Server, chan struct{}) {
+	t.Helper()
+	closed := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r)
+		if r.Context().Err() != nil {
+			closed <- struct{}{}
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, closed
+}
+
+// stall 发送部分内容后一直等待，直到客户端断开
+func stall(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("stalled.example.com\n"))
+	w.(http.Flusher).Flush()
+	<-r.Context().Done()
+}
+
+// waitClosed 等待服务器发现客户端断开
+func waitClosed(t *testing.T, name string, closed chan struct{}) {
+	t.Helper()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("%s: 请求没有被关闭", name)
+	}
+}
+
+// waitSpoolEmpty 等待下载临时目录中的文件被删除
+func waitSpoolEmpty(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, _ := os.ReadDir(getSpoolDir())
+		if len(entries) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("下载临时目录中残留 %d 个文件", len(entries))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// failuresOf 返回镜像的失败次数，竞速中其余请求可能仍在记录统计，需要加锁读取
+func failuresOf(ru *RuleUpdater, name string) int {
+	ru.mirrorHealth.mutex.Lock()
+	defer ru.mirrorHealth.mutex.Unlock()
+	if st, ok := ru.mirrorHealth.stats[name]; ok {
+		return st.Failures
+	}
+	return 0
+}
+
+// TestRaceMirrors 检查竞速下载采用最先返回的有效内容，关闭其余请求并删除其余的下载内容，
+// 被取消的请求不计入镜像失败
+func TestRaceMirrors(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ru := NewRuleUpdater(config.DefaultConfig())
+	provider := config.RuleProvider{Name: "direct", Type: "domain", Behavior: "domain"}
+
+	t.Run("采用最先返回的镜像", func(t *testing.T) {
+		fast, _ := raceServer(t, func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("fast.example.com\n")) })
+		also, _ := raceServer(t, func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("also.example.com\n"))
+		})
+		slow, slowClosed := raceServer(t, stall)
+		provider.URL = fast.URL + "/direct.txt"
+		candidates := []mirrorCandidate{
+			{name: "slow", url: slow.URL + "/direct.txt"},
+			{name: "also", url: also.URL + "/direct.txt"},
+			{name: "fast", url: fast.URL + "/direct.txt"},
+		}
+
+		resp, err := ru.raceMirrors(context.Background(), provider, candidates, providerState{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := resp.body.readAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.candidate.name != "fast" || string(data) != "fast.example.com\n" {
+			t.Errorf("采用了 %s: %q", resp.candidate.name, data)
+		}
+		resp.body.remove()
+
+		// 未完成的请求被关闭，已完成的下载被删除
+		waitClosed(t, "slow", slowClosed)
+		waitSpoolEmpty(t)
+		if st := failuresOf(ru, "slow"); st > 0 {
+			t.Errorf("被取消的请求计入了镜像失败: %d 次", st)
+		}
+	})
+
+	t.Run("全部失败", func(t *testing.T) {
+		notFound, _ := raceServer(t, func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) })
+		broken, _ := raceServer(t, func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) })
+		candidates := []mirrorCandidate{
+			{name: "not_found", url: notFound.URL + "/direct.txt"},
+			{name: "broken", url: broken.URL + "/direct.txt"},
+		}
+		if _, err := ru.raceMirrors(context.Background(), provider, candidates, providerState{}, false); err == nil {
+			t.Fatal("全部镜像失败时应返回错误")
+		}
+		for _, c := range candidates {
+			if st := failuresOf(ru, c.name); st != 1 {
+				t.Errorf("%s: 镜像失败次数 = %d, 期望 1", c.name, st)
+			}
+		}
+	})
+
+	t.Run("取消", func(t *testing.T) {
+		first, firstClosed := raceServer(t, stall)
+		second, secondClosed := raceServer(t, stall)
+		candidates := []mirrorCandidate{
+			{name: "first", url: first.URL + "/direct.txt"},
+			{name: "second", url: second.URL + "/direct.txt"},
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := ru.raceMirrors(ctx, provider, candidates, providerState{}, false)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("错误 = %v, 期望 context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("取消后等待了 %v", elapsed)
+		}
+		waitClosed(t, "first", firstClosed)
+		waitClosed(t, "second", secondClosed)
+		waitSpoolEmpty(t)
+		for _, c := range candidates {
+			if st := failuresOf(ru, c.name); st > 0 {
+				t.Errorf("%s: 被取消的请求计入了镜像失败: %d 次", c.name, st)
+			}
+		}
+	})
+}
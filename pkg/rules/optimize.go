@@ -0,0 +1,479 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// OptimizeStats 记录规则优化各步骤移除的条目数量
+type OptimizeStats struct {
+	Duplicates int `json:"duplicates"`      // 完全重复的条目
+	Covered    int `json:"covered_domains"` // 已被 +.后缀 覆盖的域名
+	Merged     int `json:"merged_cidrs"`    // 合并重叠或相邻网段后减少的网段
+}
+
+// Removed 返回优化共移除的条目数量
+func (s OptimizeStats) Removed() int {
+	return s.Duplicates + s.Covered + s.Merged
+}
+
+// valueKind 表示 payload 条目在优化时的分类
+type valueKind int
+
+const (
+	valueOther  valueKind = iota // 仅去除完全重复
+	valueDomain                  // 完整域名或通配域名，可被后缀覆盖
+	valueSuffix                  // 匹配域名本身及所有子域名的后缀
+	valueCIDR                    // 可聚合的IP网段
+)
+
+// classifyValue 按规则类型解析 payload 条目，返回分类及用于比较的域名或网段
+func classifyValue(value, ruleType string) (valueKind, string, netip.Prefix) {
+	if ruleType == "classical" || (ruleType != "domain" && ruleType != "ipcidr" && strings.Contains(value, ",")) {
+		parts := strings.Split(value, ",")
+		// 带有 no-resolve 等参数的规则只去除完全重复
+		if len(parts) != 2 {
+			return valueOther, "", netip.Prefix{}
+		}
+		arg := strings.TrimSpace(parts[1])
+		switch strings.ToUpper(strings.TrimSpace(parts[0])) {
+		case "DOMAIN":
+			return valueDomain, strings.ToLower(arg), netip.Prefix{}
+		case "DOMAIN-SUFFIX":
+			return valueSuffix, strings.ToLower(arg), netip.Prefix{}
+		case "IP-CIDR", "IP-CIDR6":
+			if prefix, ok := parsePrefix(arg); ok {
+				return valueCIDR, "", prefix
+			}
+		}
+		return valueOther, "", netip.Prefix{}
+	}
+
+	if ruleType != "domain" {
+		if prefix, ok := parsePrefix(value); ok {
+			return valueCIDR, "", prefix
+		}
+		if ruleType == "ipcidr" {
+			return valueOther, "", netip.Prefix{}
+		}
+	}
+
+	domain := strings.ToLower(value)
+	if strings.HasPrefix(domain, "+.") {
+		return valueSuffix, domain[2:], netip.Prefix{}
+	}
+	return valueDomain, domain, netip.Prefix{}
+}
+
+// parsePrefix 解析网段或单个IP地址，返回规范化的网段
+func parsePrefix(value string) (netip.Prefix, bool) {
+	if prefix, err := netip.ParsePrefix(value); err == nil {
+		if prefix.Addr().Is4In6() {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked(), prefix.Bits() >= 96
+		}
+		return prefix.Masked(), true
+	}
+	if addr, err := netip.ParseAddr(value); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), true
+	}
+	return netip.Prefix{}, false
+}
+
+// settledPrefix 判断按地址顺序收到 p 之后，已经收到的网段 q 是否还可能被合并或包含
+//
+// q 是上一级网段的下半部分时，之后的网段可能补齐上半部分，需要等到 p 超出上一级网段的范围
+func settledPrefix(q, p netip.Prefix) bool {
+	if q.Addr().BitLen() != p.Addr().BitLen() {
+		return true
+	}
+	scope := q
+	if q.Bits() > 0 {
+		if parent := netip.PrefixFrom(q.Addr(), q.Bits()-1).Masked(); parent.Addr() == q.Addr() {
+			scope = parent
+		}
+	}
+	return !scope.Contains(p.Addr())
+}
+
+// prefixAggregator 按地址顺序逐个接收网段，合并为最小集合：移除被包含的网段并合并相邻的同级网段。
+// 不会再变化的网段立即传给 emit，只保留仍可能被合并的网段，最多为地址位数加一个
+type prefixAggregator struct {
+	open []netip.Prefix
+	emit func(prefix netip.Prefix)
+}
+
+// add 添加一个网段，网段需要按地址排序，地址相同时前缀较短的在前
+func (agg *prefixAggregator) add(p netip.Prefix) {
+	// 某个网段不会再变化时，它前面的网段也无法再与后续网段合并
+	for i := len(agg.open) - 1; i >= 0; i-- {
+		if settledPrefix(agg.open[i], p) {
+			for _, q := range agg.open[:i+1] {
+				agg.emit(q)
+			}
+			agg.open = append(agg.open[:0], agg.open[i+1:]...)
+			break
+		}
+	}
+
+	result := agg.open
+	if n := len(result); n > 0 && result[n-1].Addr().BitLen() == p.Addr().BitLen() &&
+		result[n-1].Bits() <= p.Bits() && result[n-1].Contains(p.Addr()) {
+		return
+	}
+	for len(result) > 0 && p.Bits() <= result[len(result)-1].Bits() && p.Contains(result[len(result)-1].Addr()) &&
+		p.Addr().BitLen() == result[len(result)-1].Addr().BitLen() {
+		result = result[:len(result)-1]
+	}
+	result = append(result, p)
+
+	// 与前一个网段互为同级时合并为上一级网段，合并后可能继续与更前面的网段合并
+	for len(result) >= 2 {
+		a, b := result[len(result)-2], result[len(result)-1]
+		if a.Bits() != b.Bits() || a.Bits() == 0 || a.Addr().BitLen() != b.Addr().BitLen() {
+			break
+		}
+		parent := netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked()
+		if parent != netip.PrefixFrom(b.Addr(), b.Bits()-1).Masked() {
+			break
+		}
+		result = append(result[:len(result)-2], parent)
+	}
+	agg.open = result
+}
+
+// flush 输出剩余的网段
+func (agg *prefixAggregator) flush() {
+	for _, q := range agg.open {
+		agg.emit(q)
+	}
+	agg.open = agg.open[:0]
+}
+
+// bypassPaths 按排列顺序返回指定名称的已启用规则的规则文件
+func (ru *RuleUpdater) bypassPaths(names []string) []string {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	var paths []string
+	for _, provider := range config.OrderedProviders(ru.cfg.RuleProviders) {
+		if !wanted[provider.Name] || !provider.Enabled {
+			continue
+		}
+		path := filepath.Join(ru.getRulesDir(), provider.Path)
+		if !utils.FileExists(path) {
+			logger.Errorf("规则 %s 的规则文件不存在: %s", provider.Name, path)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// SyncCombinedBypass 按排列顺序合并指定名称的已启用规则的规则文件，与更新时一样去重聚合后同步到CFW绕过配置，
+// 返回优化统计和参与合并的规则数量，没有可用的规则文件时不做任何修改
+func (ru *RuleUpdater) SyncCombinedBypass(names []string) (OptimizeStats, int, error) {
+	paths := ru.bypassPaths(names)
+	if len(paths) == 0 {
+		return OptimizeStats{}, 0, nil
+	}
+	stats, err := ru.syncBypass(paths)
+	return stats, len(paths), err
+}
+
+// syncBypass 合并规则文件并同步到CFW绕过配置，合并结果只写入临时文件，不会完整读入内存
+func (ru *RuleUpdater) syncBypass(paths []string) (OptimizeStats, error) {
+	body, stats, err := optimizeBypass(paths)
+	if err != nil {
+		return stats, errors.Wrap(err, "合并规则失败")
+	}
+	defer body.remove()
+	return stats, api.SyncBypassRulesFromFile(body.path, ru.BypassOverrides())
+}
+
+// optimizeBypass 逐个读取规则文件的 payload，合并去重聚合后写入临时文件
+func optimizeBypass(paths []string) (*ruleBody, OptimizeStats, error) {
+	opt := newOptimizer("mixed")
+	defer opt.close()
+	for _, path := range paths {
+		// 文件需要完整解析或无法读取时丢弃已读取的部分
+		mark := opt.mark()
+		if err := readPayloadFile(path, opt.add, func() { opt.discard(mark) }); err != nil {
+			opt.discard(mark)
+		}
+	}
+
+	spool, err := newSpool(0)
+	if err != nil {
+		return nil, OptimizeStats{}, err
+	}
+	pw := newPayloadWriter(spool)
+	stats, err := opt.each(pw.add)
+	if err == nil {
+		err = pw.close("bypass")
+	}
+	if err != nil {
+		spool.abort()
+		return nil, stats, err
+	}
+	body, err := spool.finish()
+	return body, stats, err
+}
+
+// formatPrefix 按规则类型输出网段
+func formatPrefix(prefix netip.Prefix, ruleType string) string {
+	if ruleType != "classical" {
+		return prefix.String()
+	}
+	if prefix.Addr().Is6() {
+		return "IP-CIDR6," + prefix.String()
+	}
+	return "IP-CIDR," + prefix.String()
+}
+
+// optimizeValues 对内存中的 payload 条目去重并聚合网段，见 optimizer
+func optimizeValues(values []string, ruleType string) ([]string, OptimizeStats, error) {
+	opt := newOptimizer(ruleType)
+	defer opt.close()
+	for _, value := range values {
+		opt.add(value)
+	}
+	result := make([]string, 0, len(values))
+	stats, err := opt.each(func(value string) {
+		result = append(result, value)
+	})
+	return result, stats, err
+}
+
+// 优化时记录的分类，决定记录的排列顺序：域名和后缀在前，其他条目其次，网段最后
+const (
+	recordDomain byte = iota // 域名和后缀，按反转后的域名排序，后缀排在同名域名之前
+	recordOther              // 其他条目，按条目本身排序
+	recordCIDR               // 网段，按地址排序
+)
+
+// cidrKeySize 网段记录比较键的长度：分类、地址族、16字节地址和前缀长度
+const cidrKeySize = 1 + 1 + 16 + 1
+
+// optimizer 逐条接收 payload 条目，去除完全重复的条目、已被 +.后缀（或 DOMAIN-SUFFIX）覆盖的域名，
+// 并将网段合并为最小集合。非网段条目保持首次出现的顺序，网段按地址排序后放在最后。
+//
+// 条目以记录的形式交给 recordSorter 外部排序，排序后重复的条目相邻、后缀之后紧跟被它覆盖的域名，
+// 网段按地址排列，都可以逐条处理。内存占用与条目数量无关，使用后需要调用 close
+type optimizer struct {
+	ruleType  string
+	seq       uint64      // 下一个条目的序号，用于恢复首次出现的顺序
+	discarded [][2]uint64 // 被丢弃的序号区间 [from, to)
+	records   recordSorter
+	rec       []byte
+}
+
+// newOptimizer 创建规则类型为 ruleType 的优化器
+func newOptimizer(ruleType string) *optimizer {
+	return &optimizer{ruleType: ruleType}
+}
+
+// add 添加一个条目
+func (o *optimizer) add(value string) {
+	kind, domain, prefix := classifyValue(value, o.ruleType)
+
+	rec := o.rec[:0]
+	switch kind {
+	case valueCIDR:
+		addr := prefix.Addr()
+		family := byte(0)
+		if addr.Is6() {
+			family = 1
+		}
+		a16 := addr.As16()
+		rec = append(rec, recordCIDR, family)
+		rec = append(rec, a16[:]...)
+		rec = append(rec, byte(prefix.Bits()))
+	case valueDomain, valueSuffix:
+		// 后缀覆盖其本身及所有子域名，完整域名去掉 "*" 和 "." 通配前缀后比较
+		pos, order := domain, byte(0)
+		if kind == valueDomain {
+			pos, order = strings.TrimPrefix(strings.TrimPrefix(domain, "*"), "."), 1
+		}
+		rec = append(rec, recordDomain)
+		rec = appendReversedDomain(rec, pos)
+		rec = append(rec, 0, order)
+		rec = appendRecordKey(rec, domain)
+		rec = append(rec, 0)
+	default:
+		rec = append(rec, recordOther)
+		rec = appendRecordKey(rec, value)
+		rec = append(rec, 0)
+	}
+	rec = binary.BigEndian.AppendUint64(rec, o.seq)
+	if kind != valueCIDR {
+		rec = append(rec, value...)
+	}
+	o.seq++
+
+	o.records.add(rec)
+	o.rec = rec
+}
+
+// mark 返回下一个条目的序号，配合 discard 丢弃之后添加的条目
+func (o *optimizer) mark() uint64 {
+	return o.seq
+}
+
+// discard 丢弃从 mark 返回的序号开始添加的所有条目
+func (o *optimizer) discard(from uint64) {
+	if from < o.seq {
+		o.discarded = append(o.discarded, [2]uint64{from, o.seq})
+	}
+}
+
+// isDiscarded 判断序号对应的条目是否已被丢弃
+func (o *optimizer) isDiscarded(seq uint64) bool {
+	for _, r := range o.discarded {
+		if seq >= r[0] && seq < r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// each 按顺序将优化后的条目传给 emit，返回各步骤移除的条目数量
+func (o *optimizer) each(emit func(value string)) (OptimizeStats, error) {
+	var stats OptimizeStats
+
+	// 保留的非网段条目按序号再排序一次，恢复首次出现的顺序
+	var kept recordSorter
+	defer kept.close()
+	keptDone := false
+	emitKept := func() error {
+		if keptDone {
+			return nil
+		}
+		keptDone = true
+		return kept.each(func(rec []byte) error {
+			emit(string(rec[8:]))
+			return nil
+		})
+	}
+
+	prefixes, emitted := 0, 0
+	agg := prefixAggregator{emit: func(prefix netip.Prefix) {
+		emit(formatPrefix(prefix, o.ruleType))
+		emitted++
+	}}
+
+	var prev, cover []byte
+	err := o.records.each(func(rec []byte) error {
+		key, seq, value := splitRecord(rec)
+		if o.isDiscarded(seq) {
+			return nil
+		}
+		if prev != nil && bytes.Equal(key, prev) {
+			stats.Duplicates++
+			return nil
+		}
+		prev = append(prev[:0], key...)
+
+		switch key[0] {
+		case recordCIDR:
+			if err := emitKept(); err != nil {
+				return err
+			}
+			prefixes++
+			agg.add(decodePrefixKey(key))
+			return nil
+		case recordDomain:
+			end := 1 + bytes.IndexByte(key[1:], 0)
+			pos, suffix := key[1:end], key[end+1] == 0
+			// 排序后被后缀覆盖的条目紧跟在后缀之后，只需与最近一个未被覆盖的后缀比较
+			if len(cover) > 0 && bytes.HasPrefix(pos, cover) &&
+				((len(pos) == len(cover) && !suffix) || (len(pos) > len(cover) && pos[len(cover)] == domainLabelSeparator)) {
+				stats.Covered++
+				return nil
+			}
+			if suffix {
+				cover = append(cover[:0], pos...)
+			}
+		}
+
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], seq)
+		kept.add(append(buf[:], value...))
+		return nil
+	})
+	if err == nil {
+		err = emitKept()
+	}
+	if err != nil {
+		return stats, err
+	}
+	agg.flush()
+	stats.Merged = prefixes - emitted
+	return stats, nil
+}
+
+// close 删除排序使用的临时文件
+func (o *optimizer) close() {
+	o.records.close()
+}
+
+// domainLabelSeparator 反转后的域名中分隔各级标签的字节，小于域名中可能出现的所有字符，
+// 使子域名紧跟在父域名之后排列
+const domainLabelSeparator = 1
+
+// appendReversedDomain 将域名按标签反转后追加到 dst，如 www.example.com 写为 com\x01example\x01www
+func appendReversedDomain(dst []byte, domain string) []byte {
+	for end := len(domain); ; {
+		start := strings.LastIndexByte(domain[:end], '.') + 1
+		dst = appendRecordKey(dst, domain[start:end])
+		if start == 0 {
+			return dst
+		}
+		dst = append(dst, domainLabelSeparator)
+		end = start - 1
+	}
+}
+
+// appendRecordKey 将比较键追加到 dst，去掉用作分隔符的字节
+func appendRecordKey(dst []byte, key string) []byte {
+	for i := 0; i < len(key); i++ {
+		if key[i] > domainLabelSeparator {
+			dst = append(dst, key[i])
+		}
+	}
+	return dst
+}
+
+// splitRecord 将记录拆分为比较键、序号和条目
+func splitRecord(rec []byte) (key []byte, seq uint64, value []byte) {
+	n := cidrKeySize
+	switch rec[0] {
+	case recordDomain:
+		end := 1 + bytes.IndexByte(rec[1:], 0)
+		n = end + 2 + bytes.IndexByte(rec[end+2:], 0) + 1
+	case recordOther:
+		n = 1 + bytes.IndexByte(rec[1:], 0) + 1
+	}
+	return rec[:n], binary.BigEndian.Uint64(rec[n:]), rec[n+8:]
+}
+
+// decodePrefixKey 从网段记录的比较键还原网段
+func decodePrefixKey(key []byte) netip.Prefix {
+	addr := netip.AddrFrom16([16]byte(key[2:18]))
+	if key[1] == 0 {
+		addr = addr.Unmap()
+	}
+	return netip.PrefixFrom(addr, int(key[18]))
+}
@@ -0,0 +1,244 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestOptimizeValues 检查去重、后缀覆盖和网段聚合
+func TestOptimizeValues(t *testing.T) {
+	tests := []struct {
+		name     string
+		ruleType string
+		input    []string
+		want     []string
+		stats    OptimizeStats
+	}{
+		{
+			name:     "重复域名",
+			ruleType: "domain",
+			input:    []string{"a.com", "A.com", "b.com", "a.com"},
+			want:     []string{"a.com", "b.com"},
+			stats:    OptimizeStats{Duplicates: 2},
+		},
+		{
+			name:     "后缀覆盖",
+			ruleType: "domain",
+			input:    []string{"www.a.com", "+.a.com", "a.com", "+.x.a.com", "*.a.com", ".a.com", "a.com.cn", "+.b.com"},
+			want:     []string{"+.a.com", "a.com.cn", "+.b.com"},
+			stats:    OptimizeStats{Covered: 5},
+		},
+		{
+			name:     "网段聚合",
+			ruleType: "ipcidr",
+			input:    []string{"10.0.0.0/9", "10.128.0.0/9", "10.1.0.0/16", "192.168.0.1", "192.168.0.1/32", "192.168.0.0", "2001:db8::/33", "2001:db8:8000::/33", "10.0.0.0/8"},
+			want:     []string{"10.0.0.0/8", "192.168.0.0/31", "2001:db8::/32"},
+			stats:    OptimizeStats{Duplicates: 1, Merged: 5},
+		},
+		{
+			name:     "混合类型",
+			ruleType: "mixed",
+			input:    []string{"1.1.1.0/25", "a.com", "1.1.1.128/25", "+.a.com"},
+			want:     []string{"+.a.com", "1.1.1.0/24"},
+			stats:    OptimizeStats{Covered: 1, Merged: 1},
+		},
+		{
+			name:     "classical规则",
+			ruleType: "classical",
+			input: []string{"DOMAIN,www.a.com", "DOMAIN-SUFFIX,a.com", "IP-CIDR,10.0.0.0/9", "IP-CIDR,10.128.0.0/9",
+				"IP-CIDR,10.0.0.0/8,no-resolve", "DST-PORT,443", "DST-PORT,443"},
+			want:  []string{"DOMAIN-SUFFIX,a.com", "IP-CIDR,10.0.0.0/8,no-resolve", "DST-PORT,443", "IP-CIDR,10.0.0.0/8"},
+			stats: OptimizeStats{Duplicates: 1, Covered: 1, Merged: 1},
+		},
+	}
+
+	t.Setenv("HOME", t.TempDir())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 第二次几乎每条记录都写入临时文件，结果应当相同
+			for _, chunk := range []int{sortChunkSize, 32} {
+				setSortChunkSize(t, chunk)
+				got, stats, err := optimizeValues(tt.input, tt.ruleType)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("chunk=%d: 得到 %q, 期望 %q", chunk, got, tt.want)
+				}
+				if stats != tt.stats {
+					t.Errorf("chunk=%d: 统计 = %+v, 期望 %+v", chunk, stats, tt.stats)
+				}
+			}
+		})
+	}
+}
+
+// setSortChunkSize 在测试期间修改外部排序在内存中累积的记录大小
+func setSortChunkSize(t testing.TB, size int) {
+	old := sortChunkSize
+	sortChunkSize = size
+	t.Cleanup(func() { sortChunkSize = old })
+}
+
+// TestOptimizeSpill 检查大量条目分多批写入临时文件并分批合并后，结果与完全在内存中排序相同，且临时文件被删除
+func TestOptimizeSpill(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	rng := rand.New(rand.NewSource(1))
+	var values []string
+	for i := 0; i < 5000; i++ {
+		switch rng.Intn(5) {
+		case 0:
+			values = append(values, fmt.Sprintf("+.example-%d.com", rng.Intn(50)))
+		case 1:
+			values = append(values, fmt.Sprintf("10.%d.%d.0/%d", rng.Intn(4), rng.Intn(256), 24+rng.Intn(9)))
+		case 2:
+			values = append(values, fmt.Sprintf("2001:db8:%x::/48", rng.Intn(512)))
+		default:
+			values = append(values, fmt.Sprintf("host-%d.example-%d.com", rng.Intn(500), rng.Intn(100)))
+		}
+	}
+
+	want, wantStats, err := optimizeValues(values, "mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setSortChunkSize(t, 1024)
+	got, gotStats, err := optimizeValues(values, "mixed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) || gotStats != wantStats {
+		t.Errorf("写入临时文件后得到 %d 条 %+v, 期望 %d 条 %+v", len(got), gotStats, len(want), wantStats)
+	}
+	if wantStats.Duplicates == 0 || wantStats.Covered == 0 || wantStats.Merged == 0 {
+		t.Errorf("测试数据应当覆盖所有优化步骤: %+v", wantStats)
+	}
+
+	if left, _ := filepath.Glob(filepath.Join(getSpoolDir(), "sort-*")); len(left) != 0 {
+		t.Errorf("临时文件未删除: %v", left)
+	}
+}
+
+// TestPrefixAggregator 检查逐个输出的网段与输入覆盖的地址完全相同，且为最小集合
+func TestPrefixAggregator(t *testing.T) {
+	base := netip.MustParseAddr("10.0.0.0").As4()
+	rng := rand.New(rand.NewSource(1))
+	for round := 0; round < 500; round++ {
+		var input []netip.Prefix
+		for i := rng.Intn(40); i >= 0; i-- {
+			addr := base
+			addr[3] = byte(rng.Intn(256))
+			input = append(input, netip.PrefixFrom(netip.AddrFrom4(addr), 24+rng.Intn(9)).Masked())
+		}
+		sort.Slice(input, func(i, j int) bool {
+			if c := input[i].Addr().Compare(input[j].Addr()); c != 0 {
+				return c < 0
+			}
+			return input[i].Bits() < input[j].Bits()
+		})
+
+		var got []netip.Prefix
+		agg := prefixAggregator{emit: func(p netip.Prefix) { got = append(got, p) }}
+		for _, p := range input {
+			agg.add(p)
+		}
+		agg.flush()
+
+		covered := func(prefixes []netip.Prefix) [256]bool {
+			var set [256]bool
+			for i := range set {
+				addr := base
+				addr[3] = byte(i)
+				for _, p := range prefixes {
+					if p.Contains(netip.AddrFrom4(addr)) {
+						set[i] = true
+					}
+				}
+			}
+			return set
+		}
+		if covered(got) != covered(input) {
+			t.Fatalf("输入 %v 得到 %v, 覆盖的地址不同", input, got)
+		}
+		for i := 1; i < len(got); i++ {
+			a, b := got[i-1], got[i]
+			if a.Addr().Compare(b.Addr()) >= 0 || a.Overlaps(b) {
+				t.Fatalf("输入 %v 得到 %v, 网段未排序或重叠", input, got)
+			}
+			if a.Bits() == b.Bits() && netip.PrefixFrom(a.Addr(), a.Bits()-1).Masked() == netip.PrefixFrom(b.Addr(), b.Bits()-1).Masked() {
+				t.Fatalf("输入 %v 得到 %v, 同级网段未合并", input, got)
+			}
+		}
+	}
+}
+
+// TestSyncCombinedBypass 检查指定规则按排列顺序合并，与请求中的顺序无关，去除重复条目后
+// 逐行替换CFW设置文件中的绕过规则，其余设置保持不变
+func TestSyncCombinedBypass(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		inlineProvider("b", "b.com", "shared.com"),
+		inlineProvider("a", "a.com", "shared.com"),
+		inlineProvider("c", "c.com"),
+	}
+	cfg.RuleProviders[0].Priority = 20
+	cfg.RuleProviders[1].Priority = 10
+	ru := NewRuleUpdater(cfg)
+	if _, err := ru.UpdateAllRules(context.Background(), TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+
+	settingsPath := filepath.Join(home, ".config", "clash", "cfw-settings.yaml")
+	if err := os.MkdirAll(filepath.Dir(settingsPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	settings := "checkForUpdates: true\nbypassText: |\n  bypass:\n    - old.example.com\n\n    - other.example.com\nmixinText: |\n  mixin: {}\n"
+	if err := os.WriteFile(settingsPath, []byte(settings), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "checkForUpdates: true\nbypassText: |\n  bypass:\n"
+	for _, rule := range []string{"localhost", "127.*", "10.*", "172.16.*", "172.17.*", "172.18.*", "172.19.*",
+		"172.20.*", "172.21.*", "172.22.*", "172.23.*", "192.168.*", "<local>", "a.com", "shared.com", "b.com"} {
+		want += "    - " + rule + "\n"
+	}
+	want += "mixinText: |\n  mixin: {}\n"
+
+	// 第二次同步替换第一次写入的内容，结果不变
+	for i := 0; i < 2; i++ {
+		stats, count, err := ru.SyncCombinedBypass([]string{"b", "a", "missing"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 || stats.Duplicates != 1 {
+			t.Errorf("合并数量 = %d，重复条目 = %d，期望 2 和 1", count, stats.Duplicates)
+		}
+		data, err := os.ReadFile(settingsPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("CFW设置 = %q, 期望 %q", data, want)
+		}
+	}
+
+	if _, count, err := ru.SyncCombinedBypass([]string{"missing"}); count != 0 || err != nil {
+		t.Errorf("count = %d, err = %v, 期望没有可同步的规则", count, err)
+	}
+	if left, _ := os.ReadDir(getSpoolDir()); len(left) != 0 {
+		t.Errorf("临时文件未删除: %v", left)
+	}
+}
@@ -0,0 +1,149 @@
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+)
+
+// overrideSet 表示对一个规则提供者生效的覆盖条目，在格式转换时应用
+//
+// 被排除的上游条目在优化之前去掉，强制加入的条目不经过转换步骤，在排除之后加入，
+// 因此规则自身的 include 优先于任何 exclude
+type overrideSet struct {
+	include  []string        // 通过校验的强制加入条目
+	exclude  map[string]bool // 强制排除的域名或网段
+	excluded int             // 被排除的上游条目数量
+}
+
+// ValidateOverride 检查覆盖条目是否有效，providers 用于检查规则提供者是否存在及其类型
+func ValidateOverride(o config.Override, providers []config.RuleProvider, now time.Time) error {
+	switch o.Action {
+	case config.OverrideInclude, config.OverrideExclude:
+	default:
+		return fmt.Errorf("无效的覆盖动作: %s", o.Action)
+	}
+
+	value := strings.TrimSpace(o.Value)
+	if value == "" || strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("覆盖条目的值无效")
+	}
+	if o.ExpiresAt != nil && !o.ExpiresAt.After(now) {
+		return fmt.Errorf("过期时间必须晚于当前时间")
+	}
+
+	if o.Provider == "" {
+		// 全局强制加入的条目只用于 CFW 绕过配置
+		if o.Action == config.OverrideInclude {
+			return validateDomain(value, true)
+		}
+		return nil
+	}
+
+	for _, provider := range providers {
+		if provider.Name != o.Provider {
+			continue
+		}
+		if o.Action == config.OverrideInclude {
+			if err := validateEntry(value, payloadType(provider)); err != nil {
+				return fmt.Errorf("条目不符合规则 %s 的类型 %s: %v", provider.Name, payloadType(provider), err)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("规则提供者不存在: %s", o.Provider)
+}
+
+// overrideKey 返回排除条目用于比较的域名或网段，忽略 +. 前缀和 DOMAIN-SUFFIX 等规则类型
+func overrideKey(value string) string {
+	return lineDomain(value)
+}
+
+// providerOverrides 返回 now 时刻对规则文件生效的覆盖条目及其摘要，没有覆盖条目时返回 nil 和空字符串
+//
+// 全局的强制加入条目只用于 CFW 绕过配置，不计入规则文件
+func (ru *RuleUpdater) providerOverrides(provider config.RuleProvider, now time.Time) (*overrideSet, string) {
+	var relevant []string
+	set := &overrideSet{exclude: make(map[string]bool)}
+	for _, o := range ru.cfg.ActiveOverrides(provider.Name, now) {
+		value := strings.TrimSpace(o.Value)
+		switch o.Action {
+		case config.OverrideExclude:
+			set.exclude[overrideKey(value)] = true
+		case config.OverrideInclude:
+			if o.Provider == "" {
+				continue
+			}
+			if err := validateEntry(value, payloadType(provider)); err != nil {
+				logger.Warnf("规则 %s 的覆盖条目 %s 无效，已忽略: %v", provider.Name, value, err)
+				continue
+			}
+			set.include = append(set.include, value)
+		default:
+			continue
+		}
+		relevant = append(relevant, o.Action+" "+value)
+	}
+	if len(relevant) == 0 {
+		return nil, ""
+	}
+
+	sort.Strings(relevant)
+	sum := sha256.Sum256([]byte(strings.Join(relevant, "\n")))
+	return set, hex.EncodeToString(sum[:8])
+}
+
+// overridesChanged 判断规则文件生成后生效的覆盖条目是否发生了变化，例如新增条目或条目过期
+func (ru *RuleUpdater) overridesChanged(provider config.RuleProvider, now time.Time) bool {
+	state, ok := ru.getState(provider.Name)
+	if !ok {
+		return false
+	}
+	_, digest := ru.providerOverrides(provider, now)
+	return state.Overrides != digest
+}
+
+// excludes 判断条目是否被排除，被排除时计数
+func (o *overrideSet) excludes(value string) bool {
+	if o == nil || len(o.exclude) == 0 || !o.exclude[overrideKey(value)] {
+		return false
+	}
+	o.excluded++
+	return true
+}
+
+// includes 返回强制加入的条目
+func (o *overrideSet) includes() []string {
+	if o == nil {
+		return nil
+	}
+	return o.include
+}
+
+// reset 清空统计，用于重新读取内容
+func (o *overrideSet) reset() {
+	if o != nil {
+		o.excluded = 0
+	}
+}
+
+// BypassOverrides 返回同步 CFW 绕过配置时使用的全局覆盖条目
+func (ru *RuleUpdater) BypassOverrides() api.BypassOverrides {
+	var overrides api.BypassOverrides
+	for _, o := range ru.cfg.ActiveOverrides("", time.Now()) {
+		switch o.Action {
+		case config.OverrideInclude:
+			overrides.Include = append(overrides.Include, strings.TrimSpace(o.Value))
+		case config.OverrideExclude:
+			overrides.Exclude = append(overrides.Exclude, strings.TrimSpace(o.Value))
+		}
+	}
+	return overrides
+}
@@ -0,0 +1,119 @@
+package rules
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestOverrides 检查覆盖条目在下载后应用、变化时重新处理并在过期后触发更新
+func TestOverrides(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		inlineProvider("direct", "a.example.com", "+.bad.example", "c.example.com", "d.example.com"),
+		inlineProvider("other", "c.example.com"),
+	}
+	expiresAt := time.Now().Add(time.Hour)
+	for _, o := range []config.Override{
+		{Action: config.OverrideExclude, Value: "bad.example", Provider: "direct"},
+		{Action: config.OverrideInclude, Value: "forced.example", Provider: "direct"},
+		{Action: config.OverrideExclude, Value: "c.example.com"},
+		{Action: config.OverrideInclude, Value: "bypass.example"},
+		{Action: config.OverrideExclude, Value: "d.example.com", Provider: "direct", ExpiresAt: &expiresAt},
+	} {
+		if err := ValidateOverride(o, cfg.RuleProviders, time.Now()); err != nil {
+			t.Fatalf("ValidateOverride(%+v) = %v", o, err)
+		}
+		if _, err := cfg.AddOverride(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ru := NewRuleUpdater(cfg)
+	output := filepath.Join(t.TempDir(), "direct.yaml")
+	readEntries := func() []string {
+		var entries []string
+		if err := readPayloadFile(output, func(value string) {
+			entries = append(entries, value)
+		}, func() { entries = nil }); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+
+	result, err := ru.downloadAndProcessRule(context.Background(), cfg.RuleProviders[0], output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 全局强制加入的条目只用于绕过配置，不写入规则文件
+	if got, want := readEntries(), []string{"a.example.com", "forced.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("规则条目 = %q, 期望 %q", got, want)
+	}
+	if result.excluded != 3 || result.included != 1 {
+		t.Errorf("排除 %d 条、加入 %d 条, 期望 3 和 1", result.excluded, result.included)
+	}
+
+	// 覆盖条目未变化时内容一致，不重写文件
+	if result, err = ru.downloadAndProcessRule(context.Background(), cfg.RuleProviders[0], output); err != nil || result.changed {
+		t.Fatalf("changed = %v, err = %v, 期望未变化", result.changed, err)
+	}
+	if due := ru.DueProviders(time.Now()); len(due) != 1 || due[0] != "other" {
+		t.Errorf("到期的规则 = %v, 期望只有 other", due)
+	}
+
+	// 覆盖条目过期后立即到期，重新处理时恢复被排除的条目
+	expired := expiresAt.Add(time.Second)
+	if due := ru.DueProviders(expired); !reflect.DeepEqual(due, []string{"direct", "other"}) {
+		t.Errorf("过期后到期的规则 = %v, 期望 [direct other]", due)
+	}
+	if removed := cfg.RemoveExpiredOverrides(expired); len(removed) != 1 || removed[0].Value != "d.example.com" {
+		t.Fatalf("删除的过期条目 = %+v", removed)
+	}
+	if result, err = ru.downloadAndProcessRule(context.Background(), cfg.RuleProviders[0], output); err != nil || !result.changed {
+		t.Fatalf("changed = %v, err = %v, 期望重新处理", result.changed, err)
+	}
+	if got, want := readEntries(), []string{"a.example.com", "d.example.com", "forced.example"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("规则条目 = %q, 期望 %q", got, want)
+	}
+
+	want := api.BypassOverrides{Include: []string{"bypass.example"}, Exclude: []string{"c.example.com"}}
+	if got := ru.BypassOverrides(); !reflect.DeepEqual(got, want) {
+		t.Errorf("BypassOverrides() = %+v, 期望 %+v", got, want)
+	}
+}
+
+// TestValidateOverride 检查无效的覆盖条目
+func TestValidateOverride(t *testing.T) {
+	providers := []config.RuleProvider{
+		inlineProvider("direct", "a.example.com"),
+		{Name: "cidr", Type: "ipcidr", Behavior: "ipcidr", Entries: []string{"10.0.0.0/8"}},
+	}
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		override config.Override
+		valid    bool
+	}{
+		{config.Override{Action: "exclude", Value: "+.example.com", Provider: "direct"}, true},
+		{config.Override{Action: "include", Value: "192.168.0.0/16", Provider: "cidr"}, true},
+		{config.Override{Action: "include", Value: "example.com", Provider: "cidr"}, false},
+		{config.Override{Action: "include", Value: "10.0.0.0/8"}, false},
+		{config.Override{Action: "include", Value: "example.com"}, true},
+		{config.Override{Action: "exclude", Value: "example.com", Provider: "missing"}, false},
+		{config.Override{Action: "replace", Value: "example.com"}, false},
+		{config.Override{Action: "exclude", Value: " "}, false},
+		{config.Override{Action: "exclude", Value: "example.com", ExpiresAt: &past}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateOverride(tt.override, providers, time.Now()); (err == nil) != tt.valid {
+			t.Errorf("ValidateOverride(%+v) = %v", tt.override, err)
+		}
+	}
+}
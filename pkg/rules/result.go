@@ -0,0 +1,118 @@
+package rules
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// ProviderStatus 表示单个规则提供者一次更新的结果
+type ProviderStatus string
+
+const (
+	// StatusChanged 规则内容发生变化并已写入
+	StatusChanged ProviderStatus = "changed"
+	// StatusUnchanged 上游内容未变化，本地文件保持不变
+	StatusUnchanged ProviderStatus = "unchanged"
+	// StatusFailed 更新失败，本地文件保持不变
+	StatusFailed ProviderStatus = "failed"
+	// StatusSkipped 规则提供者已禁用，未执行更新
+	StatusSkipped ProviderStatus = "skipped"
+	// StatusRolledBack 应用失败，规则文件已恢复到最后可用版本
+	StatusRolledBack ProviderStatus = "rolled_back"
+)
+
+// UpdateRecord 记录一次规则更新的结果
+type UpdateRecord struct {
+	Time       time.Time        `json:"time"`
+	Trigger    Trigger          `json:"trigger,omitempty"`
+	Providers  []ProviderRecord `json:"providers"`
+	Bypass     *OptimizeStats   `json:"bypass_optimized,omitempty"` // 同步绕过配置时合并规则移除的条目
+	Rollback   string           `json:"rollback,omitempty"`         // 回滚原因，仅回滚记录包含
+	Unverified string           `json:"unverified,omitempty"`       // 新规则无法经过 Clash 验证的原因，此时不会自动回滚
+}
+
+// ProviderRecord 记录单个规则提供者的更新情况
+type ProviderRecord struct {
+	Name             string         `json:"name"`
+	Status           ProviderStatus `json:"status"`
+	Success          bool           `json:"success"`
+	Changed          bool           `json:"changed"`
+	Message          string         `json:"message"`
+	EntriesBefore    int            `json:"entries_before"`
+	EntriesAfter     int            `json:"entries_after"`
+	BytesDownloaded  int64          `json:"bytes_downloaded"`
+	Mirror           string         `json:"mirror,omitempty"`
+	Route            string         `json:"route,omitempty"` // 实际使用的下载路径：direct 或 clash
+	Format           string         `json:"format,omitempty"`
+	ErrorLine        int            `json:"error_line,omitempty"`
+	ErrorColumn      int            `json:"error_column,omitempty"`
+	InvalidEntries   int            `json:"invalid_entries,omitempty"`
+	InvalidSamples   []string       `json:"invalid_samples,omitempty"`
+	Filtered         int            `json:"filtered,omitempty"`          // 被转换步骤去掉的行
+	OverrideExcluded int            `json:"override_excluded,omitempty"` // 被覆盖条目排除的条目
+	OverrideIncluded int            `json:"override_included,omitempty"` // 强制加入的条目
+	Optimized        *OptimizeStats `json:"optimized,omitempty"`
+	Verified         []string       `json:"verified,omitempty"` // 通过的完整性校验项
+	DurationMs       int64          `json:"duration_ms"`
+}
+
+// setStatus 设置更新状态，同时维护兼容旧前端的 Success/Changed 字段
+func (pr *ProviderRecord) setStatus(status ProviderStatus, message string) {
+	pr.Status = status
+	pr.Message = message
+	pr.Success = status == StatusChanged || status == StatusUnchanged
+	pr.Changed = status == StatusChanged
+}
+
+// HasChanges 返回是否有规则提供者的内容发生变化
+func (r *UpdateRecord) HasChanges() bool {
+	for _, p := range r.Providers {
+		if p.Status == StatusChanged {
+			return true
+		}
+	}
+	return false
+}
+
+// HasFailures 返回是否有规则提供者更新失败
+func (r *UpdateRecord) HasFailures() bool {
+	for _, p := range r.Providers {
+		if p.Status == StatusFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// CountByStatus 统计各状态的规则提供者数量
+func (r *UpdateRecord) CountByStatus() map[ProviderStatus]int {
+	counts := map[ProviderStatus]int{
+		StatusChanged:    0,
+		StatusUnchanged:  0,
+		StatusFailed:     0,
+		StatusSkipped:    0,
+		StatusRolledBack: 0,
+	}
+	for _, p := range r.Providers {
+		counts[p.Status]++
+	}
+	return counts
+}
+
+// countRuleEntries 统计规则文件中 payload 条目数量，文件不存在时返回0
+func countRuleEntries(path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	count := 0
+	forEachLine(f, func(line string) {
+		if strings.HasPrefix(strings.TrimSpace(line), "- ") {
+			count++
+		}
+	}, nil)
+	return count
+}
@@ -0,0 +1,142 @@
+package rules
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// httpStatusError 表示服务器返回了非预期的状态码
+type httpStatusError struct {
+	code int
+	// 服务器通过 Retry-After 要求的等待时间，未提供时为0
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	if e.retryAfter > 0 {
+		return fmt.Sprintf("下载规则失败，状态码: %d (Retry-After: %s)", e.code, e.retryAfter)
+	}
+	return fmt.Sprintf("下载规则失败，状态码: %d", e.code)
+}
+
+// permanentError 表示重试也无法恢复的错误，例如内容无效
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// permanent 将错误标记为不可重试
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// isRetryable 判断下载错误是否值得在同一个镜像上重试
+//
+// 网络错误、超时、408/425/429 以及 5xx 可以重试；其余 4xx 和内容校验失败
+// 视为永久错误，重试只会浪费时间
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if stderrors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var pe *permanentError
+	if stderrors.As(err, &pe) {
+		return false
+	}
+
+	var se *httpStatusError
+	if stderrors.As(err, &se) {
+		switch {
+		case se.code == http.StatusRequestTimeout,
+			se.code == http.StatusTooEarly,
+			se.code == http.StatusTooManyRequests:
+			return true
+		case se.code >= 500:
+			return true
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// retryAfterOf 返回错误中携带的 Retry-After 等待时间
+func retryAfterOf(err error) time.Duration {
+	var se *httpStatusError
+	if stderrors.As(err, &se) {
+		return se.retryAfter
+	}
+	return 0
+}
+
+// maxRetryAfter Retry-After 等待时间的上限，避免过大的秒数溢出
+const maxRetryAfter = 24 * time.Hour
+
+// parseRetryAfter 解析 Retry-After 头，支持秒数和 HTTP 日期两种格式，结果不超过 maxRetryAfter
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	var d time.Duration
+	// 超出范围的秒数按最大或最小值处理
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil || stderrors.Is(err, strconv.ErrRange) {
+		if seconds <= 0 {
+			return 0
+		}
+		if seconds >= int64(maxRetryAfter/time.Second) {
+			return maxRetryAfter
+		}
+		d = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(value); err == nil {
+		d = t.Sub(now)
+	}
+	if d <= 0 {
+		return 0
+	}
+	if d > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return d
+}
+
+// backoffDelay 计算第 attempt 次（从1开始）重试前的等待时间
+//
+// 等待时间按 base*2^(attempt-1) 指数增长，不超过 max，并在 [d/2, d] 之间随机抖动，
+// 避免多个规则同时重试造成请求集中
+func backoffDelay(attempt int, base, max time.Duration) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
+
+// failureRetryDelay 返回规则连续第 failures 次更新失败后，重新尝试前的等待时间
+func (ru *RuleUpdater) failureRetryDelay(failures int) time.Duration {
+	rc := ru.cfg.GetRetryConfig()
+	return backoffDelay(failures, rc.FailureRetryBase, rc.FailureRetryMax)
+}
@@ -0,0 +1,245 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestBackoffDelay 检查等待时间按指数增长、不超过上限，并在 [d/2, d] 之间抖动
+func TestBackoffDelay(t *testing.T) {
+	base, max := time.Second, 10*time.Second
+	tests := []struct {
+		attempt int
+		nominal time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		seen := make(map[time.Duration]bool)
+		for i := 0; i < 200; i++ {
+			d := backoffDelay(tt.attempt, base, max)
+			if d < tt.nominal/2 || d > tt.nominal {
+				t.Fatalf("backoffDelay(%d) = %v, 期望在 [%v, %v] 之间", tt.attempt, d, tt.nominal/2, tt.nominal)
+			}
+			seen[d] = true
+		}
+		if len(seen) < 2 {
+			t.Errorf("backoffDelay(%d) 没有抖动", tt.attempt)
+		}
+	}
+
+	if d := backoffDelay(3, 0, max); d != 0 {
+		t.Errorf("初始等待时间为 0 时 backoffDelay = %v, 期望 0", d)
+	}
+	if d := backoffDelay(3, time.Minute, 10*time.Second); d < 5*time.Second || d > 10*time.Second {
+		t.Errorf("初始等待时间超过上限时 backoffDelay = %v, 期望不超过上限", d)
+	}
+}
+
+// TestParseRetryAfter 检查秒数和 HTTP 日期两种格式，过去的时间和无效值不等待，过大的值被截断
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 20, 15, 4, 5, 0, time.UTC)
+	date := func(d time.Duration) string { return now.Add(d).Format(http.TimeFormat) }
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"120", 2 * time.Minute},
+		{" 5 ", 5 * time.Second},
+		{"0", 0},
+		{"-5", 0},
+		{"", 0},
+		{"1.5", 0},
+		{"soon", 0},
+		{date(90 * time.Second), 90 * time.Second},
+		{now.Add(time.Hour).Format(time.RFC850), time.Hour},
+		{date(-time.Minute), 0},
+		{date(0), 0},
+		{"86400", maxRetryAfter},
+		{"999999999999", maxRetryAfter},
+		{"99999999999999999999", maxRetryAfter},
+		{"-99999999999999999999", 0},
+		{date(48 * time.Hour), maxRetryAfter},
+	}
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %v, 期望 %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestIsRetryable 检查网络错误、408/425/429 和 5xx 可以重试，其余 4xx、永久错误和取消不可重试
+func TestIsRetryable(t *testing.T) {
+	status := func(code int) error { return &httpStatusError{code: code} }
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"400", status(http.StatusBadRequest), false},
+		{"403", status(http.StatusForbidden), false},
+		{"404", status(http.StatusNotFound), false},
+		{"410", status(http.StatusGone), false},
+		{"408", status(http.StatusRequestTimeout), true},
+		{"425", status(http.StatusTooEarly), true},
+		{"429", status(http.StatusTooManyRequests), true},
+		{"500", status(http.StatusInternalServerError), true},
+		{"503", status(http.StatusServiceUnavailable), true},
+		{"包装的 404", fmt.Errorf("镜像 a: %w", status(http.StatusNotFound)), false},
+		{"包装的 503", fmt.Errorf("镜像 a: %w", status(http.StatusServiceUnavailable)), true},
+		{"网络错误", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, true},
+		{"超时", context.DeadlineExceeded, true},
+		{"取消", fmt.Errorf("下载: %w", context.Canceled), false},
+		{"永久错误", permanent(errors.New("内容无效")), false},
+		{"包装的永久错误", fmt.Errorf("转换: %w", permanent(errors.New("内容无效"))), false},
+		{"永久的 503", permanent(status(http.StatusServiceUnavailable)), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("%s: isRetryable(%v) = %v, 期望 %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestRetryAfterHonored 检查下载失败后按 Retry-After 等待再重试，要求的等待超过上限时不再等待
+func TestRetryAfterHonored(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var requests atomic.Int32
+	var retryAfter atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.Header().Set("Retry-After", retryAfter.Load().(string))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.RetryConfig = config.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Second}
+	ru := NewRuleUpdater(cfg)
+	provider := config.RuleProvider{Name: "direct", URL: server.URL + "/direct.txt", Type: "domain", Behavior: "domain"}
+	output := filepath.Join(t.TempDir(), "direct.yaml")
+
+	// 服务器要求等待 1 秒，远大于退避时间
+	retryAfter.Store("1")
+	start := time.Now()
+	if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err != nil {
+		t.Fatalf("下载失败: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("重试前只等待了 %v，期望遵循 Retry-After 等待 1s", elapsed)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("请求次数 = %d, 期望 2", n)
+	}
+
+	// 要求的等待超过 MaxDelay 时放弃该镜像，不等待
+	requests.Store(0)
+	retryAfter.Store("120")
+	start = time.Now()
+	_, err := ru.downloadAndProcessRule(context.Background(), provider, filepath.Join(t.TempDir(), "direct.yaml"))
+	if retryAfterOf(err) != 2*time.Minute {
+		t.Errorf("错误 = %v, 期望携带 Retry-After 2m", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Retry-After 超过上限时仍等待了 %v", elapsed)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("请求次数 = %d, 期望 1", n)
+	}
+}
+
+// TestFailureReschedule 检查更新失败后按指数退避提前安排重试，成功后恢复正常调度
+func TestFailureReschedule(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var failing atomic.Bool
+	failing.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	base := 10 * time.Minute
+	cfg := config.DefaultConfig()
+	cfg.RetryConfig = config.RetryConfig{
+		MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: 10 * time.Millisecond,
+		FailureRetryBase: base, FailureRetryMax: time.Hour,
+	}
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "direct", URL: server.URL + "/direct.txt", Type: "domain", Behavior: "domain", Path: "direct.yaml", Enabled: true},
+	}
+	ru := NewRuleUpdater(cfg)
+
+	schedule := func() ProviderSchedule {
+		t.Helper()
+		schedules := ru.GetSchedules()
+		if len(schedules) != 1 {
+			t.Fatalf("调度状态 = %+v", schedules)
+		}
+		return schedules[0]
+	}
+	update := func() time.Time {
+		t.Helper()
+		before := time.Now()
+		if _, err := ru.UpdateProviders(context.Background(), TriggerSchedule, []string{"direct"}); err != nil {
+			t.Fatal(err)
+		}
+		return before
+	}
+
+	// 连续失败时重试间隔翻倍，但不晚于正常调度
+	for failures, nominal := 1, base; failures <= 3; failures, nominal = failures+1, nominal*2 {
+		before := update()
+		s := schedule()
+		if s.Failures != failures {
+			t.Errorf("失败次数 = %d, 期望 %d", s.Failures, failures)
+		}
+		if s.NextRun.Before(before.Add(nominal/2)) || s.NextRun.After(time.Now().Add(nominal)) {
+			t.Errorf("第 %d 次失败后下一次运行 = %v，期望在 %v 到 %v 之后", failures, s.NextRun.Sub(before), nominal/2, nominal)
+		}
+		if due := ru.DueProviders(time.Now()); len(due) != 0 {
+			t.Errorf("失败后立即到期: %v", due)
+		}
+		if due := ru.DueProviders(s.NextRun); len(due) != 1 {
+			t.Errorf("重试时间到达后没有到期: %v", due)
+		}
+	}
+
+	// 成功后清除失败次数，按全局间隔调度
+	failing.Store(false)
+	update()
+	s := schedule()
+	if s.Failures != 0 {
+		t.Errorf("成功后失败次数 = %d", s.Failures)
+	}
+	// cron.Every 按整秒调度
+	if want := s.LastRun.Add(cfg.UpdateInterval); s.NextRun.Sub(want).Abs() > time.Second {
+		t.Errorf("成功后下一次运行 = %v, 期望 %v", s.NextRun, want)
+	}
+}
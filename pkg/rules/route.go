@@ -0,0 +1,110 @@
+package rules
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+)
+
+// 实际使用的下载路径，记录在更新记录中
+const (
+	RouteDirect = "direct" // 直连
+	RouteClash  = "clash"  // 通过 Clash 代理
+)
+
+// SetClashAPI 设置用于获取 Clash 代理端口的 Clash API 客户端
+func (ru *RuleUpdater) SetClashAPI(clashAPI *api.ClashAPI) {
+	ru.routeMutex.Lock()
+	defer ru.routeMutex.Unlock()
+	ru.clashProxy = clashAPI.ProxyURL
+}
+
+// ValidateFetchPolicy 检查规则提供者的下载路径策略是否有效
+func ValidateFetchPolicy(provider config.RuleProvider) error {
+	if err := config.ValidateFetchPolicy(provider.FetchPolicy); err != nil {
+		return err
+	}
+	if provider.FetchPolicy != "" && provider.FetchPolicy != config.FetchDirect &&
+		provider.HTTP != nil && provider.HTTP.Proxy != "" {
+		return fmt.Errorf("设置了代理地址的规则不能通过 Clash 代理下载")
+	}
+	return nil
+}
+
+// fetchRoutes 返回下载路径策略依次尝试的路径
+func fetchRoutes(policy string) []string {
+	switch policy {
+	case config.FetchViaClash:
+		return []string{RouteClash}
+	case config.FetchDirectThenClash:
+		return []string{RouteDirect, RouteClash}
+	case config.FetchClashThenDirect:
+		return []string{RouteClash, RouteDirect}
+	default:
+		return []string{RouteDirect}
+	}
+}
+
+// clashProxyURL 获取 Clash 代理地址
+func (ru *RuleUpdater) clashProxyURL(ctx context.Context) (string, error) {
+	ru.routeMutex.Lock()
+	clashProxy := ru.clashProxy
+	ru.routeMutex.Unlock()
+
+	if clashProxy == nil {
+		return "", fmt.Errorf("未连接 Clash API")
+	}
+	proxyURL, err := clashProxy(ctx)
+	if err != nil {
+		return "", fmt.Errorf("获取 Clash 代理端口失败: %v", err)
+	}
+	return proxyURL, nil
+}
+
+// fetchRemote 按下载路径策略下载远程规则，前一条路径失败时尝试下一条
+//
+// 规则自身的代理设置（或环境变量中的代理）属于直连路径；通过 Clash 下载时使用 Clash 的代理端口。
+// originOnly 为 true 时只从原始地址下载，不使用任何镜像
+func (ru *RuleUpdater) fetchRemote(ctx context.Context, provider config.RuleProvider, prevState providerState, hasState, originOnly bool) (*mirrorResponse, error) {
+	routes := fetchRoutes(ru.cfg.GetFetchPolicy(provider))
+
+	var lastErr error
+	for i, route := range routes {
+		if i > 0 {
+			logger.Warnf("规则 %s 通过 %s 下载失败，改为通过 %s 下载: %v", provider.Name, routes[i-1], route, lastErr)
+		}
+
+		routed := provider
+		if route == RouteClash {
+			proxyURL, err := ru.clashProxyURL(ctx)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			opts := config.HTTPOptions{}
+			if provider.HTTP != nil {
+				opts = *provider.HTTP
+			}
+			opts.Proxy = proxyURL
+			routed.HTTP = &opts
+		}
+
+		resp, err := ru.fetchRule(ctx, routed, prevState, hasState, originOnly)
+		if err == nil {
+			resp.route = route
+			return resp, nil
+		}
+		lastErr = err
+
+		// 被取消或内容超过大小限制时换一条路径也没有意义
+		var sizeErr *SizeLimitError
+		if ctx.Err() != nil || stderrors.As(err, &sizeErr) {
+			break
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,125 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestFetchPolicy 检查按下载路径策略直连或通过 Clash 代理下载，并记录实际使用的路径
+func TestFetchPolicy(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	content := "example.com\nexample.org\n"
+
+	// 直连无法访问的地址
+	blocked := httptest.NewServer(http.NotFoundHandler())
+	blockedURL := blocked.URL + "/direct.txt"
+	blocked.Close()
+
+	direct := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer direct.Close()
+
+	// Clash 代理收到完整地址，模拟可以访问直连失败的地址
+	clashProxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer clashProxy.Close()
+	proxyPort := clashProxy.Listener.Addr().(*net.TCPAddr).Port
+
+	// Clash API 的 /configs 返回代理端口
+	clashAPI := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"mode":"rule","port":0,"socks-port":7891,"mixed-port":%d}`, proxyPort)
+	}))
+	defer clashAPI.Close()
+
+	tests := []struct {
+		name    string
+		url     string
+		policy  string
+		noClash bool
+		route   string // 为空时期望失败
+	}{
+		{"直连", direct.URL + "/direct.txt", config.FetchDirect, false, RouteDirect},
+		{"直连失败", blockedURL, "", false, ""},
+		{"通过 Clash", blockedURL, config.FetchViaClash, false, RouteClash},
+		{"直连失败后通过 Clash", blockedURL, config.FetchDirectThenClash, false, RouteClash},
+		{"优先通过 Clash", direct.URL + "/direct.txt", config.FetchClashThenDirect, false, RouteClash},
+		{"Clash 不可用时直连", direct.URL + "/direct.txt", config.FetchClashThenDirect, true, RouteDirect},
+		{"Clash 不可用", blockedURL, config.FetchViaClash, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.RetryConfig.MaxAttempts = 1
+			ru := NewRuleUpdater(cfg)
+			if !tt.noClash {
+				ru.SetClashAPI(api.NewClashAPI(clashAPI.URL, ""))
+			}
+
+			provider := config.RuleProvider{Name: "direct", URL: tt.url, Type: "domain", Behavior: "domain", FetchPolicy: tt.policy}
+			if err := ValidateFetchPolicy(provider); err != nil {
+				t.Fatal(err)
+			}
+			result, err := ru.downloadAndProcessRule(context.Background(), provider, filepath.Join(t.TempDir(), "direct.yaml"))
+			if tt.route == "" {
+				if err == nil {
+					t.Fatal("期望下载失败")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("downloadAndProcessRule() = %v", err)
+			}
+			if result.route != tt.route {
+				t.Errorf("下载路径 = %q, 期望 %q", result.route, tt.route)
+			}
+		})
+	}
+}
+
+// TestValidateFetchPolicy 检查无效的下载路径策略
+func TestValidateFetchPolicy(t *testing.T) {
+	proxy := &config.HTTPOptions{Proxy: "http://127.0.0.1:8080"}
+	tests := []struct {
+		provider config.RuleProvider
+		valid    bool
+	}{
+		{config.RuleProvider{FetchPolicy: "via-clash"}, true},
+		{config.RuleProvider{FetchPolicy: "direct", HTTP: proxy}, true},
+		{config.RuleProvider{FetchPolicy: "proxy"}, false},
+		{config.RuleProvider{FetchPolicy: "direct-then-clash", HTTP: proxy}, false},
+	}
+	for _, tt := range tests {
+		if err := ValidateFetchPolicy(tt.provider); (err == nil) != tt.valid {
+			t.Errorf("ValidateFetchPolicy(%q) = %v", tt.provider.FetchPolicy, err)
+		}
+	}
+
+	// 混合端口优先，其次是 HTTP 端口和 SOCKS5 端口
+	for _, c := range []struct {
+		cfg  api.ClashConfig
+		want string
+	}{
+		{api.ClashConfig{MixedPort: 7890, Port: 7891, SocksPort: 7892}, "http://127.0.0.1:7890"},
+		{api.ClashConfig{Port: 7891, SocksPort: 7892}, "http://127.0.0.1:7891"},
+		{api.ClashConfig{SocksPort: 7892}, "socks5h://127.0.0.1:7892"},
+	} {
+		if got, _ := c.cfg.ProxyURL("127.0.0.1"); got != c.want {
+			t.Errorf("ProxyURL() = %q, 期望 %q", got, c.want)
+		}
+	}
+}
@@ -1,12 +1,17 @@
 package rules
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	stderrors "errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -26,19 +31,40 @@ type RuleUpdater struct {
 	mutex         sync.RWMutex
 	// 添加HTTP客户端，避免每次创建新的
 	client *http.Client
-}
-
-// UpdateRecord 记录规则更新历史
-type UpdateRecord struct {
-	Time      time.Time        `json:"time"`
-	Providers []ProviderRecord `json:"providers"`
-}
-
-// ProviderRecord 记录单个规则提供者的更新情况
-type ProviderRecord struct {
-	Name    string `json:"name"`
-	Success bool   `json:"success"`
-	Message string `json:"message"`
+	// 按 TLS 和代理设置缓存的 Transport，以及每个规则提供者当前使用的设置
+	transports     map[string]*http.Transport
+	transportKeys  map[string]string
+	transportMutex sync.Mutex
+	// 获取 Clash 代理地址，未设置 Clash API 时为 nil
+	clashProxy func(ctx context.Context) (string, error)
+	routeMutex sync.Mutex
+	// 每个规则提供者的校验信息，用于条件请求
+	states     map[string]providerState
+	stateMutex sync.Mutex
+	// 镜像健康统计
+	mirrorHealth *mirrorHealthStore
+	// 取消当前正在进行的更新
+	cancelCurrent context.CancelFunc
+	cancelMutex   sync.Mutex
+	// 连续失败次数和失败后的提前重试时间
+	failures      map[string]int
+	retryAt       map[string]time.Time
+	scheduleMutex sync.Mutex
+	// 本地规则来源最近一次实际完成更新时的指纹，用于发现文件变化
+	localFingerprints map[string]string
+	watchMutex        sync.Mutex
+	// 已写入但尚未被 Clash 成功加载的规则文件（名称 -> 路径）
+	pendingFiles map[string]string
+	backupMutex  sync.Mutex
+	// 保护规则历史版本索引
+	versionMutex sync.Mutex
+	// 持久化的更新历史
+	history *historyStore
+	// 规则查询使用的内存匹配器，规则文件变化后重建
+	matcher      *ruleMatcher
+	matcherMutex sync.Mutex
+	// 预设目录的加载状态
+	catalogs *catalogStore
 }
 
 // NewRuleUpdater 创建一个新的规则更新器
@@ -73,10 +99,23 @@ func NewRuleUpdater(cfg *config.Config) *RuleUpdater {
 		},
 	}
 
+	history := openHistoryStore(cfg)
+
 	return &RuleUpdater{
 		cfg:           cfg,
-		updateHistory: []UpdateRecord{},
+		updateHistory: history.recent(recentHistorySize),
+		history:       history,
 		client:        client,
+		transports:    make(map[string]*http.Transport),
+		transportKeys: make(map[string]string),
+		states:        loadProviderStates(),
+		mirrorHealth:  loadMirrorHealth(),
+		catalogs:      loadCatalogStore(),
+		failures:      make(map[string]int),
+		retryAt:       make(map[string]time.Time),
+
+		localFingerprints: make(map[string]string),
+		pendingFiles:      make(map[string]string),
 	}
 }
 
@@ -91,119 +130,150 @@ func (ru *RuleUpdater) GetUpdateHistory() []UpdateRecord {
 	return history
 }
 
-// UpdateAllRules 更新所有规则
-func (ru *RuleUpdater) UpdateAllRules() (bool, error) {
+// UpdateAllRules 更新所有规则，返回本次更新中每个规则提供者的结果
+//
+// ctx 被取消时会中止所有下载和重试，已有的规则文件保持不变
+func (ru *RuleUpdater) UpdateAllRules(ctx context.Context, trigger Trigger) (UpdateRecord, error) {
+	logger.Info("开始更新所有规则...")
+	return ru.updateProviders(ctx, trigger, nil)
+}
+
+// UpdateProviders 只更新指定名称的规则提供者，用于失败后重新尝试
+//
+// 未指定的规则提供者保持原样，但其现有规则仍会参与CFW绕过配置的同步
+func (ru *RuleUpdater) UpdateProviders(ctx context.Context, trigger Trigger, names []string) (UpdateRecord, error) {
+	only := make(map[string]bool, len(names))
+	for _, name := range names {
+		only[name] = true
+	}
+	logger.Infof("开始更新规则: %s", strings.Join(names, ", "))
+	return ru.updateProviders(ctx, trigger, only)
+}
+
+// updateProviders 更新规则提供者，only 为 nil 时更新全部
+func (ru *RuleUpdater) updateProviders(ctx context.Context, trigger Trigger, only map[string]bool) (UpdateRecord, error) {
 	ru.mutex.Lock()
 	defer ru.mutex.Unlock()
 
-	logger.Info("开始更新所有规则...")
+	ctx, cancel := ru.beginRun(ctx)
+	defer ru.endRun(cancel)
 
 	// 创建一个新的更新记录
 	record := UpdateRecord{
 		Time:      time.Now(),
+		Trigger:   trigger,
 		Providers: []ProviderRecord{},
 	}
 
 	// 创建规则目录
 	rulesDir := ru.getRulesDir()
 	if err := utils.EnsureDirExists(rulesDir); err != nil {
-		return false, fmt.Errorf("创建规则目录失败: %v", err)
+		return record, fmt.Errorf("创建规则目录失败: %v", err)
 	}
 
-	allSuccess := true
+	// 用于收集参与同步的规则文件，同步时逐个读取，不同时保存所有规则内容
+	bypassFiles := make(map[string]string)
 
-	// 用于收集所有规则内容
-	var allRuleContents []string
-
-	// 并行下载规则
-	var wg sync.WaitGroup
+	// 组合规则需要在输入规则之后更新，存在循环引用时组合规则全部失败
+	levels, cycleErr := compositeLevels(ru.cfg.RuleProviders)
+	if cycleErr != nil {
+		logger.Errorf("计算组合规则的依赖顺序失败: %v", cycleErr)
+	}
 
-	// 使用channel传递结果
-	type ruleResult struct {
-		provider    config.RuleProvider
-		record      ProviderRecord
-		ruleContent string
+	// 输入规则更新后，引用它们的组合规则也要重新生成
+	if only != nil {
+		only = withDependents(ru.cfg.RuleProviders, only)
 	}
-	resultChan := make(chan ruleResult, len(ru.cfg.RuleProviders))
 
-	// 遍历所有规则提供者
-	for _, provider := range ru.cfg.RuleProviders {
-		if !provider.Enabled {
+	// 按依赖层级分批，同一批内的规则并行更新
+	var batches [][]config.RuleProvider
+
+	// 按排列顺序遍历所有规则提供者
+	ordered := config.OrderedProviders(ru.cfg.RuleProviders)
+	for _, provider := range ordered {
+		// 不在本次更新范围内的规则，沿用现有文件参与同步
+		if only != nil && !only[provider.Name] {
+			if path := filepath.Join(rulesDir, provider.Path); provider.Enabled && utils.FileExists(path) {
+				bypassFiles[provider.Name] = path
+			}
 			continue
 		}
 
-		wg.Add(1)
-		go func(provider config.RuleProvider) {
-			defer wg.Done()
-
-			logger.Infof("更新规则: %s", provider.Name)
+		if !provider.Enabled {
+			skipped := ProviderRecord{Name: provider.Name}
+			skipped.setStatus(StatusSkipped, "规则提供者已禁用")
+			record.Providers = append(record.Providers, skipped)
+			continue
+		}
 
-			providerRecord := ProviderRecord{
-				Name:    provider.Name,
-				Success: false,
-				Message: "",
+		// 固定到历史版本的规则不更新，沿用现有文件参与同步
+		if provider.Pinned != "" {
+			pinned := ProviderRecord{Name: provider.Name}
+			pinned.setStatus(StatusSkipped, fmt.Sprintf("已固定到版本 %s", provider.Pinned))
+			record.Providers = append(record.Providers, pinned)
+			if path := filepath.Join(rulesDir, provider.Path); utils.FileExists(path) {
+				bypassFiles[provider.Name] = path
 			}
+			continue
+		}
 
-			// 下载并处理规则
-			ruleFilePath := filepath.Join(rulesDir, provider.Path)
-
-			var ruleContent string
-			err := ru.downloadAndProcessRule(provider, ruleFilePath)
-			if err != nil {
-				logger.Errorf("更新规则 %s 失败: %v", provider.Name, err)
-				providerRecord.Message = err.Error()
-				resultChan <- ruleResult{provider, providerRecord, ""}
-				return
-			}
+		if cycleErr != nil && provider.SourceKind() == config.SourceComposite {
+			failed := ProviderRecord{Name: provider.Name}
+			failed.setStatus(StatusFailed, cycleErr.Error())
+			record.Providers = append(record.Providers, failed)
+			continue
+		}
 
-			logger.Infof("规则 %s 更新成功", provider.Name)
-			providerRecord.Success = true
-			providerRecord.Message = "更新成功"
+		batches = appendToLevel(batches, levels[provider.Name], provider)
+	}
 
-			// 读取所有规则文件内容
-			content, err := os.ReadFile(ruleFilePath)
-			if err == nil {
-				ruleContent = string(content)
-				logger.Infof("已添加规则 %s 到规则列表，规则大小: %d", provider.Name, len(content))
-			} else {
-				logger.Errorf("读取规则文件 %s 失败: %v", ruleFilePath, err)
+	// 上一批全部完成后再更新下一批，组合规则读取的是输入规则本次更新后的文件
+	for _, batch := range batches {
+		for _, result := range ru.updateBatch(ctx, batch, rulesDir) {
+			record.Providers = append(record.Providers, result.record)
+			if result.path != "" {
+				bypassFiles[result.record.Name] = result.path
 			}
-
-			resultChan <- ruleResult{provider, providerRecord, ruleContent}
-		}(provider)
+		}
 	}
 
-	// 等待所有下载完成
-	go func() {
-		wg.Wait()
-		close(resultChan)
-	}()
-
-	// 收集结果
-	for result := range resultChan {
-		record.Providers = append(record.Providers, result.record)
-		if !result.record.Success {
-			allSuccess = false
-		}
-		if result.ruleContent != "" {
-			allRuleContents = append(allRuleContents, result.ruleContent)
+	// 更新记录和绕过配置都按排列顺序，未变化的规则重新更新时得到相同的结果
+	sortRecords(record.Providers, config.ProviderRanks(ordered))
+	var bypassPaths []string
+	for _, provider := range ordered {
+		if path, ok := bypassFiles[provider.Name]; ok {
+			bypassPaths = append(bypassPaths, path)
 		}
 	}
 
-	// 更新最后一次更新时间
-	ru.cfg.UpdateLastUpdateTime()
+	// 保存校验信息和镜像统计
+	ru.persistStates()
+	ru.mirrorHealth.save()
+
+	// 重建规则查询索引
+	ru.refreshMatcher()
 
 	// 将记录添加到更新历史
-	ru.updateHistory = append(ru.updateHistory, record)
-	if len(ru.updateHistory) > 10 {
-		ru.updateHistory = ru.updateHistory[len(ru.updateHistory)-10:]
+	ru.noteUnverified(&record)
+	ru.appendUpdateHistory(record)
+
+	// 更新被取消时不同步绕过配置，也不推进最后更新时间
+	if err := ctx.Err(); err != nil {
+		logger.Warn("规则更新已取消")
+		return record, errors.Wrap(err, "规则更新已取消")
 	}
 
-	// 无条件同步所有规则
-	if len(allRuleContents) > 0 {
-		combinedRules := strings.Join(allRuleContents, "\n")
-		logger.Infof("同步所有规则到CFW绕过配置，规则总数: %d", len(allRuleContents))
-		err := api.SyncBypassRulesFromDomainList(combinedRules)
+	// 更新最后一次更新时间
+	ru.cfg.UpdateLastUpdateTime()
+
+	// 仅在有规则发生变化时同步所有规则
+	if !record.HasChanges() {
+		logger.Info("所有规则均无变化，跳过同步CFW绕过配置")
+	} else if len(bypassPaths) > 0 {
+		stats, err := ru.syncBypass(bypassPaths)
+		record.Bypass = &stats
+		logger.Infof("同步所有规则到CFW绕过配置，规则总数: %d，移除 %d 条重复条目、%d 条已被后缀覆盖的域名，合并网段减少 %d 条",
+			len(bypassPaths), stats.Duplicates, stats.Covered, stats.Merged)
 		if err != nil {
 			logger.Errorf("同步规则到CFW绕过配置失败: %v", err)
 		} else {
@@ -211,16 +281,70 @@ func (ru *RuleUpdater) UpdateAllRules() (bool, error) {
 		}
 	}
 
-	logger.Info("规则更新完成")
+	counts := record.CountByStatus()
+	logger.Infof("规则更新完成: %d 个变化, %d 个未变化, %d 个失败, %d 个跳过",
+		counts[StatusChanged], counts[StatusUnchanged], counts[StatusFailed], counts[StatusSkipped])
 
-	return allSuccess, nil
+	return record, nil
+}
+
+// batchResult 表示一批更新中单个规则提供者的结果
+type batchResult struct {
+	record ProviderRecord
+	path   string // 更新成功时参与同步的规则文件
+}
+
+// sortRecords 按规则提供者的排序位置排列更新记录
+func sortRecords(records []ProviderRecord, ranks map[string]int) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return ranks[records[i].Name] < ranks[records[j].Name]
+	})
+}
+
+// updateBatch 并行更新一批规则提供者，结果与 batch 的顺序一致，调用方需持有 ru.mutex
+func (ru *RuleUpdater) updateBatch(ctx context.Context, batch []config.RuleProvider, rulesDir string) []batchResult {
+	// 并行下载规则
+	var wg sync.WaitGroup
+
+	// 每个规则写入自己的位置，结果不受完成先后的影响
+	results := make([]batchResult, len(batch))
+
+	for i, provider := range batch {
+		wg.Add(1)
+		go func(i int, provider config.RuleProvider) {
+			defer wg.Done()
+
+			ruleFilePath := filepath.Join(rulesDir, provider.Path)
+			providerRecord := ru.updateProvider(ctx, provider, ruleFilePath)
+
+			// 收集所有成功的规则文件
+			var path string
+			if providerRecord.Success {
+				if info, err := os.Stat(ruleFilePath); err == nil {
+					path = ruleFilePath
+					logger.Infof("已添加规则 %s 到规则列表，规则大小: %d", provider.Name, info.Size())
+				} else {
+					logger.Errorf("读取规则文件 %s 失败: %v", ruleFilePath, err)
+				}
+			}
+
+			results[i] = batchResult{providerRecord, path}
+		}(i, provider)
+	}
+
+	// 等待所有下载完成
+	wg.Wait()
+	return results
 }
 
 // UpdateRuleProvider 更新单个规则提供者
-func (ru *RuleUpdater) UpdateRuleProvider(providerName string) (bool, error) {
+func (ru *RuleUpdater) UpdateRuleProvider(ctx context.Context, trigger Trigger, providerName string) (ProviderRecord, error) {
 	ru.mutex.Lock()
 	defer ru.mutex.Unlock()
 
+	ctx, cancel := ru.beginRun(ctx)
+	defer ru.endRun(cancel)
+
 	// 查找指定的规则提供者
 	var provider *config.RuleProvider
 	for i := range ru.cfg.RuleProviders {
@@ -231,96 +355,226 @@ func (ru *RuleUpdater) UpdateRuleProvider(providerName string) (bool, error) {
 	}
 
 	if provider == nil {
-		return false, fmt.Errorf("未找到规则提供者: %s", providerName)
+		return ProviderRecord{}, fmt.Errorf("未找到规则提供者: %s", providerName)
 	}
 
 	if !provider.Enabled {
-		return false, fmt.Errorf("规则提供者已禁用: %s", providerName)
+		skipped := ProviderRecord{Name: provider.Name}
+		skipped.setStatus(StatusSkipped, "规则提供者已禁用")
+		return skipped, fmt.Errorf("规则提供者已禁用: %s", providerName)
 	}
 
-	logger.Infof("更新规则: %s", provider.Name)
+	if provider.Pinned != "" {
+		skipped := ProviderRecord{Name: provider.Name}
+		skipped.setStatus(StatusSkipped, fmt.Sprintf("已固定到版本 %s", provider.Pinned))
+		return skipped, fmt.Errorf("规则提供者 %s 已固定到版本 %s", providerName, provider.Pinned)
+	}
 
 	// 创建规则目录
 	rulesDir := ru.getRulesDir()
 	if err := utils.EnsureDirExists(rulesDir); err != nil {
-		return false, fmt.Errorf("创建规则目录失败: %v", err)
+		return ProviderRecord{}, fmt.Errorf("创建规则目录失败: %v", err)
 	}
 
 	// 下载并处理规则
 	ruleFilePath := filepath.Join(rulesDir, provider.Path)
-	err := ru.downloadAndProcessRule(*provider, ruleFilePath)
-	if err != nil {
-		// 记录更新历史
-		ru.recordUpdateHistory(provider.Name, false, err.Error())
-		return false, err
+	providerRecord := ru.updateProvider(ctx, *provider, ruleFilePath)
+	records := []ProviderRecord{providerRecord}
+
+	// 内容有变化时重新生成引用该规则的组合规则
+	if providerRecord.Changed {
+		records = append(records, ru.updateDependents(ctx, provider.Name, rulesDir)...)
+	}
+
+	ru.persistStates()
+	ru.mirrorHealth.save()
+	ru.refreshMatcher()
+
+	// 记录更新历史
+	record := UpdateRecord{
+		Time:      time.Now(),
+		Trigger:   trigger,
+		Providers: records,
 	}
+	ru.noteUnverified(&record)
+	ru.appendUpdateHistory(record)
 
-	// 如果这是直连域名规则，同步到CFW的绕过配置
-	if (provider.Name == "cn_domain" || strings.Contains(provider.Name, "direct")) &&
+	if providerRecord.Status == StatusFailed {
+		return providerRecord, errors.New(providerRecord.Message)
+	}
+
+	// 如果这是直连域名规则且内容有变化，同步到CFW的绕过配置
+	if providerRecord.Changed &&
+		(provider.Name == "cn_domain" || strings.Contains(provider.Name, "direct")) &&
 		(provider.Type == "domain" || provider.Type == "mixed") {
-		// 读取规则文件内容
-		ruleContent, err := os.ReadFile(ruleFilePath)
-		if err == nil {
-			// 尝试同步到CFW绕过配置
-			err := api.SyncBypassRulesFromDomainList(string(ruleContent))
-			if err != nil {
-				logger.Errorf("同步直连规则到CFW绕过配置失败: %v", err)
-			} else {
-				logger.Info("成功将直连规则同步到CFW绕过配置")
-			}
+		// 逐行读取规则文件并同步到CFW绕过配置
+		err := api.SyncBypassRulesFromFile(ruleFilePath, ru.BypassOverrides())
+		if err != nil {
+			logger.Errorf("同步直连规则到CFW绕过配置失败: %v", err)
+		} else {
+			logger.Info("成功将直连规则同步到CFW绕过配置")
 		}
 	}
 
-	// 记录更新历史
-	ru.recordUpdateHistory(provider.Name, true, "更新成功")
-
-	return true, nil
+	return providerRecord, nil
 }
 
-// recordUpdateHistory 记录单个规则的更新历史
-func (ru *RuleUpdater) recordUpdateHistory(name string, success bool, message string) {
-	// 查找最新的记录
-	var record *UpdateRecord
-	if len(ru.updateHistory) > 0 {
-		// 如果最新记录不到1分钟，则更新该记录
-		latestRecord := &ru.updateHistory[len(ru.updateHistory)-1]
-		if time.Since(latestRecord.Time) < time.Minute {
-			record = latestRecord
-		}
+// updateDependents 按依赖顺序重新生成引用了 name 的组合规则，调用方需持有 ru.mutex
+func (ru *RuleUpdater) updateDependents(ctx context.Context, name string, rulesDir string) []ProviderRecord {
+	dependents := withDependents(ru.cfg.RuleProviders, map[string]bool{name: true})
+	if len(dependents) == 1 {
+		return nil
+	}
+	levels, err := compositeLevels(ru.cfg.RuleProviders)
+	if err != nil {
+		logger.Errorf("计算组合规则的依赖顺序失败: %v", err)
+		return nil
 	}
 
-	// 如果没有合适的记录，创建新记录
-	if record == nil {
-		newRecord := UpdateRecord{
-			Time:      time.Now(),
-			Providers: []ProviderRecord{},
+	var batches [][]config.RuleProvider
+	for _, provider := range config.OrderedProviders(ru.cfg.RuleProviders) {
+		if provider.Name == name || !dependents[provider.Name] || !provider.Enabled || provider.Pinned != "" {
+			continue
 		}
-		ru.updateHistory = append(ru.updateHistory, newRecord)
-		record = &ru.updateHistory[len(ru.updateHistory)-1]
+		batches = appendToLevel(batches, levels[provider.Name], provider)
+	}
 
-		// 限制历史记录数量
-		if len(ru.updateHistory) > 10 {
-			ru.updateHistory = ru.updateHistory[len(ru.updateHistory)-10:]
+	var records []ProviderRecord
+	for _, batch := range batches {
+		for _, result := range ru.updateBatch(ctx, batch, rulesDir) {
+			records = append(records, result.record)
 		}
 	}
+	return records
+}
 
-	// 添加或更新提供者记录
+// updateProvider 更新单个规则提供者并生成更新记录，调用方需持有 ru.mutex
+func (ru *RuleUpdater) updateProvider(ctx context.Context, provider config.RuleProvider, ruleFilePath string) ProviderRecord {
+	logger.Infof("更新规则: %s", provider.Name)
+
+	startTime := time.Now()
 	providerRecord := ProviderRecord{
-		Name:    name,
-		Success: success,
-		Message: message,
+		Name:          provider.Name,
+		EntriesBefore: countRuleEntries(ruleFilePath),
+	}
+
+	// 在读取之前计算本地来源的指纹，读取期间发生的变化会在下一次检查时发现
+	fingerprint, local := localWatchFingerprint(provider)
+
+	result, err := ru.downloadAndProcessRule(ctx, provider, ruleFilePath)
+	providerRecord.BytesDownloaded = result.bytes
+	providerRecord.Mirror = result.mirror
+	providerRecord.Route = result.route
+	providerRecord.Format = result.format
+	providerRecord.Verified = result.verified
+	providerRecord.InvalidEntries = result.invalid
+	providerRecord.InvalidSamples = result.samples
+	providerRecord.Filtered = result.filtered
+	providerRecord.OverrideExcluded = result.excluded
+	providerRecord.OverrideIncluded = result.included
+	if result.optimize.Removed() > 0 {
+		providerRecord.Optimized = &result.optimize
 	}
+	providerRecord.DurationMs = time.Since(startTime).Milliseconds()
 
-	// 检查是否已存在此提供者的记录
-	for i, pr := range record.Providers {
-		if pr.Name == name {
-			record.Providers[i] = providerRecord
-			return
+	if err != nil {
+		logger.Errorf("更新规则 %s 失败: %v", provider.Name, err)
+		providerRecord.setStatus(StatusFailed, err.Error())
+		var payloadErr *PayloadError
+		if stderrors.As(err, &payloadErr) {
+			providerRecord.ErrorLine = payloadErr.Line
+			providerRecord.ErrorColumn = payloadErr.Column
+		}
+		var validationErr *ValidationError
+		if stderrors.As(err, &validationErr) {
+			providerRecord.InvalidEntries = validationErr.Invalid
+			providerRecord.InvalidSamples = validationErr.Samples
+		}
+		providerRecord.EntriesAfter = providerRecord.EntriesBefore
+		// 被取消的更新不计入失败次数，本地来源的变化留到下一次检查
+		if ctx.Err() == nil {
+			ru.recordOutcome(providerRecord, time.Now())
+			if local {
+				ru.markLocalHandled(provider.Name, fingerprint)
+			}
 		}
+		return providerRecord
+	}
+
+	if result.changed {
+		logger.Infof("规则 %s 更新成功", provider.Name)
+		providerRecord.setStatus(StatusChanged, "更新成功")
+	} else {
+		logger.Infof("规则 %s 已是最新，无需更新", provider.Name)
+		providerRecord.setStatus(StatusUnchanged, "已是最新")
+	}
+	providerRecord.EntriesAfter = countRuleEntries(ruleFilePath)
+	ru.recordOutcome(providerRecord, time.Now())
+	if local {
+		ru.markLocalHandled(provider.Name, fingerprint)
+	}
+
+	return providerRecord
+}
+
+// appendUpdateHistory 添加一条更新记录并持久化，内存中只保留最近的记录，调用方需持有 ru.mutex
+func (ru *RuleUpdater) appendUpdateHistory(record UpdateRecord) {
+	ru.history.append(record)
+
+	ru.updateHistory = append(ru.updateHistory, record)
+	if len(ru.updateHistory) > recentHistorySize {
+		ru.updateHistory = ru.updateHistory[len(ru.updateHistory)-recentHistorySize:]
+	}
+}
+
+// beginRun 为本次更新创建可取消的上下文，调用方需持有 ru.mutex
+func (ru *RuleUpdater) beginRun(ctx context.Context) (context.Context, context.CancelFunc) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	ru.cancelMutex.Lock()
+	ru.cancelCurrent = cancel
+	ru.cancelMutex.Unlock()
+
+	return ctx, cancel
+}
+
+// endRun 结束本次更新并释放上下文
+func (ru *RuleUpdater) endRun(cancel context.CancelFunc) {
+	ru.cancelMutex.Lock()
+	ru.cancelCurrent = nil
+	ru.cancelMutex.Unlock()
+
+	cancel()
+}
+
+// CancelUpdate 取消正在进行的规则更新，没有进行中的更新时返回false
+func (ru *RuleUpdater) CancelUpdate() bool {
+	ru.cancelMutex.Lock()
+	defer ru.cancelMutex.Unlock()
+
+	if ru.cancelCurrent == nil {
+		return false
 	}
 
-	// 不存在则添加新记录
-	record.Providers = append(record.Providers, providerRecord)
+	logger.Info("正在取消规则更新...")
+	ru.cancelCurrent()
+	return true
+}
+
+// sleepContext 等待指定时间，ctx 被取消时提前返回错误
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // getRulesDir 获取规则目录
@@ -330,256 +584,395 @@ func (ru *RuleUpdater) getRulesDir() string {
 	return filepath.Join(configDir, "rules")
 }
 
-// 生成备用URL的函数
-func generateBackupUrls(originalUrl string) []string {
-	// 存储原URL和所有备用URL
-	urls := []string{originalUrl}
-	
-	// 如果是jsdelivr的URL，添加备用CDN
-	if strings.Contains(originalUrl, "cdn.jsdelivr.net") {
-		// 替换为fastgit镜像
-		fastgitUrl := strings.Replace(originalUrl, "cdn.jsdelivr.net/gh", "raw.fastgit.org", 1)
-		urls = append(urls, fastgitUrl)
-		
-		// 替换为jsdelivr的备用域名
-		backupJsdelivrUrl := strings.Replace(originalUrl, "cdn.jsdelivr.net", "fastly.jsdelivr.net", 1)
-		urls = append(urls, backupJsdelivrUrl)
-		
-		// 替换为GitHub直接链接
-		if strings.Contains(originalUrl, "cdn.jsdelivr.net/gh/") {
-			// 提取用户/仓库/分支部分
-			parts := strings.Split(originalUrl, "cdn.jsdelivr.net/gh/")[1]
-			githubUrl := "https://raw.githubusercontent.com/" + parts
-			urls = append(urls, githubUrl)
+// fetchResult 记录一次规则下载的结果
+type fetchResult struct {
+	changed  bool
+	bytes    int64
+	mirror   string
+	route    string // 实际使用的下载路径
+	format   string
+	invalid  int      // 无效条目数量
+	samples  []string // 无效条目示例
+	filtered int      // 被转换步骤去掉的行
+	excluded int      // 被覆盖条目排除的条目
+	included int      // 强制加入的条目
+	optimize OptimizeStats
+	verified []string
+}
+
+// mirrorResponse 表示从某个镜像获取到的有效响应
+type mirrorResponse struct {
+	candidate   mirrorCandidate
+	body        *ruleBody // 内容未修改时为 nil
+	route       string    // 实际使用的下载路径，本地来源为空
+	notModified bool
+	etag        string
+	lastMod     string
+}
+
+// fetchFromMirror 从单个镜像下载规则内容，并记录镜像统计
+func (ru *RuleUpdater) fetchFromMirror(ctx context.Context, provider config.RuleProvider, candidate mirrorCandidate, prevState providerState, hasState bool) (*mirrorResponse, error) {
+	startTime := time.Now()
+
+	resp, err := ru.doFetch(ctx, provider, candidate, prevState, hasState)
+	if err != nil {
+		// 竞速中被取消的请求不计入镜像失败
+		if ctx.Err() == nil {
+			ru.mirrorHealth.recordFailure(candidate.name, err)
 		}
+		return nil, err
 	}
-	
-	return urls
+
+	ru.mirrorHealth.recordSuccess(candidate.name, time.Since(startTime))
+	return resp, nil
 }
 
-// downloadAndProcessRule 下载并处理规则
-func (ru *RuleUpdater) downloadAndProcessRule(provider config.RuleProvider, outputPath string) error {
-	// 确保输出目录存在
-	outputDir := filepath.Dir(outputPath)
-	if err := utils.EnsureDirExists(outputDir); err != nil {
-		return errors.Wrap(err, "创建输出目录失败")
+// doFetch 发送一次HTTP请求，将响应内容写入临时文件并校验
+func (ru *RuleUpdater) doFetch(ctx context.Context, provider config.RuleProvider, candidate mirrorCandidate, prevState providerState, hasState bool) (*mirrorResponse, error) {
+	limit := ru.maxRuleSize(provider)
+	client, err := ru.httpClient(provider)
+	if err != nil {
+		return nil, err
 	}
-	
-	// 生成主URL和所有备用URL
-	urls := generateBackupUrls(provider.URL)
-	
-	// 设置重试参数
-	maxRetries := 3
-	retryDelay := 3 * time.Second
-	var lastErr error
-	
-	// 为每个URL尝试下载
-	for urlIndex, currentUrl := range urls {
-		logger.Infof("尝试从源 #%d (%s) 下载规则 %s", urlIndex+1, currentUrl, provider.Name)
-		
-		// 对每个URL进行多次重试
-		for attempt := 1; attempt <= maxRetries; attempt++ {
-			// 创建一个特定的HTTP请求，设置更多选项
-			req, err := http.NewRequest("GET", currentUrl, nil)
+
+	// 创建一个特定的HTTP请求，设置更多选项
+	req, err := http.NewRequestWithContext(ctx, "GET", candidate.url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "创建HTTP请求失败")
+	}
+
+	// 设置UA和一些头部，有助于绕过某些限制；自定义请求头和认证信息不发送给镜像
+	req.Header.Set("Accept", "text/plain,text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+	req.Header.Set("Connection", "close") // 禁用keep-alive，减少EOF风险
+	setRequestOptions(req, provider.HTTP, candidate.url == provider.URL)
+
+	// 校验信息只对产生它的URL有效
+	if hasState && prevState.URL == candidate.url {
+		if prevState.ETag != "" {
+			req.Header.Set("If-None-Match", prevState.ETag)
+		}
+		if prevState.LastModified != "" {
+			req.Header.Set("If-Modified-Since", prevState.LastModified)
+		}
+	}
+
+	// 使用客户端有超时设置的Do方法发送请求
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// 服务器确认内容未变化
+	if resp.StatusCode == http.StatusNotModified {
+		return &mirrorResponse{candidate: candidate, notModified: true}, nil
+	}
+
+	// 检查响应状态
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpStatusError{
+			code:       resp.StatusCode,
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+
+	// 服务器声明的长度已超过限制时不必下载
+	if limit > 0 && resp.ContentLength > limit {
+		return nil, permanent(&SizeLimitError{Limit: limit})
+	}
+
+	// 边下载边写入临时文件，不把整个响应读入内存
+	body, err := spoolBody(resp.Body, limit)
+	if err != nil {
+		var sizeErr *SizeLimitError
+		if stderrors.As(err, &sizeErr) {
+			return nil, permanent(err)
+		}
+		return nil, errors.Wrap(err, "读取响应内容失败")
+	}
+
+	// 内容验证：确保有实际的内容
+	if body.size < minBodySize { // 内容太少可能是无效的
+		body.remove()
+		return nil, permanent(fmt.Errorf("规则内容太小(%d字节)，可能无效", body.size))
+	}
+
+	return &mirrorResponse{
+		candidate: candidate,
+		body:      body,
+		etag:      resp.Header.Get("ETag"),
+		lastMod:   resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// raceMirrors 同时向多个镜像发起请求，返回第一个有效响应
+func (ru *RuleUpdater) raceMirrors(ctx context.Context, provider config.RuleProvider, candidates []mirrorCandidate, prevState providerState, hasState bool) (*mirrorResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type raceResult struct {
+		resp *mirrorResponse
+		err  error
+	}
+	results := make(chan raceResult, len(candidates))
+
+	for _, candidate := range candidates {
+		go func(candidate mirrorCandidate) {
+			resp, err := ru.fetchFromMirror(ctx, provider, candidate, prevState, hasState)
 			if err != nil {
-				lastErr = err
-				logger.Warnf("创建HTTP请求失败: %v", err)
-				continue
+				logger.Warnf("竞速下载规则 %s 从镜像 %s 失败: %v", provider.Name, candidate.name, err)
 			}
-			
-			// 设置UA和一些头部，有助于绕过某些限制
-			req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-			req.Header.Set("Accept", "text/plain,text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
-			req.Header.Set("Connection", "close") // 禁用keep-alive，减少EOF风险
-			
-			// 使用客户端有超时设置的Do方法发送请求
-			resp, err := ru.client.Do(req)
-			if err != nil {
-				lastErr = err
-				// 检查是否为EOF错误
-				if err.Error() == "EOF" || strings.Contains(err.Error(), "EOF") {
-					logger.Warnf("下载规则 %s 从源 #%d 遇到EOF错误，正在重试(%d/%d)...", 
-						provider.Name, urlIndex+1, attempt, maxRetries)
-					time.Sleep(retryDelay)
-					continue
+			results <- raceResult{resp, err}
+		}(candidate)
+	}
+
+	var lastErr error
+	for i := range candidates {
+		result := <-results
+		if result.err == nil {
+			// 取消其余请求，并删除取消前已经完成的下载
+			cancel()
+			go func(remaining int) {
+				for ; remaining > 0; remaining-- {
+					if r := <-results; r.resp != nil {
+						r.resp.body.remove()
+					}
 				}
-				
-				// 其他错误也尝试重试
-				logger.Warnf("下载规则 %s 从源 #%d 失败: %v，正在重试(%d/%d)...", 
-					provider.Name, urlIndex+1, err, attempt, maxRetries)
-				time.Sleep(retryDelay)
-				continue
+			}(len(candidates) - i - 1)
+			return result.resp, nil
+		}
+		lastErr = result.err
+	}
+
+	return nil, lastErr
+}
+
+// fetchRule 按镜像健康度从各个镜像下载规则，支持竞速和逐个重试；originOnly 为 true 时只使用原始地址
+func (ru *RuleUpdater) fetchRule(ctx context.Context, provider config.RuleProvider, prevState providerState, hasState, originOnly bool) (*mirrorResponse, error) {
+	candidates := ru.mirrorCandidates(provider)
+	if originOnly {
+		candidates = []mirrorCandidate{{name: originMirrorName(provider.URL), url: provider.URL}}
+	}
+	var lastErr error
+
+	// 竞速下载得分最高的前N个镜像
+	raceCount := ru.cfg.MirrorRaceCount
+	if raceCount > 1 && len(candidates) > 1 {
+		if raceCount > len(candidates) {
+			raceCount = len(candidates)
+		}
+		logger.Infof("同时从 %d 个镜像竞速下载规则 %s", raceCount, provider.Name)
+		resp, err := ru.raceMirrors(ctx, provider, candidates[:raceCount], prevState, hasState)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, errors.Wrap(ctx.Err(), "下载已取消")
+		}
+		lastErr = err
+		logger.Warnf("规则 %s 竞速下载全部失败，改为逐个尝试", provider.Name)
+	}
+
+	// 设置重试参数
+	retry := ru.cfg.GetRetryConfig()
+
+	// 为每个镜像尝试下载
+	for index, candidate := range candidates {
+		logger.Infof("尝试从镜像 #%d %s (%s) 下载规则 %s", index+1, candidate.name, candidate.url, provider.Name)
+
+		// 对每个镜像进行多次重试
+		for attempt := 1; attempt <= retry.MaxAttempts; attempt++ {
+			resp, err := ru.fetchFromMirror(ctx, provider, candidate, prevState, hasState)
+			if err == nil {
+				return resp, nil
 			}
-			
-			// 检查响应状态
-			if resp.StatusCode != http.StatusOK {
-				resp.Body.Close()
-				lastErr = fmt.Errorf("下载规则失败，状态码: %d", resp.StatusCode)
-				logger.Warnf("下载规则 %s 从源 #%d 失败，状态码: %d，正在重试(%d/%d)...", 
-					provider.Name, urlIndex+1, resp.StatusCode, attempt, maxRetries)
-				time.Sleep(retryDelay)
-				continue
+			if ctx.Err() != nil {
+				return nil, errors.Wrap(ctx.Err(), "下载已取消")
 			}
-			
-			// 读取响应内容
-			body, err := io.ReadAll(resp.Body)
-			resp.Body.Close()
-			
-			if err != nil {
-				lastErr = errors.Wrap(err, "读取响应内容失败")
-				logger.Warnf("读取规则 %s 从源 #%d 内容失败: %v，正在重试(%d/%d)...", 
-					provider.Name, urlIndex+1, err, attempt, maxRetries)
-				time.Sleep(retryDelay)
-				continue
+			lastErr = err
+
+			// 永久错误（如404）重试无意义，直接换下一个镜像
+			if !isRetryable(err) {
+				logger.Warnf("下载规则 %s 从镜像 %s 失败: %v，不可重试", provider.Name, candidate.name, err)
+				break
 			}
-			
-			// 内容验证：确保有实际的内容
-			if len(body) < 10 { // 内容太少可能是无效的
-				lastErr = fmt.Errorf("规则内容太小，可能无效")
-				logger.Warnf("规则 %s 从源 #%d 内容太小(%d字节)，正在重试(%d/%d)...", 
-					provider.Name, urlIndex+1, len(body), attempt, maxRetries)
-				time.Sleep(retryDelay)
-				continue
+			if attempt == retry.MaxAttempts {
+				logger.Warnf("下载规则 %s 从镜像 %s 失败: %v (%d/%d)",
+					provider.Name, candidate.name, err, attempt, retry.MaxAttempts)
+				break
 			}
 
-			// 处理规则内容
-			content := string(body)
-
-			// 检查内容是否已经是YAML格式
-			if strings.Contains(content, "payload:") ||
-				strings.Contains(content, "bypass:") ||
-				strings.Contains(content, "domain:") ||
-				strings.Contains(content, "ip-cidr:") {
-				// 已经是YAML格式，直接写入
-				err = os.WriteFile(outputPath, body, 0644)
-				if err != nil {
-					return errors.Wrap(err, "写入规则文件失败")
+			// 优先遵循服务器的 Retry-After，等待过久时改用下一个镜像
+			delay := backoffDelay(attempt, retry.BaseDelay, retry.MaxDelay)
+			if retryAfter := retryAfterOf(err); retryAfter > 0 {
+				if retryAfter > retry.MaxDelay {
+					logger.Warnf("镜像 %s 要求 %s 后重试，超过最大等待时间，尝试下一个镜像", candidate.name, retryAfter)
+					break
+				}
+				if retryAfter > delay {
+					delay = retryAfter
 				}
-				logger.Infof("成功从源 #%d (%s) 下载规则 %s", urlIndex+1, currentUrl, provider.Name)
-				return nil
-			}
-			
-			// 根据类型处理规则
-			var processedRules string
-			switch provider.Type {
-			case "domain":
-				processedRules = processDomainRules(content, provider.Name)
-			case "ipcidr":
-				processedRules = processIPCIDRRules(content, provider.Name)
-			case "mixed":
-				processedRules = processMixedRules(content, provider.Name)
-			default:
-				// 默认作为混合规则处理
-				processedRules = processMixedRules(content, provider.Name)
 			}
 
-			// 写入文件
-			err = os.WriteFile(outputPath, []byte(processedRules), 0644)
-			if err != nil {
-				return errors.Wrap(err, "写入规则文件失败")
+			logger.Warnf("下载规则 %s 从镜像 %s 失败: %v，%s 后重试(%d/%d)...",
+				provider.Name, candidate.name, err, delay.Round(time.Millisecond), attempt, retry.MaxAttempts)
+			if err := sleepContext(ctx, delay); err != nil {
+				return nil, errors.Wrap(err, "下载已取消")
 			}
-
-			// 处理成功，返回nil
-			logger.Infof("成功从源 #%d (%s) 下载规则 %s", urlIndex+1, currentUrl, provider.Name)
-			return nil
 		}
-		
-		// 当前URL的所有重试都失败了，尝试下一个URL
-		logger.Warnf("规则 %s 从源 #%d (%s) 的所有重试均失败，尝试下一个源...", 
-			provider.Name, urlIndex+1, currentUrl)
+
+		// 当前镜像无法下载，尝试下一个镜像
+		logger.Warnf("规则 %s 从镜像 %s 下载失败，尝试下一个镜像...", provider.Name, candidate.name)
 	}
 
-	// 所有URL和重试都失败，返回最后一次错误
+	// 所有镜像和重试都失败，返回最后一次错误
 	if lastErr != nil {
-		return errors.Wrap(lastErr, "从所有源下载规则失败")
+		return nil, errors.Wrap(lastErr, "从所有源下载规则失败")
 	}
-	
-	return fmt.Errorf("从所有源下载规则失败，达到最大重试次数")
+
+	return nil, fmt.Errorf("从所有源下载规则失败，达到最大重试次数")
 }
 
-// processDomainRules 处理域名规则
-func processDomainRules(content, providerName string) string {
-	lines := strings.Split(content, "\n")
-	var domains []string
+// downloadAndProcessRule 下载并处理规则
+func (ru *RuleUpdater) downloadAndProcessRule(ctx context.Context, provider config.RuleProvider, outputPath string) (fetchResult, error) {
+	// 确保输出目录存在
+	outputDir := filepath.Dir(outputPath)
+	if err := utils.EnsureDirExists(outputDir); err != nil {
+		return fetchResult{}, errors.Wrap(err, "创建输出目录失败")
+	}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		domains = append(domains, line)
+	overrides, overridesDigest := ru.providerOverrides(provider, time.Now())
+
+	// 只有本地规则文件存在且类型、行为、格式、转换步骤、覆盖条目和完整性校验设置未变时，上一次的校验信息才可信
+	prevState, hasState := ru.getState(provider.Name)
+	if hasState && (!utils.FileExists(outputPath) || prevState.Type != provider.Type ||
+		prevState.Behavior != provider.Behavior || prevState.Format != provider.Format ||
+		prevState.Transforms != transformsDigest(provider.Transforms) || prevState.Overrides != overridesDigest ||
+		prevState.Verify != verifyDigest(provider.Verify)) {
+		hasState = false
 	}
 
-	// 构造YAML格式的域名规则
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("payload:\n"))
+	resp, err := ru.fetchSource(ctx, provider, prevState, hasState)
+	if err != nil {
+		return fetchResult{}, err
+	}
 
-	// 如果没有有效规则，添加注释
-	if len(domains) == 0 {
-		builder.WriteString(fmt.Sprintf("  # 空规则文件 - %s\n", providerName))
-	} else {
-		for _, domain := range domains {
-			builder.WriteString(fmt.Sprintf("  - '%s'\n", domain))
-		}
+	// 下载完成后再次检查，避免取消后仍然改写规则文件
+	if err := ctx.Err(); err != nil {
+		return fetchResult{}, errors.Wrap(err, "下载已取消")
+	}
+	mirrorURL := resp.candidate.url
+
+	// 服务器确认内容未变化
+	if resp.notModified {
+		prevState.UpdatedAt = time.Now()
+		ru.setState(provider.Name, prevState)
+		logger.Infof("规则 %s 在镜像 %s 未修改 (304)", provider.Name, resp.candidate.name)
+		return fetchResult{mirror: mirrorURL, route: resp.route}, nil
 	}
 
-	return builder.String()
-}
+	body := resp.body
+	defer body.remove()
 
-// processIPCIDRRules 处理IP CIDR规则
-func processIPCIDRRules(content, providerName string) string {
-	lines := strings.Split(content, "\n")
-	var ipCidrs []string
+	// 校验原始内容的完整性，未通过时保留现有规则文件
+	verified, err := ru.verifySource(ctx, provider, body)
+	if err != nil {
+		return fetchResult{bytes: body.size, mirror: mirrorURL, route: resp.route, verified: verified}, err
+	}
+	if len(verified) > 0 {
+		logger.Infof("规则 %s 通过完整性校验: %s", provider.Name, strings.Join(verified, ", "))
+	}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		ipCidrs = append(ipCidrs, line)
+	// 记录新的校验信息
+	newState := providerState{
+		URL:          mirrorURL,
+		ETag:         resp.etag,
+		LastModified: resp.lastMod,
+		ContentHash:  body.hash,
+		Type:         provider.Type,
+		Behavior:     provider.Behavior,
+		Format:       provider.Format,
+		Transforms:   transformsDigest(provider.Transforms),
+		Overrides:    overridesDigest,
+		Verify:       verifyDigest(provider.Verify),
+		UpdatedAt:    time.Now(),
 	}
 
-	// 构造YAML格式的IP CIDR规则
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("payload:\n"))
+	// 内容与上次相同（可能来自不同的镜像），无需重写文件
+	if hasState && newState.ContentHash == prevState.ContentHash {
+		ru.setState(provider.Name, newState)
+		logger.Infof("规则 %s 从 %s 获取的内容与本地一致", provider.Name, resp.candidate.name)
+		return fetchResult{bytes: body.size, mirror: mirrorURL, route: resp.route, verified: verified}, nil
+	}
+
+	// 识别格式并逐行转换为 Clash 规则，写入规则文件旁的临时文件
+	tmp, hash, report, err := ru.convertToTemp(provider, body, outputPath, overrides)
+	result := fetchResult{
+		bytes:    body.size,
+		mirror:   mirrorURL,
+		route:    resp.route,
+		format:   report.format,
+		invalid:  report.invalidCount,
+		samples:  report.invalid,
+		filtered: report.filtered,
+		excluded: report.excluded,
+		included: report.included,
+		optimize: report.optimize,
+		verified: verified,
+	}
+	if err != nil {
+		return result, err
+	}
 
-	// 如果没有有效规则，添加注释
-	if len(ipCidrs) == 0 {
-		builder.WriteString(fmt.Sprintf("  # 空规则文件 - %s\n", providerName))
+	// 处理结果与现有文件一致时不重写
+	if existing, err := hashFile(outputPath); err == nil && existing == hash {
+		tmp.Close()
+		os.Remove(tmp.Name())
 	} else {
-		for _, ipCidr := range ipCidrs {
-			builder.WriteString(fmt.Sprintf("  - '%s'\n", ipCidr))
+		result.changed = true
+
+		// 首次写入前保存现有文件作为第一个历史版本
+		ru.recordInitialVersion(provider.Name, outputPath)
+
+		// 通过临时文件原子写入，并保留最后可用版本
+		if err := ru.installRuleFile(provider.Name, outputPath, tmp, hash); err != nil {
+			return result, err
 		}
+		ru.recordVersion(provider.Name, outputPath, time.Now())
 	}
 
-	return builder.String()
-}
+	ru.setState(provider.Name, newState)
 
-// processMixedRules 处理混合规则（同时包含域名和IP）
-func processMixedRules(content, providerName string) string {
-	lines := strings.Split(content, "\n")
-	var rules []string
+	logger.Infof("成功从 %s (%s) 获取规则 %s", resp.candidate.name, mirrorURL, provider.Name)
+	return result, nil
+}
 
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		rules = append(rules, line)
+// convertToTemp 将原始内容转换为 Clash 规则并写入规则文件旁的临时文件，返回临时文件及其内容摘要
+//
+// 成功时临时文件保持打开，由调用方替换规则文件或删除
+func (ru *RuleUpdater) convertToTemp(provider config.RuleProvider, body *ruleBody, outputPath string, ov *overrideSet) (*os.File, string, conversionReport, error) {
+	tr, err := newTransformer(provider.Transforms, payloadType(provider))
+	if err != nil {
+		return nil, "", conversionReport{}, permanent(err)
 	}
 
-	// 构造YAML格式的混合规则
-	var builder strings.Builder
-	builder.WriteString(fmt.Sprintf("payload:\n"))
+	in, err := body.open()
+	if err != nil {
+		return nil, "", conversionReport{}, errors.Wrap(err, "读取规则内容失败")
+	}
+	defer in.Close()
 
-	// 如果没有有效规则，添加注释
-	if len(rules) == 0 {
-		builder.WriteString(fmt.Sprintf("  # 空规则文件 - %s\n", providerName))
-	} else {
-		for _, rule := range rules {
-			builder.WriteString(fmt.Sprintf("  - '%s'\n", rule))
-		}
+	tmp, err := createTempBeside(outputPath)
+	if err != nil {
+		return nil, "", conversionReport{}, errors.Wrap(err, "创建临时文件失败")
 	}
 
-	return builder.String()
+	hasher := sha256.New()
+	report, err := convertRuleStream(in, io.MultiWriter(tmp, hasher), provider.Format, payloadType(provider), provider.Name, ru.maxInvalidRatio(provider), tr, ov)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return nil, "", report, err
+	}
+	return tmp, hex.EncodeToString(hasher.Sum(nil)), report, nil
 }
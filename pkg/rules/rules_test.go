@@ -0,0 +1,422 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// recordNames 返回更新记录中的规则名称
+func recordNames(record UpdateRecord) []string {
+	var names []string
+	for _, p := range record.Providers {
+		names = append(names, p.Name)
+	}
+	return names
+}
+
+// TestProviderOrder 检查更新记录和规则查询按 Priority 排列，不受完成先后和依赖层级的影响
+func TestProviderOrder(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		compositeProvider("merged", "direct", "proxy"),
+		inlineProvider("proxy", "+.example.com"),
+		inlineProvider("direct", "cdn.example.com"),
+		inlineProvider("disabled", "example.net"),
+	}
+	cfg.RuleProviders[0].Priority = 10
+	cfg.RuleProviders[1].Priority = 30
+	cfg.RuleProviders[2].Priority = 20
+	cfg.RuleProviders[3].Enabled = false
+	ru := NewRuleUpdater(cfg)
+
+	want := []string{"disabled", "merged", "direct", "proxy"}
+	for i := 0; i < 2; i++ {
+		record, err := ru.UpdateAllRules(context.Background(), TriggerAPI)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := recordNames(record); !reflect.DeepEqual(got, want) {
+			t.Errorf("第 %d 次更新的记录顺序 = %q, 期望 %q", i+1, got, want)
+		}
+	}
+
+	result, err := ru.Lookup("cdn.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"merged", "direct", "proxy"}; !reflect.DeepEqual(result.Providers, want) {
+		t.Errorf("查询结果的规则顺序 = %q, 期望 %q", result.Providers, want)
+	}
+
+	// 调整顺序后重新分配 Priority
+	if err := cfg.ReorderRuleProviders([]string{"proxy", "direct", "merged"}); err == nil {
+		t.Error("缺少规则时应返回错误")
+	}
+	if err := cfg.ReorderRuleProviders([]string{"proxy", "direct", "merged", "proxy"}); err == nil {
+		t.Error("规则重复时应返回错误")
+	}
+	if err := cfg.ReorderRuleProviders([]string{"proxy", "disabled", "direct", "merged"}); err != nil {
+		t.Fatal(err)
+	}
+	record, err := ru.UpdateAllRules(context.Background(), TriggerAPI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := recordNames(record), []string{"proxy", "disabled", "direct", "merged"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("调整顺序后的记录顺序 = %q, 期望 %q", got, want)
+	}
+}
+
+// ruleServer 提供可以在测试中修改内容的规则服务器，honor 为 true 时按 ETag 返回 304
+type ruleServer struct {
+	mu       sync.Mutex
+	body     string
+	etag     string
+	honor    bool
+	requests []http.Header
+}
+
+func (s *ruleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, r.Header.Clone())
+	if s.honor && s.etag != "" && r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if s.etag != "" {
+		w.Header().Set("ETag", s.etag)
+		w.Header().Set("Last-Modified", "Sat, 20 Jan 2024 15:04:05 GMT")
+	}
+	w.Write([]byte(s.body))
+}
+
+// set 修改服务器返回的内容和 ETag
+func (s *ruleServer) set(body, etag string, honor bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.body, s.etag, s.honor = body, etag, honor
+}
+
+// lastRequest 返回最后一次请求的请求头
+func (s *ruleServer) lastRequest() http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+// TestConditionalUpdate 检查 304 和内容摘要相同时规则记为未变化，不重写规则文件也不同步绕过配置
+func TestConditionalUpdate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	rs := &ruleServer{}
+	rs.set("example.com\nexample.org\n", `"v1"`, true)
+	server := httptest.NewServer(rs)
+	defer server.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "direct", URL: server.URL + "/direct.txt", Type: "domain", Behavior: "domain", Path: "direct.yaml", Enabled: true},
+	}
+	ru := NewRuleUpdater(cfg)
+	output := filepath.Join(ru.getRulesDir(), "direct.yaml")
+
+	update := func(want ProviderStatus) UpdateRecord {
+		t.Helper()
+		record, err := ru.UpdateAllRules(context.Background(), TriggerSchedule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(record.Providers) != 1 || record.Providers[0].Status != want {
+			t.Fatalf("更新记录 = %+v, 期望状态 %s", record.Providers, want)
+		}
+		if record.HasChanges() != (want == StatusChanged) || (record.Bypass != nil) != (want == StatusChanged) {
+			t.Errorf("状态 %s: HasChanges = %v, 同步绕过配置 = %v", want, record.HasChanges(), record.Bypass != nil)
+		}
+		return record
+	}
+	// 把规则文件的修改时间改到过去，用于判断文件是否被重写
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	markFile := func() {
+		t.Helper()
+		if err := os.Chtimes(output, past, past); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectUntouched := func(name string) {
+		t.Helper()
+		if info, err := os.Stat(output); err != nil || !info.ModTime().Equal(past) {
+			t.Errorf("%s: 规则文件被重写", name)
+		}
+	}
+
+	// 首次下载不发送条件请求头
+	update(StatusChanged)
+	if h := rs.lastRequest(); h.Get("If-None-Match") != "" || h.Get("If-Modified-Since") != "" {
+		t.Errorf("首次下载发送了条件请求头: %v", h)
+	}
+
+	// 服务器返回 304
+	markFile()
+	record := update(StatusUnchanged)
+	if h := rs.lastRequest(); h.Get("If-None-Match") != `"v1"` || h.Get("If-Modified-Since") != "Sat, 20 Jan 2024 15:04:05 GMT" {
+		t.Errorf("条件请求头 = %v", h)
+	}
+	if p := record.Providers[0]; p.BytesDownloaded != 0 || p.EntriesBefore != 2 || p.EntriesAfter != 2 {
+		t.Errorf("304 的更新记录 = %+v", p)
+	}
+	expectUntouched("304")
+
+	// 服务器不支持条件请求，但内容摘要与上次相同
+	rs.set("example.com\nexample.org\n", `"v2"`, false)
+	record = update(StatusUnchanged)
+	if p := record.Providers[0]; p.BytesDownloaded == 0 {
+		t.Errorf("内容相同的更新记录 = %+v", p)
+	}
+	expectUntouched("内容相同")
+
+	// 新的 ETag 被保存，下一次请求使用
+	rs.set("example.com\nexample.org\n", `"v2"`, true)
+	update(StatusUnchanged)
+	if h := rs.lastRequest(); h.Get("If-None-Match") != `"v2"` {
+		t.Errorf("If-None-Match = %q, 期望使用新的 ETag", h.Get("If-None-Match"))
+	}
+	expectUntouched("新的 ETag")
+
+	// 内容变化时重写规则文件
+	rs.set("example.com\nexample.net\nexample.org\n", `"v3"`, true)
+	record = update(StatusChanged)
+	if p := record.Providers[0]; p.EntriesBefore != 2 || p.EntriesAfter != 3 {
+		t.Errorf("内容变化的更新记录 = %+v", p)
+	}
+	if info, err := os.Stat(output); err != nil || info.ModTime().Equal(past) {
+		t.Error("内容变化时规则文件没有被重写")
+	}
+}
+
+// TestUpdateRecordStatus 检查一次更新中变化、未变化、失败和跳过的规则分别记录，并汇总到更新记录
+func TestUpdateRecordStatus(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var mu sync.Mutex
+	version := 1
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/stable.txt":
+			w.Write([]byte("stable.example.com\n"))
+		case "/changing.txt":
+			for i := 0; i < version; i++ {
+				fmt.Fprintf(w, "v%d.example.com\n", i)
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	remote := func(name string) config.RuleProvider {
+		return config.RuleProvider{Name: name, URL: server.URL + "/" + name + ".txt", Type: "domain", Behavior: "domain", Path: name + ".yaml", Enabled: true}
+	}
+	cfg := config.DefaultConfig()
+	cfg.RetryConfig = config.RetryConfig{MaxAttempts: 1}
+	cfg.RuleProviders = []config.RuleProvider{remote("stable"), remote("changing"), remote("missing"), remote("disabled")}
+	cfg.RuleProviders[3].Enabled = false
+	ru := NewRuleUpdater(cfg)
+
+	if _, err := ru.UpdateAllRules(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	version = 3
+	mu.Unlock()
+	record, err := ru.UpdateAllRules(context.Background(), TriggerSchedule)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		status        ProviderStatus
+		success       bool
+		before, after int
+		downloaded    bool
+	}{
+		{"stable", StatusUnchanged, true, 1, 1, true},
+		{"changing", StatusChanged, true, 1, 3, true},
+		{"missing", StatusFailed, false, 0, 0, false},
+		{"disabled", StatusSkipped, false, 0, 0, false},
+	}
+	if got := recordNames(record); len(got) != len(tests) {
+		t.Fatalf("更新记录 = %q", got)
+	}
+	for i, tt := range tests {
+		p := record.Providers[i]
+		if p.Name != tt.name || p.Status != tt.status || p.Success != tt.success || p.Changed != (tt.status == StatusChanged) {
+			t.Errorf("%s: 状态 = %s, Success = %v, Changed = %v, 期望 %s", tt.name, p.Status, p.Success, p.Changed, tt.status)
+		}
+		if p.EntriesBefore != tt.before || p.EntriesAfter != tt.after {
+			t.Errorf("%s: 条目数 %d -> %d, 期望 %d -> %d", tt.name, p.EntriesBefore, p.EntriesAfter, tt.before, tt.after)
+		}
+		if (p.BytesDownloaded > 0) != tt.downloaded || (p.Mirror != "") != tt.downloaded {
+			t.Errorf("%s: 下载 %d 字节, 镜像 %q", tt.name, p.BytesDownloaded, p.Mirror)
+		}
+		if p.Message == "" {
+			t.Errorf("%s: 缺少说明", tt.name)
+		}
+	}
+
+	want := map[ProviderStatus]int{StatusChanged: 1, StatusUnchanged: 1, StatusFailed: 1, StatusSkipped: 1, StatusRolledBack: 0}
+	if got := record.CountByStatus(); !reflect.DeepEqual(got, want) {
+		t.Errorf("状态统计 = %v, 期望 %v", got, want)
+	}
+	if !record.HasChanges() || !record.HasFailures() || record.Trigger != TriggerSchedule {
+		t.Errorf("HasChanges = %v, HasFailures = %v, 触发来源 = %s", record.HasChanges(), record.HasFailures(), record.Trigger)
+	}
+
+	// 同一份记录保存到更新历史
+	history := ru.GetUpdateHistory()
+	if len(history) != 2 || !reflect.DeepEqual(recordNames(history[1]), recordNames(record)) || history[1].Trigger != TriggerSchedule {
+		t.Errorf("更新历史 = %+v", history)
+	}
+
+	// 只有失败的规则时整体没有变化
+	record, err = ru.UpdateProviders(context.Background(), TriggerAPI, []string{"missing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.HasChanges() || !record.HasFailures() || len(record.Providers) != 1 {
+		t.Errorf("只更新失败的规则: %+v", record)
+	}
+}
+
+// dirNames 返回目录中的文件名
+func dirNames(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// TestCancelUpdate 检查下载中和重试等待中取消更新时立即返回，现有规则文件保持不变，也不计入失败次数
+func TestCancelUpdate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	var mode atomic.Value
+	mode.Store("ok")
+	arrived := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch mode.Load() {
+		case "stall":
+			arrived <- struct{}{}
+			stall(w, r)
+		case "retry":
+			arrived <- struct{}{}
+			w.Header().Set("Retry-After", "30")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("example.com\nexample.org\n"))
+		}
+	}))
+	defer server.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.RetryConfig = config.RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Minute}
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "direct", URL: server.URL + "/direct.txt", Type: "domain", Behavior: "domain", Path: "direct.yaml", Enabled: true},
+	}
+	ru := NewRuleUpdater(cfg)
+	if _, err := ru.UpdateAllRules(context.Background(), TriggerStartup); err != nil {
+		t.Fatal(err)
+	}
+	rulesDir := ru.getRulesDir()
+	output := filepath.Join(rulesDir, "direct.yaml")
+	original, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := dirNames(t, rulesDir)
+	lastUpdate := cfg.LastUpdateTime
+
+	tests := []struct {
+		name   string
+		mode   string
+		cancel func(cancel context.CancelFunc)
+	}{
+		// 通过取消接口中止下载到一半的更新
+		{"下载中", "stall", func(context.CancelFunc) {
+			if !ru.CancelUpdate() {
+				t.Error("CancelUpdate 没有找到正在进行的更新")
+			}
+		}},
+		// 调用方的 ctx 被取消（服务停止或 HTTP 请求断开）时不再等待 Retry-After
+		{"重试等待中", "retry", func(cancel context.CancelFunc) { cancel() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mode.Store(tt.mode)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				<-arrived
+				// 等待响应到达客户端后再取消
+				time.Sleep(50 * time.Millisecond)
+				tt.cancel(cancel)
+			}()
+
+			start := time.Now()
+			record, err := ru.UpdateAllRules(ctx, TriggerAPI)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("错误 = %v, 期望 context.Canceled", err)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("取消后 %v 才返回", elapsed)
+			}
+			if len(record.Providers) != 1 || record.Providers[0].Status != StatusFailed || record.HasChanges() {
+				t.Errorf("更新记录 = %+v", record.Providers)
+			}
+
+			// 规则文件和目录保持原样，没有残留的临时文件
+			if data, err := os.ReadFile(output); err != nil || string(data) != string(original) {
+				t.Errorf("规则文件被修改: %q, %v", data, err)
+			}
+			if got := dirNames(t, rulesDir); !reflect.DeepEqual(got, files) {
+				t.Errorf("规则目录 = %q, 期望 %q", got, files)
+			}
+			waitSpoolEmpty(t)
+
+			// 取消不计入失败，也不推进最后更新时间
+			if s := ru.GetSchedules(); len(s) != 1 || s[0].Failures != 0 {
+				t.Errorf("调度状态 = %+v", s)
+			}
+			if !cfg.LastUpdateTime.Equal(lastUpdate) {
+				t.Errorf("最后更新时间 = %v, 期望 %v", cfg.LastUpdateTime, lastUpdate)
+			}
+		})
+	}
+
+	if ru.CancelUpdate() {
+		t.Error("没有进行中的更新时 CancelUpdate 应返回 false")
+	}
+}
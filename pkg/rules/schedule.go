@@ -0,0 +1,182 @@
+package rules
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// ProviderSchedule 表示规则提供者的调度状态，用于API展示
+type ProviderSchedule struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	LastRun  time.Time `json:"last_run"`
+	NextRun  time.Time `json:"next_run"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// 规则提供者允许的最小更新间隔（秒）
+const minProviderInterval = 60
+
+// ValidateSchedule 检查规则提供者的 cron 表达式和更新间隔是否有效
+func ValidateSchedule(provider config.RuleProvider) error {
+	if provider.Interval < 0 || (provider.Interval > 0 && provider.Interval < minProviderInterval) {
+		return fmt.Errorf("更新间隔必须为0（使用全局间隔）或不少于 %d 秒", minProviderInterval)
+	}
+	if provider.Cron != "" {
+		if _, err := cron.ParseStandard(provider.Cron); err != nil {
+			return fmt.Errorf("无效的 cron 表达式 %q: %v", provider.Cron, err)
+		}
+	}
+	return nil
+}
+
+// scheduleFor 返回规则提供者的调度计划及其描述
+//
+// cron 表达式优先于 Interval，两者都未设置时使用全局 UpdateInterval。
+// cron 表达式无效时回退到全局间隔，并返回解析错误
+func (ru *RuleUpdater) scheduleFor(provider config.RuleProvider) (cron.Schedule, string, error) {
+	if provider.Cron != "" {
+		sched, err := cron.ParseStandard(provider.Cron)
+		if err == nil {
+			return sched, "cron " + provider.Cron, nil
+		}
+		interval := ru.cfg.UpdateInterval
+		return cron.Every(interval), "every " + interval.String(), fmt.Errorf("无效的 cron 表达式 %q: %v", provider.Cron, err)
+	}
+
+	interval := ru.cfg.UpdateInterval
+	if provider.Interval >= minProviderInterval {
+		interval = time.Duration(provider.Interval) * time.Second
+	}
+	return cron.Every(interval), "every " + interval.String(), nil
+}
+
+// lastRun 返回规则提供者上一次成功检查的时间
+//
+// 没有状态记录时，若规则文件存在则以全局 LastUpdateTime 为准，否则视为从未更新
+func (ru *RuleUpdater) lastRun(provider config.RuleProvider) time.Time {
+	if state, ok := ru.getState(provider.Name); ok && !state.UpdatedAt.IsZero() {
+		return state.UpdatedAt
+	}
+	if utils.FileExists(filepath.Join(ru.getRulesDir(), provider.Path)) {
+		return ru.cfg.LastUpdateTime
+	}
+	return time.Time{}
+}
+
+// recordOutcome 记录规则提供者的更新结果，失败时按指数退避安排提前重试
+func (ru *RuleUpdater) recordOutcome(pr ProviderRecord, now time.Time) {
+	ru.scheduleMutex.Lock()
+	defer ru.scheduleMutex.Unlock()
+
+	switch pr.Status {
+	case StatusFailed, StatusRolledBack:
+		ru.failures[pr.Name]++
+		ru.retryAt[pr.Name] = now.Add(ru.failureRetryDelay(ru.failures[pr.Name]))
+	case StatusChanged, StatusUnchanged:
+		delete(ru.failures, pr.Name)
+		delete(ru.retryAt, pr.Name)
+	}
+}
+
+// scheduleOf 计算单个规则提供者的调度状态
+func (ru *RuleUpdater) scheduleOf(provider config.RuleProvider, now time.Time) ProviderSchedule {
+	sched, desc, err := ru.scheduleFor(provider)
+	ps := ProviderSchedule{
+		Name:     provider.Name,
+		Schedule: desc,
+		LastRun:  ru.lastRun(provider),
+	}
+	if err != nil {
+		ps.Error = err.Error()
+	}
+
+	ru.scheduleMutex.Lock()
+	ps.Failures = ru.failures[provider.Name]
+	retryAt, retrying := ru.retryAt[provider.Name]
+	ru.scheduleMutex.Unlock()
+
+	switch {
+	case retrying:
+		// 失败后的重试不晚于下一次正常调度
+		ps.NextRun = retryAt
+		if regular := sched.Next(now); regular.Before(retryAt) {
+			ps.NextRun = regular
+		}
+	case ps.LastRun.IsZero():
+		// 从未更新过，立即更新
+		ps.NextRun = now
+	case ru.overridesChanged(provider, now):
+		// 覆盖条目新增、修改或过期后立即重新生成规则文件
+		ps.NextRun = now
+	default:
+		// 基于上次更新时间计算，错过的调度（例如休眠期间）会立即到期
+		ps.NextRun = sched.Next(ps.LastRun)
+	}
+
+	return ps
+}
+
+// scheduled 判断规则提供者是否参与定时更新，即已启用且未固定版本
+func scheduled(provider config.RuleProvider) bool {
+	return provider.Enabled && provider.Pinned == ""
+}
+
+// ScheduledCount 返回参与定时更新的规则提供者数量
+func (ru *RuleUpdater) ScheduledCount() int {
+	count := 0
+	for _, provider := range ru.cfg.RuleProviders {
+		if scheduled(provider) {
+			count++
+		}
+	}
+	return count
+}
+
+// GetSchedules 返回所有已启用且未固定版本的规则提供者的调度状态，按下次运行时间排序
+func (ru *RuleUpdater) GetSchedules() []ProviderSchedule {
+	now := time.Now()
+	var schedules []ProviderSchedule
+	for _, provider := range config.OrderedProviders(ru.cfg.RuleProviders) {
+		if !scheduled(provider) {
+			continue
+		}
+		schedules = append(schedules, ru.scheduleOf(provider, now))
+	}
+
+	sort.SliceStable(schedules, func(i, j int) bool {
+		return schedules[i].NextRun.Before(schedules[j].NextRun)
+	})
+	return schedules
+}
+
+// DueProviders 返回在 now 时刻应当更新的规则提供者名称
+func (ru *RuleUpdater) DueProviders(now time.Time) []string {
+	var due []string
+	for _, provider := range ru.cfg.RuleProviders {
+		if !scheduled(provider) {
+			continue
+		}
+		if !ru.scheduleOf(provider, now).NextRun.After(now) {
+			due = append(due, provider.Name)
+		}
+	}
+	return due
+}
+
+// NextRunTime 返回最早的下一次调度时间，没有启用的规则提供者时返回零值
+func (ru *RuleUpdater) NextRunTime() time.Time {
+	schedules := ru.GetSchedules()
+	if len(schedules) == 0 {
+		return time.Time{}
+	}
+	return schedules[0].NextRun
+}
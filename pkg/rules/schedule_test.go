@@ -0,0 +1,216 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestScheduledCount 检查固定版本和停用的规则提供者不计入定时更新
+func TestScheduledCount(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := config.DefaultConfig()
+	pinned := inlineProvider("pinned", "b.example.com")
+	pinned.Pinned = "20240101-000000"
+	disabled := inlineProvider("disabled", "c.example.com")
+	disabled.Enabled = false
+	cfg.RuleProviders = []config.RuleProvider{inlineProvider("direct", "a.example.com"), pinned, disabled}
+	ru := NewRuleUpdater(cfg)
+
+	due := ru.DueProviders(time.Now())
+	if !reflect.DeepEqual(due, []string{"direct"}) {
+		t.Errorf("到期的规则 = %v, 期望 [direct]", due)
+	}
+	if got := ru.ScheduledCount(); got != len(due) {
+		t.Errorf("ScheduledCount() = %d, 期望 %d", got, len(due))
+	}
+}
+
+// ranAt 将规则提供者的上次更新时间记为 t
+func ranAt(ru *RuleUpdater, name string, t time.Time) {
+	ru.setState(name, providerState{UpdatedAt: t})
+}
+
+// TestProviderInterval 检查规则的更新间隔优先于全局间隔，过短的间隔被拒绝并回退到全局间隔
+func TestProviderInterval(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := config.DefaultConfig()
+	cfg.UpdateInterval = 12 * time.Hour
+
+	withInterval := func(name string, seconds int) config.RuleProvider {
+		p := inlineProvider(name, "a.example.com")
+		p.Interval = seconds
+		return p
+	}
+	last := time.Date(2024, 1, 20, 10, 0, 0, 0, time.Local)
+	now := last.Add(time.Minute)
+
+	tests := []struct {
+		provider config.RuleProvider
+		want     time.Duration
+		desc     string
+		valid    bool
+	}{
+		{withInterval("global", 0), 12 * time.Hour, "every 12h0m0s", true},
+		{withInterval("hourly", 3600), time.Hour, "every 1h0m0s", true},
+		{withInterval("minimum", minProviderInterval), time.Minute, "every 1m0s", true},
+		{withInterval("too_short", 30), 12 * time.Hour, "every 12h0m0s", false},
+		{withInterval("negative", -1), 12 * time.Hour, "every 12h0m0s", false},
+	}
+	ru := NewRuleUpdater(cfg)
+	for _, tt := range tests {
+		if err := ValidateSchedule(tt.provider); (err == nil) != tt.valid {
+			t.Errorf("%s: ValidateSchedule = %v, 期望有效 = %v", tt.provider.Name, err, tt.valid)
+		}
+		ranAt(ru, tt.provider.Name, last)
+		s := ru.scheduleOf(tt.provider, now)
+		if s.Schedule != tt.desc || !s.NextRun.Equal(last.Add(tt.want)) {
+			t.Errorf("%s: 调度 = %q, 下一次运行 = %v, 期望 %q, %v", tt.provider.Name, s.Schedule, s.NextRun, tt.desc, last.Add(tt.want))
+		}
+	}
+}
+
+// TestCronSchedule 检查 cron 表达式的解析和下一次运行时间，cron 优先于更新间隔，无效时回退到全局间隔
+func TestCronSchedule(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := config.DefaultConfig()
+	cfg.UpdateInterval = 12 * time.Hour
+	ru := NewRuleUpdater(cfg)
+
+	at := func(day, hour, minute int) time.Time { return time.Date(2024, 1, day, hour, minute, 0, 0, time.Local) }
+	withCron := func(expr string, interval int) config.RuleProvider {
+		p := inlineProvider("cron", "a.example.com")
+		p.Cron, p.Interval = expr, interval
+		return p
+	}
+
+	// 2024-01-20 是星期六
+	tests := []struct {
+		expr  string
+		last  time.Time
+		want  time.Time
+		valid bool
+	}{
+		{"0 4 * * *", at(20, 10, 0), at(21, 4, 0), true},
+		{"0 4 * * *", at(20, 3, 59), at(20, 4, 0), true},
+		{"*/15 * * * *", at(20, 10, 7), at(20, 10, 15), true},
+		{"30 3 * * 1", at(20, 10, 0), at(22, 3, 30), true},
+		{"0 0 1 * *", at(20, 10, 0), time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local), true},
+		{"@daily", at(20, 10, 0), at(21, 0, 0), true},
+		{"@every 2h", at(20, 10, 0), at(20, 12, 0), true},
+		{"61 * * * *", at(20, 10, 0), at(20, 22, 0), false},
+		{"0 4 * *", at(20, 10, 0), at(20, 22, 0), false},
+	}
+	for _, tt := range tests {
+		// 同时设置更新间隔，cron 表达式优先
+		provider := withCron(tt.expr, 3600)
+		if err := ValidateSchedule(provider); (err == nil) != tt.valid {
+			t.Errorf("%q: ValidateSchedule = %v, 期望有效 = %v", tt.expr, err, tt.valid)
+		}
+		ranAt(ru, provider.Name, tt.last)
+		s := ru.scheduleOf(provider, tt.last)
+		if !s.NextRun.Equal(tt.want) {
+			t.Errorf("%q: 上次 %v, 下一次运行 = %v, 期望 %v", tt.expr, tt.last, s.NextRun, tt.want)
+		}
+		if tt.valid && (s.Schedule != "cron "+tt.expr || s.Error != "") {
+			t.Errorf("%q: 调度 = %q, 错误 = %q", tt.expr, s.Schedule, s.Error)
+		}
+		if !tt.valid && (s.Schedule != "every 12h0m0s" || s.Error == "") {
+			t.Errorf("%q: 无效表达式应回退到全局间隔并报告错误: 调度 = %q, 错误 = %q", tt.expr, s.Schedule, s.Error)
+		}
+	}
+}
+
+// TestDueProvidersCatchUp 检查错过的调度（例如休眠期间）在唤醒后只补一次，从未更新的规则立即到期
+func TestDueProvidersCatchUp(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfg := config.DefaultConfig()
+	cfg.UpdateInterval = 12 * time.Hour
+
+	daily := inlineProvider("daily", "a.example.com")
+	daily.Cron = "0 16 * * *"
+	cfg.RuleProviders = []config.RuleProvider{inlineProvider("global", "b.example.com"), daily, inlineProvider("never", "c.example.com")}
+	ru := NewRuleUpdater(cfg)
+
+	now := time.Date(2024, 1, 20, 10, 0, 0, 0, time.Local)
+	expectDue := func(at time.Time, want ...string) {
+		t.Helper()
+		if got := ru.DueProviders(at); !reflect.DeepEqual(got, want) {
+			t.Errorf("%v 到期的规则 = %v, 期望 %v", at, got, want)
+		}
+	}
+
+	// 休眠三天后，错过的多次调度都已到期
+	ranAt(ru, "global", now.Add(-72*time.Hour))
+	ranAt(ru, "daily", now.Add(-72*time.Hour))
+	expectDue(now, "global", "daily", "never")
+
+	// 补上一次更新后不再重复到期，下一次按上次更新时间计算
+	ranAt(ru, "global", now)
+	ranAt(ru, "daily", now)
+	ranAt(ru, "never", now)
+	expectDue(now)
+	expectDue(now.Add(6*time.Hour - time.Second))
+	expectDue(now.Add(6*time.Hour), "daily")
+	expectDue(now.Add(12*time.Hour), "global", "daily", "never")
+
+	// 没有状态记录但规则文件存在时，以全局最后更新时间为准
+	ru.setState("global", providerState{})
+	cfg.LastUpdateTime = now.Add(-time.Hour)
+	if err := os.MkdirAll(ru.getRulesDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(ru.getRulesDir(), "global.yaml"), []byte("payload:\n  - 'b.example.com'\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectDue(now)
+	expectDue(now.Add(5 * time.Hour))
+	expectDue(now.Add(11*time.Hour), "global", "daily")
+}
+
+// TestQuietHoursContains 检查免打扰时段包含开始时间、不包含结束时间，并且可以跨越午夜
+func TestQuietHoursContains(t *testing.T) {
+	at := func(hour, minute int) time.Time { return time.Date(2024, 1, 20, hour, minute, 30, 0, time.Local) }
+	overnight := config.QuietHours{Enabled: true, Start: "23:00", End: "06:00"}
+	daytime := config.QuietHours{Enabled: true, Start: "09:00", End: "17:30"}
+
+	tests := []struct {
+		quiet config.QuietHours
+		time  time.Time
+		want  bool
+	}{
+		{overnight, at(22, 59), false},
+		{overnight, at(23, 0), true},
+		{overnight, at(23, 59), true},
+		{overnight, at(0, 0), true},
+		{overnight, at(5, 59), true},
+		{overnight, at(6, 0), false},
+		{overnight, at(12, 0), false},
+		{daytime, at(8, 59), false},
+		{daytime, at(9, 0), true},
+		{daytime, at(17, 29), true},
+		{daytime, at(17, 30), false},
+		{daytime, at(23, 0), false},
+		{config.QuietHours{Enabled: false, Start: "00:00", End: "23:59"}, at(12, 0), false},
+		{config.QuietHours{Enabled: true, Start: "08:00", End: "08:00"}, at(8, 0), false},
+		{config.QuietHours{Enabled: true, Start: "8pm", End: "06:00"}, at(23, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.quiet.Contains(tt.time); got != tt.want {
+			t.Errorf("%s-%s 包含 %s = %v, 期望 %v", tt.quiet.Start, tt.quiet.End, tt.time.Format("15:04"), got, tt.want)
+		}
+	}
+
+	if err := overnight.Validate(); err != nil {
+		t.Errorf("跨越午夜的时段无效: %v", err)
+	}
+	for _, q := range []config.QuietHours{{Enabled: true, Start: "24:00", End: "06:00"}, {Enabled: true, Start: "23:00", End: "6"}} {
+		if err := q.Validate(); err == nil {
+			t.Errorf("%s-%s 应当无效", q.Start, q.End)
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package rules
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// SimulationResult 表示按 Clash 配置文件的规则列表模拟匹配的结果
+type SimulationResult struct {
+	Domain  string `json:"domain,omitempty"`
+	IP      string `json:"ip,omitempty"`
+	Profile string `json:"profile"` // 读取的 Clash 配置文件
+	// 第一个命中的规则及其在 rules 中的位置（从0开始），没有规则命中时为 -1，此时 Clash 使用 DIRECT
+	Matched bool   `json:"matched"`
+	Index   int    `json:"index"`
+	Rule    string `json:"rule,omitempty"`
+	Policy  string `json:"policy"`
+	// 命中 RULE-SET 时对应的规则集条目
+	Entry *LookupMatch `json:"entry,omitempty"`
+	// 命中的规则之前无法离线判断的规则，这些规则实际可能先命中，结果只在该列表为空时确定
+	Unevaluated []UnevaluatedRule `json:"unevaluated"`
+	Certain     bool              `json:"certain"`
+	// 配置文件中出现的无法离线判断的规则类型
+	UnsupportedTypes []string `json:"unsupported_types"`
+}
+
+// UnevaluatedRule 表示一条无法离线判断是否命中的规则
+type UnevaluatedRule struct {
+	Index  int    `json:"index"`
+	Rule   string `json:"rule"`
+	Reason string `json:"reason"`
+}
+
+// clashProfile 是模拟匹配需要的 Clash 配置文件内容
+type clashProfile struct {
+	Rules         []string                        `yaml:"rules"`
+	RuleProviders map[string]clashProfileProvider `yaml:"rule-providers"`
+}
+
+// clashProfileProvider 是 Clash 配置文件中的 rule-provider
+type clashProfileProvider struct {
+	Type     string `yaml:"type"`
+	Behavior string `yaml:"behavior"`
+	Path     string `yaml:"path"`
+	Format   string `yaml:"format"`
+}
+
+// ruleOutcome 表示规则是否命中，无法判断时为 outcomeUnknown
+type ruleOutcome int
+
+const (
+	outcomeNo ruleOutcome = iota
+	outcomeYes
+	outcomeUnknown
+)
+
+// profileRule 是解析后的一条规则，如 DOMAIN-SUFFIX,example.com,Proxy,no-resolve
+type profileRule struct {
+	typ       string
+	payload   string
+	policy    string
+	noResolve bool
+}
+
+// parseProfileRule 解析 rules 中的一条规则，withPolicy 为 false 时用于解析 AND、OR、NOT 中的子规则
+func parseProfileRule(raw string, withPolicy bool) (profileRule, error) {
+	raw = strings.TrimSpace(raw)
+	typ, rest, _ := strings.Cut(raw, ",")
+	r := profileRule{typ: strings.ToUpper(strings.TrimSpace(typ))}
+	rest = strings.TrimSpace(rest)
+
+	var fields []string
+	switch r.typ {
+	case "MATCH", "FINAL":
+		if rest != "" {
+			fields = strings.Split(rest, ",")
+		}
+	case "AND", "OR", "NOT":
+		// 子规则列表用括号包围，其中可以包含逗号
+		end := closingParen(rest)
+		if end < 0 {
+			return r, fmt.Errorf("逻辑规则的括号不匹配")
+		}
+		r.payload = rest[:end+1]
+		if after := strings.TrimSpace(rest[end+1:]); after != "" {
+			fields = strings.Split(strings.TrimPrefix(after, ","), ",")
+		}
+	default:
+		parts := strings.Split(rest, ",")
+		r.payload = strings.TrimSpace(parts[0])
+		if r.payload == "" {
+			return r, fmt.Errorf("规则缺少内容")
+		}
+		fields = parts[1:]
+	}
+
+	for i, field := range fields {
+		field = strings.TrimSpace(field)
+		if i == 0 && withPolicy {
+			r.policy = field
+		} else if strings.EqualFold(field, "no-resolve") {
+			r.noResolve = true
+		}
+	}
+	if withPolicy && r.policy == "" {
+		return r, fmt.Errorf("规则缺少策略")
+	}
+	return r, nil
+}
+
+// closingParen 返回 s 开头的括号对应的右括号位置，s 不以左括号开头或括号不匹配时返回 -1
+func closingParen(s string) int {
+	if !strings.HasPrefix(s, "(") {
+		return -1
+	}
+	depth := 0
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitSubRules 将逻辑规则的 ((DOMAIN,a.com),(NETWORK,UDP)) 拆分为子规则
+func splitSubRules(payload string) ([]string, error) {
+	inner := strings.TrimSpace(payload[1 : len(payload)-1])
+	var subs []string
+	for inner != "" {
+		end := closingParen(inner)
+		if end < 0 {
+			return nil, fmt.Errorf("逻辑规则的括号不匹配")
+		}
+		subs = append(subs, inner[1:end])
+		inner = strings.TrimSpace(inner[end+1:])
+		inner = strings.TrimSpace(strings.TrimPrefix(inner, ","))
+	}
+	if len(subs) == 0 {
+		return nil, fmt.Errorf("逻辑规则没有子规则")
+	}
+	return subs, nil
+}
+
+// flattenRules 返回规则本身以及逻辑规则中的所有子规则
+func flattenRules(r profileRule) []profileRule {
+	rules := []profileRule{r}
+	if r.typ != "AND" && r.typ != "OR" && r.typ != "NOT" {
+		return rules
+	}
+	subs, err := splitSubRules(r.payload)
+	if err != nil {
+		return rules
+	}
+	for _, sub := range subs {
+		if sr, err := parseProfileRule(sub, false); err == nil {
+			rules = append(rules, flattenRules(sr)...)
+		}
+	}
+	return rules
+}
+
+// evaluableOffline 判断规则类型能否只根据域名和 IP 地址判断，GEOIP 只能离线判断 LAN
+func evaluableOffline(r profileRule) bool {
+	switch r.typ {
+	case "MATCH", "FINAL", "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "DOMAIN-REGEX",
+		"IP-CIDR", "IP-CIDR6", "RULE-SET", "AND", "OR", "NOT":
+		return true
+	case "GEOIP":
+		return strings.EqualFold(r.payload, "LAN")
+	}
+	return false
+}
+
+// ruleSetSource 是 RULE-SET 引用的规则集对应的匹配器
+type ruleSetSource struct {
+	matcher  *ruleMatcher
+	name     string // 匹配器中的规则提供者名称
+	behavior string
+	err      error // 规则集无法读取时的原因
+}
+
+// simulator 对一个查询按顺序判断规则
+type simulator struct {
+	domain   string
+	addr     netip.Addr
+	hasIP    bool
+	ruleSets map[string]*ruleSetSource
+	entry    *LookupMatch // 最近一次命中的规则集条目
+}
+
+// eval 判断规则是否命中，无法判断时返回原因
+func (s *simulator) eval(r profileRule) (ruleOutcome, string) {
+	switch r.typ {
+	case "MATCH", "FINAL":
+		return outcomeYes, ""
+	case "DOMAIN", "DOMAIN-SUFFIX", "DOMAIN-KEYWORD", "DOMAIN-REGEX":
+		if s.domain == "" {
+			return outcomeNo, ""
+		}
+		value := strings.ToLower(r.payload)
+		switch r.typ {
+		case "DOMAIN":
+			return boolOutcome(s.domain == value), ""
+		case "DOMAIN-SUFFIX":
+			return boolOutcome(s.domain == value || strings.HasSuffix(s.domain, "."+value)), ""
+		case "DOMAIN-KEYWORD":
+			return boolOutcome(strings.Contains(s.domain, value)), ""
+		}
+		re, err := regexp.Compile(r.payload)
+		if err != nil {
+			return outcomeUnknown, fmt.Sprintf("无效的正则表达式: %v", err)
+		}
+		return boolOutcome(re.MatchString(s.domain)), ""
+	case "IP-CIDR", "IP-CIDR6":
+		prefix, ok := parsePrefix(r.payload)
+		if !ok {
+			return outcomeUnknown, "无效的网段"
+		}
+		return s.evalIP(r, func(addr netip.Addr) bool { return prefix.Contains(addr) })
+	case "GEOIP":
+		if !strings.EqualFold(r.payload, "LAN") {
+			if !s.hasIP && (r.noResolve || s.domain == "") {
+				return outcomeNo, ""
+			}
+			return outcomeUnknown, "需要 GeoIP 数据库"
+		}
+		return s.evalIP(r, func(addr netip.Addr) bool {
+			return addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() || addr.IsUnspecified()
+		})
+	case "RULE-SET":
+		return s.evalRuleSet(r)
+	case "AND", "OR", "NOT":
+		return s.evalLogic(r)
+	}
+	return outcomeUnknown, fmt.Sprintf("%s 规则无法离线判断", r.typ)
+}
+
+// evalIP 判断 IP 类规则；只有域名时 Clash 会解析域名，除非规则带有 no-resolve
+func (s *simulator) evalIP(r profileRule, contains func(addr netip.Addr) bool) (ruleOutcome, string) {
+	if s.hasIP {
+		return boolOutcome(contains(s.addr)), ""
+	}
+	if r.noResolve || s.domain == "" {
+		return outcomeNo, ""
+	}
+	return outcomeUnknown, "需要解析域名，可以同时提供 IP 地址"
+}
+
+// evalRuleSet 判断 RULE-SET 规则，命中时记录命中的条目
+func (s *simulator) evalRuleSet(r profileRule) (ruleOutcome, string) {
+	src, ok := s.ruleSets[r.payload]
+	if !ok {
+		return outcomeUnknown, fmt.Sprintf("配置文件中没有规则集 %s", r.payload)
+	}
+	if src.err != nil {
+		return outcomeUnknown, src.err.Error()
+	}
+
+	pick := func(matches []LookupMatch) *LookupMatch {
+		for i := range matches {
+			if matches[i].Provider == src.name {
+				return &matches[i]
+			}
+		}
+		return nil
+	}
+	if s.domain != "" && src.behavior != "ipcidr" {
+		if match := pick(src.matcher.matchDomain(s.domain)); match != nil {
+			s.entry = match
+			return outcomeYes, ""
+		}
+	}
+	if src.behavior != "domain" && src.matcher.ipEntries[src.name] > 0 {
+		if s.hasIP {
+			if match := pick(src.matcher.matchIP(s.addr)); match != nil {
+				s.entry = match
+				return outcomeYes, ""
+			}
+		} else if !r.noResolve && s.domain != "" {
+			return outcomeUnknown, "规则集包含网段，需要解析域名，可以同时提供 IP 地址"
+		}
+	}
+	if n := src.matcher.unsupported[src.name]; n > 0 {
+		return outcomeUnknown, fmt.Sprintf("规则集包含 %d 条无法离线判断的条目", n)
+	}
+	return outcomeNo, ""
+}
+
+// evalLogic 判断 AND、OR、NOT 规则，子规则无法判断时按三值逻辑处理
+func (s *simulator) evalLogic(r profileRule) (ruleOutcome, string) {
+	subs, err := splitSubRules(r.payload)
+	if err != nil {
+		return outcomeUnknown, err.Error()
+	}
+	if r.typ == "NOT" && len(subs) != 1 {
+		return outcomeUnknown, "NOT 规则只能有一个子规则"
+	}
+
+	var reasons []string
+	yes, no := 0, 0
+	for _, sub := range subs {
+		sr, err := parseProfileRule(sub, false)
+		if err != nil {
+			return outcomeUnknown, err.Error()
+		}
+		switch outcome, reason := s.eval(sr); outcome {
+		case outcomeYes:
+			yes++
+		case outcomeNo:
+			no++
+		default:
+			reasons = append(reasons, reason)
+		}
+	}
+
+	switch r.typ {
+	case "AND":
+		if no > 0 {
+			return outcomeNo, ""
+		}
+		if yes == len(subs) {
+			return outcomeYes, ""
+		}
+	case "OR":
+		if yes > 0 {
+			return outcomeYes, ""
+		}
+		if no == len(subs) {
+			return outcomeNo, ""
+		}
+	case "NOT":
+		if yes+no == 1 {
+			return boolOutcome(no == 1), ""
+		}
+	}
+	return outcomeUnknown, strings.Join(reasons, "; ")
+}
+
+// boolOutcome 将布尔值转换为匹配结果
+func boolOutcome(ok bool) ruleOutcome {
+	if ok {
+		return outcomeYes
+	}
+	return outcomeNo
+}
+
+// loadProfile 读取 Clash 配置文件中的规则和规则集
+func loadProfile(path string) (*clashProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "读取 Clash 配置文件失败")
+	}
+	var profile clashProfile
+	if err := yaml.Unmarshal(data, &profile); err != nil {
+		return nil, errors.Wrap(err, "解析 Clash 配置文件失败")
+	}
+	return &profile, nil
+}
+
+// profileRuleSets 为配置文件中的规则集找到本地规则文件
+//
+// 规则集的 path 指向同步的规则文件或与同步的规则同名时使用已建立的查询索引，
+// 否则读取 path 指向的文件（相对路径相对于配置文件所在目录）
+func (ru *RuleUpdater) profileRuleSets(profile *clashProfile, profilePath string) map[string]*ruleSetSource {
+	synced := ru.currentMatcher()
+	byPath := make(map[string]config.RuleProvider)
+	byName := make(map[string]config.RuleProvider)
+	for _, provider := range ru.cfg.RuleProviders {
+		if _, ok := synced.order[provider.Name]; !ok {
+			continue
+		}
+		byPath[filepath.Clean(filepath.Join(ru.getRulesDir(), provider.Path))] = provider
+		byName[provider.Name] = provider
+	}
+
+	external := newRuleMatcher("")
+	sets := make(map[string]*ruleSetSource, len(profile.RuleProviders))
+	for name, p := range profile.RuleProviders {
+		src := &ruleSetSource{behavior: strings.ToLower(p.Behavior)}
+		sets[name] = src
+
+		path := p.Path
+		if path != "" && !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(profilePath), path)
+		}
+		if path != "" {
+			path = filepath.Clean(path)
+		}
+
+		own, ok := byPath[path]
+		if !ok {
+			own, ok = byName[name]
+		}
+		if ok {
+			src.matcher, src.name = synced, own.Name
+			if src.behavior == "" {
+				src.behavior = payloadType(own)
+			}
+			continue
+		}
+
+		switch {
+		case path == "":
+			src.err = fmt.Errorf("规则集 %s 没有设置 path", name)
+		case strings.EqualFold(p.Format, "mrs"):
+			src.err = fmt.Errorf("规则集 %s 为 mrs 格式，无法读取", name)
+		default:
+			if err := external.load(name, src.behavior, path, strings.EqualFold(p.Format, "text")); err != nil {
+				src.err = fmt.Errorf("读取规则集 %s 失败: %v", name, err)
+				continue
+			}
+			src.matcher, src.name = external, name
+		}
+	}
+	return sets
+}
+
+// Simulate 按 Clash 配置文件中 rules 的顺序模拟匹配域名、IP 地址或两者，返回第一个命中的规则和策略
+//
+// 配置文件路径为 clash_config_path，RULE-SET 引用的规则集使用本地同步的规则文件。
+// 无法离线判断的规则（如 PROCESS-NAME、GEOIP）按未命中处理，并在结果中列出
+func (ru *RuleUpdater) Simulate(domain, ip string) (*SimulationResult, error) {
+	s := &simulator{domain: strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")}
+	if s.domain == "" && strings.TrimSpace(ip) == "" {
+		return nil, fmt.Errorf("需要提供域名或 IP 地址")
+	}
+	if s.domain != "" {
+		if err := validateDomain(s.domain, false); err != nil {
+			return nil, fmt.Errorf("无效的域名 %q: %v", domain, err)
+		}
+	}
+	if ip = strings.TrimSpace(ip); ip != "" {
+		addr, err := netip.ParseAddr(strings.Trim(ip, "[]"))
+		if err != nil {
+			return nil, fmt.Errorf("无效的 IP 地址 %q", ip)
+		}
+		s.addr, s.hasIP = addr.Unmap(), true
+	}
+
+	profilePath := ru.cfg.ClashConfigPath
+	if profilePath == "" {
+		return nil, fmt.Errorf("未设置 Clash 配置文件路径 (clash_config_path)")
+	}
+	profile, err := loadProfile(profilePath)
+	if err != nil {
+		return nil, err
+	}
+	s.ruleSets = ru.profileRuleSets(profile, profilePath)
+
+	result := &SimulationResult{
+		Domain:           s.domain,
+		Profile:          profilePath,
+		Index:            -1,
+		Policy:           "DIRECT",
+		Unevaluated:      []UnevaluatedRule{},
+		UnsupportedTypes: []string{},
+	}
+	if s.hasIP {
+		result.IP = s.addr.String()
+	}
+
+	unsupported := make(map[string]bool)
+	for i, raw := range profile.Rules {
+		r, err := parseProfileRule(raw, true)
+		if err != nil {
+			if !result.Matched {
+				result.Unevaluated = append(result.Unevaluated, UnevaluatedRule{i, raw, err.Error()})
+			}
+			continue
+		}
+		for _, sub := range flattenRules(r) {
+			if !evaluableOffline(sub) {
+				unsupported[sub.typ] = true
+			}
+		}
+		if result.Matched {
+			continue
+		}
+
+		s.entry = nil
+		switch outcome, reason := s.eval(r); outcome {
+		case outcomeYes:
+			result.Matched = true
+			result.Index, result.Rule, result.Policy = i, strings.TrimSpace(raw), r.policy
+			result.Entry = s.entry
+		case outcomeUnknown:
+			result.Unevaluated = append(result.Unevaluated, UnevaluatedRule{i, strings.TrimSpace(raw), reason})
+		}
+	}
+
+	for typ := range unsupported {
+		result.UnsupportedTypes = append(result.UnsupportedTypes, typ)
+	}
+	sort.Strings(result.UnsupportedTypes)
+	result.Certain = len(result.Unevaluated) == 0
+	return result, nil
+}
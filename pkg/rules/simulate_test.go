@@ -0,0 +1,129 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestSimulate 检查按配置文件中 rules 的顺序模拟匹配，并列出无法离线判断的规则
+func TestSimulate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		inlineProvider("proxy", "+.google.com", "github.com"),
+	}
+	ru := NewRuleUpdater(cfg)
+	if _, err := ru.UpdateAllRules(context.Background(), TriggerAPI); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ru.Simulate("www.google.com", ""); err == nil {
+		t.Error("未设置配置文件路径时应返回错误")
+	}
+
+	dir := t.TempDir()
+	profile := `rule-providers:
+  proxy:
+    type: http
+    behavior: domain
+    path: ./ruleset/proxy.yaml
+    url: https://example.com/proxy.yaml
+  lan:
+    type: file
+    behavior: ipcidr
+    format: text
+    path: ./lan.txt
+rules:
+  - PROCESS-NAME,curl,DIRECT
+  - AND,((DOMAIN-SUFFIX,example.com),(NETWORK,UDP)),REJECT
+  - RULE-SET,proxy,Proxy
+  - DOMAIN-KEYWORD,tracker,REJECT
+  - RULE-SET,lan,DIRECT
+  - GEOIP,LAN,DIRECT
+  - GEOIP,CN,DIRECT,no-resolve
+  - MATCH,Final
+`
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(profile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "lan.txt"), []byte("# 内网\n10.0.0.0/8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.ClashConfigPath = filepath.Join(dir, "config.yaml")
+
+	tests := []struct {
+		domain, ip  string
+		index       int
+		policy      string
+		unevaluated []int
+		entry       string
+		line        int
+	}{
+		{"www.google.com", "", 2, "Proxy", []int{0}, "+.google.com", 2},
+		{"a.tracker.net", "", 3, "REJECT", []int{0}, "", 0},
+		{"a.example.com", "", 7, "Final", []int{0, 1, 4, 5}, "", 0},
+		{"a.example.com", "1.1.1.1", 7, "Final", []int{0, 1, 6}, "", 0},
+		{"", "10.1.2.3", 4, "DIRECT", []int{0}, "10.0.0.0/8", 2},
+		{"", "192.168.1.1", 5, "DIRECT", []int{0}, "", 0},
+	}
+	for _, tt := range tests {
+		result, err := ru.Simulate(tt.domain, tt.ip)
+		if err != nil {
+			t.Errorf("Simulate(%q, %q) 失败: %v", tt.domain, tt.ip, err)
+			continue
+		}
+		var unevaluated []int
+		for _, u := range result.Unevaluated {
+			unevaluated = append(unevaluated, u.Index)
+		}
+		if result.Index != tt.index || result.Policy != tt.policy || !reflect.DeepEqual(unevaluated, tt.unevaluated) {
+			t.Errorf("Simulate(%q, %q) = 第 %d 条 %s，未判断 %v，期望第 %d 条 %s，未判断 %v",
+				tt.domain, tt.ip, result.Index, result.Policy, unevaluated, tt.index, tt.policy, tt.unevaluated)
+		}
+		if tt.entry != "" && (result.Entry == nil || result.Entry.Entry != tt.entry || result.Entry.Line != tt.line) {
+			t.Errorf("Simulate(%q, %q) 命中条目 %+v，期望 %s 第 %d 行", tt.domain, tt.ip, result.Entry, tt.entry, tt.line)
+		}
+		if want := []string{"GEOIP", "NETWORK", "PROCESS-NAME"}; !reflect.DeepEqual(result.UnsupportedTypes, want) {
+			t.Errorf("unsupported_types = %q, 期望 %q", result.UnsupportedTypes, want)
+		}
+	}
+
+	if _, err := ru.Simulate("", ""); err == nil {
+		t.Error("没有域名和 IP 地址时应返回错误")
+	}
+}
+
+// TestParseProfileRule 检查规则和逻辑规则的解析
+func TestParseProfileRule(t *testing.T) {
+	r, err := parseProfileRule("AND,((DOMAIN,a.com),(OR,((NETWORK,UDP),(DST-PORT,443)))),REJECT", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.typ != "AND" || r.policy != "REJECT" {
+		t.Errorf("解析结果 %+v", r)
+	}
+	var types []string
+	for _, sub := range flattenRules(r) {
+		types = append(types, sub.typ)
+	}
+	if want := []string{"AND", "DOMAIN", "OR", "NETWORK", "DST-PORT"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("子规则类型 = %q, 期望 %q", types, want)
+	}
+
+	r, err = parseProfileRule("IP-CIDR,10.0.0.0/8,DIRECT,no-resolve", true)
+	if err != nil || r.payload != "10.0.0.0/8" || r.policy != "DIRECT" || !r.noResolve {
+		t.Errorf("解析结果 %+v, %v", r, err)
+	}
+
+	for _, raw := range []string{"DOMAIN,a.com", "AND,((DOMAIN,a.com),DIRECT", "DOMAIN-SUFFIX,,DIRECT"} {
+		if _, err := parseProfileRule(raw, true); err == nil {
+			t.Errorf("parseProfileRule(%q) 应返回错误", raw)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+package rules
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// inlineSourceName 内联规则在更新记录中显示的来源
+const inlineSourceName = "inline"
+
+// windowsDrivePattern 匹配 file:///C:/... 形式中多余的前导斜杠
+var windowsDrivePattern = regexp.MustCompile(`^/[A-Za-z]:`)
+
+// localFilePath 将 file:// 地址转换为本地路径，相对路径基于配置目录
+func localFilePath(rawURL string) (string, error) {
+	p := rawURL[len("file://"):]
+	p, err := url.PathUnescape(p)
+	if err != nil {
+		return "", fmt.Errorf("无效的本地路径 %q: %v", rawURL, err)
+	}
+	if windowsDrivePattern.MatchString(p) {
+		p = p[1:]
+	}
+	if p == "" {
+		return "", fmt.Errorf("本地路径为空: %q", rawURL)
+	}
+
+	p = filepath.FromSlash(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(utils.GetConfigDir(), p)
+	}
+	return p, nil
+}
+
+// isHiddenName 判断文件或目录是否应被忽略，例如 .git
+func isHiddenName(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// walkSourceDir 按文件名顺序遍历目录中的规则文件，跳过隐藏文件和目录
+func walkSourceDir(dir string, fn func(path string, info fs.FileInfo) error) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != dir && isHiddenName(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, info)
+	})
+}
+
+// readLocalSource 将本地文件、目录或内联条目写入临时文件，返回内容和来源描述
+func readLocalSource(provider config.RuleProvider, limit int64) (*ruleBody, string, error) {
+	if provider.SourceKind() == config.SourceInline {
+		body, err := spoolBody(strings.NewReader(strings.Join(provider.Entries, "\n")), 0)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "写入内联规则失败")
+		}
+		return body, inlineSourceName, nil
+	}
+
+	path, err := localFilePath(provider.URL)
+	if err != nil {
+		return nil, "", permanent(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "读取本地规则失败")
+	}
+
+	if !info.IsDir() {
+		if limit > 0 && info.Size() > limit {
+			return nil, "", permanent(&SizeLimitError{Limit: limit})
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "读取本地规则失败")
+		}
+		defer f.Close()
+		body, err := spoolBody(f, limit)
+		if err != nil {
+			return nil, "", localSourceError(err, "读取本地规则失败")
+		}
+		return body, provider.URL, nil
+	}
+
+	// 目录中的所有文件按名称顺序拼接
+	spool, err := newSpool(limit)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "读取本地规则目录失败")
+	}
+	files := 0
+	err = walkSourceDir(path, func(filePath string, _ fs.FileInfo) error {
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// 文件末尾没有换行时补上，避免与下一个文件的第一行连在一起
+		tail := &lastByteWriter{w: spool}
+		if _, err := io.Copy(tail, f); err != nil {
+			return err
+		}
+		if tail.n > 0 && tail.last != '\n' {
+			if _, err := spool.Write([]byte{'\n'}); err != nil {
+				return err
+			}
+		}
+		files++
+		return nil
+	})
+	if err != nil {
+		spool.abort()
+		return nil, "", localSourceError(err, "读取本地规则目录失败")
+	}
+	body, err := spool.finish()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "读取本地规则目录失败")
+	}
+
+	logger.Debugf("从目录 %s 读取了 %d 个规则文件", path, files)
+	return body, provider.URL, nil
+}
+
+// localSourceError 包装读取本地来源的错误，超过大小限制时不可重试
+func localSourceError(err error, message string) error {
+	var sizeErr *SizeLimitError
+	if stderrors.As(err, &sizeErr) {
+		return permanent(err)
+	}
+	return errors.Wrap(err, message)
+}
+
+// lastByteWriter 记录写入内容的最后一个字节
+type lastByteWriter struct {
+	w    io.Writer
+	n    int64
+	last byte
+}
+
+func (l *lastByteWriter) Write(p []byte) (int, error) {
+	n, err := l.w.Write(p)
+	if n > 0 {
+		l.n += int64(n)
+		l.last = p[n-1]
+	}
+	return n, err
+}
+
+// fetchSource 根据规则来源获取规则内容，本地来源和组合规则不使用镜像和条件请求
+func (ru *RuleUpdater) fetchSource(ctx context.Context, provider config.RuleProvider, prevState providerState, hasState bool) (*mirrorResponse, error) {
+	var (
+		body     *ruleBody
+		location string
+		err      error
+	)
+	switch provider.SourceKind() {
+	case config.SourceRemote:
+		return ru.fetchRemote(ctx, provider, prevState, hasState, false)
+	case config.SourceComposite:
+		body, location, err = ru.readComposite(provider, ru.maxRuleSize(provider))
+	default:
+		body, location, err = readLocalSource(provider, ru.maxRuleSize(provider))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorResponse{
+		candidate: mirrorCandidate{name: provider.SourceKind(), url: location},
+		body:      body,
+	}, nil
+}
+
+// localFingerprint 计算本地来源的指纹，用于发现文件变化
+//
+// 文件和目录使用大小与修改时间，内联条目使用内容摘要；读取失败时指纹包含错误信息，
+// 这样文件被删除或重新出现时同样会被发现
+func localFingerprint(provider config.RuleProvider) string {
+	if provider.SourceKind() == config.SourceInline {
+		return hashContent([]byte(strings.Join(provider.Entries, "\n")))
+	}
+
+	path, err := localFilePath(provider.URL)
+	if err != nil {
+		return "error:" + err.Error()
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "error:" + err.Error()
+	}
+	if !info.IsDir() {
+		return fmt.Sprintf("%d:%d", info.Size(), info.ModTime().UnixNano())
+	}
+
+	var builder strings.Builder
+	err = walkSourceDir(path, func(filePath string, info fs.FileInfo) error {
+		fmt.Fprintf(&builder, "%s:%d:%d\n", filePath, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+	if err != nil {
+		return "error:" + err.Error()
+	}
+	return hashContent([]byte(builder.String()))
+}
+
+// localWatchFingerprint 返回需要监视变化的本地来源的指纹，组合规则随输入规则一起更新，不单独监视
+func localWatchFingerprint(provider config.RuleProvider) (string, bool) {
+	kind := provider.SourceKind()
+	if kind == config.SourceRemote || kind == config.SourceComposite {
+		return "", false
+	}
+	return localFingerprint(provider), true
+}
+
+// markLocalHandled 记录本地来源在一次实际完成的更新中使用的指纹，之后 ChangedLocalSources 不再报告这些内容
+//
+// 更新失败时同样记录，失败后的重试由调度按退避时间安排，内容再次变化时立即更新
+func (ru *RuleUpdater) markLocalHandled(name, fingerprint string) {
+	ru.watchMutex.Lock()
+	defer ru.watchMutex.Unlock()
+	ru.localFingerprints[name] = fingerprint
+}
+
+// ChangedLocalSources 检查本地规则来源，返回内容与最近一次实际完成的更新不同的规则提供者名称
+//
+// 首次检查只记录指纹，不视为变化。检查本身不会记录新的指纹，因此 Clash 未运行、
+// 更新被取消等原因没有完成更新的规则会在下一次检查时再次返回，直到更新完成
+func (ru *RuleUpdater) ChangedLocalSources() []string {
+	ru.watchMutex.Lock()
+	defer ru.watchMutex.Unlock()
+
+	var changed []string
+	seen := make(map[string]bool)
+	for _, provider := range ru.cfg.RuleProviders {
+		if !provider.Enabled || provider.Pinned != "" {
+			continue
+		}
+		fingerprint, local := localWatchFingerprint(provider)
+		if !local {
+			continue
+		}
+		seen[provider.Name] = true
+
+		previous, ok := ru.localFingerprints[provider.Name]
+		if !ok {
+			ru.localFingerprints[provider.Name] = fingerprint
+		} else if previous != fingerprint {
+			changed = append(changed, provider.Name)
+		}
+	}
+
+	// 清理已删除或禁用的规则提供者
+	for name := range ru.localFingerprints {
+		if !seen[name] {
+			delete(ru.localFingerprints, name)
+		}
+	}
+
+	return changed
+}
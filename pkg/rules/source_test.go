@@ -0,0 +1,267 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// TestLocalFilePath 检查 file:// 地址的解码、相对路径和 Windows 盘符
+func TestLocalFilePath(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	configDir := utils.GetConfigDir()
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"file:///etc/rules/direct.txt", filepath.FromSlash("/etc/rules/direct.txt")},
+		{"file://lists/direct.txt", filepath.Join(configDir, "lists", "direct.txt")},
+		{"file://my%20lists/a.txt", filepath.Join(configDir, "my lists", "a.txt")},
+	}
+	if runtime.GOOS == "windows" {
+		tests = append(tests, struct{ url, want string }{"file:///C:/rules/a.txt", `C:\rules\a.txt`})
+	}
+	for _, tt := range tests {
+		got, err := localFilePath(tt.url)
+		if err != nil || got != tt.want {
+			t.Errorf("localFilePath(%q) = %q, %v, 期望 %q", tt.url, got, err, tt.want)
+		}
+	}
+
+	for _, url := range []string{"file://", "file://%zz"} {
+		if _, err := localFilePath(url); err == nil {
+			t.Errorf("localFilePath(%q) 应当返回错误", url)
+		}
+	}
+}
+
+// writeFiles 在 dir 下写入文件，files 的键为以 / 分隔的相对路径
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readBody 读取并删除规则原始内容
+func readBody(t *testing.T, body *ruleBody) string {
+	t.Helper()
+	defer body.remove()
+	data, err := body.readAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.size != int64(len(data)) || body.hash != hashContent(data) {
+		t.Errorf("大小 = %d, 摘要 = %s, 与内容不符", body.size, body.hash)
+	}
+	return string(data)
+}
+
+// TestReadLocalSource 检查本地文件、目录和内联条目的读取
+func TestReadLocalSource(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"single.txt":          "a.com\nb.com\n",
+		"lists/b.txt":         "b.com",
+		"lists/a.txt":         "a.com\r\n",
+		"lists/sub/c.txt":     "c.com\n",
+		"lists/.hidden.txt":   "hidden.com\n",
+		"lists/.git/HEAD":     "ref: refs/heads/main\n",
+		"lists/empty.txt":     "",
+		"lists/sub/.skip.txt": "skip.com\n",
+	})
+	fileURL := func(name string) string { return "file://" + filepath.ToSlash(filepath.Join(dir, name)) }
+
+	tests := []struct {
+		name     string
+		provider config.RuleProvider
+		want     string
+		location string
+	}{
+		{"文件", config.RuleProvider{URL: fileURL("single.txt")}, "a.com\nb.com\n", fileURL("single.txt")},
+		// 按路径顺序拼接，跳过隐藏文件和目录，缺少换行的文件末尾补上换行
+		{"目录", config.RuleProvider{URL: fileURL("lists")}, "a.com\r\nb.com\nc.com\n", fileURL("lists")},
+		{"内联", config.RuleProvider{Entries: []string{"a.com", "+.b.com"}}, "a.com\n+.b.com", inlineSourceName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, location, err := readLocalSource(tt.provider, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readBody(t, body); got != tt.want {
+				t.Errorf("内容 = %q, 期望 %q", got, tt.want)
+			}
+			if location != tt.location {
+				t.Errorf("来源 = %q, 期望 %q", location, tt.location)
+			}
+		})
+	}
+
+	t.Run("错误", func(t *testing.T) {
+		// 目录拼接后超过大小限制时不可重试，临时文件被删除
+		_, _, err := readLocalSource(config.RuleProvider{URL: fileURL("lists")}, 10)
+		var sizeErr *SizeLimitError
+		if !errors.As(err, &sizeErr) || isRetryable(err) {
+			t.Errorf("错误 = %v, 期望不可重试的 *SizeLimitError", err)
+		}
+		if entries, _ := os.ReadDir(getSpoolDir()); len(entries) > 0 {
+			t.Errorf("下载临时目录中残留 %d 个文件", len(entries))
+		}
+
+		// 文件不存在时可以重试，地址无效时不可重试
+		if _, _, err := readLocalSource(config.RuleProvider{URL: fileURL("missing.txt")}, 0); err == nil || !isRetryable(err) {
+			t.Errorf("文件不存在: 错误 = %v, 期望可重试的错误", err)
+		}
+		if _, _, err := readLocalSource(config.RuleProvider{URL: "file://%zz"}, 0); err == nil || isRetryable(err) {
+			t.Errorf("无效地址: 错误 = %v, 期望不可重试的错误", err)
+		}
+	})
+}
+
+// TestLocalFingerprint 检查文件、目录和内联条目的变化都会改变指纹，隐藏文件不影响指纹
+func TestLocalFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"single.txt": "a.com\n", "lists/a.txt": "a.com\n"})
+	file := config.RuleProvider{URL: "file://" + filepath.ToSlash(filepath.Join(dir, "single.txt"))}
+	list := config.RuleProvider{URL: "file://" + filepath.ToSlash(filepath.Join(dir, "lists"))}
+	inline := config.RuleProvider{Entries: []string{"a.com"}}
+
+	check := func(name string, provider *config.RuleProvider, change func(), changed bool) {
+		t.Helper()
+		before := localFingerprint(*provider)
+		if again := localFingerprint(*provider); again != before {
+			t.Fatalf("%s: 内容不变时指纹不同: %q, %q", name, before, again)
+		}
+		change()
+		if after := localFingerprint(*provider); (after != before) != changed {
+			t.Errorf("%s: 指纹 %q -> %q, 期望变化 = %v", name, before, after, changed)
+		}
+	}
+	touch := func(path string) {
+		future := time.Now().Add(time.Hour)
+		if err := os.Chtimes(path, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check("修改文件", &file, func() { writeFiles(t, dir, map[string]string{"single.txt": "a.com\nb.com\n"}) }, true)
+	check("只更新修改时间", &file, func() { touch(filepath.Join(dir, "single.txt")) }, true)
+	check("删除文件", &file, func() { os.Remove(filepath.Join(dir, "single.txt")) }, true)
+	check("文件重新出现", &file, func() { writeFiles(t, dir, map[string]string{"single.txt": "a.com\n"}) }, true)
+	check("目录中添加文件", &list, func() { writeFiles(t, dir, map[string]string{"lists/sub/b.txt": "b.com\n"}) }, true)
+	check("目录中修改文件", &list, func() { touch(filepath.Join(dir, "lists", "a.txt")) }, true)
+	check("目录中添加隐藏文件", &list, func() { writeFiles(t, dir, map[string]string{"lists/.b.txt.swp": "x"}) }, false)
+	check("修改内联条目", &inline, func() { inline.Entries = append(inline.Entries, "b.com") }, true)
+}
+
+// TestChangedLocalSources 检查本地来源的变化在更新实际完成之前一直被报告
+func TestChangedLocalSources(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "direct.txt")
+	writeFiles(t, dir, map[string]string{"direct.txt": "a.com\n"})
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "direct", Type: "domain", Behavior: "domain", Path: "direct.yaml", Enabled: true, URL: "file://" + filepath.ToSlash(path)},
+		inlineProvider("inline", "b.com"),
+		{Name: "remote", Type: "domain", Behavior: "domain", Path: "remote.yaml", Enabled: true, URL: "http://127.0.0.1:1/remote.txt"},
+	}
+	ru := NewRuleUpdater(cfg)
+	expectChanged := func(want ...string) {
+		t.Helper()
+		if got := ru.ChangedLocalSources(); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("变化的规则 = %v, 期望 %v", got, want)
+		}
+	}
+	update := func(ctx context.Context) {
+		t.Helper()
+		ru.UpdateProviders(ctx, TriggerLocal, []string{"direct"})
+	}
+
+	// 首次检查只记录指纹
+	expectChanged()
+	writeFiles(t, dir, map[string]string{"direct.txt": "a.com\nc.com\n"})
+	expectChanged("direct")
+
+	// 没有更新（例如 Clash 未运行）或更新被取消时，下一次检查仍然报告变化
+	expectChanged("direct")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	update(ctx)
+	expectChanged("direct")
+
+	// 更新完成后不再报告
+	update(context.Background())
+	expectChanged()
+
+	// 更新失败时不再立即报告，由失败重试安排；内容再次变化时立即报告
+	cfg.RuleProviders[0].MaxSize = 4
+	writeFiles(t, dir, map[string]string{"direct.txt": "a.com\nd.com\n"})
+	expectChanged("direct")
+	update(context.Background())
+	expectChanged()
+	for _, s := range ru.GetSchedules() {
+		if s.Name == "direct" && s.Failures != 1 {
+			t.Errorf("失败次数 = %d, 期望 1", s.Failures)
+		}
+	}
+	writeFiles(t, dir, map[string]string{"direct.txt": "a.com\n"})
+	expectChanged("direct")
+
+	// 内联条目同样被监视，禁用后不再报告
+	cfg.RuleProviders[1].Entries = []string{"b.com", "e.com"}
+	expectChanged("direct", "inline")
+	cfg.RuleProviders[0].Enabled = false
+	cfg.RuleProviders[1].Enabled = false
+	expectChanged()
+}
+
+// TestLocalSourceUpdate 检查目录来源拼接后按格式转换写入规则文件
+func TestLocalSourceUpdate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"lists/a.list": "DOMAIN-SUFFIX,a.com\nDOMAIN,www.b.com",
+		"lists/b.list": "DOMAIN-SUFFIX,a.com\nIP-CIDR,10.0.0.0/8\n",
+	})
+	provider := config.RuleProvider{
+		Name: "lists", Type: "classical", Behavior: "classical", Format: FormatSurge,
+		URL: "file://" + filepath.ToSlash(filepath.Join(dir, "lists")),
+	}
+	output := filepath.Join(t.TempDir(), "lists.yaml")
+
+	ru := NewRuleUpdater(config.DefaultConfig())
+	result, err := ru.downloadAndProcessRule(context.Background(), provider, output)
+	if err != nil || !result.changed {
+		t.Fatalf("changed = %v, err = %v", result.changed, err)
+	}
+	f, err := os.Open(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	want := "payload:\n  - 'DOMAIN-SUFFIX,a.com'\n  - 'DOMAIN,www.b.com'\n  - 'IP-CIDR,10.0.0.0/8'\n"
+	if string(data) != want {
+		t.Errorf("规则文件 = %q, 期望 %q", data, want)
+	}
+}
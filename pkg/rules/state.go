@@ -0,0 +1,98 @@
+package rules
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// providerState 记录规则提供者上一次成功下载时的校验信息
+type providerState struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	ContentHash  string    `json:"content_hash"`
+	Type         string    `json:"type"`
+	Behavior     string    `json:"behavior,omitempty"`
+	Format       string    `json:"format,omitempty"`
+	Transforms   string    `json:"transforms,omitempty"` // 转换步骤的摘要，转换步骤变化后需要重新处理
+	Overrides    string    `json:"overrides,omitempty"`  // 生效的覆盖条目的摘要，覆盖条目变化或过期后需要重新处理
+	Verify       string    `json:"verify,omitempty"`     // 完整性校验设置的摘要，校验设置变化后需要重新下载并校验
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// getStatePath 获取规则状态文件路径
+func getStatePath() string {
+	return filepath.Join(utils.GetConfigDir(), "rule_state.json")
+}
+
+// loadProviderStates 从文件加载规则状态，文件不存在或损坏时返回空状态
+func loadProviderStates() map[string]providerState {
+	states := make(map[string]providerState)
+
+	data, err := os.ReadFile(getStatePath())
+	if err != nil {
+		return states
+	}
+
+	if err := json.Unmarshal(data, &states); err != nil {
+		logger.Warnf("解析规则状态文件失败，将重新下载所有规则: %v", err)
+		return make(map[string]providerState)
+	}
+
+	return states
+}
+
+// saveProviderStates 保存规则状态到文件
+func saveProviderStates(states map[string]providerState) error {
+	statePath := getStatePath()
+	if err := utils.EnsureDirExists(filepath.Dir(statePath)); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(statePath, data, 0644)
+}
+
+// getState 获取指定规则提供者的状态（线程安全）
+func (ru *RuleUpdater) getState(name string) (providerState, bool) {
+	ru.stateMutex.Lock()
+	defer ru.stateMutex.Unlock()
+
+	state, ok := ru.states[name]
+	return state, ok
+}
+
+// setState 设置指定规则提供者的状态（线程安全）
+func (ru *RuleUpdater) setState(name string, state providerState) {
+	ru.stateMutex.Lock()
+	defer ru.stateMutex.Unlock()
+
+	ru.states[name] = state
+}
+
+// persistStates 将当前状态写入磁盘
+func (ru *RuleUpdater) persistStates() {
+	ru.stateMutex.Lock()
+	defer ru.stateMutex.Unlock()
+
+	if err := saveProviderStates(ru.states); err != nil {
+		logger.Warnf("保存规则状态失败: %v", err)
+	}
+}
+
+// hashContent 计算内容的SHA-256摘要
+func hashContent(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
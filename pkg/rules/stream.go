@@ -0,0 +1,217 @@
+package rules
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+const (
+	// maxLineLength 单行的最大长度，规则条目不会这么长，超长的行整行丢弃
+	maxLineLength = 64 * 1024
+	// longLineSample 超长行报告时保留的开头长度
+	longLineSample = 64
+	// formatSampleSize 自动识别格式时读取的内容长度
+	formatSampleSize = 64 * 1024
+	// minBodySize 有效规则内容的最小长度
+	minBodySize = 10
+)
+
+// SizeLimitError 表示规则内容超过了允许的最大长度
+type SizeLimitError struct {
+	Limit int64
+}
+
+func (e *SizeLimitError) Error() string {
+	return fmt.Sprintf("规则内容超过大小限制(%d字节)", e.Limit)
+}
+
+// maxRuleSize 返回规则提供者原始内容的最大字节数，规则未设置时使用全局配置
+func (ru *RuleUpdater) maxRuleSize(provider config.RuleProvider) int64 {
+	if provider.MaxSize > 0 {
+		return provider.MaxSize
+	}
+	return ru.cfg.GetMaxRuleSize()
+}
+
+// getSpoolDir 获取下载内容的临时目录
+//
+// 使用配置目录而不是系统临时目录，后者可能位于内存文件系统中
+func getSpoolDir() string {
+	return filepath.Join(utils.GetConfigDir(), "rules_download")
+}
+
+// ruleBody 表示下载或读取到的规则原始内容，保存在临时文件中，使用后需要调用 remove
+type ruleBody struct {
+	path string
+	size int64
+	hash string // 原始内容的 SHA-256
+}
+
+// open 打开原始内容
+func (b *ruleBody) open() (*os.File, error) {
+	return os.Open(b.path)
+}
+
+// readAll 读取全部原始内容，只用于签名校验等必须使用完整内容的场合
+func (b *ruleBody) readAll() ([]byte, error) {
+	return os.ReadFile(b.path)
+}
+
+// remove 删除临时文件
+func (b *ruleBody) remove() {
+	if b != nil {
+		os.Remove(b.path)
+	}
+}
+
+// spoolWriter 将内容写入临时文件并计算摘要，超过大小限制时返回 *SizeLimitError
+type spoolWriter struct {
+	file   *os.File
+	buf    *bufio.Writer
+	hasher hash.Hash
+	limit  int64
+	size   int64
+}
+
+// newSpool 在下载临时目录中创建临时文件，limit 为0表示不限制大小
+func newSpool(limit int64) (*spoolWriter, error) {
+	dir := getSpoolDir()
+	if err := utils.EnsureDirExists(dir); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(dir, "body-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spoolWriter{file: f, hasher: sha256.New(), limit: limit}
+	s.buf = bufio.NewWriterSize(io.MultiWriter(f, s.hasher), 64*1024)
+	return s, nil
+}
+
+func (s *spoolWriter) Write(p []byte) (int, error) {
+	if s.limit > 0 && s.size+int64(len(p)) > s.limit {
+		return 0, &SizeLimitError{Limit: s.limit}
+	}
+	n, err := s.buf.Write(p)
+	s.size += int64(n)
+	return n, err
+}
+
+// finish 完成写入并返回原始内容
+func (s *spoolWriter) finish() (*ruleBody, error) {
+	err := s.buf.Flush()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(s.file.Name())
+		return nil, err
+	}
+	return &ruleBody{
+		path: s.file.Name(),
+		size: s.size,
+		hash: hex.EncodeToString(s.hasher.Sum(nil)),
+	}, nil
+}
+
+// abort 放弃写入并删除临时文件
+func (s *spoolWriter) abort() {
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// spoolBody 将 r 的内容写入临时文件，内容超过 limit 时返回 *SizeLimitError
+func spoolBody(r io.Reader, limit int64) (*ruleBody, error) {
+	spool, err := newSpool(limit)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(spool, r); err != nil {
+		spool.abort()
+		return nil, err
+	}
+	return spool.finish()
+}
+
+// forEachLine 逐行读取内容并去掉行尾的换行符。超过 maxLineLength 的行不传给 fn，
+// 而是把开头部分传给 tooLong，tooLong 为 nil 时直接丢弃
+func forEachLine(r io.Reader, fn func(line string), tooLong func(prefix string)) error {
+	reader := bufio.NewReaderSize(r, maxLineLength)
+	var prefix []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// 行比缓冲区长，只保留开头用于报告，其余部分丢弃
+			if prefix == nil {
+				prefix = append([]byte{}, chunk[:min(len(chunk), longLineSample)]...)
+			}
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if prefix != nil {
+			if tooLong != nil {
+				tooLong(string(prefix))
+			}
+			prefix = nil
+		} else {
+			line := bytes.TrimSuffix(chunk, []byte("\n"))
+			line = bytes.TrimSuffix(line, []byte("\r"))
+			if len(line) > 0 || err == nil {
+				fn(string(line))
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readSample 读取内容开头的一部分用于识别格式，截断在最后一个完整行
+func readSample(r io.Reader) (string, error) {
+	buf := make([]byte, formatSampleSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	sample := buf[:n]
+	if n == formatSampleSize {
+		if i := bytes.LastIndexByte(sample, '\n'); i >= 0 {
+			sample = sample[:i+1]
+		}
+	}
+	return string(sample), nil
+}
+
+// hashFile 计算文件内容的 SHA-256
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// createTempBeside 在目标文件所在目录创建临时文件，用于写入后原子替换目标文件
+func createTempBeside(path string) (*os.File, error) {
+	return os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+}
@@ -0,0 +1,298 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestForEachLine 检查换行符处理和超长行丢弃
+func TestForEachLine(t *testing.T) {
+	long := strings.Repeat("a", maxLineLength+100)
+	input := "a.com\r\n\nb.com\n" + long + "\nc.com\n" + long
+
+	var lines, prefixes []string
+	if err := forEachLine(strings.NewReader(input), func(line string) {
+		lines = append(lines, line)
+	}, func(prefix string) {
+		prefixes = append(prefixes, prefix)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.com", "", "b.com", "c.com"}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("行 = %q, 期望 %q", lines, want)
+	}
+	wantPrefixes := []string{long[:longLineSample], long[:longLineSample]}
+	if !reflect.DeepEqual(prefixes, wantPrefixes) {
+		t.Errorf("超长行 = %q, 期望 %q", prefixes, wantPrefixes)
+	}
+}
+
+// TestReadPayload 检查逐行读取与完整解析 YAML 的结果一致
+func TestReadPayload(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		simple bool
+	}{
+		{"规范格式", "payload:\n  - '+.example.com'\n  - 'it''s.example.net'\n", true},
+		{"普通标量", "# comment\n---\npayload: # list\n- DOMAIN-SUFFIX,example.com\n- 2001:db8::/32\n\n- \"a.com\"\n", true},
+		{"flow 列表", "payload: [a.com, b.com]\n", false},
+		{"其他键", "payload:\n  - a.com\nextra: 1\n", false},
+		{"行尾注释", "payload:\n  - a.com # comment\n", false},
+		{"缩进不一致", "payload:\n  - a.com\n    - b.com\n", false},
+		{"多行标量", "payload:\n  - a.com\n    b.com\n", false},
+		{"转义", "payload:\n  - \"a\\u002ecom\"\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var scanned []string
+			simple, err := scanSimplePayload(strings.NewReader(tt.input), func(value string) {
+				scanned = append(scanned, value)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if simple != tt.simple {
+				t.Errorf("逐行读取 = %v, 期望 %v", simple, tt.simple)
+			}
+
+			var got []string
+			err = readPayload(strings.NewReader(tt.input), func(value string) {
+				got = append(got, value)
+			}, func() {
+				got = nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries, err := parseClashPayload(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, entry := range entries {
+				want = append(want, entry.value)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("得到 %q, 期望 %q", got, want)
+			}
+		})
+	}
+}
+
+// TestSizeLimit 检查超过大小限制的下载和本地文件被拒绝且不可重试
+func TestSizeLimit(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	content := strings.Repeat("example.com\n", 200)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 分块传输时没有 Content-Length，只能在读取时发现超出限制
+		if r.URL.Path == "/chunked.txt" {
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	localPath := filepath.Join(t.TempDir(), "direct.txt")
+	if err := os.WriteFile(localPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ru := NewRuleUpdater(config.DefaultConfig())
+	output := filepath.Join(t.TempDir(), "direct.yaml")
+	for _, url := range []string{server.URL + "/direct.txt", server.URL + "/chunked.txt", "file://" + filepath.ToSlash(localPath)} {
+		provider := config.RuleProvider{Name: "direct", URL: url, Type: "domain", Behavior: "domain", MaxSize: 1024}
+		_, err := ru.downloadAndProcessRule(context.Background(), provider, output)
+		var sizeErr *SizeLimitError
+		if !errors.As(err, &sizeErr) || isRetryable(err) {
+			t.Errorf("%s: 错误 = %v, 期望不可重试的 *SizeLimitError", url, err)
+		}
+		if fileExists(output) {
+			t.Errorf("%s: 超出限制时不应写入规则文件", url)
+		}
+
+		provider.MaxSize = 0
+		if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err != nil {
+			t.Errorf("%s: 使用默认限制时下载失败: %v", url, err)
+		}
+		os.Remove(output)
+	}
+
+	// 临时文件都已删除
+	if entries, _ := os.ReadDir(getSpoolDir()); len(entries) > 0 {
+		t.Errorf("下载临时目录中残留 %d 个文件", len(entries))
+	}
+}
+
+// fileExists 判断文件是否存在
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// writeLargeList 生成约 size 字节、每行一个域名的规则列表
+func writeLargeList(b *testing.B, size int) string {
+	return writeLargeFile(b, size, "", "host-%d.example-%d.com\n")
+}
+
+// writeLargeFile 生成以 header 开头、约 size 字节的文件，每行按 line 格式写入序号和序号除以5000的余数
+func writeLargeFile(b *testing.B, size int, header, line string) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "large.txt")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	written := 0
+	for i := 0; written < size; i++ {
+		n, _ := fmt.Fprintf(&buf, line, i, i%5000)
+		written += n
+		if buf.Len() > 1<<20 {
+			buf.WriteTo(f)
+		}
+	}
+	buf.WriteTo(f)
+	return path
+}
+
+// measurePeakHeap 运行 fn 并定期采样，返回期间堆内存使用的峰值（字节）
+func measurePeakHeap(fn func()) uint64 {
+	runtime.GC()
+	var peak atomic.Uint64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		var stats runtime.MemStats
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapInuse > peak.Load() {
+				peak.Store(stats.HeapInuse)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+	fn()
+	close(done)
+	<-stopped
+	return peak.Load()
+}
+
+// maxStreamPeakHeap 处理 50 MB 规则列表时允许的堆内存峰值，与列表大小和条目数量无关
+const maxStreamPeakHeap = 32 << 20
+
+// BenchmarkConvertRuleStream 逐行转换 50 MB 的规则列表并写入文件，报告堆内存峰值，超过 maxStreamPeakHeap 时失败
+//
+// 去重和网段聚合使用外部排序，内存中只保留 sortChunkSize 大小的记录
+func BenchmarkConvertRuleStream(b *testing.B) {
+	b.Setenv("HOME", b.TempDir())
+	const size = 50 << 20
+	input := writeLargeList(b, size)
+	output := filepath.Join(b.TempDir(), "large.yaml")
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peak := measurePeakHeap(func() {
+			in, err := os.Open(input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer in.Close()
+			out, err := os.Create(output)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer out.Close()
+			if _, err := convertRuleStream(in, out, FormatAuto, "domain", "large", 1, nil, nil); err != nil {
+				b.Fatal(err)
+			}
+		})
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		if peak > maxStreamPeakHeap {
+			b.Fatalf("堆内存峰值 %d MB, 超过 %d MB", peak>>20, maxStreamPeakHeap>>20)
+		}
+	}
+}
+
+// BenchmarkSyncBypass 合并两个共 50 MB 的规则文件并同步到CFW绕过配置，报告堆内存峰值，
+// 超过 maxStreamPeakHeap 时失败
+func BenchmarkSyncBypass(b *testing.B) {
+	home := b.TempDir()
+	b.Setenv("HOME", home)
+	settingsPath := filepath.Join(home, ".config", "clash", "cfw-settings.yaml")
+	if err := os.MkdirAll(filepath.Dir(settingsPath), 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := os.WriteFile(settingsPath, []byte("bypassText: |\n  bypass:\n    - localhost\n"), 0644); err != nil {
+		b.Fatal(err)
+	}
+
+	const size = 25 << 20
+	paths := []string{
+		writeLargeFile(b, size, "payload:\n", "  - 'host-%d.example-%d.com'\n"),
+		writeLargeFile(b, size, "payload:\n", "  - '+.sub-%d.example-%d.com'\n"),
+	}
+	ru := NewRuleUpdater(config.DefaultConfig())
+
+	b.SetBytes(2 * size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peak := measurePeakHeap(func() {
+			if _, err := ru.syncBypass(paths); err != nil {
+				b.Fatal(err)
+			}
+		})
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		if peak > maxStreamPeakHeap {
+			b.Fatalf("堆内存峰值 %d MB, 超过 %d MB", peak>>20, maxStreamPeakHeap>>20)
+		}
+	}
+}
+
+// BenchmarkConvertRulesInMemory 作为对比，将 50 MB 的规则列表读入内存后转换
+func BenchmarkConvertRulesInMemory(b *testing.B) {
+	const size = 50 << 20
+	input := writeLargeList(b, size)
+
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		peak := measurePeakHeap(func() {
+			data, err := os.ReadFile(input)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, _, err := convertRules(string(data), FormatAuto, "domain", "large", 1); err != nil {
+				b.Fatal(err)
+			}
+		})
+		b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+	}
+}
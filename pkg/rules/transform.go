@@ -0,0 +1,399 @@
+package rules
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// maxPreviewEntries 预览中返回的转换结果条目数量
+const maxPreviewEntries = 50
+
+// transformStep 处理一行，返回处理后的行，返回 false 表示去掉该行
+type transformStep func(line string) (string, bool)
+
+// TransformChange 记录一行被改写前后的内容
+type TransformChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// transformer 在格式转换之前依次对每一行执行规则的过滤和改写
+type transformer struct {
+	steps     []transformStep
+	filtered  int               // 被去掉的行
+	rewritten int               // 被改写的行
+	removed   []string          // 被去掉的行示例
+	changes   []TransformChange // 被改写的行示例
+}
+
+// newTransformer 编译规则的转换步骤，没有转换步骤时返回 nil
+func newTransformer(transforms []config.Transform, ruleType string) (*transformer, error) {
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+	t := &transformer{}
+	for i, tr := range transforms {
+		step, err := compileTransform(tr, ruleType)
+		if err != nil {
+			return nil, fmt.Errorf("第 %d 个转换 (%s) 无效: %v", i+1, tr.Type, err)
+		}
+		t.steps = append(t.steps, step)
+	}
+	return t, nil
+}
+
+// transformsDigest 返回转换步骤的摘要，没有转换步骤时返回空字符串
+func transformsDigest(transforms []config.Transform) string {
+	if len(transforms) == 0 {
+		return ""
+	}
+	data, _ := json.Marshal(transforms)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// ValidateTransforms 检查规则提供者的转换步骤是否有效
+func ValidateTransforms(provider config.RuleProvider) error {
+	_, err := newTransformer(provider.Transforms, payloadType(provider))
+	return err
+}
+
+// compileTransform 编译单个转换步骤
+func compileTransform(tr config.Transform, ruleType string) (transformStep, error) {
+	switch tr.Type {
+	case config.TransformInclude, config.TransformExclude, config.TransformRewrite:
+		if tr.Pattern == "" {
+			return nil, fmt.Errorf("缺少 pattern")
+		}
+		re, err := regexp.Compile(tr.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("无效的正则表达式: %v", err)
+		}
+		switch tr.Type {
+		case config.TransformInclude:
+			return func(line string) (string, bool) { return line, re.MatchString(line) }, nil
+		case config.TransformExclude:
+			return func(line string) (string, bool) { return line, !re.MatchString(line) }, nil
+		}
+		return func(line string) (string, bool) {
+			line = strings.TrimSpace(re.ReplaceAllString(line, tr.Replace))
+			return line, line != ""
+		}, nil
+
+	case config.TransformIncludeSuffix, config.TransformExcludeSuffix:
+		suffixes := make([]string, 0, len(tr.Values))
+		for _, value := range tr.Values {
+			if suffix := trimDomainPrefix(strings.ToLower(strings.TrimSpace(value))); suffix != "" {
+				suffixes = append(suffixes, suffix)
+			}
+		}
+		if len(suffixes) == 0 {
+			return nil, fmt.Errorf("缺少 values")
+		}
+		include := tr.Type == config.TransformIncludeSuffix
+		return func(line string) (string, bool) {
+			return line, hasDomainSuffix(lineDomain(line), suffixes) == include
+		}, nil
+
+	case config.TransformIncludeKeyword, config.TransformExcludeKeyword:
+		var keywords []string
+		for _, value := range tr.Values {
+			if value != "" {
+				keywords = append(keywords, value)
+			}
+		}
+		if len(keywords) == 0 {
+			return nil, fmt.Errorf("缺少 values")
+		}
+		include := tr.Type == config.TransformIncludeKeyword
+		return func(line string) (string, bool) {
+			matched := false
+			for _, keyword := range keywords {
+				if strings.Contains(line, keyword) {
+					matched = true
+					break
+				}
+			}
+			return line, matched == include
+		}, nil
+
+	case config.TransformConvertPrefix:
+		return func(line string) (string, bool) { return convertPrefix(line, ruleType) }, nil
+
+	default:
+		return nil, fmt.Errorf("不支持的转换类型")
+	}
+}
+
+// apply 依次执行转换步骤，返回 false 表示去掉该行
+func (t *transformer) apply(line string) (string, bool) {
+	if t == nil {
+		return line, true
+	}
+	original := line
+	for _, step := range t.steps {
+		var keep bool
+		if line, keep = step(line); !keep {
+			t.filtered++
+			if len(t.removed) < maxReportedInvalid {
+				t.removed = append(t.removed, original)
+			}
+			return "", false
+		}
+	}
+	if line != original {
+		t.rewritten++
+		if len(t.changes) < maxReportedInvalid {
+			t.changes = append(t.changes, TransformChange{From: original, To: line})
+		}
+	}
+	return line, true
+}
+
+// reset 清空统计，用于重新读取内容
+func (t *transformer) reset() {
+	if t != nil {
+		t.filtered, t.rewritten = 0, 0
+		t.removed, t.changes = nil, nil
+	}
+}
+
+// trimDomainPrefix 去掉域名的 +.、*. 和 . 前缀
+func trimDomainPrefix(domain string) string {
+	for _, prefix := range []string{"+.", "*.", "."} {
+		domain = strings.TrimPrefix(domain, prefix)
+	}
+	return domain
+}
+
+// hasDomainSuffix 判断域名是否等于某个后缀或是其子域名
+func hasDomainSuffix(domain string, suffixes []string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, suffix := range suffixes {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// geositePrefixes v2ray 域名列表使用的前缀
+var geositePrefixes = []string{"full:", "domain:", "keyword:", "regexp:"}
+
+// lineDomain 从任意格式的一行中取出域名，取不到时返回空字符串
+func lineDomain(line string) string {
+	value := strings.TrimSpace(line)
+	switch {
+	case dnsmasqLinePattern.MatchString(value):
+		m := dnsmasqLinePattern.FindStringSubmatch(value)
+		value = strings.Split(strings.Trim(m[1], "/"), "/")[0]
+	case isHostsLine(value):
+		value = strings.Fields(value)[1]
+	case strings.Contains(value, ","):
+		// DOMAIN-SUFFIX,example.com,proxy
+		value = strings.Split(value, ",")[1]
+	default:
+		for _, prefix := range geositePrefixes {
+			if strings.HasPrefix(strings.ToLower(value), prefix) {
+				value = value[len(prefix):]
+				break
+			}
+		}
+		// 去掉 v2ray 的属性，如 "example.com @cn"
+		if fields := strings.Fields(value); len(fields) > 0 {
+			value = fields[0]
+		}
+	}
+	return trimDomainPrefix(strings.ToLower(strings.TrimSpace(value)))
+}
+
+// convertPrefix 将 v2ray 域名列表的前缀转换为 Clash 写法
+//
+// full: 为完整域名，domain: 为域名及其子域名；keyword: 和 regexp: 只能用于 classical 规则，
+// 其他规则类型中去掉这些行。没有前缀的行保持不变
+func convertPrefix(line, ruleType string) (string, bool) {
+	i := strings.IndexByte(line, ':')
+	if i < 0 {
+		return line, true
+	}
+	prefix := strings.ToLower(line[:i+1])
+	value := strings.TrimSpace(line[i+1:])
+	// 去掉 v2ray 的属性，如 "domain:example.com @cn"
+	if fields := strings.Fields(value); len(fields) > 0 && prefix != "regexp:" {
+		value = fields[0]
+	}
+
+	if ruleType == "classical" {
+		switch prefix {
+		case "full:":
+			return "DOMAIN," + value, true
+		case "domain:":
+			return "DOMAIN-SUFFIX," + value, true
+		case "keyword:":
+			return "DOMAIN-KEYWORD," + value, true
+		case "regexp:":
+			return "DOMAIN-REGEX," + value, true
+		}
+		return line, true
+	}
+
+	switch prefix {
+	case "full:":
+		return value, ruleType != "ipcidr"
+	case "domain:":
+		return "+." + value, ruleType != "ipcidr"
+	case "keyword:", "regexp:":
+		return "", false
+	}
+	return line, true
+}
+
+// TransformPreview 表示转换步骤对当前上游内容的效果
+type TransformPreview struct {
+	Format        string            `json:"format"`
+	Bytes         int64             `json:"bytes"`
+	EntriesBefore int               `json:"entries_before"` // 不做转换时的条目数量
+	EntriesAfter  int               `json:"entries_after"`  // 转换后的条目数量
+	Filtered      int               `json:"filtered"`       // 被去掉的行
+	Rewritten     int               `json:"rewritten"`      // 被改写的行
+	Removed       []string          `json:"removed,omitempty"`
+	Changes       []TransformChange `json:"changes,omitempty"`
+	Entries       []string          `json:"entries,omitempty"` // 转换结果的前若干条
+	Invalid       []string          `json:"invalid,omitempty"` // 转换后的无效条目示例
+}
+
+// ValidatePreviewSource 检查预览的规则来源
+//
+// 预览可以提交任意规则，为避免通过预览读取任意本地文件，只允许 HTTP(S) 地址、内联条目和组合规则；
+// 本地来源和 CA 证书文件必须已被某个已配置的规则使用
+func (ru *RuleUpdater) ValidatePreviewSource(provider config.RuleProvider) error {
+	configured := func(match func(p config.RuleProvider) bool) bool {
+		for _, p := range ru.cfg.RuleProviders {
+			if match(p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch provider.SourceKind() {
+	case config.SourceFile:
+		if !configured(func(p config.RuleProvider) bool {
+			return p.SourceKind() == config.SourceFile && p.URL == provider.URL
+		}) {
+			return fmt.Errorf("只能预览已配置的规则使用的本地来源")
+		}
+	case config.SourceRemote:
+		u, err := url.Parse(provider.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("预览只支持 HTTP(S) 地址: %s", provider.URL)
+		}
+	}
+
+	if provider.HTTP != nil && provider.HTTP.CAFile != "" && !configured(func(p config.RuleProvider) bool {
+		return p.HTTP != nil && p.HTTP.CAFile == provider.HTTP.CAFile
+	}) {
+		return fmt.Errorf("只能使用已配置的规则使用的 CA 证书文件")
+	}
+	return nil
+}
+
+// PreviewTransforms 下载规则的当前内容，返回执行转换步骤（以及覆盖条目）前后的对比，不修改规则文件
+//
+// 规则来源需要通过 ValidatePreviewSource 的检查
+func (ru *RuleUpdater) PreviewTransforms(ctx context.Context, provider config.RuleProvider) (*TransformPreview, error) {
+	if err := ru.ValidatePreviewSource(provider); err != nil {
+		return nil, err
+	}
+
+	tr, err := newTransformer(provider.Transforms, payloadType(provider))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ru.fetchSource(ctx, provider, providerState{}, false)
+	if err != nil {
+		return nil, err
+	}
+	body := resp.body
+	defer body.remove()
+
+	convert := func(tr *transformer, ov *overrideSet, w io.Writer) (conversionReport, error) {
+		in, err := body.open()
+		if err != nil {
+			return conversionReport{}, errors.Wrap(err, "读取规则内容失败")
+		}
+		defer in.Close()
+		// 预览不因无效条目过多而失败
+		return convertRuleStream(in, w, provider.Format, payloadType(provider), provider.Name, 1, tr, ov)
+	}
+
+	before, err := convert(nil, nil, io.Discard)
+	if err != nil {
+		return nil, err
+	}
+	head := &headWriter{limit: 64 * 1024}
+	overrides, _ := ru.providerOverrides(provider, time.Now())
+	after, err := convert(tr, overrides, head)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &TransformPreview{
+		Format:        after.format,
+		Bytes:         body.size,
+		EntriesBefore: before.entries,
+		EntriesAfter:  after.entries,
+		Invalid:       after.invalid,
+	}
+	if tr != nil {
+		preview.Filtered, preview.Rewritten = tr.filtered, tr.rewritten
+		preview.Removed, preview.Changes = tr.removed, tr.changes
+	}
+	// 输出是规范格式，截断在最后一个完整行后可以逐行读取
+	scanSimplePayload(strings.NewReader(head.complete()), func(value string) {
+		if len(preview.Entries) < maxPreviewEntries {
+			preview.Entries = append(preview.Entries, value)
+		}
+	})
+	return preview, nil
+}
+
+// headWriter 只保存写入内容的开头部分
+type headWriter struct {
+	limit int
+	buf   []byte
+}
+
+func (h *headWriter) Write(p []byte) (int, error) {
+	if room := h.limit - len(h.buf); room > 0 {
+		if len(p) < room {
+			room = len(p)
+		}
+		h.buf = append(h.buf, p[:room]...)
+	}
+	return len(p), nil
+}
+
+// complete 返回截断在最后一个完整行的内容
+func (h *headWriter) complete() string {
+	s := string(h.buf)
+	if i := strings.LastIndexByte(s, '\n'); i >= 0 {
+		return s[:i+1]
+	}
+	return ""
+}
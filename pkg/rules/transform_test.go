@@ -0,0 +1,215 @@
+package rules
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// transformEntries 使用转换步骤转换内容，返回写入的条目
+func transformEntries(t *testing.T, content, ruleType string, transforms []config.Transform) ([]string, *transformer) {
+	t.Helper()
+	tr, err := newTransformer(transforms, ruleType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	if _, err := convertRuleStream(strings.NewReader(content), &out, FormatAuto, ruleType, "test", 1, tr, nil); err != nil {
+		t.Fatal(err)
+	}
+	var entries []string
+	if _, err := scanSimplePayload(strings.NewReader(out.String()), func(value string) {
+		entries = append(entries, value)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return entries, tr
+}
+
+// TestTransforms 检查各类转换步骤按顺序执行
+func TestTransforms(t *testing.T) {
+	content := "full:a.example.com\ndomain:example.org @cn\nkeyword:tracker\nregexp:^ad\\.\nads.example.net\ncdn.example.net\n"
+
+	tests := []struct {
+		name       string
+		ruleType   string
+		transforms []config.Transform
+		want       []string
+	}{
+		{"转换前缀", "domain", []config.Transform{
+			{Type: config.TransformConvertPrefix},
+		}, []string{"a.example.com", "+.example.org", "ads.example.net", "cdn.example.net"}},
+		{"classical 转换前缀", "classical", []config.Transform{
+			{Type: config.TransformConvertPrefix},
+			{Type: config.TransformExcludeSuffix, Values: []string{"example.net"}},
+		}, []string{"DOMAIN,a.example.com", "DOMAIN-SUFFIX,example.org", "DOMAIN-KEYWORD,tracker", "DOMAIN-REGEX,^ad\\."}},
+		{"正则包含", "domain", []config.Transform{
+			{Type: config.TransformInclude, Pattern: `\.net$`},
+		}, []string{"ads.example.net", "cdn.example.net"}},
+		{"正则排除", "domain", []config.Transform{
+			{Type: config.TransformConvertPrefix},
+			{Type: config.TransformExclude, Pattern: `^ads\.`},
+		}, []string{"a.example.com", "+.example.org", "cdn.example.net"}},
+		{"后缀包含", "domain", []config.Transform{
+			{Type: config.TransformIncludeSuffix, Values: []string{"+.example.org", "example.com"}},
+			{Type: config.TransformConvertPrefix},
+		}, []string{"a.example.com", "+.example.org"}},
+		{"关键字排除", "domain", []config.Transform{
+			{Type: config.TransformExcludeKeyword, Values: []string{"ads", ":"}},
+		}, []string{"cdn.example.net"}},
+		{"改写", "domain", []config.Transform{
+			{Type: config.TransformInclude, Pattern: `example\.net$`},
+			{Type: config.TransformRewrite, Pattern: `^[^.]+\.`, Replace: "+."},
+		}, []string{"+.example.net"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _ := transformEntries(t, content, tt.ruleType, tt.transforms)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("得到 %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestValidateTransforms 检查无效的转换步骤被拒绝
+func TestValidateTransforms(t *testing.T) {
+	tests := []struct {
+		transform config.Transform
+		valid     bool
+	}{
+		{config.Transform{Type: config.TransformInclude, Pattern: "^a"}, true},
+		{config.Transform{Type: config.TransformInclude}, false},
+		{config.Transform{Type: config.TransformRewrite, Pattern: "("}, false},
+		{config.Transform{Type: config.TransformIncludeSuffix, Values: []string{""}}, false},
+		{config.Transform{Type: config.TransformExcludeKeyword, Values: []string{"ad"}}, true},
+		{config.Transform{Type: config.TransformConvertPrefix}, true},
+		{config.Transform{Type: "sort"}, false},
+	}
+	for _, tt := range tests {
+		provider := config.RuleProvider{Type: "domain", Transforms: []config.Transform{tt.transform}}
+		if err := ValidateTransforms(provider); (err == nil) != tt.valid {
+			t.Errorf("ValidateTransforms(%+v) = %v", tt.transform, err)
+		}
+	}
+}
+
+// TestLineDomain 检查从各种格式的行中取出域名
+func TestLineDomain(t *testing.T) {
+	tests := map[string]string{
+		"Example.COM":                         "example.com",
+		"+.example.com":                       "example.com",
+		"domain:example.com @cn":              "example.com",
+		"full:a.example.com":                  "a.example.com",
+		"DOMAIN-SUFFIX,example.com,proxy":     "example.com",
+		"server=/example.com/114.114.114.114": "example.com",
+		"0.0.0.0 ads.example.com":             "ads.example.com",
+		"IP-CIDR,10.0.0.0/8,no-resolve":       "10.0.0.0/8",
+	}
+	for line, want := range tests {
+		if got := lineDomain(line); got != want {
+			t.Errorf("lineDomain(%q) = %q, 期望 %q", line, got, want)
+		}
+	}
+}
+
+// TestPreviewTransforms 检查预览返回转换前后的对比且不写入规则文件
+func TestPreviewTransforms(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ru := NewRuleUpdater(config.DefaultConfig())
+
+	provider := config.RuleProvider{
+		Name:     "preview",
+		Type:     "domain",
+		Behavior: "domain",
+		Entries:  []string{"full:a.example.com", "domain:example.org", "keyword:ads", "b.example.net"},
+		Transforms: []config.Transform{
+			{Type: config.TransformConvertPrefix},
+			{Type: config.TransformExcludeSuffix, Values: []string{"example.net"}},
+		},
+	}
+	preview, err := ru.PreviewTransforms(context.Background(), provider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 不做转换时带前缀的行都是无效条目
+	if preview.EntriesBefore != 1 || preview.EntriesAfter != 2 {
+		t.Errorf("条目数量 = %d -> %d, 期望 1 -> 2", preview.EntriesBefore, preview.EntriesAfter)
+	}
+	if preview.Filtered != 2 || preview.Rewritten != 2 {
+		t.Errorf("去掉 %d 行、改写 %d 行, 期望 2 和 2", preview.Filtered, preview.Rewritten)
+	}
+	if want := []string{"a.example.com", "+.example.org"}; !reflect.DeepEqual(preview.Entries, want) {
+		t.Errorf("预览条目 = %q, 期望 %q", preview.Entries, want)
+	}
+	if want := []string{"keyword:ads", "b.example.net"}; !reflect.DeepEqual(preview.Removed, want) {
+		t.Errorf("去掉的行 = %q, 期望 %q", preview.Removed, want)
+	}
+}
+
+// TestPreviewSource 检查预览只能读取 HTTP(S) 地址和已配置的规则使用的本地文件
+func TestPreviewSource(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	listed := filepath.Join(t.TempDir(), "listed.txt")
+	if err := os.WriteFile(listed, []byte("listed.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := config.DefaultConfig()
+	cfg.RuleProviders = []config.RuleProvider{
+		{Name: "listed", Type: "domain", Behavior: "domain", URL: "file://" + listed, Enabled: true},
+	}
+	ru := NewRuleUpdater(cfg)
+
+	rejected := []config.RuleProvider{
+		{Name: "secret", Type: "domain", Behavior: "domain", URL: "file://" + secret},
+		{Name: "ftp", Type: "domain", Behavior: "domain", URL: "ftp://example.com/list.txt"},
+		{Name: "ca", Type: "domain", Behavior: "domain", URL: "https://example.com/list.txt", HTTP: &config.HTTPOptions{CAFile: secret}},
+	}
+	for _, provider := range rejected {
+		if _, err := ru.PreviewTransforms(context.Background(), provider); err == nil {
+			t.Errorf("预览 %s 应返回错误", provider.Name)
+		}
+	}
+
+	preview, err := ru.PreviewTransforms(context.Background(), config.RuleProvider{
+		Name: "copy", Type: "domain", Behavior: "domain", URL: "file://" + listed,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"listed.example.com"}; !reflect.DeepEqual(preview.Entries, want) {
+		t.Errorf("预览条目 = %q, 期望 %q", preview.Entries, want)
+	}
+}
+
+// TestTransformsInvalidateState 检查修改转换步骤后即使内容未变也会重新处理
+func TestTransformsInvalidateState(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ru := NewRuleUpdater(config.DefaultConfig())
+	output := filepath.Join(t.TempDir(), "list.yaml")
+
+	provider := config.RuleProvider{Name: "list", Type: "domain", Behavior: "domain", Entries: []string{"a.example.com", "b.example.net"}}
+	if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err != nil {
+		t.Fatal(err)
+	}
+
+	provider.Transforms = []config.Transform{{Type: config.TransformExcludeSuffix, Values: []string{"example.net"}}}
+	result, err := ru.downloadAndProcessRule(context.Background(), provider, output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.changed || result.filtered != 1 {
+		t.Errorf("changed = %v, filtered = %d, 期望重新处理并去掉 1 行", result.changed, result.filtered)
+	}
+}
@@ -0,0 +1,236 @@
+package rules
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// 单条更新记录中最多保留的无效条目数量
+const maxReportedInvalid = 20
+
+// ValidationError 表示规则中无效条目过多，整个更新被拒绝
+type ValidationError struct {
+	Invalid int      // 无效条目数量
+	Total   int      // 条目总数（含无效条目）
+	Limit   float64  // 允许的最大无效比例
+	Samples []string // 部分无效条目
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("无效条目过多 (%d/%d，超过 %.0f%%)，可能下载到了错误页面", e.Invalid, e.Total, e.Limit*100)
+}
+
+// invalidEntry 记录一条无效条目及原因
+func invalidEntry(value string, err error) string {
+	return fmt.Sprintf("%s (%v)", value, err)
+}
+
+var (
+	domainLabelPattern = regexp.MustCompile(`^(?:\*|[A-Za-z0-9_](?:[A-Za-z0-9_-]{0,61}[A-Za-z0-9_])?)$`)
+	portPattern        = regexp.MustCompile(`^\d{1,5}(?:[-/]\d{1,5})*$`)
+	digitsPattern      = regexp.MustCompile(`^\d+$`)
+)
+
+// validateDomain 检查域名语法，允许 "+." 和 "." 前缀以及 "*" 通配标签
+func validateDomain(value string, allowPrefix bool) error {
+	domain := value
+	if allowPrefix {
+		if strings.HasPrefix(domain, "+.") {
+			domain = domain[2:]
+		} else if strings.HasPrefix(domain, ".") {
+			domain = domain[1:]
+		}
+	}
+	domain = strings.TrimSuffix(domain, ".")
+
+	if domain == "" {
+		return fmt.Errorf("域名为空")
+	}
+	if len(domain) > 253 {
+		return fmt.Errorf("域名超过253个字符")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !domainLabelPattern.MatchString(label) {
+			return fmt.Errorf("无效的域名标签 %q", label)
+		}
+	}
+	return nil
+}
+
+// validateCIDR 检查 IP 网段，同时接受单个 IP 地址
+func validateCIDR(value string) error {
+	if _, err := netip.ParsePrefix(value); err == nil {
+		return nil
+	}
+	if _, err := netip.ParseAddr(value); err == nil {
+		return nil
+	}
+	return fmt.Errorf("无效的IP网段")
+}
+
+// validateNotEmpty 检查值不为空
+func validateNotEmpty(value string) error {
+	if value == "" {
+		return fmt.Errorf("值为空")
+	}
+	return nil
+}
+
+// validatePort 检查端口或端口范围，如 443、8000-9000、80/443
+func validatePort(value string) error {
+	if !portPattern.MatchString(value) {
+		return fmt.Errorf("无效的端口")
+	}
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == '-' || r == '/' }) {
+		if port, _ := strconv.Atoi(part); port > 65535 {
+			return fmt.Errorf("端口超出范围")
+		}
+	}
+	return nil
+}
+
+// validateDigits 检查值为非负整数，如 ASN 和 UID
+func validateDigits(value string) error {
+	if !digitsPattern.MatchString(value) {
+		return fmt.Errorf("应为数字")
+	}
+	return nil
+}
+
+// validateRegexp 检查正则表达式能否编译
+func validateRegexp(value string) error {
+	if _, err := regexp.Compile(value); err != nil {
+		return fmt.Errorf("无效的正则表达式")
+	}
+	return nil
+}
+
+// validateLogic 检查 AND/OR/NOT 逻辑规则的括号是否匹配
+func validateLogic(value string) error {
+	if !strings.HasPrefix(value, "(") {
+		return fmt.Errorf("逻辑规则应以括号开始")
+	}
+	depth := 0
+	for _, r := range value {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("括号不匹配")
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("括号不匹配")
+	}
+	return nil
+}
+
+// classicalRuleTypes 已知的 classical 规则类型及其取值校验
+var classicalRuleTypes = map[string]func(string) error{
+	"DOMAIN":             func(v string) error { return validateDomain(v, false) },
+	"DOMAIN-SUFFIX":      func(v string) error { return validateDomain(v, false) },
+	"DOMAIN-KEYWORD":     validateNotEmpty,
+	"DOMAIN-WILDCARD":    validateNotEmpty,
+	"DOMAIN-REGEX":       validateRegexp,
+	"GEOSITE":            validateNotEmpty,
+	"GEOIP":              validateNotEmpty,
+	"SRC-GEOIP":          validateNotEmpty,
+	"IP-CIDR":            validateCIDR,
+	"IP-CIDR6":           validateCIDR,
+	"SRC-IP-CIDR":        validateCIDR,
+	"IP-SUFFIX":          validateCIDR,
+	"SRC-IP-SUFFIX":      validateCIDR,
+	"IP-ASN":             validateDigits,
+	"SRC-IP-ASN":         validateDigits,
+	"DST-PORT":           validatePort,
+	"SRC-PORT":           validatePort,
+	"IN-PORT":            validatePort,
+	"PROCESS-NAME":       validateNotEmpty,
+	"PROCESS-PATH":       validateNotEmpty,
+	"PROCESS-NAME-REGEX": validateRegexp,
+	"PROCESS-PATH-REGEX": validateRegexp,
+	"NETWORK": func(v string) error {
+		if v = strings.ToLower(v); v != "tcp" && v != "udp" {
+			return fmt.Errorf("应为 tcp 或 udp")
+		}
+		return nil
+	},
+	"UID":      validateDigits,
+	"IN-TYPE":  validateNotEmpty,
+	"IN-USER":  validateNotEmpty,
+	"IN-NAME":  validateNotEmpty,
+	"AND":      validateLogic,
+	"OR":       validateLogic,
+	"NOT":      validateLogic,
+	"SUB-RULE": validateNotEmpty,
+}
+
+// validateClassical 检查 classical 规则，如 DOMAIN-SUFFIX,example.com 或 IP-CIDR,10.0.0.0/8,no-resolve
+func validateClassical(value string) error {
+	i := strings.IndexByte(value, ',')
+	if i <= 0 {
+		return fmt.Errorf("缺少规则类型")
+	}
+	typ := strings.ToUpper(strings.TrimSpace(value[:i]))
+	check, ok := classicalRuleTypes[typ]
+	if !ok {
+		return fmt.Errorf("未知的规则类型 %s", typ)
+	}
+
+	rest := strings.TrimSpace(value[i+1:])
+	// 逻辑规则的参数中包含逗号，整体校验
+	if typ != "AND" && typ != "OR" && typ != "NOT" {
+		if j := strings.IndexByte(rest, ','); j >= 0 {
+			rest = strings.TrimSpace(rest[:j])
+		}
+	}
+	return check(rest)
+}
+
+// payloadType 返回规则提供者 payload 的类型，classical 等 Clash 行为优先于 Type
+func payloadType(provider config.RuleProvider) string {
+	switch provider.Behavior {
+	case "domain", "ipcidr", "classical":
+		return provider.Behavior
+	}
+	return provider.Type
+}
+
+// maxInvalidRatio 返回规则提供者允许的最大无效条目比例
+func (ru *RuleUpdater) maxInvalidRatio(provider config.RuleProvider) float64 {
+	if provider.MaxInvalidRatio != nil {
+		return *provider.MaxInvalidRatio
+	}
+	return ru.cfg.GetMaxInvalidRatio()
+}
+
+// validateEntry 检查 payload 条目是否符合规则类型
+//
+// domain 和 ipcidr 分别只接受域名和IP网段，classical 只接受 classical 规则，
+// mixed 接受以上任意一种
+func validateEntry(value, ruleType string) error {
+	switch ruleType {
+	case "domain":
+		return validateDomain(value, true)
+	case "ipcidr":
+		return validateCIDR(value)
+	case "classical":
+		return validateClassical(value)
+	default:
+		if strings.Contains(value, ",") {
+			return validateClassical(value)
+		}
+		if validateCIDR(value) == nil {
+			return nil
+		}
+		return validateDomain(value, true)
+	}
+}
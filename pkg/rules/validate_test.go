@@ -0,0 +1,222 @@
+package rules
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestValidateDomain 检查域名语法，domain 类型允许 "+." 和 "." 前缀，classical 规则中的域名不允许
+func TestValidateDomain(t *testing.T) {
+	tests := []struct {
+		value       string
+		allowPrefix bool
+		valid       bool
+	}{
+		{"example.com", false, true},
+		{"www.example.com.", false, true},
+		{"_dmarc.example.com", false, true},
+		{"*.example.com", false, true},
+		{"localhost", false, true},
+		{"xn--fiqs8s.cn", false, true},
+		{"+.example.com", true, true},
+		{".example.com", true, true},
+		{"+.example.com", false, false},
+		{".example.com", false, false},
+		{"+.", true, false},
+		{".", true, false},
+		{"", false, false},
+		{"a..com", false, false},
+		{"-a.com", false, false},
+		{"a-.com", false, false},
+		{"a b.com", false, false},
+		{"bad!.com", false, false},
+		{"例子.com", false, false},
+		{"https://example.com", false, false},
+		{strings.Repeat("a", 63) + ".com", false, true},
+		{strings.Repeat("a", 64) + ".com", false, false},
+		{strings.Repeat("a.", 125) + "abc", false, true},
+		{strings.Repeat("a.", 125) + "abcd", false, false},
+	}
+	for _, tt := range tests {
+		if err := validateDomain(tt.value, tt.allowPrefix); (err == nil) != tt.valid {
+			t.Errorf("validateDomain(%q, %v) = %v, 期望有效 = %v", tt.value, tt.allowPrefix, err, tt.valid)
+		}
+	}
+}
+
+// TestValidateCIDR 检查 IPv4/IPv6 网段和单个地址
+func TestValidateCIDR(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"10.0.0.0/8", true},
+		{"10.1.2.3/8", true},
+		{"1.1.1.1", true},
+		{"0.0.0.0/0", true},
+		{"2001:db8::/32", true},
+		{"::1", true},
+		{"::ffff:10.0.0.0/104", true},
+		{"10.0.0.0/33", false},
+		{"2001:db8::/129", false},
+		{"10.0.0.256/8", false},
+		{"10.0.0/8", false},
+		{"010.0.0.0/8", false},
+		{"10.0.0.0/-1", false},
+		{"example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if err := validateCIDR(tt.value); (err == nil) != tt.valid {
+			t.Errorf("validateCIDR(%q) = %v, 期望有效 = %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+// TestValidateClassical 检查 classical 规则的类型和取值，附加参数（如 no-resolve）不参与校验
+func TestValidateClassical(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"DOMAIN,www.example.com", true},
+		{"domain-suffix,example.com", true},
+		{"DOMAIN, example.com ", true},
+		{"DOMAIN-SUFFIX,+.example.com", false},
+		{"DOMAIN-KEYWORD,google", true},
+		{"DOMAIN-KEYWORD,", false},
+		{"DOMAIN-REGEX,^ad[0-9]+\\.", true},
+		{"DOMAIN-REGEX,^(ad", false},
+		{"GEOIP,CN", true},
+		{"IP-CIDR,10.0.0.0/8,no-resolve", true},
+		{"IP-CIDR6,2001:db8::/32,no-resolve", true},
+		{"IP-CIDR,example.com", false},
+		{"IP-ASN,13335", true},
+		{"IP-ASN,AS13335", false},
+		{"DST-PORT,443", true},
+		{"DST-PORT,8000-9000", true},
+		{"DST-PORT,80/443", true},
+		{"DST-PORT,70000", false},
+		{"DST-PORT,http", false},
+		{"NETWORK,UDP", true},
+		{"NETWORK,icmp", false},
+		{"PROCESS-NAME,curl", true},
+		{"AND,((NETWORK,UDP),(DST-PORT,443))", true},
+		{"NOT,((DOMAIN,example.com))", true},
+		{"OR,((NETWORK,UDP)", false},
+		{"AND,NETWORK,UDP", false},
+		{"FOO,bar", false},
+		{"example.com", false},
+		{",example.com", false},
+	}
+	for _, tt := range tests {
+		if err := validateClassical(tt.value); (err == nil) != tt.valid {
+			t.Errorf("validateClassical(%q) = %v, 期望有效 = %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+// TestValidateEntry 检查条目按规则类型校验，其他类型接受任意一种条目
+func TestValidateEntry(t *testing.T) {
+	tests := []struct {
+		value    string
+		ruleType string
+		valid    bool
+	}{
+		{"+.example.com", "domain", true},
+		{"10.0.0.0/8", "domain", false},
+		{"10.0.0.0/8", "ipcidr", true},
+		{"example.com", "ipcidr", false},
+		{"DOMAIN-SUFFIX,example.com", "classical", true},
+		{"example.com", "classical", false},
+		{"+.example.com", "mixed", true},
+		{"2001:db8::/32", "mixed", true},
+		{"IP-CIDR,10.0.0.0/8", "mixed", true},
+		{"FOO,bar", "mixed", false},
+		{"bad!", "mixed", false},
+	}
+	for _, tt := range tests {
+		if err := validateEntry(tt.value, tt.ruleType); (err == nil) != tt.valid {
+			t.Errorf("validateEntry(%q, %s) = %v, 期望有效 = %v", tt.value, tt.ruleType, err, tt.valid)
+		}
+	}
+}
+
+// TestInvalidRatioThreshold 检查无效条目比例等于上限时接受，超过上限时拒绝，上限为 0 时不允许任何无效条目
+func TestInvalidRatioThreshold(t *testing.T) {
+	// 5 条中 1 条无效，比例为 0.2
+	input := "a.com\nb.com\nc.com\nd.com\nbad!.com\n"
+	tests := []struct {
+		input    string
+		limit    float64
+		accepted bool
+	}{
+		{input, 1, true},
+		{input, 0.2, true},
+		{input, 0.19, false},
+		{input, 0, false},
+		{"a.com\nb.com\n", 0, true},
+		{"bad!.com\n", 1, true},
+		{"bad!.com\n", 0.99, false},
+	}
+	for _, tt := range tests {
+		_, report, err := convertRules(tt.input, FormatPlain, "domain", "test", tt.limit)
+		var validationErr *ValidationError
+		if tt.accepted {
+			if err != nil {
+				t.Errorf("上限 %v: %q 被拒绝: %v", tt.limit, tt.input, err)
+			}
+			continue
+		}
+		if !errors.As(err, &validationErr) {
+			t.Errorf("上限 %v: 期望 *ValidationError, 得到 %v (无效条目 %d)", tt.limit, err, report.invalidCount)
+			continue
+		}
+		if validationErr.Limit != tt.limit || validationErr.Invalid == 0 || len(validationErr.Samples) != validationErr.Invalid {
+			t.Errorf("上限 %v: 错误信息不完整: %+v", tt.limit, validationErr)
+		}
+	}
+}
+
+// TestMaxInvalidRatio 检查全局上限未设置时使用默认值，可以设为 0，规则的设置优先于全局设置
+func TestMaxInvalidRatio(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ratio := func(v float64) *float64 { return &v }
+
+	cfg := config.DefaultConfig()
+	ru := NewRuleUpdater(cfg)
+	provider := inlineProvider("direct", "a.com", "b.com", "c.com", "d.com", "bad!.com")
+
+	tests := []struct {
+		global   *float64
+		provider *float64
+		want     float64
+	}{
+		{nil, nil, 0.2},
+		{ratio(0.5), nil, 0.5},
+		{ratio(0), nil, 0},
+		{ratio(0), ratio(0.2), 0.2},
+		{nil, ratio(0), 0},
+	}
+	for _, tt := range tests {
+		cfg.Validation.MaxInvalidRatio = tt.global
+		provider.MaxInvalidRatio = tt.provider
+		if got := ru.maxInvalidRatio(provider); got != tt.want {
+			t.Errorf("全局 %v, 规则 %v: 上限 = %v, 期望 %v", tt.global, tt.provider, got, tt.want)
+		}
+	}
+
+	// 全局上限为 0 时，含有无效条目的更新被拒绝
+	cfg.Validation.MaxInvalidRatio = ratio(0)
+	provider.MaxInvalidRatio = nil
+	_, err := ru.downloadAndProcessRule(context.Background(), provider, filepath.Join(t.TempDir(), "direct.yaml"))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Errorf("期望 *ValidationError, 得到 %v", err)
+	}
+}
@@ -0,0 +1,456 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// 自动推导校验文件地址时使用的后缀
+const (
+	checksumSuffix = ".sha256sum"
+	minisignSuffix = ".minisig"
+	ed25519Suffix  = ".sig"
+)
+
+// minisign 的签名算法标识和密钥编号长度
+const (
+	minisignAlgLegacy   = "Ed" // 直接对内容签名
+	minisignAlgPrehash  = "ED" // 对内容的 BLAKE2b-512 摘要签名
+	minisignKeyIDSize   = 8
+	minisignTrustedLine = "trusted comment: "
+)
+
+// VerificationError 表示规则内容没有通过完整性校验
+type VerificationError struct {
+	Check  string // 未通过的校验项：sha256、checksum、ed25519 或 minisign
+	Reason string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("规则完整性校验失败(%s): %s", e.Check, e.Reason)
+}
+
+// ValidateVerification 检查规则提供者的完整性校验设置
+func ValidateVerification(provider config.RuleProvider) error {
+	v := provider.Verify
+	if v == nil {
+		return nil
+	}
+	if provider.SourceKind() == config.SourceInline {
+		return fmt.Errorf("内联规则不支持完整性校验")
+	}
+	if v.SHA256 == "" && v.ChecksumURL == "" && v.SignatureURL == "" {
+		return fmt.Errorf("完整性校验至少需要设置 sha256、checksum_url 或 signature_url 之一")
+	}
+	if v.SHA256 != "" {
+		if _, err := parseSHA256(v.SHA256); err != nil {
+			return err
+		}
+	}
+
+	sigType := v.GetSignatureType()
+	if sigType != config.SignatureEd25519 && sigType != config.SignatureMinisign {
+		return fmt.Errorf("不支持的签名类型: %s", v.SignatureType)
+	}
+	if v.SignatureURL == "" {
+		if len(v.PublicKeys) > 0 {
+			return fmt.Errorf("设置了公钥但没有设置 signature_url")
+		}
+		return nil
+	}
+	if len(v.PublicKeys) == 0 {
+		return fmt.Errorf("签名校验至少需要一个公钥")
+	}
+	for _, key := range v.PublicKeys {
+		var err error
+		if sigType == config.SignatureMinisign {
+			_, err = parseMinisignPublicKey(key)
+		} else {
+			_, err = parseEd25519PublicKey(key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSHA256 解析十六进制的 SHA-256 摘要
+func parseSHA256(value string) ([]byte, error) {
+	sum, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("无效的 SHA-256 摘要: %q", value)
+	}
+	return sum, nil
+}
+
+// verifyURL 返回校验文件地址，"auto" 表示规则地址加上后缀
+func verifyURL(value, sourceURL, suffix string) string {
+	if strings.EqualFold(value, config.VerifyAuto) {
+		return sourceURL + suffix
+	}
+	return value
+}
+
+// sourceBaseName 返回规则地址中的文件名，用于在校验和文件中查找对应的行
+func sourceBaseName(provider config.RuleProvider) string {
+	if provider.SourceKind() == config.SourceFile {
+		if p, err := localFilePath(provider.URL); err == nil {
+			return filepath.Base(p)
+		}
+	}
+	if u, err := url.Parse(provider.URL); err == nil && u.Path != "" {
+		return path.Base(u.Path)
+	}
+	return path.Base(provider.URL)
+}
+
+// verifyDigest 返回完整性校验设置的摘要，未设置校验时为空
+func verifyDigest(v *config.Verification) string {
+	if v == nil {
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// verifySource 按规则提供者的设置校验下载的原始内容，返回通过的校验项
+//
+// 校验文件和签名只从原始地址获取，不使用镜像，避免镜像同时篡改规则内容和校验文件
+func (ru *RuleUpdater) verifySource(ctx context.Context, provider config.RuleProvider, body *ruleBody) ([]string, error) {
+	v := provider.Verify
+	if v == nil {
+		return nil, nil
+	}
+
+	var passed []string
+	sum, err := hex.DecodeString(body.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if v.SHA256 != "" {
+		expected, err := parseSHA256(v.SHA256)
+		if err != nil {
+			return passed, &VerificationError{Check: "sha256", Reason: err.Error()}
+		}
+		if !bytes.Equal(sum, expected) {
+			return passed, &VerificationError{
+				Check:  "sha256",
+				Reason: fmt.Sprintf("摘要 %s 与固定的摘要 %x 不一致", body.hash, expected),
+			}
+		}
+		passed = append(passed, "sha256")
+	}
+
+	if v.ChecksumURL != "" {
+		checksumURL := verifyURL(v.ChecksumURL, provider.URL, checksumSuffix)
+		data, err := ru.fetchVerifyFile(ctx, provider, checksumURL)
+		if err != nil {
+			return passed, &VerificationError{Check: "checksum", Reason: "获取校验和文件失败: " + err.Error()}
+		}
+		expected, err := findChecksum(string(data), sourceBaseName(provider))
+		if err != nil {
+			return passed, &VerificationError{Check: "checksum", Reason: err.Error()}
+		}
+		if !bytes.Equal(sum, expected) {
+			return passed, &VerificationError{
+				Check:  "checksum",
+				Reason: fmt.Sprintf("摘要 %s 与校验和文件中的 %x 不一致", body.hash, expected),
+			}
+		}
+		passed = append(passed, "checksum")
+	}
+
+	if v.SignatureURL != "" {
+		sigType := v.GetSignatureType()
+		suffix := minisignSuffix
+		if sigType == config.SignatureEd25519 {
+			suffix = ed25519Suffix
+		}
+		signatureURL := verifyURL(v.SignatureURL, provider.URL, suffix)
+		data, err := ru.fetchVerifyFile(ctx, provider, signatureURL)
+		if err != nil {
+			return passed, &VerificationError{Check: sigType, Reason: "获取签名文件失败: " + err.Error()}
+		}
+
+		if sigType == config.SignatureEd25519 {
+			err = verifyEd25519(body, data, v.PublicKeys)
+		} else {
+			err = verifyMinisign(body, data, v.PublicKeys)
+		}
+		if err != nil {
+			return passed, &VerificationError{Check: sigType, Reason: err.Error()}
+		}
+		passed = append(passed, sigType)
+	}
+
+	return passed, nil
+}
+
+// fetchVerifyFile 获取校验和或签名文件，远程地址只从原始地址下载，不使用规则和全局的镜像
+func (ru *RuleUpdater) fetchVerifyFile(ctx context.Context, provider config.RuleProvider, rawURL string) ([]byte, error) {
+	sidecar := provider
+	sidecar.URL = rawURL
+	sidecar.Entries = nil
+	sidecar.Mirrors = nil
+	// 校验文件位于其他主机时不发送规则的请求头和认证信息
+	if sidecar.HTTP != nil && !sameHost(rawURL, provider.URL) {
+		opts := *sidecar.HTTP
+		opts.Headers, opts.Auth = nil, nil
+		sidecar.HTTP = &opts
+	}
+
+	var (
+		resp *mirrorResponse
+		err  error
+	)
+	if sidecar.SourceKind() == config.SourceRemote {
+		resp, err = ru.fetchRemote(ctx, sidecar, providerState{}, false, true)
+	} else {
+		resp, err = ru.fetchSource(ctx, sidecar, providerState{}, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.body.remove()
+	return resp.body.readAll()
+}
+
+// findChecksum 在 sha256sum 或 BSD 格式的校验和文件中查找文件对应的摘要
+//
+// 文件只有一条记录时直接使用，否则按文件名匹配
+func findChecksum(content, name string) ([]byte, error) {
+	type entry struct {
+		name string
+		sum  string
+	}
+	var entries []entry
+
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		// BSD 格式：SHA256 (file) = hex
+		if strings.HasPrefix(line, "SHA256 (") {
+			if i := strings.LastIndex(line, ") = "); i > 0 {
+				entries = append(entries, entry{name: line[len("SHA256 ("):i], sum: line[i+len(") = "):]})
+			}
+			continue
+		}
+
+		// sha256sum 格式：hex  file 或 hex *file，也允许只有摘要
+		fields := strings.Fields(line)
+		e := entry{sum: fields[0]}
+		if len(fields) > 1 {
+			e.name = strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+		}
+		entries = append(entries, e)
+	}
+
+	var matched *entry
+	switch {
+	case len(entries) == 0:
+		return nil, fmt.Errorf("校验和文件为空")
+	case len(entries) == 1:
+		matched = &entries[0]
+	default:
+		for i := range entries {
+			if path.Base(filepath.ToSlash(entries[i].name)) == name {
+				matched = &entries[i]
+				break
+			}
+		}
+	}
+	if matched == nil {
+		return nil, fmt.Errorf("校验和文件中没有 %s 的记录", name)
+	}
+	return parseSHA256(matched.sum)
+}
+
+// decodeKeyMaterial 解码十六进制或 base64 编码的密钥和签名
+func decodeKeyMaterial(value string) ([]byte, error) {
+	value = strings.TrimSpace(value)
+	if data, err := hex.DecodeString(value); err == nil {
+		return data, nil
+	}
+	if data, err := base64.StdEncoding.DecodeString(value); err == nil {
+		return data, nil
+	}
+	return base64.RawStdEncoding.DecodeString(value)
+}
+
+// parseEd25519PublicKey 解析十六进制或 base64 编码的 ed25519 公钥
+func parseEd25519PublicKey(value string) (ed25519.PublicKey, error) {
+	data, err := decodeKeyMaterial(value)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("无效的 ed25519 公钥: %q", value)
+	}
+	return ed25519.PublicKey(data), nil
+}
+
+// verifyEd25519 校验对原始内容的 ed25519 签名，签名文件可以是原始字节、十六进制或 base64
+//
+// ed25519 需要完整的消息，校验时会把原始内容读入内存
+func verifyEd25519(body *ruleBody, signature []byte, keys []string) error {
+	sig := signature
+	if len(sig) != ed25519.SignatureSize {
+		decoded, err := decodeKeyMaterial(string(signature))
+		if err != nil || len(decoded) != ed25519.SignatureSize {
+			return fmt.Errorf("无效的签名文件")
+		}
+		sig = decoded
+	}
+
+	message, err := body.readAll()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		pub, err := parseEd25519PublicKey(key)
+		if err != nil {
+			return err
+		}
+		if ed25519.Verify(pub, message, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("签名与所有可信公钥都不匹配")
+}
+
+// minisignPublicKey 表示 minisign 公钥
+type minisignPublicKey struct {
+	keyID []byte
+	key   ed25519.PublicKey
+}
+
+// minisignKeyIDString 按 minisign 的显示方式格式化密钥编号
+func minisignKeyIDString(keyID []byte) string {
+	reversed := make([]byte, len(keyID))
+	for i, b := range keyID {
+		reversed[len(keyID)-1-i] = b
+	}
+	return strings.ToUpper(hex.EncodeToString(reversed))
+}
+
+// parseMinisignPublicKey 解析 minisign 公钥，可以是公钥文件的完整内容或其中的 base64 行
+func parseMinisignPublicKey(value string) (minisignPublicKey, error) {
+	line := ""
+	for _, l := range strings.Split(value, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" && !strings.HasPrefix(l, "untrusted comment:") {
+			line = l
+		}
+	}
+
+	data, err := base64.StdEncoding.DecodeString(line)
+	if err != nil || len(data) != 2+minisignKeyIDSize+ed25519.PublicKeySize || string(data[:2]) != minisignAlgLegacy {
+		return minisignPublicKey{}, fmt.Errorf("无效的 minisign 公钥: %q", value)
+	}
+	return minisignPublicKey{
+		keyID: data[2 : 2+minisignKeyIDSize],
+		key:   ed25519.PublicKey(data[2+minisignKeyIDSize:]),
+	}, nil
+}
+
+// verifyMinisign 校验 minisign 签名文件，包括对内容的签名和对可信注释的全局签名
+//
+// 预哈希签名（ED）逐块计算摘要，旧格式签名（Ed）需要把原始内容读入内存
+func verifyMinisign(body *ruleBody, signature []byte, keys []string) error {
+	var lines []string
+	for _, l := range strings.Split(strings.ReplaceAll(string(signature), "\r\n", "\n"), "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], minisignTrustedLine) {
+		return fmt.Errorf("无效的 minisign 签名文件")
+	}
+
+	sigData, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sigData) != 2+minisignKeyIDSize+ed25519.SignatureSize {
+		return fmt.Errorf("无效的 minisign 签名")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("无效的 minisign 全局签名")
+	}
+
+	alg := string(sigData[:2])
+	keyID := sigData[2 : 2+minisignKeyIDSize]
+	sig := sigData[2+minisignKeyIDSize:]
+	trustedComment := strings.TrimPrefix(lines[2], minisignTrustedLine)
+
+	var message []byte
+	switch alg {
+	case minisignAlgLegacy:
+		if message, err = body.readAll(); err != nil {
+			return err
+		}
+	case minisignAlgPrehash:
+		if message, err = blake2bFile(body.path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("不支持的 minisign 签名算法: %q", alg)
+	}
+
+	// 不同公钥的编号可能相同，编号匹配但验证失败时继续尝试其余公钥
+	lastErr := fmt.Errorf("签名使用的密钥 %s 不在可信公钥中", minisignKeyIDString(keyID))
+	for _, key := range keys {
+		pub, err := parseMinisignPublicKey(key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pub.keyID, keyID) {
+			continue
+		}
+		if !ed25519.Verify(pub.key, message, sig) {
+			lastErr = fmt.Errorf("签名无效")
+			continue
+		}
+		if !ed25519.Verify(pub.key, append(append([]byte{}, sig...), trustedComment...), globalSig) {
+			lastErr = fmt.Errorf("可信注释的签名无效")
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// blake2bFile 逐块计算文件内容的 BLAKE2b-512 摘要
+func blake2bFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hasher, err := blake2b.New512(nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hasher, f); err != nil {
+		return nil, err
+	}
+	return hasher.Sum(nil), nil
+}
@@ -0,0 +1,261 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// minisignFixture 生成 minisign 公钥和对 body 的签名文件
+func minisignFixture(t *testing.T, body []byte, alg string) (string, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	message := body
+	if alg == minisignAlgPrehash {
+		sum := blake2b.Sum512(body)
+		message = sum[:]
+	}
+	sig := ed25519.Sign(priv, message)
+	trusted := "timestamp:1700000000\tfile:direct.txt"
+	global := ed25519.Sign(priv, append(append([]byte{}, sig...), trusted...))
+
+	pubKey := base64.StdEncoding.EncodeToString(append(append([]byte(minisignAlgLegacy), keyID...), pub...))
+	sigFile := fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		base64.StdEncoding.EncodeToString(append(append([]byte(alg), keyID...), sig...)),
+		trusted,
+		base64.StdEncoding.EncodeToString(global))
+	return "untrusted comment: minisign public key\n" + pubKey + "\n", sigFile
+}
+
+// TestVerifySource 检查固定摘要、校验和文件与签名校验
+func TestVerifySource(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ru := NewRuleUpdater(config.DefaultConfig())
+
+	dir := t.TempDir()
+	body := []byte("example.com\nexample.org\n")
+	listPath := filepath.Join(dir, "direct.txt")
+	writeFile := func(name string, data []byte) {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile("direct.txt", body)
+
+	sum := sha256.Sum256(body)
+	other := sha256.Sum256([]byte("other"))
+	writeFile("direct.txt.sha256sum", []byte(fmt.Sprintf("%x  proxy.txt\n%x *direct.txt\n", other, sum)))
+	writeFile("bsd.sha256", []byte(fmt.Sprintf("SHA256 (direct.txt) = %x\n", sum)))
+	writeFile("bad.sha256sum", []byte(fmt.Sprintf("%x  direct.txt\n", other)))
+
+	pubMinisign, sigMinisign := minisignFixture(t, body, minisignAlgPrehash)
+	writeFile("direct.txt.minisig", []byte(sigMinisign))
+	pubLegacy, sigLegacy := minisignFixture(t, body, minisignAlgLegacy)
+	writeFile("legacy.minisig", []byte(sigLegacy))
+	_, sigTampered := minisignFixture(t, []byte("tampered"), minisignAlgPrehash)
+	writeFile("tampered.minisig", []byte(sigTampered))
+
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile("direct.txt.sig", ed25519.Sign(priv, body))
+	writeFile("hex.sig", []byte(hex.EncodeToString(ed25519.Sign(priv, body))))
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+
+	fileURL := func(name string) string { return "file://" + filepath.ToSlash(filepath.Join(dir, name)) }
+
+	spooled, err := spoolBody(bytes.NewReader(body), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spooled.remove()
+
+	tests := []struct {
+		name   string
+		verify config.Verification
+		passed int
+		check  string // 期望失败的校验项，为空时期望通过
+	}{
+		{"固定摘要", config.Verification{SHA256: hex.EncodeToString(sum[:])}, 1, ""},
+		{"固定摘要不一致", config.Verification{SHA256: hex.EncodeToString(other[:])}, 0, "sha256"},
+		{"自动校验和文件", config.Verification{ChecksumURL: "auto"}, 1, ""},
+		{"BSD 校验和文件", config.Verification{ChecksumURL: fileURL("bsd.sha256")}, 1, ""},
+		{"校验和不一致", config.Verification{ChecksumURL: fileURL("bad.sha256sum")}, 0, "checksum"},
+		{"校验和文件不存在", config.Verification{ChecksumURL: fileURL("missing.sha256sum")}, 0, "checksum"},
+		{"minisign", config.Verification{SignatureURL: "auto", PublicKeys: []string{pubMinisign}}, 1, ""},
+		{"minisign 旧算法", config.Verification{SignatureURL: fileURL("legacy.minisig"), PublicKeys: []string{pubMinisign, pubLegacy}}, 1, ""},
+		{"minisign 密钥不在可信公钥中", config.Verification{SignatureURL: "auto", PublicKeys: []string{pubLegacy}}, 0, "minisign"},
+		{"minisign 内容被篡改", config.Verification{SignatureURL: fileURL("tampered.minisig"), PublicKeys: []string{pubMinisign}}, 0, "minisign"},
+		{"ed25519", config.Verification{SignatureType: "ed25519", SignatureURL: "auto", PublicKeys: []string{base64.StdEncoding.EncodeToString(pub)}}, 1, ""},
+		{"ed25519 十六进制", config.Verification{SignatureType: "ed25519", SignatureURL: fileURL("hex.sig"), PublicKeys: []string{hex.EncodeToString(otherPub), hex.EncodeToString(pub)}}, 1, ""},
+		{"ed25519 公钥不匹配", config.Verification{SignatureType: "ed25519", SignatureURL: "auto", PublicKeys: []string{hex.EncodeToString(otherPub)}}, 0, "ed25519"},
+		{"全部校验", config.Verification{SHA256: hex.EncodeToString(sum[:]), ChecksumURL: "auto", SignatureURL: "auto", PublicKeys: []string{pubMinisign}}, 3, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verify := tt.verify
+			provider := config.RuleProvider{Name: "direct", URL: fileURL("direct.txt"), Verify: &verify}
+			if err := ValidateVerification(provider); err != nil {
+				t.Fatalf("ValidateVerification() = %v", err)
+			}
+
+			passed, err := ru.verifySource(context.Background(), provider, spooled)
+			if len(passed) != tt.passed {
+				t.Errorf("通过的校验项 = %v, 期望 %d 项", passed, tt.passed)
+			}
+			if tt.check == "" {
+				if err != nil {
+					t.Fatalf("verifySource() = %v", err)
+				}
+				return
+			}
+			var verr *VerificationError
+			if !errors.As(err, &verr) || verr.Check != tt.check {
+				t.Fatalf("verifySource() = %v, 期望 %s 校验失败", err, tt.check)
+			}
+		})
+	}
+
+	// 校验失败时保留现有规则文件
+	output := filepath.Join(t.TempDir(), "direct.yaml")
+	previous := "payload:\n  - 'old.example.com'\n"
+	if err := os.WriteFile(output, []byte(previous), 0644); err != nil {
+		t.Fatal(err)
+	}
+	provider := config.RuleProvider{
+		Name:     "direct",
+		URL:      fileURL("direct.txt"),
+		Type:     "domain",
+		Behavior: "domain",
+		Verify:   &config.Verification{ChecksumURL: fileURL("bad.sha256sum")},
+	}
+	if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err == nil {
+		t.Fatal("校验失败时 downloadAndProcessRule() 应返回错误")
+	}
+	if data, _ := os.ReadFile(listPath); string(data) != string(body) {
+		t.Fatal("规则来源被修改")
+	}
+	if data, _ := os.ReadFile(output); string(data) != previous {
+		t.Fatalf("校验失败后规则文件被改写: %q", data)
+	}
+}
+
+// TestValidateVerification 检查无效的校验设置
+func TestValidateVerification(t *testing.T) {
+	tests := []struct {
+		name     string
+		provider config.RuleProvider
+	}{
+		{"内联规则", config.RuleProvider{Entries: []string{"a.com"}, Verify: &config.Verification{SHA256: "00"}}},
+		{"没有校验项", config.RuleProvider{URL: "https://example.com/a.txt", Verify: &config.Verification{}}},
+		{"无效摘要", config.RuleProvider{URL: "https://example.com/a.txt", Verify: &config.Verification{SHA256: "abc"}}},
+		{"缺少公钥", config.RuleProvider{URL: "https://example.com/a.txt", Verify: &config.Verification{SignatureURL: "auto"}}},
+		{"无效公钥", config.RuleProvider{URL: "https://example.com/a.txt", Verify: &config.Verification{SignatureURL: "auto", PublicKeys: []string{"RWQ"}}}},
+		{"未知签名类型", config.RuleProvider{URL: "https://example.com/a.txt", Verify: &config.Verification{SignatureURL: "auto", SignatureType: "gpg", PublicKeys: []string{"x"}}}},
+	}
+	for _, tt := range tests {
+		if err := ValidateVerification(tt.provider); err == nil {
+			t.Errorf("%s: ValidateVerification() 应返回错误", tt.name)
+		}
+	}
+}
+
+// TestVerifyInvalidateState 检查添加完整性校验后即使内容未变也会重新校验
+func TestVerifyInvalidateState(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	ru := NewRuleUpdater(config.DefaultConfig())
+	dir := t.TempDir()
+	output := filepath.Join(dir, "list.yaml")
+	source := filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(source, []byte("a.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	provider := config.RuleProvider{Name: "list", Type: "domain", Behavior: "domain", URL: "file://" + filepath.ToSlash(source)}
+	if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err != nil {
+		t.Fatal(err)
+	}
+
+	other := sha256.Sum256([]byte("other"))
+	provider.Verify = &config.Verification{SHA256: hex.EncodeToString(other[:])}
+	if _, err := ru.downloadAndProcessRule(context.Background(), provider, output); err == nil {
+		t.Error("修改校验设置后应重新校验并失败")
+	}
+}
+
+// TestVerifyFileOriginOnly 检查校验和文件只从原始地址下载，镜像同时篡改规则内容和校验和文件时校验失败
+func TestVerifyFileOriginOnly(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	body := []byte("example.com\n")
+	tampered := []byte("evil.example.com\n")
+	sum := sha256.Sum256(body)
+	tamperedSum := sha256.Sum256(tampered)
+
+	// 原始地址的规则暂时不可用，校验和文件正常
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, checksumSuffix) {
+			fmt.Fprintf(w, "%x  direct.txt\n", sum)
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer origin.Close()
+
+	var mirrorChecksums atomic.Int32
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, checksumSuffix) {
+			mirrorChecksums.Add(1)
+			fmt.Fprintf(w, "%x  direct.txt\n", tamperedSum)
+			return
+		}
+		w.Write(tampered)
+	}))
+	defer mirror.Close()
+
+	cfg := config.DefaultConfig()
+	cfg.RetryConfig = config.RetryConfig{MaxAttempts: 1}
+	cfg.Mirrors = []config.Mirror{{Name: "global", Template: mirror.URL + "/global/{url}"}}
+	ru := NewRuleUpdater(cfg)
+	provider := config.RuleProvider{
+		Name: "direct", URL: origin.URL + "/direct.txt", Type: "domain", Behavior: "domain",
+		Mirrors: []config.Mirror{{Name: "own", Template: mirror.URL + "/own/{url}"}},
+		Verify:  &config.Verification{ChecksumURL: config.VerifyAuto},
+	}
+	output := filepath.Join(t.TempDir(), "direct.yaml")
+
+	_, err := ru.downloadAndProcessRule(context.Background(), provider, output)
+	var verifyErr *VerificationError
+	if !errors.As(err, &verifyErr) || verifyErr.Check != "checksum" {
+		t.Errorf("错误 = %v, 期望 checksum 校验失败", err)
+	}
+	if n := mirrorChecksums.Load(); n != 0 {
+		t.Errorf("从镜像下载了 %d 次校验和文件", n)
+	}
+	if fileExists(output) {
+		t.Error("未通过校验的规则被写入")
+	}
+}
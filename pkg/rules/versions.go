@@ -0,0 +1,270 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/utils"
+)
+
+// RuleVersion 记录规则文件的一个历史版本
+type RuleVersion struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Hash    string    `json:"hash"`
+	Entries int       `json:"entries"`
+	Size    int64     `json:"size"`
+	Current bool      `json:"current"` // 是否与当前规则文件一致，仅在列出版本时计算
+}
+
+// VersionDiff 两个版本之间的条目差异
+type VersionDiff struct {
+	From    string   `json:"from"`
+	To      string   `json:"to"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// getVersionsDir 获取规则提供者的历史版本目录
+func getVersionsDir(name string) string {
+	return filepath.Join(utils.GetConfigDir(), "rules_versions", unsafeFilenameChars.ReplaceAllString(name, "_"))
+}
+
+// loadVersions 读取规则提供者的版本索引，按时间从旧到新排列
+func loadVersions(name string) []RuleVersion {
+	data, err := os.ReadFile(filepath.Join(getVersionsDir(name), "index.json"))
+	if err != nil {
+		return nil
+	}
+
+	var versions []RuleVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		logger.Warnf("解析规则 %s 的版本索引失败: %v", name, err)
+		return nil
+	}
+	return versions
+}
+
+// saveVersions 保存规则提供者的版本索引
+func saveVersions(name string, versions []RuleVersion) error {
+	data, err := json.MarshalIndent(versions, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(filepath.Join(getVersionsDir(name), "index.json"), data, 0644)
+}
+
+// recordVersion 将规则文件保存为新版本，超出保留数量的旧版本会被删除
+func (ru *RuleUpdater) recordVersion(name, path string, t time.Time) {
+	ru.versionMutex.Lock()
+	defer ru.versionMutex.Unlock()
+
+	if err := ru.addVersion(name, path, t); err != nil {
+		logger.Warnf("保存规则 %s 的历史版本失败: %v", name, err)
+	}
+}
+
+// recordInitialVersion 规则还没有历史版本时，将现有规则文件保存为第一个版本
+func (ru *RuleUpdater) recordInitialVersion(name, path string) {
+	ru.versionMutex.Lock()
+	defer ru.versionMutex.Unlock()
+
+	if len(loadVersions(name)) > 0 {
+		return
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	if err := ru.addVersion(name, path, info.ModTime()); err != nil {
+		logger.Warnf("保存规则 %s 的历史版本失败: %v", name, err)
+	}
+}
+
+// addVersion 复制规则文件作为新版本并更新索引，调用方需持有 ru.versionMutex
+func (ru *RuleUpdater) addVersion(name, path string, t time.Time) error {
+	versions := loadVersions(name)
+	hash, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+
+	// 与最新版本相同时不重复保存
+	if n := len(versions); n > 0 && versions[n-1].Hash == hash {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	entries, _ := countPayloadFile(path)
+
+	version := RuleVersion{
+		ID:      t.Format("20060102-150405") + "-" + hash[:8],
+		Time:    t,
+		Hash:    hash,
+		Entries: entries,
+		Size:    info.Size(),
+	}
+	dir := getVersionsDir(name)
+	if err := copyFileAtomic(path, filepath.Join(dir, version.ID+".yaml")); err != nil {
+		return err
+	}
+	versions = append(versions, version)
+
+	if max := ru.cfg.GetMaxRuleVersions(); len(versions) > max {
+		for _, old := range versions[:len(versions)-max] {
+			os.Remove(filepath.Join(dir, old.ID+".yaml"))
+		}
+		versions = versions[len(versions)-max:]
+	}
+
+	return saveVersions(name, versions)
+}
+
+// findProvider 按名称查找规则提供者
+func (ru *RuleUpdater) findProvider(name string) (config.RuleProvider, error) {
+	for _, provider := range ru.cfg.RuleProviders {
+		if provider.Name == name {
+			return provider, nil
+		}
+	}
+	return config.RuleProvider{}, fmt.Errorf("未找到规则提供者: %s", name)
+}
+
+// ListVersions 返回规则提供者的历史版本，按时间从新到旧排列
+func (ru *RuleUpdater) ListVersions(name string) ([]RuleVersion, error) {
+	provider, err := ru.findProvider(name)
+	if err != nil {
+		return nil, err
+	}
+
+	ru.versionMutex.Lock()
+	versions := loadVersions(name)
+	ru.versionMutex.Unlock()
+
+	currentHash, _ := hashFile(filepath.Join(ru.getRulesDir(), provider.Path))
+
+	result := make([]RuleVersion, len(versions))
+	for i, v := range versions {
+		v.Current = v.Hash == currentHash
+		result[len(versions)-1-i] = v
+	}
+	return result, nil
+}
+
+// readVersion 读取指定版本的规则内容
+func (ru *RuleUpdater) readVersion(name, id string) (string, error) {
+	ru.versionMutex.Lock()
+	defer ru.versionMutex.Unlock()
+
+	for _, v := range loadVersions(name) {
+		if v.ID == id {
+			data, err := os.ReadFile(filepath.Join(getVersionsDir(name), id+".yaml"))
+			if err != nil {
+				return "", errors.Wrapf(err, "读取版本 %s 失败", id)
+			}
+			return string(data), nil
+		}
+	}
+	return "", fmt.Errorf("规则 %s 不存在版本 %s", name, id)
+}
+
+// DiffVersions 比较规则提供者的两个版本，返回 to 相对于 from 新增和移除的条目
+func (ru *RuleUpdater) DiffVersions(name, from, to string) (VersionDiff, error) {
+	if _, err := ru.findProvider(name); err != nil {
+		return VersionDiff{}, err
+	}
+
+	fromContent, err := ru.readVersion(name, from)
+	if err != nil {
+		return VersionDiff{}, err
+	}
+	toContent, err := ru.readVersion(name, to)
+	if err != nil {
+		return VersionDiff{}, err
+	}
+
+	fromEntries, err := parseClashPayload(fromContent)
+	if err != nil {
+		return VersionDiff{}, errors.Wrapf(err, "解析版本 %s 失败", from)
+	}
+	toEntries, err := parseClashPayload(toContent)
+	if err != nil {
+		return VersionDiff{}, errors.Wrapf(err, "解析版本 %s 失败", to)
+	}
+
+	diff := VersionDiff{From: from, To: to, Added: []string{}, Removed: []string{}}
+	fromSet := make(map[string]bool, len(fromEntries))
+	for _, e := range fromEntries {
+		fromSet[e.value] = true
+	}
+	toSet := make(map[string]bool, len(toEntries))
+	for _, e := range toEntries {
+		toSet[e.value] = true
+		if !fromSet[e.value] {
+			diff.Added = append(diff.Added, e.value)
+		}
+	}
+	for _, e := range fromEntries {
+		if !toSet[e.value] {
+			diff.Removed = append(diff.Removed, e.value)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
+
+// RollbackToVersion 将规则文件恢复到指定的历史版本并记录到更新历史
+//
+// 恢复后的文件与其他写入一样需要通过 ApplyChanges 确认；固定版本由调用方设置
+func (ru *RuleUpdater) RollbackToVersion(name, id string) (ProviderRecord, error) {
+	ru.mutex.Lock()
+	defer ru.mutex.Unlock()
+
+	provider, err := ru.findProvider(name)
+	if err != nil {
+		return ProviderRecord{}, err
+	}
+	content, err := ru.readVersion(name, id)
+	if err != nil {
+		return ProviderRecord{}, err
+	}
+
+	path := filepath.Join(ru.getRulesDir(), provider.Path)
+	pr := ProviderRecord{
+		Name:          name,
+		EntriesBefore: countRuleEntries(path),
+	}
+	if err := ru.writeRuleFile(name, path, content); err != nil {
+		return pr, err
+	}
+
+	// 恢复后的内容与记录的校验信息不符，取消固定后重新下载
+	ru.stateMutex.Lock()
+	delete(ru.states, name)
+	ru.stateMutex.Unlock()
+	ru.persistStates()
+	ru.refreshMatcher()
+
+	logger.Infof("已将规则 %s 回滚到版本 %s", name, id)
+	pr.setStatus(StatusRolledBack, fmt.Sprintf("已回滚到版本 %s", id))
+	pr.EntriesAfter = countRuleEntries(path)
+
+	ru.appendUpdateHistory(UpdateRecord{
+		Time:      time.Now(),
+		Trigger:   TriggerAPI,
+		Providers: []ProviderRecord{pr},
+		Rollback:  fmt.Sprintf("手动回滚到版本 %s", id),
+	})
+	return pr, nil
+}
@@ -0,0 +1,71 @@
+package rules
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+)
+
+// TestRuleVersions 检查历史版本的保存、数量限制、比较和回滚
+func TestRuleVersions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	cfg := config.DefaultConfig()
+	cfg.MaxRuleVersions = 3
+	cfg.RuleProviders = []config.RuleProvider{{Name: "cn_domain", Path: "cn_domain.yaml", Enabled: true}}
+	ru := NewRuleUpdater(cfg)
+	if err := os.MkdirAll(ru.getRulesDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(ru.getRulesDir(), "cn_domain.yaml")
+
+	contents := []string{
+		"payload:\n  - 'a.com'\n",
+		"payload:\n  - 'a.com'\n  - 'b.com'\n",
+		"payload:\n  - 'b.com'\n  - 'c.com'\n",
+		"payload:\n  - 'c.com'\n  - 'd.com'\n",
+	}
+	start := time.Date(2024, 1, 20, 15, 0, 0, 0, time.UTC)
+	for i, content := range contents {
+		if err := ru.writeRuleFile("cn_domain", path, content); err != nil {
+			t.Fatal(err)
+		}
+		ru.recordVersion("cn_domain", path, start.Add(time.Duration(i)*time.Hour))
+	}
+	// 内容未变化时不重复保存
+	ru.recordVersion("cn_domain", path, start.Add(5*time.Hour))
+
+	versions, err := ru.ListVersions("cn_domain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("版本数量 = %d, 期望 3", len(versions))
+	}
+	if !versions[0].Current || versions[0].Entries != 2 {
+		t.Errorf("最新版本应为当前版本: %+v", versions[0])
+	}
+
+	diff, err := ru.DiffVersions("cn_domain", versions[2].ID, versions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff.Added, []string{"c.com", "d.com"}) || !reflect.DeepEqual(diff.Removed, []string{"a.com", "b.com"}) {
+		t.Errorf("差异 = +%v -%v", diff.Added, diff.Removed)
+	}
+
+	if _, err := ru.RollbackToVersion("cn_domain", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != contents[2] {
+		t.Errorf("回滚后内容 = %q, 期望 %q", data, contents[2])
+	}
+}
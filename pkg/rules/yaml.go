@@ -0,0 +1,270 @@
+package rules
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PayloadError 表示 Clash 规则文件无效，包含出错的位置
+type PayloadError struct {
+	Line    int // 从1开始，0表示未知
+	Column  int // 从1开始，0表示未知
+	Message string
+}
+
+func (e *PayloadError) Error() string {
+	switch {
+	case e.Line > 0 && e.Column > 0:
+		return fmt.Sprintf("无效的规则文件 (第 %d 行第 %d 列): %s", e.Line, e.Column, e.Message)
+	case e.Line > 0:
+		return fmt.Sprintf("无效的规则文件 (第 %d 行): %s", e.Line, e.Message)
+	default:
+		return fmt.Sprintf("无效的规则文件: %s", e.Message)
+	}
+}
+
+var (
+	// yamlTopLevelKey 匹配位于行首的 YAML 键，如 "payload:"，IPv6 地址中的 "::" 不会匹配
+	yamlTopLevelKey = regexp.MustCompile(`^[A-Za-z_][\w-]*:(?:\s|$)`)
+	// yamlErrorLine 从 yaml 库的错误信息中提取行号
+	yamlErrorLine = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+)
+
+// looksLikeYAML 判断内容是否为 YAML 文档：第一个有效行是位于行首的键或文档开始标记
+func looksLikeYAML(content string) bool {
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		return trimmed == "---" || yamlTopLevelKey.MatchString(line)
+	}
+	return false
+}
+
+// nodeError 根据 YAML 节点位置创建错误
+func nodeError(node *yaml.Node, format string, args ...interface{}) *PayloadError {
+	return &PayloadError{Line: node.Line, Column: node.Column, Message: fmt.Sprintf(format, args...)}
+}
+
+// syntaxError 将 yaml 库的语法错误转换为 PayloadError
+func syntaxError(err error) *PayloadError {
+	msg := strings.TrimSpace(err.Error())
+	if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return &PayloadError{Line: line, Message: m[2]}
+	}
+	return &PayloadError{Message: strings.TrimPrefix(msg, "yaml: ")}
+}
+
+// parseClashPayload 解析 Clash rule-provider 文件，返回 payload 中的条目
+//
+// 文档必须是包含 payload 键的映射，payload 必须是标量列表
+func parseClashPayload(content string) ([]ruleEntry, error) {
+	items, err := parsePayloadNodes(content)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]ruleEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, ruleEntry{kind: entryRaw, value: strings.TrimSpace(item.Value)})
+	}
+	return entries, nil
+}
+
+// parsePayloadNodes 解析 Clash rule-provider 文件，返回 payload 中的标量节点，节点中带有所在行号
+func parsePayloadNodes(content string) ([]*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, syntaxError(err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return nil, &PayloadError{Message: "文档为空"}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, nodeError(root, "顶层应为包含 payload 的映射")
+	}
+
+	var payload *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "payload" {
+			payload = root.Content[i+1]
+			break
+		}
+	}
+	if payload == nil {
+		return nil, nodeError(root, "缺少 payload 字段")
+	}
+
+	// payload 为空（payload: 或 payload: []）时视为空规则
+	if payload.Kind == yaml.ScalarNode && payload.Tag == "!!null" {
+		return nil, nil
+	}
+	if payload.Kind != yaml.SequenceNode {
+		return nil, nodeError(payload, "payload 应为列表")
+	}
+
+	for _, item := range payload.Content {
+		if item.Kind != yaml.ScalarNode {
+			return nil, nodeError(item, "payload 条目应为字符串")
+		}
+		if strings.TrimSpace(item.Value) == "" {
+			return nil, nodeError(item, "payload 条目为空")
+		}
+	}
+	return payload.Content, nil
+}
+
+// simplePayloadHeader 匹配逐行读取时接受的 payload 键，允许行尾注释
+var simplePayloadHeader = regexp.MustCompile(`^payload:\s*(?:#.*)?$`)
+
+// simpleScalar 解析逐行读取时接受的标量写法：单引号、不含转义的双引号和不含特殊字符的普通标量
+func simpleScalar(s string) (string, bool) {
+	if s == "" {
+		return "", false
+	}
+	switch s[0] {
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", false
+		}
+		inner := s[1 : len(s)-1]
+		// 内部的单引号必须成对出现
+		if strings.Contains(strings.ReplaceAll(inner, "''", ""), "'") {
+			return "", false
+		}
+		return strings.ReplaceAll(inner, "''", "'"), true
+	case '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return "", false
+		}
+		inner := s[1 : len(s)-1]
+		if strings.ContainsAny(inner, "\"\\") {
+			return "", false
+		}
+		return inner, true
+	}
+	if strings.ContainsRune("-?:,[]{}#&*!|>%@`", rune(s[0])) ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.Contains(s, "\t#") || strings.HasSuffix(s, ":") {
+		return "", false
+	}
+	return s, true
+}
+
+// scanSimplePayload 逐行读取最常见的 Clash 规则文件写法：
+//
+//	payload:
+//	  - '+.example.com'
+//	  - DOMAIN-SUFFIX,example.org
+//
+// 遇到其他写法时返回 false，已经传给 emit 的条目应被丢弃
+func scanSimplePayload(r io.Reader, emit func(value string)) (bool, error) {
+	return scanPayloadLines(r, func(value string, _ int) { emit(value) })
+}
+
+// scanPayloadLines 与 scanSimplePayload 相同，同时传出条目所在的行号（从1开始）
+func scanPayloadLines(r io.Reader, emit func(value string, line int)) (bool, error) {
+	inPayload, simple := false, true
+	indent := -1
+	lineNo := 0
+	err := forEachLine(r, func(line string) {
+		lineNo++
+		if !simple {
+			return
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			return
+		}
+		if !inPayload {
+			inPayload = simplePayloadHeader.MatchString(line)
+			simple = inPayload || (trimmed == "---" && line == trimmed)
+			return
+		}
+
+		lead := len(line) - len(strings.TrimLeft(line, " "))
+		if !strings.HasPrefix(trimmed, "- ") || (indent >= 0 && lead != indent) || strings.HasPrefix(line[lead:], "\t") {
+			simple = false
+			return
+		}
+		indent = lead
+
+		value, ok := simpleScalar(strings.TrimSpace(trimmed[2:]))
+		value = strings.TrimSpace(value)
+		if !ok || value == "" {
+			simple = false
+			return
+		}
+		emit(value, lineNo)
+	}, func(string) {
+		// 超长的行交给完整解析处理，由条目校验记为无效
+		lineNo++
+		simple = false
+	})
+	if err != nil {
+		return false, err
+	}
+	// 没有 payload 或 payload 为空时交给完整解析处理
+	return simple && indent >= 0, nil
+}
+
+// readPayload 读取 Clash 规则文件的 payload 条目
+//
+// 常见写法逐行读取，不必把整个文件读入内存；其余写法回到开头完整解析 YAML，
+// 此时会先调用 reset，调用方应丢弃此前收到的条目
+func readPayload(r io.ReadSeeker, emit func(value string), reset func()) error {
+	return readPayloadLines(r, func(value string, _ int) { emit(value) }, reset)
+}
+
+// readPayloadLines 与 readPayload 相同，同时传出条目所在的行号（从1开始）
+func readPayloadLines(r io.ReadSeeker, emit func(value string, line int), reset func()) error {
+	simple, err := scanPayloadLines(r, emit)
+	if err != nil {
+		return err
+	}
+	if simple {
+		return nil
+	}
+
+	reset()
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	items, err := parsePayloadNodes(string(data))
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		emit(strings.TrimSpace(item.Value), item.Line)
+	}
+	return nil
+}
+
+// readPayloadFile 读取规则文件的 payload 条目
+func readPayloadFile(path string, emit func(value string), reset func()) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return readPayload(f, emit, reset)
+}
+
+// countPayloadFile 统计规则文件中的 payload 条目数量，文件无效时返回错误
+func countPayloadFile(path string) (int, error) {
+	count := 0
+	err := readPayloadFile(path, func(string) { count++ }, func() { count = 0 })
+	return count, err
+}
@@ -92,6 +92,40 @@ func FileExists(path string) bool {
 	return err == nil
 }
 
+// WriteFileAtomic 先写入同目录下的临时文件再重命名，避免崩溃或磁盘已满时留下不完整的文件
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	// 任一步骤失败都清理临时文件，原文件保持不变
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
 // CreateBackgroundProcess 创建后台进程
 func CreateBackgroundProcess(command string, args ...string) *exec.Cmd {
 	return exec.Command(command, args...)
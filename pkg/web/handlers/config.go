@@ -28,8 +28,11 @@ func NewConfigHandler(cfg *config.Config, clashAPI *api.ClashAPI, systemAutoStar
 // HandleConfig 处理配置请求
 func (h *ConfigHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodGet {
-		// 返回当前配置
-		common.SendJSONResponse(w, h.Config)
+		// 返回当前配置，规则的HTTP密钥被隐藏
+		common.SendJSONResponse(w, struct {
+			*config.Config
+			RuleProviders []config.RuleProvider `json:"rule_providers"`
+		}{h.Config, config.RedactProviders(h.Config.RuleProviders)})
 	} else if r.Method == http.MethodPost {
 		// 解析新配置
 		var updatedConfig config.Config
@@ -37,6 +40,25 @@ func (h *ConfigHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		if err := updatedConfig.QuietHours.Validate(); err != nil {
+			common.SendBadRequest(w, "免打扰时段设置无效", err)
+			return
+		}
+		if ratio := updatedConfig.Validation.MaxInvalidRatio; ratio != nil {
+			if err := config.ValidateInvalidRatio(*ratio); err != nil {
+				common.SendBadRequest(w, "校验设置无效", err)
+				return
+			}
+		}
+		if err := config.ValidateFetchPolicy(updatedConfig.FetchPolicy); err != nil {
+			common.SendBadRequest(w, "下载路径策略无效", err)
+			return
+		}
+		if err := config.ValidatePresetCatalogs(updatedConfig.PresetCatalogs); err != nil {
+			common.SendBadRequest(w, "预设目录设置无效", err)
+			return
+		}
+
 		// 更新部分可以更改的配置
 		h.Config.ClashAPIURL = updatedConfig.ClashAPIURL
 		h.Config.ClashAPISecret = updatedConfig.ClashAPISecret
@@ -45,6 +67,39 @@ func (h *ConfigHandler) HandleConfig(w http.ResponseWriter, r *http.Request) {
 		h.Config.AutoStartEnabled = updatedConfig.AutoStartEnabled
 		h.Config.SystemAutoStartEnabled = updatedConfig.SystemAutoStartEnabled
 
+		// 镜像配置仅在请求中提供时更新，避免旧版前端清空镜像列表
+		if updatedConfig.Mirrors != nil {
+			h.Config.Mirrors = updatedConfig.Mirrors
+		}
+		if updatedConfig.MirrorRaceCount > 0 {
+			h.Config.MirrorRaceCount = updatedConfig.MirrorRaceCount
+		}
+		if updatedConfig.RetryConfig != (config.RetryConfig{}) {
+			h.Config.RetryConfig = updatedConfig.RetryConfig
+		}
+		if updatedConfig.QuietHours != (config.QuietHours{}) {
+			h.Config.QuietHours = updatedConfig.QuietHours
+		}
+		if updatedConfig.Validation.MaxInvalidRatio != nil {
+			h.Config.Validation = updatedConfig.Validation
+		}
+		if updatedConfig.MaxRuleVersions > 0 {
+			h.Config.MaxRuleVersions = updatedConfig.MaxRuleVersions
+		}
+		if updatedConfig.MaxRuleSize > 0 {
+			h.Config.MaxRuleSize = updatedConfig.MaxRuleSize
+		}
+		if updatedConfig.HistoryRetention != (config.HistoryRetention{}) {
+			h.Config.HistoryRetention = updatedConfig.HistoryRetention
+		}
+		if updatedConfig.FetchPolicy != "" {
+			h.Config.FetchPolicy = updatedConfig.FetchPolicy
+		}
+		// 预设目录仅在请求中提供时更新
+		if updatedConfig.PresetCatalogs != nil {
+			h.Config.PresetCatalogs = updatedConfig.PresetCatalogs
+		}
+
 		// 保存配置
 		err := h.Config.SaveConfig()
 		if err != nil {
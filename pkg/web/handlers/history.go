@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// 更新历史分页的默认和最大每页数量，以及最大页码
+const (
+	defaultHistoryPageSize = 20
+	maxHistoryPageSize     = 200
+	maxHistoryPage         = 1000000
+)
+
+// HistoryHandler 处理更新历史查询请求
+type HistoryHandler struct {
+	RuleUpdater *rules.RuleUpdater
+}
+
+// NewHistoryHandler 创建更新历史处理器
+func NewHistoryHandler(ruleUpdater *rules.RuleUpdater) *HistoryHandler {
+	return &HistoryHandler{
+		RuleUpdater: ruleUpdater,
+	}
+}
+
+// HandleHistory 处理分页查询更新历史请求
+func (h *HistoryHandler) HandleHistory(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	query, page, pageSize, err := parseHistoryQuery(r)
+	if err != nil {
+		common.SendBadRequest(w, "无效的查询参数", err)
+		return
+	}
+
+	result := h.RuleUpdater.QueryHistory(query)
+
+	resp := map[string]interface{}{
+		"status":    "ok",
+		"total":     result.Total,
+		"page":      page,
+		"page_size": pageSize,
+		"records":   result.Records,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
+// parseHistoryQuery 解析查询参数：provider、status、trigger、since、until（RFC3339）、page、page_size
+func parseHistoryQuery(r *http.Request) (rules.HistoryQuery, int, int, error) {
+	values := r.URL.Query()
+	query := rules.HistoryQuery{
+		Provider: values.Get("provider"),
+		Status:   rules.ProviderStatus(values.Get("status")),
+		Trigger:  rules.Trigger(values.Get("trigger")),
+	}
+
+	var err error
+	if s := values.Get("since"); s != "" {
+		if query.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return query, 0, 0, fmt.Errorf("since 应为 RFC3339 时间: %v", err)
+		}
+	}
+	if s := values.Get("until"); s != "" {
+		if query.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return query, 0, 0, fmt.Errorf("until 应为 RFC3339 时间: %v", err)
+		}
+	}
+
+	page := 1
+	if s := values.Get("page"); s != "" {
+		if page, err = strconv.Atoi(s); err != nil || page < 1 {
+			return query, 0, 0, fmt.Errorf("page 应为正整数")
+		}
+	}
+	pageSize := defaultHistoryPageSize
+	if s := values.Get("page_size"); s != "" {
+		if pageSize, err = strconv.Atoi(s); err != nil || pageSize < 1 {
+			return query, 0, 0, fmt.Errorf("page_size 应为正整数")
+		}
+	}
+	if pageSize > maxHistoryPageSize {
+		pageSize = maxHistoryPageSize
+	}
+	// 限制页码，避免计算偏移量时溢出
+	if page > maxHistoryPage {
+		page = maxHistoryPage
+	}
+
+	query.Offset = (page - 1) * pageSize
+	query.Limit = pageSize
+	return query, page, pageSize, nil
+}
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// LookupHandler 处理规则查询和模拟匹配请求
+type LookupHandler struct {
+	RuleUpdater *rules.RuleUpdater
+}
+
+// NewLookupHandler 创建规则查询处理器
+func NewLookupHandler(ruleUpdater *rules.RuleUpdater) *LookupHandler {
+	return &LookupHandler{
+		RuleUpdater: ruleUpdater,
+	}
+}
+
+// HandleLookup 处理查询域名或 IP 地址命中了哪些规则的请求
+func (h *LookupHandler) HandleLookup(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		common.SendBadRequest(w, "缺少查询参数 q", nil)
+		return
+	}
+
+	result, err := h.RuleUpdater.Lookup(q)
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status": "ok",
+		"result": result,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
+// HandleSimulate 处理按 Clash 配置文件的规则列表模拟匹配的请求，domain 和 ip 参数至少提供一个
+func (h *LookupHandler) HandleSimulate(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	result, err := h.RuleUpdater.Simulate(query.Get("domain"), query.Get("ip"))
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status": "ok",
+		"result": result,
+	}
+	common.SendJSONResponse(w, resp)
+}
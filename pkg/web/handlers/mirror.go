@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// MirrorHandler 处理镜像相关的请求
+type MirrorHandler struct {
+	Config      *config.Config
+	RuleUpdater *rules.RuleUpdater
+}
+
+// NewMirrorHandler 创建镜像处理器
+func NewMirrorHandler(cfg *config.Config, ruleUpdater *rules.RuleUpdater) *MirrorHandler {
+	return &MirrorHandler{
+		Config:      cfg,
+		RuleUpdater: ruleUpdater,
+	}
+}
+
+// HandleMirrors 处理获取镜像健康状态请求
+func (h *MirrorHandler) HandleMirrors(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":            "ok",
+		"mirror_race_count": h.Config.MirrorRaceCount,
+		"mirrors":           h.RuleUpdater.GetMirrorHealth(),
+	}
+
+	common.SendJSONResponse(w, resp)
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// OverridesHandler 处理本地覆盖条目相关的请求
+type OverridesHandler struct {
+	Config      *config.Config
+	RuleUpdater *rules.RuleUpdater
+}
+
+// NewOverridesHandler 创建覆盖条目处理器
+func NewOverridesHandler(cfg *config.Config, ruleUpdater *rules.RuleUpdater) *OverridesHandler {
+	return &OverridesHandler{
+		Config:      cfg,
+		RuleUpdater: ruleUpdater,
+	}
+}
+
+// overrideRequest 添加或修改覆盖条目的请求
+type overrideRequest struct {
+	config.Override
+	// 有效期（秒），大于0时根据当前时间计算 expires_at
+	TTL int `json:"ttl"`
+}
+
+// toOverride 将请求转换为覆盖条目并校验
+func (h *OverridesHandler) toOverride(req overrideRequest) (config.Override, error) {
+	o := req.Override
+	o.Value = strings.TrimSpace(o.Value)
+	now := time.Now()
+	if req.TTL > 0 {
+		expiresAt := now.Add(time.Duration(req.TTL) * time.Second)
+		o.ExpiresAt = &expiresAt
+	}
+	return o, rules.ValidateOverride(o, h.Config.RuleProviders, now)
+}
+
+// HandleOverrides 处理获取覆盖条目列表请求，可以通过 provider 参数只返回某个规则的覆盖条目
+func (h *OverridesHandler) HandleOverrides(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	overrides := h.Config.GetOverrides()
+	if provider := r.URL.Query().Get("provider"); provider != "" {
+		filtered := []config.Override{}
+		for _, o := range overrides {
+			if o.Provider == provider {
+				filtered = append(filtered, o)
+			}
+		}
+		overrides = filtered
+	}
+
+	resp := map[string]interface{}{
+		"status":    "ok",
+		"overrides": overrides,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
+// HandleAddOverride 处理添加覆盖条目请求
+//
+// 受影响的规则会在下一次调度检查时重新生成
+func (h *OverridesHandler) HandleAddOverride(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req overrideRequest
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+
+	o, err := h.toOverride(req)
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	added, err := h.Config.AddOverride(o)
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	common.SendSuccessResponse(w, "添加覆盖条目成功", added)
+}
+
+// HandleEditOverride 处理修改覆盖条目请求
+func (h *OverridesHandler) HandleEditOverride(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req overrideRequest
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+	if req.ID == "" {
+		common.SendBadRequest(w, "覆盖条目 ID 不能为空", nil)
+		return
+	}
+
+	o, err := h.toOverride(req)
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	updated, err := h.Config.UpdateOverride(req.ID, o)
+	if err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	common.SendSuccessResponse(w, "修改覆盖条目成功", updated)
+}
+
+// HandleDeleteOverride 处理删除覆盖条目请求
+func (h *OverridesHandler) HandleDeleteOverride(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req struct {
+		ID string `json:"id"`
+	}
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+
+	if !h.Config.DeleteOverride(req.ID) {
+		common.SendBadRequest(w, "覆盖条目不存在", nil)
+		return
+	}
+
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	common.SendSuccessResponse(w, "删除覆盖条目成功", nil)
+}
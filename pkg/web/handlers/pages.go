@@ -111,7 +111,7 @@ func (h *PageHandler) HandleTestConnection(w http.ResponseWriter, r *http.Reques
 	tempAPI := api.NewClashAPI(req.ClashAPIURL, req.ClashAPISecret)
 
 	// 测试连接
-	connected, err := tempAPI.TestConnection()
+	connected, err := tempAPI.TestConnection(r.Context())
 
 	// 构建响应
 	resp := map[string]interface{}{
@@ -155,9 +155,13 @@ func (h *PageHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
 		AutoStartEnabled       bool       `json:"autoStartEnabled"`       // 小写开头
 		SystemAutoStartEnabled bool       `json:"systemAutoStartEnabled"` // 小写开头
 		SelectedRules          []struct { // 接收前端发送的规则列表
-			Name string `json:"name"`
-			URL  string `json:"url"`
-			Type string `json:"type"`
+			Name   string `json:"name"`
+			URL    string `json:"url"`
+			Type   string `json:"type"`
+			Preset string `json:"preset"` // 预设 ID，用于提示预设变化
+			Format string `json:"format"`
+			// 预设的优先级，决定规则的排列顺序
+			Priority int `json:"priority"`
 		} `json:"selectedRules"`
 	}
 
@@ -169,6 +173,13 @@ func (h *PageHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
 		req.ClashAPIURL, req.UpdateInterval, req.AutoStartEnabled, req.SystemAutoStartEnabled)
 	logger.Printf("Setup 选中规则数量: %d", len(req.SelectedRules))
 
+	for _, rule := range req.SelectedRules {
+		if err := rules.ValidateFormat(rule.Format); err != nil {
+			common.SendBadRequest(w, fmt.Sprintf("规则 %s 的格式无效", rule.Name), err)
+			return
+		}
+	}
+
 	// 更新配置
 	logger.Println("Setup: 更新配置...")
 	h.Config.ClashAPIURL = req.ClashAPIURL
@@ -208,6 +219,9 @@ func (h *PageHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
 			Behavior: behavior,
 			Path:     rulePath,
 			Enabled:  true,
+			Format:   rule.Format,
+			Preset:   rule.Preset,
+			Priority: rule.Priority,
 		})
 	}
 
@@ -245,10 +259,10 @@ func (h *PageHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
 	if len(h.Config.RuleProviders) > 0 {
 		logger.Printf("Setup: 发现 %d 个规则提供者，开始更新规则...", len(h.Config.RuleProviders))
 		// 立即更新规则
-		success, err := h.RuleUpdater.UpdateAllRules()
+		result, err := h.RuleUpdater.UpdateAllRules(r.Context(), rules.TriggerAPI)
 		if err != nil {
 			logger.Printf("Setup 警告: 首次更新规则失败: %v", err)
-		} else if success {
+		} else if !result.HasFailures() {
 			logger.Println("Setup: 首次更新规则成功")
 		} else {
 			logger.Println("Setup: 首次更新规则部分成功，部分失败")
@@ -256,9 +270,9 @@ func (h *PageHandler) HandleSetup(w http.ResponseWriter, r *http.Request) {
 
 		// 尝试重新加载 Clash 配置
 		logger.Println("Setup: 尝试重新加载 Clash 配置...")
-		err = h.ClashAPI.ReloadConfig()
+		err = h.RuleUpdater.ApplyToClash(r.Context(), h.ClashAPI)
 		if err != nil {
-			logger.Printf("Setup 警告: 重新加载 Clash 配置失败: %v", err)
+			logger.Printf("Setup 警告: 应用规则失败: %v", err)
 		} else {
 			logger.Println("Setup: 重新加载 Clash 配置成功")
 		}
@@ -0,0 +1,38 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// PresetsHandler 处理预设目录相关的请求
+type PresetsHandler struct {
+	RuleUpdater *rules.RuleUpdater
+}
+
+// NewPresetsHandler 创建预设目录处理器
+func NewPresetsHandler(ruleUpdater *rules.RuleUpdater) *PresetsHandler {
+	return &PresetsHandler{
+		RuleUpdater: ruleUpdater,
+	}
+}
+
+// HandlePresets 处理获取合并后的预设目录请求，refresh=true 时重新下载远程目录
+func (h *PresetsHandler) HandlePresets(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	refresh := r.URL.Query().Get("refresh") == "true"
+	catalogs := h.RuleUpdater.GetPresetCatalogs(r.Context(), refresh)
+
+	resp := map[string]interface{}{
+		"status":   "ok",
+		"catalogs": catalogs.Catalogs,
+		"presets":  catalogs.Presets,
+		"notices":  catalogs.Notices,
+	}
+	common.SendJSONResponse(w, resp)
+}
@@ -5,7 +5,6 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/shuakami/clashrule-sync/pkg/api"
 	"github.com/shuakami/clashrule-sync/pkg/config"
@@ -37,8 +36,8 @@ func (h *RulesHandler) HandleRules(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// 获取规则提供者列表
-	ruleProviders := h.Config.RuleProviders
+	// 获取规则提供者列表，隐藏HTTP密钥
+	ruleProviders := config.RedactProviders(h.Config.RuleProviders)
 
 	// 准备响应
 	resp := map[string]interface{}{
@@ -66,8 +65,8 @@ func (h *RulesHandler) HandleAddRule(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 验证规则数据
-	if req.Rule.Name == "" || req.Rule.URL == "" || req.Rule.Type == "" || req.Rule.Behavior == "" || req.Rule.Path == "" {
-		common.SendBadRequest(w, "规则数据不完整", nil)
+	if err := validateRuleProvider(req.Rule); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
 		return
 	}
 
@@ -79,6 +78,18 @@ func (h *RulesHandler) HandleAddRule(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// 检查组合规则引用的规则是否存在以及是否有循环引用
+	providers := append(append([]config.RuleProvider{}, h.Config.RuleProviders...), req.Rule)
+	if err := rules.ValidateComposites(providers); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	// 未指定顺序的新规则排在最后
+	if req.Rule.Priority == 0 {
+		req.Rule.Priority = h.Config.NextPriority()
+	}
+
 	// 添加规则
 	h.Config.RuleProviders = append(h.Config.RuleProviders, req.Rule)
 
@@ -90,18 +101,22 @@ func (h *RulesHandler) HandleAddRule(w http.ResponseWriter, r *http.Request) {
 
 	// 更新规则
 	if req.Rule.Enabled {
-		success, err := h.RuleUpdater.UpdateRuleProvider(req.Rule.Name)
+		result, err := h.RuleUpdater.UpdateRuleProvider(r.Context(), rules.TriggerAPI, req.Rule.Name)
 		if err != nil {
 			logger.Errorf("更新规则失败: %v", err)
-		} else if success {
+		} else if result.Changed {
 			logger.Infof("规则 %s 更新成功", req.Rule.Name)
-		}
 
-		// 尝试重新加载 Clash 配置
-		err = h.ClashAPI.ReloadConfig()
-		if err != nil {
-			logger.Errorf("重新加载 Clash 配置失败: %v", err)
+			// 尝试重新加载 Clash 配置，Clash 拒绝新规则时恢复最后可用的规则文件
+			err = h.RuleUpdater.ApplyToClash(r.Context(), h.ClashAPI)
+			if err != nil {
+				logger.Errorf("应用规则失败: %v", err)
+			}
 		}
+
+		// 发送成功响应，附带本次更新结果
+		common.SendSuccessResponse(w, "添加规则成功", result)
+		return
 	}
 
 	// 发送成功响应
@@ -111,10 +126,40 @@ func (h *RulesHandler) HandleAddRule(w http.ResponseWriter, r *http.Request) {
 // validateRuleProvider 验证规则提供者的数据是否完整
 func validateRuleProvider(rule config.RuleProvider) error {
 	// 验证规则数据
-	if rule.Name == "" || rule.URL == "" || rule.Type == "" || rule.Behavior == "" || rule.Path == "" {
+	if rule.Name == "" || rule.Type == "" || rule.Behavior == "" || rule.Path == "" {
+		return fmt.Errorf("规则数据不完整")
+	}
+	// 内联规则和组合规则可以不填写URL
+	if rule.URL == "" && len(rule.Entries) == 0 && len(rule.Composite) == 0 {
 		return fmt.Errorf("规则数据不完整")
 	}
-	return nil
+	if err := rules.ValidateFormat(rule.Format); err != nil {
+		return err
+	}
+	if rule.MaxInvalidRatio != nil {
+		if err := config.ValidateInvalidRatio(*rule.MaxInvalidRatio); err != nil {
+			return err
+		}
+	}
+	if rule.MaxSize < 0 {
+		return fmt.Errorf("规则大小上限不能为负数")
+	}
+	if rule.Priority < 0 {
+		return fmt.Errorf("规则优先级不能为负数")
+	}
+	if err := rules.ValidateVerification(rule); err != nil {
+		return err
+	}
+	if err := rules.ValidateHTTPOptions(rule); err != nil {
+		return err
+	}
+	if err := rules.ValidateFetchPolicy(rule); err != nil {
+		return err
+	}
+	if err := rules.ValidateTransforms(rule); err != nil {
+		return err
+	}
+	return rules.ValidateSchedule(rule)
 }
 
 // HandleEditRule 处理编辑规则请求
@@ -148,6 +193,22 @@ func (h *RulesHandler) HandleEditRule(w http.ResponseWriter, r *http.Request) {
 	// 获取当前规则
 	oldRule := h.Config.RuleProviders[req.Index]
 
+	// 检查修改后的组合规则引用，重命名被引用的规则也会被拒绝
+	providers := append([]config.RuleProvider{}, h.Config.RuleProviders...)
+	providers[req.Index] = req.Rule
+	if err := rules.ValidateComposites(providers); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	// 提交的是接口返回的隐藏值时保留原有密钥
+	req.Rule.HTTP.RestoreSecrets(oldRule.HTTP)
+
+	// 未指定顺序时保留原有顺序
+	if req.Rule.Priority == 0 {
+		req.Rule.Priority = oldRule.Priority
+	}
+
 	// 确保Path和名称的匹配 - 保留原路径但更新文件名
 	pathDir := filepath.Dir(oldRule.Path)
 	pathExt := filepath.Ext(oldRule.Path)
@@ -183,8 +244,11 @@ func (h *RulesHandler) HandleEditRule(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	// 更新配置中的规则
+	// 更新配置中的规则，覆盖条目随规则改名
 	h.Config.RuleProviders[req.Index] = req.Rule
+	if oldRule.Name != req.Rule.Name {
+		h.Config.RenameOverrideProvider(oldRule.Name, req.Rule.Name)
+	}
 
 	// 保存配置
 	if err := h.Config.SaveConfig(); err != nil {
@@ -197,6 +261,46 @@ func (h *RulesHandler) HandleEditRule(w http.ResponseWriter, r *http.Request) {
 	h.notifyRuleUpdate(w)
 }
 
+// HandlePreviewRule 处理转换预览请求，下载规则的当前内容并返回执行转换步骤前后的对比，不保存规则
+func (h *RulesHandler) HandlePreviewRule(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req struct {
+		Rule config.RuleProvider `json:"rule"`
+	}
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+
+	rule := req.Rule
+	if err := validateRuleProvider(rule); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+	// 预览已有规则时使用保存的认证信息
+	if existing := h.Config.GetRuleProvider(rule.Name); existing != nil {
+		rule.HTTP.RestoreSecrets(existing.HTTP)
+	}
+	if err := h.RuleUpdater.ValidatePreviewSource(rule); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	preview, err := h.RuleUpdater.PreviewTransforms(r.Context(), rule)
+	if err != nil {
+		common.SendErrorResponse(w, http.StatusBadGateway, "获取规则内容失败", err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":  "ok",
+		"preview": preview,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
 // HandleDeleteRule 处理删除规则请求
 func (h *RulesHandler) HandleDeleteRule(w http.ResponseWriter, r *http.Request) {
 	if !common.RequirePostMethod(w, r) {
@@ -218,22 +322,31 @@ func (h *RulesHandler) HandleDeleteRule(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// 查找并删除规则
-	found := false
+	// 查找规则
+	index := -1
 	for i, rule := range h.Config.RuleProviders {
 		if rule.Name == req.Name {
-			// 删除规则
-			h.Config.RuleProviders = append(h.Config.RuleProviders[:i], h.Config.RuleProviders[i+1:]...)
-			found = true
+			index = i
 			break
 		}
 	}
 
-	if !found {
+	if index < 0 {
 		common.SendBadRequest(w, "规则不存在", nil)
 		return
 	}
 
+	// 被组合规则引用的规则不能删除
+	providers := append(append([]config.RuleProvider{}, h.Config.RuleProviders[:index]...), h.Config.RuleProviders[index+1:]...)
+	if err := rules.ValidateComposites(providers); err != nil {
+		common.SendBadRequest(w, err.Error(), nil)
+		return
+	}
+
+	// 删除规则及其覆盖条目
+	h.Config.RuleProviders = providers
+	h.Config.RenameOverrideProvider(req.Name, "")
+
 	// 保存配置
 	if err := h.Config.SaveConfig(); err != nil {
 		common.SendInternalError(w, "保存配置失败", err)
@@ -250,6 +363,35 @@ func (h *RulesHandler) HandleDeleteRule(w http.ResponseWriter, r *http.Request)
 	common.SendSuccessResponse(w, "删除规则成功", nil)
 }
 
+// HandleReorderRules 处理调整规则顺序请求
+func (h *RulesHandler) HandleReorderRules(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	// 解析请求，names 为调整后的全部规则名称
+	var req struct {
+		Names []string `json:"names"`
+	}
+
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+
+	if err := h.Config.ReorderRuleProviders(req.Names); err != nil {
+		common.SendBadRequest(w, "规则顺序无效", err)
+		return
+	}
+
+	// 保存配置
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	common.SendSuccessResponse(w, "调整规则顺序成功", config.RedactProviders(h.Config.RuleProviders))
+}
+
 // HandleSyncBypass 处理绕过规则同步请求
 func (h *RulesHandler) HandleSyncBypass(w http.ResponseWriter, r *http.Request) {
 	if !common.RequirePostMethod(w, r) {
@@ -281,33 +423,13 @@ func (h *RulesHandler) HandleSyncBypass(w http.ResponseWriter, r *http.Request)
 		message = "成功更新绕过规则"
 		success = true
 	} else if len(req.RuleNames) > 0 {
-		// 根据规则名称同步
-		var rulesToSync []string
-
-		// 收集规则内容
-		for _, ruleName := range req.RuleNames {
-			for _, provider := range h.Config.RuleProviders {
-				if provider.Name == ruleName && provider.Enabled {
-					// 找到规则文件
-					rulesDir := common.GetRulesDir()
-					ruleFilePath := filepath.Join(rulesDir, provider.Path)
-
-					// 读取规则内容
-					content, err := os.ReadFile(ruleFilePath)
-					if err != nil {
-						logger.Errorf("读取规则 %s 失败: %v", ruleName, err)
-						continue
-					}
-
-					rulesToSync = append(rulesToSync, string(content))
-				}
-			}
-		}
+		// 根据规则名称同步，按规则的排列顺序合并并去重聚合
+		stats, count, err := h.RuleUpdater.SyncCombinedBypass(req.RuleNames)
 
 		// 如果找到了规则，进行同步
-		if len(rulesToSync) > 0 {
-			combinedRules := strings.Join(rulesToSync, "\n")
-			err := api.SyncBypassRulesFromDomainList(combinedRules)
+		if count > 0 {
+			logger.Infof("同步 %d 个规则到绕过配置，移除 %d 条重复条目、%d 条已被后缀覆盖的域名，合并网段减少 %d 条",
+				count, stats.Duplicates, stats.Covered, stats.Merged)
 			if err != nil {
 				common.SendInternalError(w, "同步规则到绕过配置失败", err)
 				return
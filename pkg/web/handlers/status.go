@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
 	"time"
 
 	"github.com/shuakami/clashrule-sync/pkg/api"
 	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
 	"github.com/shuakami/clashrule-sync/pkg/process"
 	"github.com/shuakami/clashrule-sync/pkg/rules"
 	"github.com/shuakami/clashrule-sync/pkg/web/common"
@@ -13,16 +15,20 @@ import (
 
 // StatusResponse 表示状态响应
 type StatusResponse struct {
-	Status                 string               `json:"status"`
-	StatusMessage          string               `json:"status_message"`
-	ClashRunning           bool                 `json:"clash_running"`
-	ProcessDetected        bool                 `json:"process_detected"`
-	APIConnected           bool                 `json:"api_connected"`
-	LastUpdateTime         time.Time            `json:"last_update_time"`
-	NextUpdateTime         time.Time            `json:"next_update_time"`
-	UpdateHistory          []rules.UpdateRecord `json:"update_history"`
-	AutoStartEnabled       bool                 `json:"auto_start_enabled"`
-	SystemAutoStartEnabled bool                 `json:"system_auto_start_enabled"`
+	Status                 string                   `json:"status"`
+	StatusMessage          string                   `json:"status_message"`
+	ClashRunning           bool                     `json:"clash_running"`
+	ProcessDetected        bool                     `json:"process_detected"`
+	APIConnected           bool                     `json:"api_connected"`
+	LastUpdateTime         time.Time                `json:"last_update_time"`
+	NextUpdateTime         time.Time                `json:"next_update_time"`
+	Schedules              []rules.ProviderSchedule `json:"schedules"`
+	QuietHoursActive       bool                     `json:"quiet_hours_active"`
+	UpdateHistory          []rules.UpdateRecord     `json:"update_history"`
+	LastResult             *rules.UpdateRecord      `json:"last_result,omitempty"`
+	AutoStartEnabled       bool                     `json:"auto_start_enabled"`
+	SystemAutoStartEnabled bool                     `json:"system_auto_start_enabled"`
+	PresetNotices          []rules.PresetNotice     `json:"preset_notices"`
 }
 
 // 处理状态相关的函数需要访问WebServer的字段
@@ -56,7 +62,7 @@ func (h *StatusHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 检查API是否可连接
-	_, err = h.ClashAPI.TestConnection()
+	_, err = h.ClashAPI.TestConnection(r.Context())
 	if err == nil {
 		apiRunning = true
 	}
@@ -72,10 +78,18 @@ func (h *StatusHandler) HandleStatus(w http.ResponseWriter, r *http.Request) {
 		APIConnected:           apiRunning,
 		ClashRunning:           clashRunning,
 		LastUpdateTime:         h.Config.LastUpdateTime,
-		NextUpdateTime:         h.Config.LastUpdateTime.Add(h.Config.UpdateInterval),
+		NextUpdateTime:         h.RuleUpdater.NextRunTime(),
+		Schedules:              h.RuleUpdater.GetSchedules(),
+		QuietHoursActive:       h.Config.QuietHours.Contains(time.Now()),
 		UpdateHistory:          h.RuleUpdater.GetUpdateHistory(),
 		AutoStartEnabled:       h.Config.AutoStartEnabled,
 		SystemAutoStartEnabled: h.Config.SystemAutoStartEnabled,
+		PresetNotices:          h.RuleUpdater.GetPresetNotices(),
+	}
+
+	// 最近一次更新结果
+	if len(resp.UpdateHistory) > 0 {
+		resp.LastResult = &resp.UpdateHistory[len(resp.UpdateHistory)-1]
 	}
 
 	// 根据检测结果设置状态
@@ -109,25 +123,56 @@ func (h *StatusHandler) HandleUpdate(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// 执行规则更新
-	success, err := h.RuleUpdater.UpdateAllRules()
+	// 客户端断开连接时中止更新
+	result, err := h.RuleUpdater.UpdateAllRules(r.Context(), rules.TriggerAPI)
 	if err != nil {
 		common.SendInternalError(w, "更新规则失败", err)
 		return
 	}
 
-	// 尝试重新加载 Clash 配置
-	err = h.ClashAPI.ReloadConfig()
-	if err != nil {
-		common.SendInternalError(w, "重新加载 Clash 配置失败", err)
-		return
+	// 仅在有规则内容变化时重新加载 Clash 配置
+	message := "规则已是最新"
+	if result.HasChanges() {
+		err = h.RuleUpdater.ApplyToClash(r.Context(), h.ClashAPI)
+		if errors.Is(err, rules.ErrRolledBack) {
+			common.SendInternalError(w, "应用新规则失败，已回滚规则", err)
+			return
+		}
+		message = "规则更新成功"
+		if errors.Is(err, api.ErrConfigPathUnknown) {
+			logger.Warnf("%v，请设置 clash_config_path", err)
+			message += "，但未找到 Clash 配置文件，新规则未经 Clash 验证"
+		} else if err != nil {
+			logger.Warnf("重新加载 Clash 配置失败: %v", err)
+			message += "，但重新加载 Clash 配置失败"
+		}
+	}
+	if result.HasFailures() {
+		message += "，部分规则更新失败"
 	}
 
 	// 发送成功响应
 	resp := map[string]interface{}{
 		"status":  "ok",
-		"success": success,
-		"message": "规则更新成功",
+		"success": !result.HasFailures(),
+		"changed": result.HasChanges(),
+		"message": message,
+		"result":  result,
 	}
 
 	common.SendJSONResponse(w, resp)
 }
+
+// HandleCancelUpdate 处理取消规则更新请求
+func (h *StatusHandler) HandleCancelUpdate(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	if !h.RuleUpdater.CancelUpdate() {
+		common.SendBadRequest(w, "当前没有正在进行的规则更新", nil)
+		return
+	}
+
+	common.SendSuccessResponse(w, "已取消规则更新", nil)
+}
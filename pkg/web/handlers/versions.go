@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/shuakami/clashrule-sync/pkg/api"
+	"github.com/shuakami/clashrule-sync/pkg/config"
+	"github.com/shuakami/clashrule-sync/pkg/logger"
+	"github.com/shuakami/clashrule-sync/pkg/rules"
+	"github.com/shuakami/clashrule-sync/pkg/web/common"
+)
+
+// VersionsHandler 处理规则历史版本相关的请求
+type VersionsHandler struct {
+	Config      *config.Config
+	RuleUpdater *rules.RuleUpdater
+	ClashAPI    *api.ClashAPI
+}
+
+// NewVersionsHandler 创建规则版本处理器
+func NewVersionsHandler(cfg *config.Config, ruleUpdater *rules.RuleUpdater, clashAPI *api.ClashAPI) *VersionsHandler {
+	return &VersionsHandler{
+		Config:      cfg,
+		RuleUpdater: ruleUpdater,
+		ClashAPI:    clashAPI,
+	}
+}
+
+// findRule 按名称查找规则在配置中的索引，不存在时返回 -1
+func (h *VersionsHandler) findRule(name string) int {
+	for i, rule := range h.Config.RuleProviders {
+		if rule.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// HandleVersions 处理获取规则历史版本列表请求
+func (h *VersionsHandler) HandleVersions(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	index := h.findRule(name)
+	if index < 0 {
+		common.SendBadRequest(w, "规则不存在", nil)
+		return
+	}
+
+	versions, err := h.RuleUpdater.ListVersions(name)
+	if err != nil {
+		common.SendInternalError(w, "获取历史版本失败", err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":   "ok",
+		"name":     name,
+		"pinned":   h.Config.RuleProviders[index].Pinned,
+		"versions": versions,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
+// HandleVersionDiff 处理比较两个历史版本请求
+func (h *VersionsHandler) HandleVersionDiff(w http.ResponseWriter, r *http.Request) {
+	if !common.RequireGetMethod(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	name, from, to := query.Get("name"), query.Get("from"), query.Get("to")
+	if name == "" || from == "" || to == "" {
+		common.SendBadRequest(w, "缺少 name、from 或 to 参数", nil)
+		return
+	}
+
+	diff, err := h.RuleUpdater.DiffVersions(name, from, to)
+	if err != nil {
+		common.SendBadRequest(w, "比较版本失败", err)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"status":        "ok",
+		"name":          name,
+		"from":          diff.From,
+		"to":            diff.To,
+		"added_count":   len(diff.Added),
+		"removed_count": len(diff.Removed),
+		"added":         diff.Added,
+		"removed":       diff.Removed,
+	}
+	common.SendJSONResponse(w, resp)
+}
+
+// HandleRollback 处理将规则回滚到指定版本的请求，回滚后规则保持固定直到取消固定
+func (h *VersionsHandler) HandleRollback(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+	if req.Version == "" {
+		common.SendBadRequest(w, "版本不能为空", nil)
+		return
+	}
+
+	index := h.findRule(req.Name)
+	if index < 0 {
+		common.SendBadRequest(w, "规则不存在", nil)
+		return
+	}
+
+	// 先固定版本，避免回滚期间被定时更新覆盖
+	previousPin := h.Config.RuleProviders[index].Pinned
+	h.Config.RuleProviders[index].Pinned = req.Version
+
+	result, err := h.RuleUpdater.RollbackToVersion(req.Name, req.Version)
+	if err != nil {
+		h.Config.RuleProviders[index].Pinned = previousPin
+		common.SendBadRequest(w, "回滚规则失败", err)
+		return
+	}
+
+	// Clash 拒绝加载时恢复回滚前的规则文件
+	if err := h.RuleUpdater.ApplyToClash(r.Context(), h.ClashAPI); errors.Is(err, rules.ErrRolledBack) {
+		h.Config.RuleProviders[index].Pinned = previousPin
+		common.SendInternalError(w, "应用规则失败，已恢复回滚前的规则", err)
+		return
+	} else if err != nil {
+		logger.Warnf("重新加载 Clash 配置失败: %v", err)
+	}
+
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	common.SendSuccessResponse(w, "回滚成功，规则已固定到版本 "+req.Version, result)
+}
+
+// HandleUnpin 处理取消固定版本请求，取消后立即更新该规则
+func (h *VersionsHandler) HandleUnpin(w http.ResponseWriter, r *http.Request) {
+	if !common.RequirePostMethod(w, r) {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if !common.ParseJSON(w, r, &req) {
+		return
+	}
+
+	index := h.findRule(req.Name)
+	if index < 0 {
+		common.SendBadRequest(w, "规则不存在", nil)
+		return
+	}
+	if h.Config.RuleProviders[index].Pinned == "" {
+		common.SendBadRequest(w, "规则未固定版本", nil)
+		return
+	}
+
+	h.Config.RuleProviders[index].Pinned = ""
+	if err := h.Config.SaveConfig(); err != nil {
+		common.SendInternalError(w, "保存配置失败", err)
+		return
+	}
+
+	if !h.Config.RuleProviders[index].Enabled {
+		common.SendSuccessResponse(w, "已取消固定", nil)
+		return
+	}
+
+	result, err := h.RuleUpdater.UpdateRuleProvider(r.Context(), rules.TriggerAPI, req.Name)
+	if err != nil {
+		logger.Errorf("更新规则失败: %v", err)
+	} else if result.Changed {
+		if err := h.RuleUpdater.ApplyToClash(r.Context(), h.ClashAPI); err != nil {
+			logger.Errorf("应用规则失败: %v", err)
+		}
+	}
+
+	common.SendSuccessResponse(w, "已取消固定", result)
+}
@@ -28,12 +28,18 @@ type WebServer struct {
 	router      *http.ServeMux
 
 	// 处理器
-	pageHandler   *handlers.PageHandler
-	statusHandler *handlers.StatusHandler
-	configHandler *handlers.ConfigHandler
-	rulesHandler  *handlers.RulesHandler
-	systemHandler *handlers.SystemHandler
-	logHandler    *handlers.LogHandler
+	pageHandler      *handlers.PageHandler
+	statusHandler    *handlers.StatusHandler
+	configHandler    *handlers.ConfigHandler
+	rulesHandler     *handlers.RulesHandler
+	systemHandler    *handlers.SystemHandler
+	logHandler       *handlers.LogHandler
+	mirrorHandler    *handlers.MirrorHandler
+	versionsHandler  *handlers.VersionsHandler
+	historyHandler   *handlers.HistoryHandler
+	overridesHandler *handlers.OverridesHandler
+	lookupHandler    *handlers.LookupHandler
+	presetsHandler   *handlers.PresetsHandler
 }
 
 // NewWebServer 创建一个新的 Web 服务器
@@ -52,6 +58,12 @@ func NewWebServer(cfg *config.Config, ruleUpdater *rules.RuleUpdater, clashAPI *
 	ws.rulesHandler = handlers.NewRulesHandler(cfg, ruleUpdater, clashAPI)
 	ws.configHandler = handlers.NewConfigHandler(cfg, clashAPI, ws.systemHandler.HandleSystemAutoStart)
 	ws.logHandler = handlers.NewLogHandler(cfg)
+	ws.mirrorHandler = handlers.NewMirrorHandler(cfg, ruleUpdater)
+	ws.versionsHandler = handlers.NewVersionsHandler(cfg, ruleUpdater, clashAPI)
+	ws.historyHandler = handlers.NewHistoryHandler(ruleUpdater)
+	ws.overridesHandler = handlers.NewOverridesHandler(cfg, ruleUpdater)
+	ws.lookupHandler = handlers.NewLookupHandler(ruleUpdater)
+	ws.presetsHandler = handlers.NewPresetsHandler(ruleUpdater)
 
 	return ws
 }
@@ -132,6 +144,8 @@ func (ws *WebServer) registerRoutes() {
 	// API 路由 - 状态
 	router.HandleFunc("/api/status", ws.statusHandler.HandleStatus)
 	router.HandleFunc("/api/update", ws.statusHandler.HandleUpdate)
+	router.HandleFunc("/api/update/cancel", ws.statusHandler.HandleCancelUpdate)
+	router.HandleFunc("/api/history", ws.historyHandler.HandleHistory)
 
 	// API 路由 - 配置
 	router.HandleFunc("/api/config", ws.configHandler.HandleConfig)
@@ -143,8 +157,32 @@ func (ws *WebServer) registerRoutes() {
 	router.HandleFunc("/api/rules/add", ws.rulesHandler.HandleAddRule)
 	router.HandleFunc("/api/rules/edit", ws.rulesHandler.HandleEditRule)
 	router.HandleFunc("/api/rules/delete", ws.rulesHandler.HandleDeleteRule)
+	router.HandleFunc("/api/rules/reorder", ws.rulesHandler.HandleReorderRules)
+	router.HandleFunc("/api/rules/preview", ws.rulesHandler.HandlePreviewRule)
 	router.HandleFunc("/api/sync-bypass", ws.rulesHandler.HandleSyncBypass)
 
+	// API 路由 - 覆盖条目
+	router.HandleFunc("/api/overrides", ws.overridesHandler.HandleOverrides)
+	router.HandleFunc("/api/overrides/add", ws.overridesHandler.HandleAddOverride)
+	router.HandleFunc("/api/overrides/edit", ws.overridesHandler.HandleEditOverride)
+	router.HandleFunc("/api/overrides/delete", ws.overridesHandler.HandleDeleteOverride)
+
+	// API 路由 - 预设目录
+	router.HandleFunc("/api/presets", ws.presetsHandler.HandlePresets)
+
+	// API 路由 - 规则查询
+	router.HandleFunc("/api/lookup", ws.lookupHandler.HandleLookup)
+	router.HandleFunc("/api/simulate", ws.lookupHandler.HandleSimulate)
+
+	// API 路由 - 规则历史版本
+	router.HandleFunc("/api/rules/versions", ws.versionsHandler.HandleVersions)
+	router.HandleFunc("/api/rules/versions/diff", ws.versionsHandler.HandleVersionDiff)
+	router.HandleFunc("/api/rules/versions/rollback", ws.versionsHandler.HandleRollback)
+	router.HandleFunc("/api/rules/unpin", ws.versionsHandler.HandleUnpin)
+
+	// API 路由 - 镜像
+	router.HandleFunc("/api/mirrors", ws.mirrorHandler.HandleMirrors)
+
 	// API 路由 - 日志管理
 	router.HandleFunc("/api/logs", ws.logHandler.HandleGetLog)
 	router.HandleFunc("/api/logs/config", ws.logHandler.HandleSetLogConfig)